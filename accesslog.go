@@ -0,0 +1,288 @@
+// Copyright 2023 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The access log formats.
+const (
+	// AccessLogFormatLog logs each request as a message in the proxy's own log.
+	AccessLogFormatLog = "log"
+	// AccessLogFormatCommon writes the Common Log Format, like Apache and nginx.
+	AccessLogFormatCommon = "common"
+	// AccessLogFormatCombined is the Common Log Format with the referer and user agent.
+	AccessLogFormatCombined = "combined"
+	// AccessLogFormatJSON writes one JSON object per request.
+	AccessLogFormatJSON = "json"
+)
+
+// CommonLogTime is the timestamp layout of the Common Log Format.
+const CommonLogTime = "02/Jan/2006:15:04:05 -0700"
+
+// ErrBadAccessLogFormat is returned when the access log format isn't one we know.
+var ErrBadAccessLogFormat = errors.New("access log format must be log, common, combined, or json")
+
+// AccessLog logs each request after it has been served.
+//
+// Paths are matched against the Include and Exclude patterns, which use
+// the syntax of path.Match, so /api/* matches /api/items but not /api/a/b.
+// If Include isn't empty, only paths matching one of its patterns are logged.
+// Paths matching one of the Exclude patterns are never logged, which keeps
+// high frequency polling out of the log.
+//
+// In the log format, requests are logged with the rest of the proxy's
+// messages. The other formats are written to Out, one line per request, so
+// they can be read by the usual access log tools, and kept apart from the
+// proxy's messages. The JSON format includes the origin, which says which
+// Alma instance sent the request, and the time the reader service took.
+// Barcodes and patron identifiers in the path, query, and referer are masked
+// by the Redactor, as they are in the proxy's messages.
+type AccessLog struct {
+	Include  []string
+	Exclude  []string
+	Format   string
+	Out      io.Writer
+	Redactor *Redactor
+
+	mu sync.Mutex
+}
+
+// AccessLogEntry is a request in the JSON access log format.
+type AccessLogEntry struct {
+	Time       string  `json:"time"`
+	RequestID  string  `json:"request_id,omitempty"`
+	Client     string  `json:"client"`
+	Method     string  `json:"method"`
+	Path       string  `json:"path"`
+	Origin     string  `json:"origin,omitempty"`
+	Status     int     `json:"status"`
+	Bytes      int64   `json:"bytes"`
+	DurationMS float64 `json:"duration_ms"`
+	UpstreamMS float64 `json:"upstream_ms,omitempty"`
+	UserAgent  string  `json:"user_agent,omitempty"`
+	ClientCert string  `json:"client_cert,omitempty"`
+}
+
+// upstreamTiming is where the proxy records how long the reader service took
+// to respond to a request, for the access log.
+type upstreamTiming struct {
+	latency time.Duration
+}
+
+// upstreamTimingKey is the context key of a request's upstreamTiming.
+type upstreamTimingKey struct{}
+
+// NewAccessLog returns an AccessLog in format for the comma separated include
+// and exclude patterns, writing to out.
+func NewAccessLog(include, exclude, format string, out io.Writer) (*AccessLog, error) {
+	switch format {
+	case AccessLogFormatLog, AccessLogFormatCommon, AccessLogFormatCombined, AccessLogFormatJSON:
+	default:
+		return nil, fmt.Errorf("%w, not %q", ErrBadAccessLogFormat, format)
+	}
+	a := &AccessLog{Include: splitList(include), Exclude: splitList(exclude), Format: format, Out: out}
+	for _, patterns := range [][]string{a.Include, a.Exclude} {
+		for _, pattern := range patterns {
+			_, err := path.Match(pattern, "")
+			if err != nil {
+				return nil, fmt.Errorf("bad access log pattern %q: %w", pattern, err)
+			}
+		}
+	}
+	return a, nil
+}
+
+// Logged reports whether requests for a URL path are logged.
+func (a *AccessLog) Logged(urlPath string) bool {
+	if len(a.Include) > 0 && !matchAny(a.Include, urlPath) {
+		return false
+	}
+	return !matchAny(a.Exclude, urlPath)
+}
+
+// Middleware wraps a handler, logging the requests it serves.
+func (a *AccessLog) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !a.Logged(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		start := time.Now()
+		recorder := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		timing := &upstreamTiming{}
+		next.ServeHTTP(recorder, r.WithContext(context.WithValue(r.Context(), upstreamTimingKey{}, timing)))
+		duration := time.Since(start)
+		clientCert := ""
+		// With -client-ca, log who the caller's certificate says they are.
+		if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+			clientCert = r.TLS.PeerCertificates[0].Subject.String()
+		}
+		switch a.Format {
+		case AccessLogFormatCommon, AccessLogFormatCombined:
+			a.write(a.Redactor.Redact(commonLogLine(r, recorder, start, a.Format == AccessLogFormatCombined)))
+		case AccessLogFormatJSON:
+			line, _ := json.Marshal(AccessLogEntry{
+				Time:       start.Format(RFC3339Milli),
+				RequestID:  RequestID(r.Context()),
+				Client:     r.RemoteAddr,
+				Method:     r.Method,
+				Path:       a.Redactor.Redact(r.URL.Path),
+				Origin:     r.Header.Get("Origin"),
+				Status:     recorder.status,
+				Bytes:      recorder.bytes,
+				DurationMS: milliseconds(duration),
+				UpstreamMS: milliseconds(timing.latency),
+				UserAgent:  r.UserAgent(),
+				ClientCert: clientCert,
+			})
+			a.write(string(line) + "\n")
+		default:
+			args := []any{
+				"client", r.RemoteAddr,
+				"method", r.Method,
+				"path", r.URL.Path,
+				"status", recorder.status,
+				"bytes", recorder.bytes,
+				"duration", duration.Round(time.Millisecond),
+			}
+			if origin := r.Header.Get("Origin"); origin != "" {
+				args = append(args, "origin", origin)
+			}
+			if timing.latency > 0 {
+				args = append(args, "upstream", timing.latency.Round(time.Millisecond))
+			}
+			if clientCert != "" {
+				args = append(args, "client_cert", clientCert)
+			}
+			slog.InfoContext(r.Context(), "Request.", args...)
+		}
+	})
+}
+
+// write writes a line to Out.
+func (a *AccessLog) write(line string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	io.WriteString(a.Out, line)
+}
+
+// commonLogLine returns a request in the Common Log Format, or with combined,
+// the Combined Log Format.
+func commonLogLine(r *http.Request, recorder *responseRecorder, start time.Time, combined bool) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	user := "-"
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		user = strings.ReplaceAll(r.TLS.PeerCertificates[0].Subject.CommonName, " ", "_")
+	}
+	size := "-"
+	if recorder.bytes > 0 {
+		size = strconv.FormatInt(recorder.bytes, 10)
+	}
+	line := fmt.Sprintf("%v - %v [%v] %v %d %v", host, user, start.Format(CommonLogTime),
+		quoteLogField(r.Method+" "+r.URL.RequestURI()+" "+r.Proto), recorder.status, size)
+	if combined {
+		line += " " + quoteLogField(r.Referer()) + " " + quoteLogField(r.UserAgent())
+	}
+	return line + "\n"
+}
+
+// quoteLogField quotes a field in the Common Log Format, escaping quotes,
+// backslashes, and control characters. Empty fields are a quoted dash.
+func quoteLogField(field string) string {
+	if field == "" {
+		return `"-"`
+	}
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, c := range []byte(field) {
+		switch {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < 0x20 || c == 0x7f:
+			fmt.Fprintf(&b, "\\x%02x", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// recordUpstreamLatency records how long the reader service took to respond,
+// for the access log, if the request is being logged.
+func recordUpstreamLatency(ctx context.Context, latency time.Duration) {
+	if timing, ok := ctx.Value(upstreamTimingKey{}).(*upstreamTiming); ok {
+		timing.latency = latency
+	}
+}
+
+// milliseconds returns a duration in milliseconds, to the microsecond.
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// matchAny reports whether name matches any of the patterns.
+// The patterns have already been checked, so errors can't happen.
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// responseRecorder records the status and size of a response.
+type responseRecorder struct {
+	http.ResponseWriter
+	status      int
+	bytes       int64
+	wroteHeader bool
+}
+
+// WriteHeader records the status, then writes it.
+func (r *responseRecorder) WriteHeader(status int) {
+	if !r.wroteHeader {
+		r.status = status
+		r.wroteHeader = true
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Write counts the bytes written.
+func (r *responseRecorder) Write(p []byte) (int, error) {
+	r.wroteHeader = true
+	n, err := r.ResponseWriter.Write(p)
+	r.bytes += int64(n)
+	return n, err
+}
+
+// Flush flushes the underlying writer, if it supports flushing.
+func (r *responseRecorder) Flush() {
+	http.NewResponseController(r.ResponseWriter).Flush()
+}
+
+// Unwrap returns the underlying writer, for http.ResponseController.
+func (r *responseRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
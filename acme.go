@@ -0,0 +1,89 @@
+// Copyright 2023 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// DefaultACMEHTTPAddress is where HTTP-01 challenges are answered. The
+// certificate authority always connects to port 80.
+const DefaultACMEHTTPAddress = ":80"
+
+// ErrNoACMEHosts is returned when ACME is asked for without any host names.
+var ErrNoACMEHosts = errors.New("at least one host name is needed for ACME")
+
+// DefaultACMECacheDir returns the default directory certificates from the
+// ACME certificate authority are kept in.
+func DefaultACMECacheDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "almarfidintercept", "acme")
+}
+
+// NewACMEManager returns an autocert.Manager which gets certificates for hosts
+// from Let's Encrypt, or the directory URL if it's set, keeping them in cacheDir.
+// Certificates are renewed in the background before they expire.
+func NewACMEManager(hosts []string, cacheDir, email, directoryURL string) (*autocert.Manager, error) {
+	if len(hosts) == 0 {
+		return nil, ErrNoACMEHosts
+	}
+	manager := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(cacheDir),
+		HostPolicy: autocert.HostWhitelist(hosts...),
+		Email:      email,
+	}
+	if directoryURL != "" {
+		manager.Client = &acme.Client{DirectoryURL: directoryURL}
+	}
+	return manager, nil
+}
+
+// NewACMETLSConfig returns the TLS configuration for serving HTTPS with
+// certificates from the manager. TLS-ALPN-01 challenges are answered during
+// the handshake, which works when the proxy is served on port 443.
+// With fips, TLS is restricted to FIPS 140 approved algorithms.
+func NewACMETLSConfig(manager *autocert.Manager, fips bool) *tls.Config {
+	config := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: manager.GetCertificate,
+		NextProtos:     []string{"h2", "http/1.1", acme.ALPNProto},
+	}
+	if fips {
+		config = FIPSTLSConfig(config)
+	}
+	return config
+}
+
+// ServeACMEChallenges answers HTTP-01 challenges from the certificate authority
+// on the listener until ctx is cancelled. Other requests are redirected to HTTPS.
+func ServeACMEChallenges(ctx context.Context, manager *autocert.Manager, listener net.Listener) {
+	server := &http.Server{
+		Handler:           manager.HTTPHandler(nil),
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	err := server.Serve(listener)
+	if !errors.Is(err, http.ErrServerClosed) {
+		slog.Error("Unable to answer ACME challenges.", "address", listener.Addr(), "error", err)
+	}
+}
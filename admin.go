@@ -0,0 +1,102 @@
+// Copyright 2023 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// AdminPrefix is the path prefix of the proxy's own admin endpoints,
+// which are never forwarded to the reader service.
+const AdminPrefix = "/admin/"
+
+// AdminOnly wraps an admin handler so that it only serves clients on this computer.
+// A web page can reach the proxy from this computer with a name of its own, by
+// DNS rebinding, so the Host must be localhost or a loopback address too, and
+// requests with an Origin which isn't are refused.
+func AdminOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isLoopback(r.RemoteAddr) || !isLoopbackHost(r.Host) {
+			http.Error(w, "Admin endpoints are only available from this computer.", http.StatusForbidden)
+			return
+		}
+		if origin := r.Header.Get("Origin"); origin != "" && !isLoopbackOrigin(origin) {
+			http.Error(w, "Admin endpoints are only available to pages from this computer.", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// isLoopbackHost reports whether a Host header, with or without a port,
+// is localhost or a loopback address.
+func isLoopbackHost(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	if strings.EqualFold(strings.TrimSuffix(host, "."), "localhost") {
+		return true
+	}
+	return isLoopback(host)
+}
+
+// isLoopbackOrigin reports whether an Origin header is a page served from
+// localhost or a loopback address.
+func isLoopbackOrigin(origin string) bool {
+	u, err := url.Parse(origin)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && isLoopbackHost(u.Host)
+}
+
+// isLoopback reports whether a remote address is a loopback address.
+// 127.0.0.0/8, ::1, and IPv4 loopback addresses mapped to IPv6, like
+// ::ffff:127.0.0.1, are all loopback addresses.
+func isLoopback(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	host, _, _ = strings.Cut(host, "%") // Drop any IPv6 zone, like %lo0.
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// PprofHandler returns a handler serving the Go runtime's profiles under
+// /debug/pprof/, like net/http/pprof does on the default mux.
+func PprofHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return mux
+}
+
+// ServeAdmin serves admin endpoints, like the Prometheus metrics, on their own
+// listener until ctx is cancelled. They can be served on another port than the
+// proxy, reachable by the monitoring system but not the browser.
+func ServeAdmin(ctx context.Context, handler http.Handler, listener net.Listener) {
+	server := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	err := server.Serve(listener)
+	if !errors.Is(err, http.ErrServerClosed) {
+		slog.Error("Unable to serve admin endpoints.", "address", listener.Addr(), "error", err)
+	}
+}
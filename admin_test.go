@@ -0,0 +1,49 @@
+// Copyright 2023 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAdminOnly(t *testing.T) {
+	h := AdminOnly(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	tests := []struct {
+		name       string
+		remoteAddr string
+		host       string
+		origin     string
+		want       int
+	}{
+		{"localhost", "127.0.0.1:50000", "localhost:53535", "", http.StatusOK},
+		{"localhost without a port", "127.0.0.1:50000", "localhost", "", http.StatusOK},
+		{"IPv4 loopback", "127.0.0.1:50000", "127.0.0.1:53535", "", http.StatusOK},
+		{"IPv6 loopback", "[::1]:50000", "[::1]:53535", "", http.StatusOK},
+		{"IPv6 loopback without a port", "[::1]:50000", "[::1]", "", http.StatusOK},
+		{"same origin", "127.0.0.1:50000", "localhost:53535", "http://localhost:53535", http.StatusOK},
+		{"remote client", "192.0.2.1:50000", "localhost:53535", "", http.StatusForbidden},
+		{"rebound name", "127.0.0.1:50000", "attacker.example.com:53535", "", http.StatusForbidden},
+		{"localhost lookalike", "127.0.0.1:50000", "localhost.example.com", "", http.StatusForbidden},
+		{"cross-site page", "127.0.0.1:50000", "localhost:53535", "https://attacker.example.com", http.StatusForbidden},
+		{"opaque origin", "127.0.0.1:50000", "localhost:53535", "null", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, AdminPrefix+"status", nil)
+			r.RemoteAddr = tt.remoteAddr
+			r.Host = tt.host
+			if tt.origin != "" {
+				r.Header.Set("Origin", tt.origin)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != tt.want {
+				t.Errorf("got status %v, want %v", w.Code, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,152 @@
+// Copyright 2023 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultAlertWindow is the default window over which upstream
+	// error rates and latencies are measured.
+	DefaultAlertWindow = 5 * time.Minute
+
+	// AlertMinRequests is the number of upstream requests there must be in
+	// the window before an alert is raised, so one failure on a quiet desk
+	// isn't a 100% error rate.
+	AlertMinRequests = 10
+)
+
+// UpstreamAlarm raises an alert when requests to the reader service fail too
+// often, or take too long, over a sliding window. Raising and clearing the
+// alert is logged and published on the event bus, so it can be sent to webhooks.
+type UpstreamAlarm struct {
+	// ErrorRate is the fraction of upstream requests, from 0 to 1, which
+	// may fail before an alert is raised. Zero disables the check.
+	ErrorRate float64
+
+	// Latency is the 95th percentile upstream latency above which an
+	// alert is raised. Zero disables the check.
+	Latency time.Duration
+
+	// Window is how far back requests are considered.
+	Window time.Duration
+
+	// Bus is where alert events are published.
+	Bus *EventBus
+
+	mu      sync.Mutex
+	samples []upstreamSample
+	alert   string // Why the alert is raised, or empty if it isn't.
+	since   time.Time
+}
+
+// upstreamSample is the outcome of one upstream request.
+type upstreamSample struct {
+	at      time.Time
+	latency time.Duration
+	failed  bool
+}
+
+// Enabled reports whether any threshold is set.
+func (a *UpstreamAlarm) Enabled() bool {
+	return a != nil && (a.ErrorRate > 0 || a.Latency > 0)
+}
+
+// Observe records the outcome of an upstream request, then raises
+// or clears the alert. It does nothing if no threshold is set.
+func (a *UpstreamAlarm) Observe(latency time.Duration, failed bool) {
+	if !a.Enabled() {
+		return
+	}
+	now := time.Now()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.samples = append(a.samples, upstreamSample{at: now, latency: latency, failed: failed})
+	cutoff := now.Add(-a.Window)
+	drop := 0
+	for drop < len(a.samples) && a.samples[drop].at.Before(cutoff) {
+		drop++
+	}
+	a.samples = append(a.samples[:0], a.samples[drop:]...)
+
+	reason := a.evaluate()
+	switch {
+	case reason != "" && a.alert == "":
+		slog.Warn("Upstream alert raised.", "reason", reason, "window", a.Window)
+		a.since = now
+		a.Bus.Publish(Event{Type: EventUpstreamAlert, Detail: reason, Time: now})
+	case reason == "" && a.alert != "":
+		slog.Info("Upstream alert cleared.", "duration", now.Sub(a.since).Round(time.Second))
+		a.Bus.Publish(Event{Type: EventUpstreamRecovered, Time: now})
+	}
+	a.alert = reason
+}
+
+// evaluate returns why the samples breach the thresholds, or an empty string.
+func (a *UpstreamAlarm) evaluate() string {
+	if len(a.samples) < AlertMinRequests {
+		return ""
+	}
+	var reasons []string
+	if a.ErrorRate > 0 {
+		failed := 0
+		for _, sample := range a.samples {
+			if sample.failed {
+				failed++
+			}
+		}
+		rate := float64(failed) / float64(len(a.samples))
+		if rate > a.ErrorRate {
+			reasons = append(reasons, fmt.Sprintf("%.0f%% of requests to the reader service failed, threshold is %.0f%%",
+				rate*100, a.ErrorRate*100))
+		}
+	}
+	if a.Latency > 0 {
+		latencies := make([]time.Duration, len(a.samples))
+		for i, sample := range a.samples {
+			latencies[i] = sample.latency
+		}
+		if p95 := percentile(latencies, 0.95); p95 > a.Latency {
+			reasons = append(reasons, fmt.Sprintf("95th percentile latency of the reader service is %v, threshold is %v",
+				p95.Round(time.Millisecond), a.Latency))
+		}
+	}
+	return strings.Join(reasons, "; ")
+}
+
+// Alert returns why the alert is raised, and since when,
+// or an empty string if it isn't raised.
+func (a *UpstreamAlarm) Alert() (string, time.Time) {
+	if a == nil {
+		return "", time.Time{}
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.alert, a.since
+}
+
+// percentile returns the p-th percentile, from 0 to 1, of the latencies,
+// using the nearest rank method. The latencies are sorted in place.
+func percentile(latencies []time.Duration, p float64) time.Duration {
+	if len(latencies) == 0 {
+		return 0
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	rank := int(math.Ceil(p*float64(len(latencies)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	if rank >= len(latencies) {
+		rank = len(latencies) - 1
+	}
+	return latencies[rank]
+}
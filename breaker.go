@@ -0,0 +1,120 @@
+// Copyright 2023 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultBreakerFailures is how many upstream requests in a row must
+	// fail before the circuit breaker opens.
+	DefaultBreakerFailures = 5
+
+	// DefaultBreakerCooldown is how long the circuit breaker stays open
+	// before letting a request through to see if the reader service is back.
+	DefaultBreakerCooldown = 10 * time.Second
+)
+
+// CircuitBreaker stops sending requests to a reader service while it keeps
+// failing, so desks get an answer straight away, instead of each request
+// waiting out the upstream timeout. After Failures requests in a row fail to
+// get a response, the breaker opens, and requests are answered with 503 and
+// a Retry-After of the time left. After Cooldown, it lets one request through.
+// If that request gets a response, the breaker closes, otherwise it stays
+// open for another Cooldown. A response with an error status still shows the
+// reader service is answering, so it isn't a failure. Each reader service,
+// like those of the institutions sharing a consortial server, has its own
+// circuit, so one failing doesn't pause requests for the others.
+type CircuitBreaker struct {
+	// Failures is how many upstream requests in a row must fail before the
+	// breaker opens. Zero disables the breaker.
+	Failures int
+
+	// Cooldown is how long the breaker stays open before trying a request.
+	Cooldown time.Duration
+
+	mu       sync.Mutex
+	circuits map[string]*circuit // Keyed by reader service address.
+}
+
+// circuit is the state of the breaker for one reader service.
+type circuit struct {
+	failures int       // Requests in a row which have failed.
+	open     bool      // Whether requests are being refused.
+	openedAt time.Time // When the circuit opened, or last let a request through.
+	since    time.Time // When the circuit first opened, for the log.
+}
+
+// Enabled reports whether the breaker is on.
+func (b *CircuitBreaker) Enabled() bool {
+	return b != nil && b.Failures > 0
+}
+
+// circuit returns the state of the breaker for a reader service.
+func (b *CircuitBreaker) circuit(upstream string) *circuit {
+	if b.circuits == nil {
+		b.circuits = map[string]*circuit{}
+	}
+	c, ok := b.circuits[upstream]
+	if !ok {
+		c = &circuit{}
+		b.circuits[upstream] = c
+	}
+	return c
+}
+
+// Allow reports whether a request may be sent to a reader service. If not,
+// it also returns how long until the breaker lets a request through. Once
+// the breaker has been open for Cooldown, one request is let through, and
+// another after each further Cooldown, until one gets a response.
+func (b *CircuitBreaker) Allow(upstream string) (bool, time.Duration) {
+	if !b.Enabled() {
+		return true, 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c := b.circuit(upstream)
+	if !c.open {
+		return true, 0
+	}
+	wait := b.Cooldown - time.Since(c.openedAt)
+	if wait > 0 {
+		return false, wait
+	}
+	c.openedAt = time.Now()
+	slog.Info("Circuit breaker is letting a request through to the reader service.", "upstream", upstream)
+	return true, 0
+}
+
+// Observe records how a request to a reader service went, with the error it
+// failed with, or nil, and opens or closes its circuit. It does nothing if
+// the breaker is off.
+func (b *CircuitBreaker) Observe(upstream string, err error) {
+	if !b.Enabled() {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c := b.circuit(upstream)
+	if err == nil {
+		c.failures = 0
+		if c.open {
+			c.open = false
+			slog.Info("Circuit breaker closed, the reader service is answering again.", "upstream", upstream, "duration", time.Since(c.since).Round(time.Second))
+		}
+		return
+	}
+	c.failures++
+	if c.open || c.failures < b.Failures {
+		return
+	}
+	c.open = true
+	c.openedAt = time.Now()
+	c.since = c.openedAt
+	slog.Warn("Circuit breaker opened, refusing requests to the reader service.", "upstream", upstream, "failures", c.failures, "cooldown", b.Cooldown, "error", err)
+}
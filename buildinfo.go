@@ -0,0 +1,101 @@
+// Copyright 2023 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"strings"
+)
+
+// BuildInfo describes exactly which build of the program is running.
+type BuildInfo struct {
+	Version   string `json:"version"`
+	Revision  string `json:"revision"`
+	Modified  bool   `json:"modified"`
+	BuildDate string `json:"build_date"`
+	GoVersion string `json:"go_version"`
+	Platform  string `json:"platform"`
+}
+
+// GetBuildInfo returns the build information for the running program.
+func GetBuildInfo() BuildInfo {
+	info := BuildInfo{
+		Version:   version,
+		Revision:  commit,
+		BuildDate: date,
+		GoVersion: runtime.Version(),
+		Platform:  runtime.GOOS + "/" + runtime.GOARCH,
+	}
+	build, ok := debug.ReadBuildInfo()
+	if !ok {
+		return info
+	}
+	// Installed with go install, the module version is the release.
+	if info.Version == "devel" && build.Main.Version != "" && build.Main.Version != "(devel)" {
+		info.Version = strings.TrimPrefix(build.Main.Version, "v")
+	}
+	for _, setting := range build.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			if info.Revision == "" {
+				info.Revision = setting.Value
+			}
+		case "vcs.time":
+			if info.BuildDate == "" {
+				info.BuildDate = setting.Value
+			}
+		case "vcs.modified":
+			info.Modified = setting.Value == "true"
+		}
+	}
+	return info
+}
+
+// String formats the build information for humans and support tickets.
+func (b BuildInfo) String() string {
+	revision := b.Revision
+	if revision == "" {
+		revision = "unknown"
+	}
+	if b.Modified {
+		revision += " (modified)"
+	}
+	buildDate := b.BuildDate
+	if buildDate == "" {
+		buildDate = "unknown"
+	}
+	return fmt.Sprintf("almarfidintercept %v\nRevision: %v\nBuilt: %v\nGo: %v\nPlatform: %v\n",
+		b.Version, revision, buildDate, b.GoVersion, b.Platform)
+}
+
+// VersionReport is the JSON response at /version.
+type VersionReport struct {
+	BuildInfo
+	Station string `json:"station"`
+}
+
+// VersionHandler serves the build information as JSON at /version, so fleet
+// inventory scripts can find which build each workstation is running. Like
+// /livez, any client may ask.
+type VersionHandler struct {
+	Station string
+}
+
+// ServeHTTP serves the build information.
+func (h VersionHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set(VersionHeader, version)
+	json.NewEncoder(w).Encode(VersionReport{BuildInfo: GetBuildInfo(), Station: h.Station})
+}
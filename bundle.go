@@ -0,0 +1,213 @@
+// Copyright 2023 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// BundleLogBackups is how many rotated log files are put in a bundle.
+	BundleLogBackups = 3
+
+	// BundleMaxLogBytes is the most of each log file put in a bundle, from its end.
+	BundleMaxLogBytes = 4 << 20
+)
+
+// Bundle is a zip file for staff to attach to a help ticket, with everything
+// support usually asks for: the version, the configuration, details of the
+// computer, and the recent logs. Secrets in the configuration and environment
+// are masked, and barcodes and patron identifiers in the logs are masked by
+// the Redactor. It is served at /admin/bundle, and written by the bundle
+// command.
+type Bundle struct {
+	Config   *ConfigFile
+	Redactor *Redactor
+
+	// Tail is the recent log output of the running proxy. It may be nil.
+	Tail *LogTail
+
+	// LogFile is the -log-file, which is included with its newest rotated
+	// files. It may be empty.
+	LogFile string
+
+	// Started is when the proxy started. It is zero outside the proxy.
+	Started time.Time
+}
+
+// BundleName returns the file name of a bundle made at t.
+func BundleName(t time.Time) string {
+	return fmt.Sprintf("almarfidintercept-%v-%v.zip", hostname(), t.Format("20060102-150405"))
+}
+
+// Write writes the bundle as a zip file.
+func (b *Bundle) Write(w io.Writer) error {
+	archive := zip.NewWriter(w)
+	now := time.Now()
+	add := func(name, content string) error {
+		f, err := archive.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: now})
+		if err != nil {
+			return fmt.Errorf("unable to add %v to the bundle: %w", name, err)
+		}
+		_, err = io.WriteString(f, content)
+		return err
+	}
+	err := add("version.txt", GetBuildInfo().String())
+	if err != nil {
+		return err
+	}
+	err = add("config.toml", b.Config.Effective())
+	if err != nil {
+		return err
+	}
+	err = add("environment.txt", b.environment())
+	if err != nil {
+		return err
+	}
+	if b.Tail != nil {
+		err = add("logs/recent.log", b.Redactor.Redact(b.Tail.String()))
+		if err != nil {
+			return err
+		}
+	}
+	if b.LogFile != "" {
+		files := append([]string{b.LogFile}, LogBackups(b.LogFile)...)
+		if len(files) > BundleLogBackups+1 {
+			files = files[:BundleLogBackups+1]
+		}
+		for _, path := range files {
+			content, err := readLogEnd(path)
+			if err != nil {
+				content = fmt.Sprintf("Unable to read %v: %v\n", path, err)
+			}
+			err = add("logs/"+filepath.Base(path), b.Redactor.Redact(content))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return archive.Close()
+}
+
+// environment describes the computer and process.
+func (b *Bundle) environment() string {
+	var s strings.Builder
+	now := time.Now()
+	fmt.Fprintf(&s, "Time: %v\n", now.Format(time.RFC3339))
+	fmt.Fprintf(&s, "UTC: %v\n", now.UTC().Format(time.RFC3339))
+	fmt.Fprintf(&s, "Host: %v\n", hostname())
+	fmt.Fprintf(&s, "Platform: %v/%v\n", runtime.GOOS, runtime.GOARCH)
+	fmt.Fprintf(&s, "CPUs: %v\n", runtime.NumCPU())
+	fmt.Fprintf(&s, "Process: %v\n", os.Getpid())
+	if !b.Started.IsZero() {
+		fmt.Fprintf(&s, "Uptime: %v\n", now.Sub(b.Started).Round(time.Second))
+		fmt.Fprintf(&s, "Goroutines: %v\n", runtime.NumGoroutine())
+	}
+	if executable, err := os.Executable(); err == nil {
+		fmt.Fprintf(&s, "Executable: %v\n", executable)
+	}
+	if dir, err := os.Getwd(); err == nil {
+		fmt.Fprintf(&s, "Working directory: %v\n", dir)
+	}
+	fmt.Fprintf(&s, "Temporary directory: %v\n", os.TempDir())
+	var env []string
+	for _, variable := range os.Environ() {
+		name, value, _ := strings.Cut(variable, "=")
+		if !strings.HasPrefix(name, EnvPrefix) {
+			continue
+		}
+		env = append(env, name+"="+maskSecret(name, value))
+	}
+	sort.Strings(env)
+	fmt.Fprintf(&s, "\n== Environment variables ==\n")
+	for _, variable := range env {
+		fmt.Fprintln(&s, variable)
+	}
+	return s.String()
+}
+
+// ServeHTTP sends the bundle as a download.
+func (b *Bundle) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", BundleName(time.Now())))
+	w.Header().Set("Cache-Control", "no-store")
+	err := b.Write(w)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Unable to write diagnostics bundle.", "error", err)
+	}
+}
+
+// readLogEnd reads a log file, or its last BundleMaxLogBytes if it is larger,
+// starting at a whole line.
+func readLogEnd(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	if info.Size() <= BundleMaxLogBytes {
+		content, err := io.ReadAll(f)
+		return string(content), err
+	}
+	_, err = f.Seek(info.Size()-BundleMaxLogBytes, io.SeekStart)
+	if err != nil {
+		return "", err
+	}
+	content, err := io.ReadAll(f)
+	if err != nil {
+		return "", err
+	}
+	if i := strings.IndexByte(string(content), '\n'); i >= 0 {
+		content = content[i+1:]
+	}
+	return string(content), nil
+}
+
+// runBundleCommand writes a bundle to the current directory, with the
+// configuration the proxy would start with, and its log file. The running
+// proxy's recent logs are only in the bundle from /admin/bundle.
+func runBundleCommand(args []string, stdout io.Writer) error {
+	config, err := ParseConfig("bundle", args)
+	if err != nil {
+		return err
+	}
+	get := func(name string) string { return config.fs.Lookup(name).Value.String() }
+	redactor, err := NewRedactor(get("redact-fields"), get("redact-patterns"))
+	if err != nil {
+		return err
+	}
+	bundle := &Bundle{Config: config, Redactor: redactor, LogFile: get("log-file")}
+	name := BundleName(time.Now())
+	f, err := os.Create(name)
+	if err != nil {
+		return fmt.Errorf("unable to create bundle: %w", err)
+	}
+	err = bundle.Write(f)
+	if err != nil {
+		f.Close()
+		os.Remove(name)
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		return fmt.Errorf("unable to write bundle: %w", err)
+	}
+	fmt.Fprintf(stdout, "Wrote %v. Attach it to the help ticket.\n", name)
+	return nil
+}
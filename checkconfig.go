@@ -0,0 +1,392 @@
+// Copyright 2023 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CertExpiryWarning is how long before a TLS certificate expires check-config warns about it.
+const CertExpiryWarning = 14 * 24 * time.Hour
+
+// ErrBadConfig is returned by check-config when it finds problems.
+var ErrBadConfig = errors.New("the configuration has problems")
+
+// runCheckConfigCommand checks the configuration the proxy would start with,
+// from the same flags, environment variables, and config file, without starting
+// it. Each problem is printed with what to do about it, and finding any is an error.
+func runCheckConfigCommand(args []string, stdout io.Writer) error {
+	config, err := ParseConfig("check-config", args)
+	if err != nil {
+		return err
+	}
+
+	check := &configCheck{fs: config.fs}
+	check.run()
+	for _, warning := range check.warnings {
+		fmt.Fprintf(stdout, "Warning: %v\n", warning)
+	}
+	for _, problem := range check.problems {
+		fmt.Fprintf(stdout, "Problem: %v\n", problem)
+	}
+	if len(check.problems) > 0 {
+		return fmt.Errorf("%w, %d found", ErrBadConfig, len(check.problems))
+	}
+	fmt.Fprintln(stdout, "Configuration OK.")
+	return nil
+}
+
+// configCheck collects the problems, and warnings, found in the flags.
+type configCheck struct {
+	fs       *flag.FlagSet
+	problems []string
+	warnings []string
+}
+
+// get returns the value of a flag.
+func (c *configCheck) get(name string) string {
+	return c.fs.Lookup(name).Value.String()
+}
+
+// problem records something which would stop the proxy from starting, or from working.
+func (c *configCheck) problem(format string, args ...any) {
+	c.problems = append(c.problems, fmt.Sprintf(format, args...))
+}
+
+// warn records something which works, but probably isn't what was meant.
+func (c *configCheck) warn(format string, args ...any) {
+	c.warnings = append(c.warnings, fmt.Sprintf(format, args...))
+}
+
+// run runs the checks.
+func (c *configCheck) run() {
+	c.checkLogging()
+	c.checkOrigins()
+	c.checkURLs()
+	c.checkLists()
+	c.checkLimits()
+	c.checkFiles()
+	c.checkTLS()
+	c.checkPorts()
+}
+
+// checkLogging checks the log settings.
+func (c *configCheck) checkLogging() {
+	_, err := ReloadableSettings{LogLevel: c.get("log-level")}.Level()
+	if err != nil {
+		c.problem("-log-level %q is not a level. Use debug, info, warn, or error.", c.get("log-level"))
+	}
+	_, err = ResolveLogFormat(c.get("log-format"), os.Stderr)
+	if err != nil {
+		c.problem("-log-format: %v.", err)
+	}
+}
+
+// checkOrigins checks the allowed origins, and the environments they're in.
+func (c *configCheck) checkOrigins() {
+	c.checkOrigin("origin", true)
+	err := validateEnvironment(c.get("environment"))
+	if err != nil {
+		c.problem("-environment: %v.", err)
+	}
+	if c.get("sandbox-origin") != "" {
+		c.checkOrigin("sandbox-origin", false)
+		if c.get("sandbox-proxy") == "" {
+			c.problem("-sandbox-origin is set, but -sandbox-proxy isn't. A sandbox origin needs its own proxied address.")
+		}
+	}
+	if path := c.get("institutions"); path != "" {
+		// Loading the institutions checks their origins and upstreams.
+		institutions, err := LoadInstitutions(path, false)
+		if err != nil {
+			c.problem("-institutions: %v. Check the file against the JSON Schema printed by the schema command.", err)
+		} else {
+			institutions.Close()
+		}
+	}
+}
+
+// checkOrigin checks an origin flag is an origin browsers will send, or with allowAny, *.
+func (c *configCheck) checkOrigin(name string, allowAny bool) {
+	origin := c.get(name)
+	if allowAny && origin == "*" {
+		c.warn("-%v is *, so any web page can use the reader. Set it to your Alma domain.", name)
+		return
+	}
+	err := validateOrigin(origin)
+	switch {
+	case err != nil:
+		c.problem("-%v %q is not an origin. Use the scheme and host of your Alma domain, like https://example.alma.exlibrisgroup.com.", name, origin)
+	case strings.HasSuffix(origin, "/"):
+		c.problem("-%v %q ends with a slash, so browsers will never match it. Remove the slash.", name, origin)
+	case !strings.HasPrefix(origin, "https://"):
+		c.warn("-%v %q doesn't start with https://, but Alma is always served over HTTPS.", name, origin)
+	}
+}
+
+// checkURLs checks the addresses the proxy connects to.
+func (c *configCheck) checkURLs() {
+	c.checkUpstream("proxy")
+	if c.get("sandbox-proxy") != "" {
+		c.checkUpstream("sandbox-proxy")
+	}
+	_, err := NewUpstreamPool(append([]string{c.get("proxy")}, splitList(c.get("proxy-pool"))...), c.get("balance"))
+	if err != nil {
+		c.problem("-proxy-pool or -balance: %v.", err)
+	}
+	if c.get("proxy-fallback") != "" {
+		c.checkUpstream("proxy-fallback")
+	}
+	for _, receiver := range splitList(c.get("webhooks")) {
+		_, err := NewWebhook(receiver, nil)
+		if err != nil {
+			c.problem("-webhooks: %v. Use http:// or https:// URLs.", err)
+		}
+	}
+	if c.get("digest-webhook") != "" {
+		_, err := NewDigest(nil, "", 0, c.get("digest-webhook"), "")
+		if err != nil {
+			c.problem("-digest-webhook: %v. Use an http:// or https:// URL.", err)
+		}
+	}
+	if c.get("statsd-addr") != "" {
+		if _, _, err := net.SplitHostPort(c.get("statsd-addr")); err != nil {
+			c.problem("-statsd-addr: %v. Use an address like localhost:8125.", err)
+		}
+	}
+	if c.get("otlp-endpoint") != "" {
+		if _, err := NewTracer(c.get("otlp-endpoint"), "", ""); err != nil {
+			c.problem("-otlp-endpoint: %v. Use a URL like http://collector:4318.", err)
+		}
+	}
+	if c.get("syslog-addr") != "" {
+		handler, err := NewSyslogHandler(c.get("syslog-addr"), c.get("syslog-facility"), c.get("syslog-ca"), false, slog.LevelInfo)
+		if err != nil {
+			c.problem("-syslog-addr, -syslog-facility, or -syslog-ca: %v.", err)
+		} else {
+			handler.Close()
+		}
+	}
+	if _, err := NewUpdateChecker(c.get("update-url"), 0); err != nil {
+		c.problem("-update-url: %v. Use an http:// or https:// URL.", err)
+	}
+	if c.get("gate-api") != "" {
+		_, err := NewGateForwarder(c.get("gate-api"), "", "")
+		if err != nil {
+			c.problem("-gate-api: %v. Use an http:// or https:// URL.", err)
+		}
+	}
+	if c.get("mqtt-broker") != "" {
+		_, err := NewMQTTPublisher(c.get("mqtt-broker"), "", "", "", "")
+		if err != nil {
+			c.problem("-mqtt-broker: %v. Use a URL like tcp://broker:1883 or ssl://broker:8883.", err)
+		}
+	}
+	if local := c.get("upstream-local-address"); local != "" {
+		if _, err := net.InterfaceByName(local); err != nil && net.ParseIP(local) == nil {
+			c.problem("-upstream-local-address %q is not an IP address, or a network interface on this computer.", local)
+		}
+	}
+}
+
+// checkUpstream checks a flag is the URL of a reader service.
+func (c *configCheck) checkUpstream(name string) {
+	upstream := c.get(name)
+	u, err := url.Parse(upstream)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		c.problem("-%v %q is not the address of the RFID software. Use a URL like %v.", name, upstream, DefaultProxy)
+	}
+}
+
+// checkLists checks the flags which are lists, or have their own syntax.
+func (c *configCheck) checkLists() {
+	_, err := NewPathFilter(c.get("allowed-paths"))
+	if err != nil {
+		c.problem("-allowed-paths: %v.", err)
+	}
+	_, err = NewAccessLog(c.get("access-log-include"), c.get("access-log-exclude"), c.get("access-log-format"), nil)
+	if err != nil {
+		c.problem("-access-log-format, -access-log-include, or -access-log-exclude: %v.", err)
+	}
+	_, err = NewRedactor(c.get("redact-fields"), c.get("redact-patterns"))
+	if err != nil {
+		c.problem("-redact-patterns: %v.", err)
+	}
+	_, err = ParseRoutes(c.get("routes"))
+	if err != nil {
+		c.problem("-routes: %v.", err)
+	}
+	_, err = ParseActionRoutes(c.get("action-routes"))
+	if err != nil {
+		c.problem("-action-routes: %v.", err)
+	}
+	_, err = ParseLatencyObjectives(c.get("latency-objectives"))
+	if err != nil {
+		c.problem("-latency-objectives: %v.", err)
+	}
+	_, err = ParseOperationTimeouts(c.get("operation-timeouts"))
+	if err != nil {
+		c.problem("-operation-timeouts: %v.", err)
+	}
+	_, err = ParseEventTypes(c.get("webhook-events"))
+	if err != nil {
+		c.problem("-webhook-events: %v.", err)
+	}
+	if c.get("digest-at") != "" {
+		_, err = ParseDigestTime(c.get("digest-at"))
+		if err != nil {
+			c.problem("-digest-at: %v.", err)
+		}
+	}
+	_, err = ListenNetwork(c.get("ip-version"))
+	if err != nil {
+		c.problem("-ip-version: %v.", err)
+	}
+}
+
+// checkLimits checks the numbers which must be in a range.
+func (c *configCheck) checkLimits() {
+	rate, err := strconv.ParseFloat(c.get("alert-error-rate"), 64)
+	if err == nil && (rate < 0 || rate > 1) {
+		c.problem("-alert-error-rate %v must be between 0 and 1, like 0.2 for one request in five.", rate)
+	}
+	maxAge, err := time.ParseDuration(c.get("cors-max-age"))
+	if err == nil && maxAge < 0 {
+		c.problem("-cors-max-age %v can't be negative.", maxAge)
+	}
+	logMaxSize, err := strconv.Atoi(c.get("log-max-size"))
+	if err == nil && logMaxSize < 0 {
+		c.problem("-log-max-size %v can't be negative.", logMaxSize)
+	}
+	warmUp, err := time.ParseDuration(c.get("warm-up-interval"))
+	if err != nil {
+		return
+	}
+	idle, err := time.ParseDuration(c.get("upstream-idle-timeout"))
+	if err == nil && warmUp > 0 && warmUp >= idle {
+		c.warn("-warm-up-interval %v is longer than -upstream-idle-timeout %v, so the warmed up connection will be closed between requests.", warmUp, idle)
+	}
+}
+
+// checkFiles checks the files and directories the proxy reads and writes.
+func (c *configCheck) checkFiles() {
+	if spool := c.get("receipt-spool"); spool != "" {
+		info, err := os.Stat(spool)
+		if err != nil || !info.IsDir() {
+			c.problem("-receipt-spool %q is not a directory. Create it, or fix the path.", spool)
+		}
+	}
+	if logFile := c.get("log-file"); logFile != "" {
+		info, err := os.Stat(filepath.Dir(logFile))
+		if err != nil || !info.IsDir() {
+			c.problem("-log-file %q is not in a directory which exists. Create it, or fix the path.", logFile)
+		}
+	}
+	if ca := c.get("gelf-ca"); ca != "" {
+		_, err := os.ReadFile(ca)
+		if err != nil {
+			c.problem("-gelf-ca: %v.", err)
+		}
+	}
+	for _, name := range []string{"reader-command", "watchdog-command"} {
+		if command := c.get(name); command != "" {
+			err := checkCommand(command)
+			if err != nil {
+				c.problem("-%v: %v. Quote the program with double quotes if its path has spaces.", name, err)
+			}
+		}
+	}
+}
+
+// checkTLS checks the certificate and key, and the client CAs.
+func (c *configCheck) checkTLS() {
+	certFile, keyFile := c.get("tls-cert"), c.get("tls-key")
+	https := certFile != "" || c.get("acme-host") != ""
+	switch {
+	case certFile != "" && c.get("acme-host") != "":
+		c.problem("Both -tls-cert and -acme-host are set. Use one or the other.")
+	case (certFile == "") != (keyFile == ""):
+		c.problem("Only one of -tls-cert and -tls-key is set. Both are needed to serve HTTPS.")
+	case certFile != "":
+		c.checkCert(certFile, keyFile)
+	}
+	if ca := c.get("client-ca"); ca != "" {
+		if !https {
+			c.problem("-client-ca is set, but client certificates can only be required over HTTPS. Set -tls-cert and -tls-key, or -acme-host.")
+		} else if err := RequireClientCerts(&tls.Config{}, ca); err != nil {
+			c.problem("-client-ca: %v.", err)
+		}
+	}
+}
+
+// checkCert checks a certificate and key can be loaded, and the certificate
+// isn't about to expire.
+func (c *configCheck) checkCert(certFile, keyFile string) {
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		c.problem("Unable to load -tls-cert and -tls-key: %v. Check the files are PEM, and the key matches the certificate.", err)
+		return
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		c.problem("Unable to parse -tls-cert: %v.", err)
+		return
+	}
+	switch left := time.Until(cert.NotAfter); {
+	case left <= 0:
+		c.problem("The -tls-cert certificate expired on %v. Renew it, or make a new one with the gencert command.", cert.NotAfter.Format(time.DateOnly))
+	case left < CertExpiryWarning:
+		c.warn("The -tls-cert certificate expires on %v.", cert.NotAfter.Format(time.DateOnly))
+	}
+}
+
+// checkPorts checks the addresses the proxy listens on are free.
+func (c *configCheck) checkPorts() {
+	address := c.get("address")
+	listeners, err := Listen(c.get("ip-version"), address)
+	if err != nil {
+		c.problem("Unable to listen on -address %v: %v. If the proxy is already running, stop it first. Otherwise, choose another address.", address, err)
+	}
+	for _, listener := range listeners {
+		listener.Close()
+	}
+	if c.get("acme-host") != "" && c.get("acme-http-address") != "" {
+		listener, err := net.Listen("tcp", c.get("acme-http-address"))
+		if err != nil {
+			c.problem("Unable to listen on -acme-http-address %v: %v. Stop the program using it, or set -acme-http-address empty to only use TLS challenges.", c.get("acme-http-address"), err)
+		} else {
+			listener.Close()
+		}
+	}
+	if admin := c.get("admin-address"); admin != "" {
+		listener, err := net.Listen("tcp", admin)
+		if err != nil {
+			c.problem("Unable to listen on -admin-address %v: %v. Stop the program using it, or choose another address.", admin, err)
+		} else {
+			listener.Close()
+		}
+	}
+	if snmp := c.get("snmp-address"); snmp != "" {
+		conn, err := net.ListenPacket("udp", snmp)
+		if err != nil {
+			c.problem("Unable to listen on -snmp-address %v: %v. Stop the program using it, or choose another address.", snmp, err)
+		} else {
+			conn.Close()
+		}
+	}
+}
@@ -0,0 +1,195 @@
+/*
+ * almarfidintercept client helper, version __VERSION__.
+ *
+ * Served by the proxy at /client.js, so it always matches the proxy it came from.
+ * It finds the proxy, polls the RFID pad, and turns the proxy's error responses
+ * into errors the Alma customization can show to staff.
+ *
+ *   RFIDIntercept.discover(['https://localhost:53535', 'http://localhost:53535']).then(function (baseURL) {
+ *     var client = new RFIDIntercept.Client({
+ *       baseURL: baseURL,
+ *       path: '/getItems',
+ *       onItems: function (items) { ... },       // [{barcode: '...', secure: true}]
+ *       onError: function (err) { ... }          // err.name is UnavailableError, RateLimitError, or Error
+ *     });
+ *     client.start();
+ *   });
+ *
+ * Copyright 2023 Carleton University Library All rights reserved.
+ * Use of this source code is governed by the MIT
+ * license that can be found in the LICENSE file.
+ */
+(function (root) {
+  'use strict';
+
+  var VERSION = '__VERSION__';
+  var VERSION_HEADER = 'X-RFID-Intercept-Version';
+  var ENVIRONMENT_HEADER = 'X-RFID-Intercept-Environment';
+  var DEFAULT_CANDIDATES = ['https://localhost:53535', 'http://localhost:53535', 'http://127.0.0.1:53535'];
+  var MAX_BACKOFF = 30000;
+
+  // UnavailableError means the proxy is running, but the RFID software behind it isn't.
+  // help has the instructions the proxy was configured with.
+  function UnavailableError(payload) {
+    this.name = 'UnavailableError';
+    this.message = payload.error || 'RFID software unavailable';
+    this.reason = payload.reason || '';
+    this.help = payload.help || '';
+    this.station = payload.station || '';
+  }
+  UnavailableError.prototype = Object.create(Error.prototype);
+
+  // RateLimitError means this origin sent too many requests. retryAfter is in seconds.
+  function RateLimitError(retryAfter) {
+    this.name = 'RateLimitError';
+    this.message = 'Too many requests to the RFID intercept.';
+    this.retryAfter = retryAfter;
+  }
+  RateLimitError.prototype = Object.create(Error.prototype);
+
+  // fetchWithTimeout is fetch, aborted after timeout milliseconds.
+  function fetchWithTimeout(url, options, timeout) {
+    var controller = new AbortController();
+    var timer = setTimeout(function () { controller.abort(); }, timeout);
+    options = Object.assign({}, options, { signal: controller.signal });
+    return fetch(url, options).finally(function () { clearTimeout(timer); });
+  }
+
+  // discover resolves to the first candidate base URL where a proxy answers.
+  function discover(candidates, timeout) {
+    candidates = candidates || DEFAULT_CANDIDATES;
+    timeout = timeout || 2000;
+    var i = 0;
+    function next() {
+      if (i >= candidates.length) {
+        return Promise.reject(new Error('No RFID intercept found at ' + candidates.join(', ')));
+      }
+      var candidate = candidates[i++].replace(/\/+$/, '');
+      return fetchWithTimeout(candidate + '/client.js', { method: 'HEAD' }, timeout).then(function (resp) {
+        if (resp.ok && resp.headers.get(VERSION_HEADER)) {
+          return candidate;
+        }
+        return next();
+      }, next);
+    }
+    return next();
+  }
+
+  // parseItems finds items in a reader service response, the same way the proxy does.
+  // Any element named item with a barcode child is an item. Namespaces and case are ignored.
+  function parseItems(text) {
+    var doc = new DOMParser().parseFromString(text, 'application/xml');
+    if (doc.getElementsByTagName('parsererror').length > 0) {
+      throw new Error('The RFID software sent a response which is not XML.');
+    }
+    var items = [];
+    var elements = doc.getElementsByTagName('*');
+    for (var i = 0; i < elements.length; i++) {
+      if (elements[i].localName.toLowerCase() !== 'item') {
+        continue;
+      }
+      var item = { barcode: '', secure: false };
+      var children = elements[i].children;
+      for (var j = 0; j < children.length; j++) {
+        var name = children[j].localName.toLowerCase();
+        var value = children[j].textContent.trim();
+        if (name === 'barcode') {
+          item.barcode = value;
+        } else if (name === 'issecure' || name === 'secure') {
+          item.secure = value === 'true' || value === '1';
+        }
+      }
+      if (item.barcode) {
+        items.push(item);
+      }
+    }
+    return items;
+  }
+
+  // Client talks to one proxy.
+  function Client(options) {
+    this.baseURL = (options.baseURL || 'http://localhost:53535').replace(/\/+$/, '');
+    this.path = options.path || '/getItems';
+    this.soapAction = options.soapAction || '';
+    this.interval = options.interval || 1000;
+    this.timeout = options.timeout || 5000;
+    this.onItems = options.onItems || function () {};
+    this.onError = options.onError || function () {};
+    this.environment = '';
+    this.timer = null;
+    this.backoff = 0;
+  }
+
+  // request sends a request through the proxy, resolving to the response text.
+  // It rejects with an UnavailableError or RateLimitError when the proxy says so.
+  Client.prototype.request = function (path, options) {
+    var self = this;
+    options = Object.assign({ method: 'GET', headers: {} }, options);
+    if (self.soapAction && !options.headers.SOAPAction) {
+      options.headers.SOAPAction = self.soapAction;
+    }
+    return fetchWithTimeout(self.baseURL + path, options, self.timeout).then(function (resp) {
+      self.environment = resp.headers.get(ENVIRONMENT_HEADER) || self.environment;
+      if (resp.status === 503) {
+        return resp.json().then(function (payload) {
+          throw new UnavailableError(payload);
+        }, function () {
+          throw new UnavailableError({});
+        });
+      }
+      if (resp.status === 429) {
+        throw new RateLimitError(parseInt(resp.headers.get('Retry-After') || '1', 10));
+      }
+      if (!resp.ok) {
+        throw new Error('The RFID intercept responded ' + resp.status + '.');
+      }
+      return resp.text();
+    });
+  };
+
+  // items resolves to the items on the pad.
+  Client.prototype.items = function () {
+    return this.request(this.path).then(parseItems);
+  };
+
+  // start polls the pad every interval milliseconds, backing off after errors.
+  Client.prototype.start = function () {
+    var self = this;
+    self.stop();
+    function poll() {
+      self.items().then(function (items) {
+        self.backoff = 0;
+        self.onItems(items);
+      }, function (err) {
+        if (err.name === 'RateLimitError') {
+          self.backoff = err.retryAfter * 1000;
+        } else {
+          self.backoff = Math.min(Math.max(self.backoff * 2, self.interval), MAX_BACKOFF);
+        }
+        self.onError(err);
+      }).then(function () {
+        if (self.timer !== null) {
+          self.timer = setTimeout(poll, self.interval + self.backoff);
+        }
+      });
+    }
+    self.timer = setTimeout(poll, 0);
+  };
+
+  // stop stops polling.
+  Client.prototype.stop = function () {
+    if (this.timer !== null) {
+      clearTimeout(this.timer);
+    }
+    this.timer = null;
+  };
+
+  root.RFIDIntercept = {
+    version: VERSION,
+    discover: discover,
+    parseItems: parseItems,
+    Client: Client,
+    UnavailableError: UnavailableError,
+    RateLimitError: RateLimitError
+  };
+}(typeof self !== 'undefined' ? self : this));
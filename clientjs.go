@@ -0,0 +1,33 @@
+// Copyright 2023 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	_ "embed"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// VersionHeader is the response header with the proxy's version, so the
+// client helper and the Alma customization can check they are compatible.
+const VersionHeader = "X-RFID-Intercept-Version"
+
+// clientJS is the JavaScript client helper served at /client.js.
+//
+//go:embed client.js
+var clientJS string
+
+// ServeClientJS serves the JavaScript client helper, stamped with this proxy's version.
+// Any page may load it, since it is the same for every origin.
+func ServeClientJS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/javascript; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("ETag", `"`+version+`"`)
+	w.Header().Set(VersionHeader, version)
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Expose-Headers", VersionHeader)
+	http.ServeContent(w, r, "client.js", time.Time{}, strings.NewReader(strings.ReplaceAll(clientJS, "__VERSION__", version)))
+}
@@ -0,0 +1,129 @@
+// Copyright 2023 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// CoalescedHeader is set on responses shared with a request already in flight.
+const CoalescedHeader = "X-RFID-Intercept-Coalesced"
+
+// Coalescer shares one upstream call between identical GET requests which are
+// in flight at the same time, like the tag polls from several open tabs of the
+// Alma RFID plugin. The first request is proxied, and the others wait for its
+// response, which is copied to each of them. Nothing is kept once it finishes.
+type Coalescer struct {
+	mu       sync.Mutex
+	inFlight map[string]*coalescedCall
+}
+
+// coalescedCall is one request in flight, and the response it got.
+type coalescedCall struct {
+	done   chan struct{} // Closed when the response is recorded, or abandoned.
+	ok     bool          // Whether a response was recorded.
+	shared int           // How many other requests waited for it.
+	status int
+	header http.Header
+	body   []byte
+}
+
+// NewCoalescer returns a Coalescer with nothing in flight.
+func NewCoalescer() *Coalescer {
+	return &Coalescer{inFlight: make(map[string]*coalescedCall)}
+}
+
+// Middleware wraps a handler, sharing responses between identical GET requests.
+// Other requests are passed through.
+func (c *Coalescer) Middleware(next http.Handler) http.Handler {
+	if c == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet || isUpgrade(r) || isEventStream(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		key := coalesceKey(r)
+		for {
+			call, leader := c.join(key)
+			if leader {
+				c.lead(key, call, w, r, next)
+				return
+			}
+			select {
+			case <-call.done:
+			case <-r.Context().Done():
+				return
+			}
+			if call.ok {
+				call.replay(w)
+				return
+			}
+			// The first request was abandoned, so try again ourselves.
+		}
+	})
+}
+
+// coalesceKey identifies the requests which can share a response: the URL,
+// and the request headers which could change the response, must match.
+func coalesceKey(r *http.Request) string {
+	var key strings.Builder
+	key.WriteString(r.URL.RequestURI())
+	for _, name := range []string{"Origin", "SOAPAction", "Accept", "Accept-Encoding", "Authorization", "Cookie"} {
+		key.WriteByte('\n')
+		key.WriteString(strings.Join(r.Header.Values(name), ","))
+	}
+	return key.String()
+}
+
+// join returns the call in flight for a key. If there isn't one, it starts one
+// and returns leader set, and the caller must make the request.
+func (c *Coalescer) join(key string) (*coalescedCall, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if call, ok := c.inFlight[key]; ok {
+		call.shared++
+		return call, false
+	}
+	call := &coalescedCall{done: make(chan struct{})}
+	c.inFlight[key] = call
+	return call, true
+}
+
+// lead serves a request, recording the response for the requests waiting on it.
+func (c *Coalescer) lead(key string, call *coalescedCall, w http.ResponseWriter, r *http.Request, next http.Handler) {
+	recorder := &bodyRecorder{responseRecorder: responseRecorder{ResponseWriter: w, status: http.StatusOK}}
+	defer func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		delete(c.inFlight, key)
+		// If our client went away, the response may be cut short, so don't share it.
+		if r.Context().Err() == nil {
+			call.ok = true
+			call.status = recorder.status
+			call.header = w.Header().Clone()
+			call.body = recorder.body.Bytes()
+		}
+		if call.shared > 0 {
+			slog.Debug("Shared a response with identical requests.", "path", r.URL.Path, "requests", call.shared+1)
+		}
+		close(call.done)
+	}()
+	next.ServeHTTP(recorder, r)
+}
+
+// replay writes a shared response.
+func (call *coalescedCall) replay(w http.ResponseWriter) {
+	for name, values := range call.header {
+		w.Header()[name] = values
+	}
+	w.Header().Set(CoalescedHeader, "true")
+	w.WriteHeader(call.status)
+	w.Write(call.body)
+}
@@ -0,0 +1,96 @@
+// Copyright 2023 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCoalesceKey(t *testing.T) {
+	request := func(target string, header ...string) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, target, nil)
+		r.Header.Set("Origin", "https://example.alma.exlibrisgroup.com")
+		for i := 0; i+1 < len(header); i += 2 {
+			r.Header.Set(header[i], header[i+1])
+		}
+		return r
+	}
+	base := coalesceKey(request("/getItems?reader=1"))
+	tests := []struct {
+		name string
+		r    *http.Request
+		same bool
+	}{
+		{"identical", request("/getItems?reader=1"), true},
+		{"other headers", request("/getItems?reader=1", "User-Agent", "test", "X-Request-Id", "abc"), true},
+		{"other query", request("/getItems?reader=2"), false},
+		{"other path", request("/getTags?reader=1"), false},
+		{"other origin", request("/getItems?reader=1", "Origin", "https://other.alma.exlibrisgroup.com"), false},
+		{"other action", request("/getItems?reader=1", "SOAPAction", "urn:rfid#getItems"), false},
+		{"other accept", request("/getItems?reader=1", "Accept", "application/json"), false},
+		{"other encoding", request("/getItems?reader=1", "Accept-Encoding", "gzip"), false},
+		{"credentials", request("/getItems?reader=1", "Authorization", "Basic YTpi"), false},
+		{"cookie", request("/getItems?reader=1", "Cookie", "session=1"), false},
+	}
+	for _, tt := range tests {
+		if same := coalesceKey(tt.r) == base; same != tt.same {
+			t.Errorf("%v: same key %v, want %v", tt.name, same, tt.same)
+		}
+	}
+}
+
+func TestCoalescer(t *testing.T) {
+	var calls atomic.Int32
+	arrived := make(chan struct{})
+	finish := make(chan struct{})
+	c := NewCoalescer()
+	h := c.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			close(arrived)
+			<-finish
+		}
+		w.Write([]byte(r.Method + " " + r.URL.RequestURI()))
+	}))
+	request := func(method, target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(method, target, nil))
+		return w
+	}
+	first := make(chan *httptest.ResponseRecorder)
+	go func() { first <- request(http.MethodGet, "/getItems") }()
+	<-arrived
+	// Another poll waits for the one in flight, while other requests go through.
+	if w := request(http.MethodGet, "/getTags"); w.Header().Get(CoalescedHeader) != "" {
+		t.Error("a different request was coalesced")
+	}
+	if w := request(http.MethodPost, "/getItems"); w.Header().Get(CoalescedHeader) != "" {
+		t.Error("a POST was coalesced")
+	}
+	shared := make(chan *httptest.ResponseRecorder)
+	go func() { shared <- request(http.MethodGet, "/getItems") }()
+	// Wait for it to join the poll in flight.
+	for joined := false; !joined; {
+		c.mu.Lock()
+		for _, call := range c.inFlight {
+			joined = call.shared > 0
+		}
+		c.mu.Unlock()
+		time.Sleep(time.Millisecond)
+	}
+	close(finish)
+	if w := <-first; w.Body.String() != "GET /getItems" {
+		t.Errorf("first got %q", w.Body.String())
+	}
+	if w := <-shared; w.Body.String() != "GET /getItems" || w.Header().Get(CoalescedHeader) != "true" {
+		t.Errorf("second got %q, %v", w.Body.String(), w.Header())
+	}
+	if got := calls.Load(); got != 3 {
+		t.Errorf("got %v calls, want 3", got)
+	}
+}
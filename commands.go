@@ -0,0 +1,135 @@
+// Copyright 2023 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// ErrUsage is returned when a subcommand is called with bad arguments.
+var ErrUsage = errors.New("bad arguments")
+
+// Command is a subcommand, run as almarfidintercept <name> [arguments].
+// Running with no subcommand, or only flags, starts the proxy.
+type Command struct {
+	Name  string
+	Usage string
+	Run   func(args []string, stdout io.Writer) error
+}
+
+// Commands returns the available subcommands.
+func Commands() []Command {
+	return []Command{
+		{
+			Name:  "version",
+			Usage: "Print the version, revision, build date, and platform.",
+			Run: func(args []string, stdout io.Writer) error {
+				if len(args) != 0 {
+					return fmt.Errorf("%w, version takes no arguments", ErrUsage)
+				}
+				_, err := fmt.Fprint(stdout, GetBuildInfo())
+				return err
+			},
+		},
+		{
+			Name:  "schema",
+			Usage: "Print a JSON Schema for the institutions file, or with config, for the -config file.",
+			Run: func(args []string, stdout io.Writer) error {
+				switch {
+				case len(args) == 0 || (len(args) == 1 && args[0] == "institutions"):
+					return WriteSchema(stdout)
+				case len(args) == 1 && args[0] == "config":
+					return WriteConfigSchema(stdout, flag.CommandLine)
+				}
+				return fmt.Errorf("%w, usage: schema [institutions|config]", ErrUsage)
+			},
+		},
+		{
+			Name:  "check-config",
+			Usage: "Check the configuration from flags, environment variables, and -config, without starting the proxy. Exits non-zero if there are problems.",
+			Run:   runCheckConfigCommand,
+		},
+		{
+			Name:  "doctor",
+			Usage: "Check the port, the RFID software, the TLS certificate, the allowed origins, and the clock, with the same configuration as the proxy. Exits non-zero if any check fails.",
+			Run:   runDoctorCommand,
+		},
+		{
+			Name:  "bundle",
+			Usage: "Write a zip file for a help ticket, with the version, the configuration with secrets masked, details of this computer, and the log file.",
+			Run:   runBundleCommand,
+		},
+		{
+			Name:  "print-config",
+			Usage: "Print the configuration from flags, environment variables, and -config, with where each value came from. Secrets are masked.",
+			Run:   runPrintConfigCommand,
+		},
+		{
+			Name:  "self-update",
+			Usage: "Replace this executable with the latest signed release, and restart the service. With -check, only say whether there is one.",
+			Run:   runSelfUpdateCommand,
+		},
+		{
+			Name:  "service",
+			Usage: "Install, uninstall, start, or stop the Windows service running the proxy, like: service install -- -config C:\\almarfidintercept\\config.toml",
+			Run:   runServiceCommand,
+		},
+		{
+			Name:  "tray",
+			Usage: "Show an icon in the Windows system tray, green when RFID works, yellow when it is slow, and red when it doesn't, with a menu to open the self test and restart the proxy.",
+			Run:   runTrayCommand,
+		},
+		{
+			Name:  "allow-firewall",
+			Usage: "Add, or with -remove remove, a Windows Firewall rule allowing inbound connections to -address.",
+			Run:   runFirewallCommand,
+		},
+		{
+			Name:  "gencert",
+			Usage: "Write a self-signed certificate and key for localhost, and with -install, add the certificate to the trust store.",
+			Run:   runGencertCommand,
+		},
+		{
+			Name:  "perf-counters",
+			Usage: "Print a manifest registering the Windows performance counters, for lodctr /m:<manifest>.",
+			Run:   runPerfCountersCommand,
+		},
+		{
+			Name:  "completion",
+			Usage: "Print a completion script for bash, zsh, or powershell.",
+			Run: func(args []string, stdout io.Writer) error {
+				if len(args) != 1 {
+					return fmt.Errorf("%w, usage: completion %v", ErrUsage, strings.ReplaceAll(CompletionShells, " ", "|"))
+				}
+				return WriteCompletion(stdout, args[0], flag.CommandLine)
+			},
+		},
+	}
+}
+
+// FindCommand returns the subcommand with the given name, or nil.
+func FindCommand(name string) *Command {
+	for _, command := range Commands() {
+		if command.Name == name {
+			return &command
+		}
+	}
+	return nil
+}
+
+// RunCommand runs a subcommand and exits.
+func RunCommand(command *Command, args []string) {
+	err := command.Run(args, os.Stdout)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v: %v\n", command.Name, err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
@@ -0,0 +1,154 @@
+// Copyright 2023 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// CompletionShells are the shells we can write completion scripts for.
+const CompletionShells = "bash zsh powershell"
+
+// WriteCompletion writes a completion script for the named shell,
+// covering the subcommands and the flags in fs.
+func WriteCompletion(w io.Writer, shell string, fs *flag.FlagSet) error {
+	commands := Commands()
+	var flags []*flag.Flag
+	fs.VisitAll(func(f *flag.Flag) { flags = append(flags, f) })
+
+	var script string
+	switch shell {
+	case "bash":
+		script = bashCompletion(commands, flags)
+	case "zsh":
+		script = zshCompletion(commands, flags)
+	case "powershell":
+		script = powershellCompletion(commands, flags)
+	default:
+		return fmt.Errorf("%w, shell must be one of: %v", ErrUsage, CompletionShells)
+	}
+	_, err := io.WriteString(w, script)
+	if err != nil {
+		return fmt.Errorf("unable to write completion script: %w", err)
+	}
+	return nil
+}
+
+// bashCompletion returns a completion script for bash. Load it with
+// source <(almarfidintercept completion bash).
+func bashCompletion(commands []Command, flags []*flag.Flag) string {
+	names := make([]string, 0, len(commands))
+	for _, command := range commands {
+		names = append(names, command.Name)
+	}
+	options := make([]string, 0, len(flags))
+	for _, f := range flags {
+		options = append(options, "-"+f.Name)
+	}
+	return fmt.Sprintf(`# bash completion for almarfidintercept
+_almarfidintercept() {
+    local cur="${COMP_WORDS[COMP_CWORD]}"
+    local commands="%v"
+    local flags="%v"
+    if [ "$COMP_CWORD" -eq 1 ]; then
+        COMPREPLY=( $(compgen -W "$commands $flags" -- "$cur") )
+    elif [ "${COMP_WORDS[1]}" = "completion" ] && [ "$COMP_CWORD" -eq 2 ]; then
+        COMPREPLY=( $(compgen -W "%v" -- "$cur") )
+    elif [[ "$cur" == -* ]]; then
+        COMPREPLY=( $(compgen -W "$flags" -- "$cur") )
+    fi
+}
+complete -o default -F _almarfidintercept almarfidintercept
+`, strings.Join(names, " "), strings.Join(options, " "), CompletionShells)
+}
+
+// zshCompletion returns a completion script for zsh. Load it with
+// source <(almarfidintercept completion zsh).
+func zshCompletion(commands []Command, flags []*flag.Flag) string {
+	var b strings.Builder
+	b.WriteString("#compdef almarfidintercept\n\n")
+	b.WriteString("_almarfidintercept() {\n")
+	b.WriteString("  local -a commands\n  commands=(\n")
+	for _, command := range commands {
+		fmt.Fprintf(&b, "    '%v:%v'\n", command.Name, zshEscape(command.Usage))
+	}
+	b.WriteString("  )\n")
+	b.WriteString("  if (( CURRENT == 2 )) && [[ $words[2] != -* ]]; then\n")
+	b.WriteString("    _describe -t commands 'almarfidintercept command' commands\n    return\n  fi\n")
+	fmt.Fprintf(&b, "  if [[ $words[2] == completion ]]; then\n    _values 'shell' %v\n    return\n  fi\n", CompletionShells)
+	b.WriteString("  _arguments \\\n")
+	for _, f := range flags {
+		value := ":value:"
+		if isBoolFlag(f) {
+			value = ""
+		}
+		fmt.Fprintf(&b, "    '-%v[%v]%v' \\\n", f.Name, zshEscape(firstLine(f.Usage)), value)
+	}
+	b.WriteString("    '*::argument:_files'\n")
+	b.WriteString("}\n\ncompdef _almarfidintercept almarfidintercept\n")
+	return b.String()
+}
+
+// powershellCompletion returns a completion script for PowerShell. Load it with
+// almarfidintercept completion powershell | Out-String | Invoke-Expression.
+func powershellCompletion(commands []Command, flags []*flag.Flag) string {
+	var b strings.Builder
+	b.WriteString("# PowerShell completion for almarfidintercept\n")
+	b.WriteString("Register-ArgumentCompleter -Native -CommandName 'almarfidintercept', 'almarfidintercept.exe' -ScriptBlock {\n")
+	b.WriteString("    param($wordToComplete, $commandAst, $cursorPosition)\n")
+	b.WriteString("    $commands = @{\n")
+	for _, command := range commands {
+		fmt.Fprintf(&b, "        '%v' = '%v'\n", command.Name, powershellEscape(command.Usage))
+	}
+	b.WriteString("    }\n    $flags = @{\n")
+	for _, f := range flags {
+		fmt.Fprintf(&b, "        '-%v' = '%v'\n", f.Name, powershellEscape(firstLine(f.Usage)))
+	}
+	b.WriteString("    }\n")
+	fmt.Fprintf(&b, "    $shells = @{ %v }\n", powershellShells())
+	b.WriteString(`    $elements = @($commandAst.CommandElements | Select-Object -Skip 1 | ForEach-Object { $_.ToString() })
+    if ($wordToComplete) { $elements = @($elements | Select-Object -SkipLast 1) }
+    if ($elements.Count -eq 0) {
+        $candidates = $commands + $flags
+    } elseif ($elements[0] -eq 'completion' -and $elements.Count -eq 1) {
+        $candidates = $shells
+    } else {
+        $candidates = $flags
+    }
+    $candidates.GetEnumerator() | Sort-Object Key | Where-Object { $_.Key -like "$wordToComplete*" } | ForEach-Object {
+        [System.Management.Automation.CompletionResult]::new($_.Key, $_.Key, 'ParameterValue', $_.Value)
+    }
+}
+`)
+	return b.String()
+}
+
+// powershellShells returns the completion shells as PowerShell hashtable entries.
+func powershellShells() string {
+	var entries []string
+	for _, shell := range strings.Fields(CompletionShells) {
+		entries = append(entries, fmt.Sprintf("'%v' = '%v'", shell, shell))
+	}
+	return strings.Join(entries, "; ")
+}
+
+// isBoolFlag reports whether a flag is a boolean, which takes no value.
+func isBoolFlag(f *flag.Flag) bool {
+	b, ok := f.Value.(interface{ IsBoolFlag() bool })
+	return ok && b.IsBoolFlag()
+}
+
+// zshEscape escapes text for a single quoted _arguments or _describe spec.
+func zshEscape(s string) string {
+	return strings.NewReplacer(`'`, `'\''`, `[`, `\[`, `]`, `\]`, `:`, `\:`).Replace(s)
+}
+
+// powershellEscape escapes text for a single quoted PowerShell string.
+func powershellEscape(s string) string {
+	return strings.ReplaceAll(s, "'", "''")
+}
@@ -0,0 +1,122 @@
+// Copyright 2023 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// ConfigChange is one setting which differs between two configurations.
+type ConfigChange struct {
+	Key string
+	Old string // Empty if the setting was added.
+	New string // Empty if the setting was removed.
+}
+
+// String formats the change for the log.
+func (c ConfigChange) String() string {
+	switch {
+	case c.Old == "":
+		return fmt.Sprintf("%v: added %v", c.Key, c.New)
+	case c.New == "":
+		return fmt.Sprintf("%v: removed %v", c.Key, c.Old)
+	default:
+		return fmt.Sprintf("%v: %v → %v", c.Key, c.Old, c.New)
+	}
+}
+
+// DiffConfig compares two configurations, which are flattened through their
+// JSON encoding into dotted keys. Secret values are masked.
+func DiffConfig(old, new any) ([]ConfigChange, error) {
+	oldValues, err := flattenConfig(old)
+	if err != nil {
+		return nil, err
+	}
+	newValues, err := flattenConfig(new)
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []ConfigChange
+	for key, oldValue := range oldValues {
+		newValue, found := newValues[key]
+		if found && newValue == oldValue {
+			continue
+		}
+		change := ConfigChange{Key: key, Old: oldValue, New: newValue}
+		if isSecret(key) {
+			change.Old = maskIfSet(change.Old)
+			change.New = maskIfSet(change.New)
+		} else {
+			change.Old = maskURLPasswords(change.Old)
+			change.New = maskURLPasswords(change.New)
+		}
+		changes = append(changes, change)
+	}
+	for key, newValue := range newValues {
+		if _, found := oldValues[key]; found {
+			continue
+		}
+		change := ConfigChange{Key: key, New: newValue}
+		if isSecret(key) {
+			change.New = maskIfSet(change.New)
+		} else {
+			change.New = maskURLPasswords(change.New)
+		}
+		changes = append(changes, change)
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Key < changes[j].Key })
+	return changes, nil
+}
+
+// flattenConfig encodes v as JSON, then flattens the result
+// into a map of dotted keys to encoded values.
+func flattenConfig(v any) (map[string]string, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("unable to encode configuration: %w", err)
+	}
+	var decoded any
+	err = json.Unmarshal(data, &decoded)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode configuration: %w", err)
+	}
+	values := make(map[string]string)
+	flatten("", decoded, values)
+	return values, nil
+}
+
+// flatten walks a decoded JSON value, adding its leaves to values.
+func flatten(prefix string, v any, values map[string]string) {
+	join := func(key string) string {
+		if prefix == "" {
+			return key
+		}
+		return prefix + "." + key
+	}
+	switch v := v.(type) {
+	case map[string]any:
+		for key, child := range v {
+			flatten(join(key), child, values)
+		}
+	case []any:
+		for i, child := range v {
+			flatten(join(fmt.Sprint(i)), child, values)
+		}
+	default:
+		encoded, _ := json.Marshal(v)
+		values[prefix] = string(encoded)
+	}
+}
+
+// maskIfSet masks a value unless it is empty.
+func maskIfSet(value string) string {
+	if value == "" || value == `""` {
+		return value
+	}
+	return Masked
+}
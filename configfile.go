@@ -0,0 +1,241 @@
+// Copyright 2023 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/cu-library/overridefromenv"
+)
+
+// ErrUnknownSetting is returned when the config file has a setting which isn't a flag.
+var ErrUnknownSetting = errors.New("unknown setting")
+
+// ErrBadSetting is returned when a setting in the config file has a value which
+// can't be used for its flag, like an array of tables.
+var ErrBadSetting = errors.New("unsupported value")
+
+// ConfigFile is a TOML file of settings for the flags in a FlagSet. Each setting
+// is named for its flag, and flags sharing a prefix can be grouped in a table, so
+// tls-cert can be set with cert in a [tls] table. Lists, like origins or allowed
+// paths, can be arrays. Durations are strings.
+//
+//	address = ":53535"
+//	allowed-paths = ["/getItems", "/setSecurity"]
+//
+//	[tls]
+//	cert = "C:\\ProgramData\\almarfidintercept\\cert.pem"
+//	key = "C:\\ProgramData\\almarfidintercept\\key.pem"
+//
+// Flags set on the command line, or by environment variables, take precedence
+// over the file.
+type ConfigFile struct {
+	Path string // Empty for no file.
+
+	fs      *flag.FlagSet
+	sources map[string]string // Where each flag which isn't a default was set.
+}
+
+// The sources of a flag's value, reported by ConfigFile.Source.
+const (
+	SourceFlag    = "flag"
+	SourceEnv     = "env"
+	SourceFile    = "file"
+	SourceDefault = "default"
+)
+
+// NewConfigFile returns the config file at path, for the flags in fs. It must be
+// called after the command line is parsed, and before Load. Flags with an
+// environment variable starting with envPrefix are overridden, like those set
+// on the command line.
+func NewConfigFile(path string, fs *flag.FlagSet, envPrefix string) *ConfigFile {
+	sources := map[string]string{}
+	fs.VisitAll(func(f *flag.Flag) {
+		if _, ok := os.LookupEnv(envPrefix + strings.ToUpper(f.Name)); ok {
+			sources[f.Name] = SourceEnv
+		}
+	})
+	fs.Visit(func(f *flag.Flag) {
+		sources[f.Name] = SourceFlag
+	})
+	return &ConfigFile{Path: path, fs: fs, sources: sources}
+}
+
+// Load sets the flags which aren't overridden from the file, and returns the
+// names of the flags it set.
+func (c *ConfigFile) Load() ([]string, error) {
+	settings, err := c.read()
+	if err != nil {
+		return nil, err
+	}
+	var set []string
+	for _, name := range sortedKeys(settings) {
+		if c.overridden(name) {
+			continue
+		}
+		err := c.fs.Set(name, settings[name])
+		if err != nil {
+			return nil, fmt.Errorf("config file %v: bad value for %v: %w", c.Path, name, err)
+		}
+		set = append(set, name)
+	}
+	for _, name := range set {
+		c.sources[name] = SourceFile
+	}
+	return set, nil
+}
+
+// Source returns where a flag's value came from: the command line, an
+// environment variable, the file, or its default.
+func (c *ConfigFile) Source(name string) string {
+	if source, ok := c.sources[name]; ok {
+		return source
+	}
+	return SourceDefault
+}
+
+// overridden reports whether a flag was set on the command line or by an
+// environment variable, so the file can't change it.
+func (c *ConfigFile) overridden(name string) bool {
+	source := c.sources[name]
+	return source == SourceFlag || source == SourceEnv
+}
+
+// Reload reads the file again, and returns the value each flag would have if
+// it was loaded now: the overridden flags keep their values, the others have
+// the file's setting or their default. The flags themselves aren't changed.
+func (c *ConfigFile) Reload() (map[string]string, error) {
+	settings, err := c.read()
+	if err != nil {
+		return nil, err
+	}
+	values := map[string]string{}
+	c.fs.VisitAll(func(f *flag.Flag) {
+		value, inFile := settings[f.Name]
+		switch {
+		case c.overridden(f.Name):
+			values[f.Name] = f.Value.String()
+		case inFile:
+			values[f.Name] = value
+		default:
+			values[f.Name] = f.DefValue
+		}
+	})
+	return values, nil
+}
+
+// ParseConfig parses the command line of a subcommand which works with the
+// proxy's configuration, then reads the environment variables and config file,
+// the way the proxy does when it starts.
+func ParseConfig(command string, args []string) (*ConfigFile, error) {
+	fs := flag.CommandLine
+	err := fs.Parse(args)
+	if err != nil {
+		return nil, fmt.Errorf("%w, %v", ErrUsage, err)
+	}
+	if fs.NArg() != 0 {
+		return nil, fmt.Errorf("%w, %v takes only flags", ErrUsage, command)
+	}
+	err = overridefromenv.Override(fs, EnvPrefix)
+	if err != nil {
+		return nil, err
+	}
+	config := NewConfigFile(fs.Lookup("config").Value.String(), fs, EnvPrefix)
+	_, err = config.Load()
+	if err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// read returns the settings in the file, formatted as flag values.
+func (c *ConfigFile) read() (map[string]string, error) {
+	settings := map[string]string{}
+	if c.Path == "" {
+		return settings, nil
+	}
+	var file map[string]any
+	_, err := toml.DecodeFile(c.Path, &file)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read config file %v: %w", c.Path, err)
+	}
+	err = flattenSettings("", file, settings)
+	if err != nil {
+		return nil, fmt.Errorf("config file %v: %w", c.Path, err)
+	}
+	for _, name := range sortedKeys(settings) {
+		if name == "config" || c.fs.Lookup(name) == nil {
+			return nil, fmt.Errorf("config file %v: %w %q", c.Path, ErrUnknownSetting, name)
+		}
+	}
+	return settings, nil
+}
+
+// sortedKeys returns the keys of a map of settings, in order.
+func sortedKeys(settings map[string]string) []string {
+	keys := make([]string, 0, len(settings))
+	for key := range settings {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// flattenSettings adds the settings in a TOML table to settings, formatted as
+// flag values. Settings in nested tables are named with the table's name as a prefix.
+func flattenSettings(prefix string, table map[string]any, settings map[string]string) error {
+	for key, value := range table {
+		name := prefix + key
+		if nested, ok := value.(map[string]any); ok {
+			err := flattenSettings(name+"-", nested, settings)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		formatted, err := formatSetting(value)
+		if err != nil {
+			return fmt.Errorf("%v: %w", name, err)
+		}
+		settings[name] = formatted
+	}
+	return nil
+}
+
+// formatSetting formats a TOML value as a flag value. Arrays become comma separated lists.
+func formatSetting(value any) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64), nil
+	case time.Time:
+		return v.Format(time.RFC3339), nil
+	case []any:
+		items := make([]string, 0, len(v))
+		for _, item := range v {
+			formatted, err := formatSetting(item)
+			if err != nil {
+				return "", err
+			}
+			items = append(items, formatted)
+		}
+		return strings.Join(items, ","), nil
+	default:
+		return "", fmt.Errorf("%w %T", ErrBadSetting, value)
+	}
+}
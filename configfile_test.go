@@ -0,0 +1,143 @@
+// Copyright 2023 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cu-library/overridefromenv"
+)
+
+// configTestPrefix is the environment variable prefix for the config file tests.
+const configTestPrefix = "ALMARFIDINTERCEPT_CONFIGTEST_"
+
+// loadTestConfig writes a config file, then sets the flags in fs from the
+// command line args, the environment, and the file, the way the proxy does.
+func loadTestConfig(t *testing.T, fs *flag.FlagSet, file string, args ...string) (*ConfigFile, error) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "almarfidintercept.toml")
+	err := os.WriteFile(path, []byte(file), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fs.Parse(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = overridefromenv.Override(fs, configTestPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := NewConfigFile(path, fs, configTestPrefix)
+	_, err = config.Load()
+	return config, err
+}
+
+func TestConfigFilePrecedence(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	fs.String("address", ":53535", "")
+	fs.String("proxy", "http://localhost:21645", "")
+	fs.String("origin", "https://example.alma.exlibrisgroup.com", "")
+	fs.String("tls-cert", "", "")
+	fs.String("allowed-paths", "", "")
+	fs.Duration("upstream-timeout", DefaultUpstreamTimeout, "")
+	fs.Bool("quiet", false, "")
+	fs.String("station", "desk", "")
+	t.Setenv(configTestPrefix+"ADDRESS", ":1000")
+	t.Setenv(configTestPrefix+"PROXY", "http://localhost:2000")
+	config, err := loadTestConfig(t, fs, `
+address = ":3000"
+proxy = "http://localhost:3000"
+origin = "https://file.alma.exlibrisgroup.com"
+allowed-paths = ["/getItems", "/setSecurity"]
+upstream-timeout = "10s"
+quiet = true
+
+[tls]
+cert = "cert.pem"
+`, "-address", ":4000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name       string
+		want       string
+		wantSource string
+	}{
+		{"address", ":4000", SourceFlag},
+		{"proxy", "http://localhost:2000", SourceEnv},
+		{"origin", "https://file.alma.exlibrisgroup.com", SourceFile},
+		{"tls-cert", "cert.pem", SourceFile},
+		{"allowed-paths", "/getItems,/setSecurity", SourceFile},
+		{"upstream-timeout", "10s", SourceFile},
+		{"quiet", "true", SourceFile},
+		{"station", "desk", SourceDefault},
+	}
+	for _, tt := range tests {
+		if got := fs.Lookup(tt.name).Value.String(); got != tt.want {
+			t.Errorf("%v = %q, want %q", tt.name, got, tt.want)
+		}
+		if got := config.Source(tt.name); got != tt.wantSource {
+			t.Errorf("%v came from %v, want %v", tt.name, got, tt.wantSource)
+		}
+	}
+
+	// Reloading keeps the overridden flags, and takes the file's settings or the defaults for the others.
+	err = os.WriteFile(config.Path, []byte(`address = ":5000"`+"\n"+`station = "front"`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	values, err := config.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{
+		"address": ":4000",
+		"proxy":   "http://localhost:2000",
+		"origin":  "https://example.alma.exlibrisgroup.com",
+		"station": "front",
+	} {
+		if values[name] != want {
+			t.Errorf("reloaded %v = %q, want %q", name, values[name], want)
+		}
+	}
+}
+
+func TestConfigFileErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		wantErr error
+	}{
+		{"unknown setting", `adress = ":53535"`, ErrUnknownSetting},
+		{"config", `config = "other.toml"`, ErrUnknownSetting},
+		{"array of tables", "[[tls]]\ncert = \"cert.pem\"", ErrBadSetting},
+		{"bad value", `quiet = "sometimes"`, nil},
+		{"not TOML", `address = `, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := flag.NewFlagSet("test", flag.ContinueOnError)
+			fs.SetOutput(io.Discard)
+			fs.String("config", "", "")
+			fs.String("address", ":53535", "")
+			fs.String("tls-cert", "", "")
+			fs.Bool("quiet", false, "")
+			_, err := loadTestConfig(t, fs, tt.file)
+			if err == nil {
+				t.Fatal("got no error")
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Errorf("got error %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,157 @@
+// Copyright 2023 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// DashboardErrors is how many recent failed requests the dashboard shows.
+const DashboardErrors = 10
+
+// dashboardPage is the admin dashboard, linking to the other admin pages.
+const dashboardPage = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="30">
+<title>RFID intercept dashboard</title>
+<style>
+body { font-family: sans-serif; max-width: 48em; margin: 2em auto; padding: 0 1em; }
+.alert { border: 2px solid #c00; border-radius: 6px; padding: 0.5em 1.5em; color: #c00; }
+.ok { border: 2px solid #080; border-radius: 6px; padding: 0.5em 1.5em; color: #080; }
+.sandbox { border: 2px solid #b05c00; border-radius: 6px; padding: 0.5em 1.5em; background: #fff3e0; color: #b05c00; }
+table { border-collapse: collapse; }
+th, td { text-align: left; padding: 0.2em 1em 0.2em 0; vertical-align: top; }
+.details { color: #555; font-size: 0.9em; }
+</style>
+</head>
+<body>
+<h1>RFID intercept dashboard</h1>
+{{if eq .Environment "sandbox"}}<div class="sandbox"><p><strong>Sandbox:</strong> requests are proxied to a sandbox reader service, not the one used for real circulation.</p></div>
+{{else}}{{with .SandboxOrigins}}<div class="sandbox"><p><strong>Sandbox:</strong> requests from {{range $i, $origin := .}}{{if $i}}, {{end}}{{$origin}}{{end}} are proxied to a sandbox reader service.</p></div>
+{{end}}{{end}}{{with .Upstream}}{{if eq .Status "ok"}}<div class="ok"><p>The reader service at {{.Address}} answered in {{.LatencyMS}} ms.</p></div>
+{{else}}<div class="alert"><p><strong>The reader service at {{.Address}} isn't answering.</strong></p>
+<p>{{.Error}}</p></div>
+{{end}}{{end}}{{if .Alert}}<div class="alert"><p><strong>Alert:</strong> {{.Alert}}</p>
+<p>Since {{.AlertSince.Format "2006-01-02 15:04:05"}}.</p></div>
+{{end}}{{with .Update}}{{if .Available}}<div class="alert"><p><strong>Version {{.Latest}} is available.</strong>
+This is version {{.Current}}. {{with .ReleaseURL}}<a href="{{.}}">Release notes</a>.{{end}}</p></div>
+{{end}}{{end}}
+<h2>Requests</h2>
+<table>
+<tr><th>Uptime</th><td>{{.Metrics.Uptime}}</td></tr>
+<tr><th>Requests</th><td>{{.Metrics.Requests}}</td></tr>
+<tr><th>In flight</th><td>{{.Metrics.InFlight}}</td></tr>
+{{range $class, $count := .Metrics.Responses}}<tr><th>{{$class}} responses</th><td>{{$count}}</td></tr>
+{{end}}<tr><th>Preflights</th><td>{{.Metrics.Preflights}}</td></tr>
+</table>
+<h2>Recent errors</h2>
+{{with .Errors}}<table>
+<tr><th>Time</th><th>Request</th><th>Status</th><th>Request ID</th></tr>
+{{range .}}<tr><td>{{.Time.Format "15:04:05"}}</td><td>{{.Method}} {{.Path}}</td><td>{{.Status}}</td><td>{{.RequestID}}</td></tr>
+{{end}}</table>
+<p><a href="/admin/recent">All recent requests</a></p>
+{{else}}<p>None.</p>
+{{end}}
+<h2>Configuration</h2>
+{{with .Settings}}<table>
+{{range .}}<tr><th>{{.Name}}</th><td>{{.Value}}</td></tr>
+{{end}}</table>
+{{else}}<p>All settings are the defaults.</p>
+{{end}}
+<h2>More</h2>
+<p><a href="/admin/status">Status</a> &middot; <a href="/diagnostics">Diagnostics</a> &middot; <a href="/selftest">Self test</a> &middot;
+<a href="/admin/recent">Recent requests</a> &middot; <a href="/admin/responses">Recent responses</a> &middot;
+<a href="/admin/metrics">Metrics</a></p>
+<p><a href="/admin/bundle">Download a diagnostics bundle</a> for a help ticket.</p>
+<p class="details">Computer: {{.Station}}<br>
+Version: {{.Build.Version}}{{with .Build.Revision}}, revision {{.}}{{end}}{{with .Build.BuildDate}}, built {{.}}{{end}}<br>
+Time: {{.Time.Format "2006-01-02 15:04:05"}}</p>
+</body>
+</html>
+`
+
+// DashboardSetting is a setting shown on the dashboard.
+type DashboardSetting struct {
+	Name  string
+	Value string
+}
+
+// Dashboard serves a page at /admin, for circulation supervisors to check on
+// the proxy from a browser: whether the reader service answers, the request
+// counts, recent failed requests, the settings changed from the defaults, the
+// version, whether there's a newer one, and a banner when requests are
+// proxied to a sandbox. Secrets in the settings are masked.
+type Dashboard struct {
+	Health  *Health
+	Metrics *Metrics
+	Alarm   *UpstreamAlarm
+	Recent  *RecentRequests
+	Flags   *flag.FlagSet
+	Station string
+
+	// Updates says whether a newer version is available. It may be nil.
+	Updates *UpdateChecker
+
+	page *template.Template
+}
+
+// NewDashboard returns a Dashboard.
+func NewDashboard(health *Health, metrics *Metrics, alarm *UpstreamAlarm, recent *RecentRequests, flags *flag.FlagSet, station string) *Dashboard {
+	return &Dashboard{
+		Health:  health,
+		Metrics: metrics,
+		Alarm:   alarm,
+		Recent:  recent,
+		Flags:   flags,
+		Station: station,
+		page:    template.Must(template.New("dashboard").Parse(dashboardPage)),
+	}
+}
+
+// ServeHTTP checks the reader service, and renders the dashboard. Other paths
+// under /admin/ aren't found.
+func (d *Dashboard) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/admin" && r.URL.Path != AdminPrefix {
+		http.NotFound(w, r)
+		return
+	}
+	var failed []RecentRequest
+	for _, request := range d.Recent.Recent() {
+		if request.Status >= http.StatusBadRequest && len(failed) < DashboardErrors {
+			failed = append(failed, request)
+		}
+	}
+	var settings []DashboardSetting
+	d.Flags.Visit(func(f *flag.Flag) {
+		settings = append(settings, DashboardSetting{Name: f.Name, Value: flagValue(f)})
+	})
+	alert, since := d.Alarm.Alert()
+	environment, sandboxOrigins := environmentsOf(d.Health.Environments)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	err := d.page.Execute(w, map[string]any{
+		"Upstream":       d.Health.CheckUpstream(r.Context()),
+		"Alert":          alert,
+		"AlertSince":     since,
+		"Environment":    environment,
+		"SandboxOrigins": sandboxOrigins,
+		"Metrics":        d.Metrics.Snapshot(),
+		"Errors":         failed,
+		"Settings":       settings,
+		"Station":        d.Station,
+		"Build":          GetBuildInfo(),
+		"Update":         d.Updates.Status(),
+		"Time":           time.Now(),
+	})
+	if err != nil {
+		slog.Error("Unable to render dashboard.", "error", err)
+	}
+}
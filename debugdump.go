@@ -0,0 +1,202 @@
+// Copyright 2023 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// DefaultDebugDumpBytes is how much of each body is included in a debug dump.
+const DefaultDebugDumpBytes = 16 << 10
+
+// DebugDump logs complete requests and responses, for diagnosing a vendor's
+// SOAP quirks on a desk computer where a packet capture isn't possible. For
+// each proxied request, it logs the request from the browser, the request as
+// rewritten for the reader service, and the reader service's response, with
+// their headers and the first MaxBytes of their bodies. Each dump is one log
+// message, so the three can be matched by their request ID.
+//
+// Request bodies are read ahead, up to MaxBytes, so the request can be logged
+// before it is forwarded. Response bodies are logged once they have been read,
+// so streaming responses aren't held up. Credentials in headers are masked.
+type DebugDump struct {
+	MaxBytes int
+}
+
+// dumpKey is the context key marking a request whose upstream calls are dumped.
+type dumpKey struct{}
+
+// Middleware wraps a handler, logging each request it is sent.
+func (d *DebugDump) Middleware(next http.Handler) http.Handler {
+	if d == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isPreflight(r) {
+			var body []byte
+			body, r.Body = d.peek(r.Body)
+			head := fmt.Sprintf("%v %v %v\r\nHost: %v\r\n", r.Method, r.URL.RequestURI(), r.Proto, r.Host)
+			slog.InfoContext(r.Context(), "Debug dump, request from the browser.", "client", r.RemoteAddr, "dump", d.dump(head, r.Header, body, r.ContentLength))
+			r = r.WithContext(context.WithValue(r.Context(), dumpKey{}, true))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Transport wraps a transport, logging the requests sent to the reader
+// service while proxying, and its responses. Other requests, like health
+// checks, aren't logged.
+func (d *DebugDump) Transport(next http.RoundTripper) http.RoundTripper {
+	if d == nil {
+		return next
+	}
+	return &dumpTransport{dump: d, next: next}
+}
+
+// dumpTransport logs the requests it sends, and the responses.
+type dumpTransport struct {
+	dump *DebugDump
+	next http.RoundTripper
+}
+
+// RoundTrip logs the request, sends it, then logs the response once its body has been read.
+func (t *dumpTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	next := t.next
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	ctx := req.Context()
+	if ctx.Value(dumpKey{}) == nil {
+		return next.RoundTrip(req)
+	}
+	if req.Body != nil {
+		var body []byte
+		req = req.Clone(ctx)
+		body, req.Body = t.dump.peek(req.Body)
+		head := fmt.Sprintf("%v %v %v\r\nHost: %v\r\n", req.Method, req.URL.RequestURI(), req.Proto, req.URL.Host)
+		slog.InfoContext(ctx, "Debug dump, request to the reader service.", "upstream", req.URL.Redacted(), "dump", t.dump.dump(head, req.Header, body, req.ContentLength))
+	}
+	resp, err := next.RoundTrip(req)
+	if err != nil {
+		slog.InfoContext(ctx, "Debug dump, no response from the reader service.", "upstream", req.URL.Redacted(), "error", err)
+		return resp, err
+	}
+	head := fmt.Sprintf("%v %v\r\n", resp.Proto, resp.Status)
+	if resp.Body == nil || resp.Body == http.NoBody {
+		slog.InfoContext(ctx, "Debug dump, response from the reader service.", "dump", t.dump.dump(head, resp.Header, nil, 0))
+		return resp, nil
+	}
+	resp.Body = &dumpBody{ReadCloser: resp.Body, max: t.dump.MaxBytes, done: func(body []byte) {
+		slog.InfoContext(ctx, "Debug dump, response from the reader service.", "dump", t.dump.dump(head, resp.Header, body, resp.ContentLength))
+	}}
+	return resp, nil
+}
+
+// peek reads up to MaxBytes of a body, plus one byte to tell whether there's
+// more, and returns what it read with a body which reads it all again.
+func (d *DebugDump) peek(body io.ReadCloser) ([]byte, io.ReadCloser) {
+	if body == nil || body == http.NoBody {
+		return nil, body
+	}
+	read, err := io.ReadAll(io.LimitReader(body, int64(d.MaxBytes)+1))
+	restored := struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(read), &errReader{err: err}, body), body}
+	return read, restored
+}
+
+// dump formats a request or response: the head, the headers in order with
+// credentials masked, then the body. A body over MaxBytes is cut off, with a
+// note of its full size if known.
+func (d *DebugDump) dump(head string, header http.Header, body []byte, size int64) string {
+	var b strings.Builder
+	b.WriteString(head)
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, value := range header[name] {
+			if isCredentialHeader(name) {
+				value = Masked
+			}
+			fmt.Fprintf(&b, "%v: %v\r\n", name, value)
+		}
+	}
+	b.WriteString("\r\n")
+	if len(body) > d.MaxBytes {
+		b.Write(body[:d.MaxBytes])
+		if size > 0 {
+			fmt.Fprintf(&b, "\n[cut off, %v of %v bytes shown]", d.MaxBytes, size)
+		} else {
+			fmt.Fprintf(&b, "\n[cut off, first %v bytes shown]", d.MaxBytes)
+		}
+	} else {
+		b.Write(body)
+	}
+	return b.String()
+}
+
+// isCredentialHeader reports whether a header carries credentials, which are
+// never logged.
+func isCredentialHeader(name string) bool {
+	switch http.CanonicalHeaderKey(name) {
+	case "Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie":
+		return true
+	}
+	return isSecret(name)
+}
+
+// dumpBody keeps the start of a body as it is read, and calls done with it
+// when the body is read to the end or closed.
+type dumpBody struct {
+	io.ReadCloser
+	max  int
+	kept []byte
+	once sync.Once
+	done func(body []byte)
+}
+
+// Read reads from the body, keeping the start of it.
+func (b *dumpBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if room := b.max + 1 - len(b.kept); room > 0 {
+		b.kept = append(b.kept, p[:min(n, room)]...)
+	}
+	if err != nil {
+		b.once.Do(func() { b.done(b.kept) })
+	}
+	return n, err
+}
+
+// Close closes the body, logging it if it wasn't read to the end.
+func (b *dumpBody) Close() error {
+	b.once.Do(func() { b.done(b.kept) })
+	return b.ReadCloser.Close()
+}
+
+// errReader returns an error when read, or io.EOF if the error is nil. It
+// passes on an error which happened while a body was read ahead.
+type errReader struct {
+	err error
+}
+
+// Read returns the error.
+func (r *errReader) Read([]byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	return 0, io.EOF
+}
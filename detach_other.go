@@ -0,0 +1,15 @@
+// Copyright 2023 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+//go:build !windows
+
+package main
+
+import "syscall"
+
+// detachAttr starts the background proxy in a new session, so it isn't
+// stopped when the terminal which started it closes.
+func detachAttr() (*syscall.SysProcAttr, error) {
+	return &syscall.SysProcAttr{Setsid: true}, nil
+}
@@ -0,0 +1,20 @@
+// Copyright 2023 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+//go:build windows
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+// ErrDetachUnsupported is returned when -detach is used on Windows.
+var ErrDetachUnsupported = errors.New("-detach isn't supported on Windows, install the proxy as a service instead")
+
+// detachAttr isn't supported on Windows, where the proxy runs as a service.
+func detachAttr() (*syscall.SysProcAttr, error) {
+	return nil, ErrDetachUnsupported
+}
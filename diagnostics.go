@@ -0,0 +1,276 @@
+// Copyright 2023 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DiagnosticsTimeout is how long each diagnostic check may take.
+	DiagnosticsTimeout = 5 * time.Second
+
+	// MaxClockSkew is the largest difference from Alma's clock which passes.
+	MaxClockSkew = time.Minute
+
+	// MinCertificateLife is how long Alma's certificate must still be valid to pass.
+	MinCertificateLife = 14 * 24 * time.Hour
+)
+
+// The results of a diagnostic check.
+const (
+	DiagnosticOK      = "ok"
+	DiagnosticFailed  = "failed"
+	DiagnosticUnknown = "unknown"
+)
+
+// diagnosticsPage shows the checks as green and red rows staff can read out to the help desk.
+const diagnosticsPage = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>RFID diagnostics</title>
+<style>
+body { font-family: sans-serif; max-width: 48em; margin: 2em auto; padding: 0 1em; }
+table { border-collapse: collapse; width: 100%; }
+td { padding: 0.6em; border-bottom: 1px solid #ddd; vertical-align: top; }
+.ok { background: #e6f4e6; }
+.failed { background: #fbe3e3; }
+.unknown { background: #f3f3f3; }
+.result { font-weight: bold; white-space: nowrap; }
+.ok .result { color: #080; }
+.failed .result { color: #c00; }
+.details { color: #555; font-size: 0.9em; }
+</style>
+</head>
+<body>
+<h1>RFID diagnostics</h1>
+<table>
+{{range .Checks}}<tr class="{{.Result}}">
+<td class="result">{{if eq .Result "ok"}}&#10004; OK{{else if eq .Result "failed"}}&#10008; Problem{{else}}? Unknown{{end}}</td>
+<td><strong>{{.Name}}</strong><br>{{.Detail}}</td>
+</tr>
+{{end}}</table>
+<p><a href="">Run the checks again</a></p>
+<p class="details">Computer: {{.Station}}<br>
+Time: {{.Time.Format "2006-01-02 15:04:05"}}</p>
+</body>
+</html>
+`
+
+// DiagnosticCheck is the result of one diagnostic check.
+type DiagnosticCheck struct {
+	Name   string `json:"name"`
+	Result string `json:"result"`
+	Detail string `json:"detail"`
+}
+
+// Diagnostics runs checks staff can use to tell the help desk what's wrong.
+// The upstream and origin are changed with SetTarget when the configuration is reloaded.
+type Diagnostics struct {
+	Upstream string
+	Origin   string
+	Station  string
+
+	// Updates says whether a newer version is available. It may be nil.
+	Updates *UpdateChecker
+
+	mu     sync.Mutex
+	client *http.Client
+	page   *template.Template
+}
+
+// NewDiagnostics returns Diagnostics for the given upstream and Alma origin.
+func NewDiagnostics(upstream, origin, station string) *Diagnostics {
+	return &Diagnostics{
+		Upstream: upstream,
+		Origin:   origin,
+		Station:  station,
+		client:   &http.Client{Timeout: DiagnosticsTimeout},
+		page:     template.Must(template.New("diagnostics").Parse(diagnosticsPage)),
+	}
+}
+
+// SetTarget changes the upstream and Alma origin checked.
+func (d *Diagnostics) SetTarget(upstream, origin string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.Upstream = upstream
+	d.Origin = origin
+}
+
+// Run runs the checks at the same time, returning their results in order.
+func (d *Diagnostics) Run(ctx context.Context) []DiagnosticCheck {
+	// Check a copy, so the target can't change while the checks run.
+	d.mu.Lock()
+	target := &Diagnostics{Upstream: d.Upstream, Origin: d.Origin, Station: d.Station, Updates: d.Updates, client: d.client}
+	d.mu.Unlock()
+	checks := []func(context.Context) []DiagnosticCheck{
+		target.checkUpstream,
+		target.checkCORS,
+		target.checkAlma,
+		target.checkVersion,
+	}
+	results := make([][]DiagnosticCheck, len(checks))
+	var wg sync.WaitGroup
+	for i, check := range checks {
+		i, check := i, check
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = check(ctx)
+		}()
+	}
+	wg.Wait()
+	var all []DiagnosticCheck
+	for _, result := range results {
+		all = append(all, result...)
+	}
+	return all
+}
+
+// checkUpstream checks the reader service answers HTTP requests.
+func (d *Diagnostics) checkUpstream(ctx context.Context) []DiagnosticCheck {
+	check := DiagnosticCheck{Name: "RFID software is running"}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, d.Upstream, nil)
+	if err != nil {
+		check.Result, check.Detail = DiagnosticFailed, fmt.Sprintf("The RFID software address %v is not valid.", d.Upstream)
+		return []DiagnosticCheck{check}
+	}
+	start := time.Now()
+	resp, err := d.client.Do(req)
+	if err != nil {
+		check.Result, check.Detail = DiagnosticFailed, fmt.Sprintf("Unable to reach the RFID software at %v: %v", d.Upstream, err)
+		return []DiagnosticCheck{check}
+	}
+	resp.Body.Close()
+	check.Result = DiagnosticOK
+	check.Detail = fmt.Sprintf("The RFID software at %v answered in %v.", d.Upstream, time.Since(start).Round(time.Millisecond))
+	return []DiagnosticCheck{check}
+}
+
+// checkCORS checks the allowed Alma origin is one browsers will match.
+func (d *Diagnostics) checkCORS(_ context.Context) []DiagnosticCheck {
+	check := DiagnosticCheck{Name: "Alma is allowed to use the RFID pad"}
+	err := validateOrigin(d.Origin)
+	switch {
+	case err != nil:
+		check.Result, check.Detail = DiagnosticFailed, fmt.Sprintf("The allowed Alma address %q is not valid: %v", d.Origin, err)
+	case strings.HasSuffix(d.Origin, "/"):
+		check.Result, check.Detail = DiagnosticFailed, fmt.Sprintf("The allowed Alma address %v ends with a slash, so browsers will never match it.", d.Origin)
+	case !strings.HasPrefix(d.Origin, "https://"):
+		check.Result, check.Detail = DiagnosticFailed, fmt.Sprintf("The allowed Alma address %v doesn't start with https://.", d.Origin)
+	default:
+		check.Result, check.Detail = DiagnosticOK, fmt.Sprintf("Requests from %v are allowed.", d.Origin)
+	}
+	return []DiagnosticCheck{check}
+}
+
+// checkAlma connects to Alma, checking its certificate is valid for a while
+// yet, and that this computer's clock agrees with Alma's.
+func (d *Diagnostics) checkAlma(ctx context.Context) []DiagnosticCheck {
+	tlsCheck := DiagnosticCheck{Name: "Secure connection to Alma"}
+	clockCheck := DiagnosticCheck{Name: "Computer clock is correct", Result: DiagnosticUnknown}
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, d.Origin, nil)
+	if err != nil {
+		tlsCheck.Result, tlsCheck.Detail = DiagnosticFailed, fmt.Sprintf("The allowed Alma address %q is not valid.", d.Origin)
+		clockCheck.Detail = "Unable to compare the clock with Alma's."
+		return []DiagnosticCheck{tlsCheck, clockCheck}
+	}
+	start := time.Now()
+	resp, err := d.client.Do(req)
+	if err != nil {
+		tlsCheck.Result, tlsCheck.Detail = DiagnosticFailed, fmt.Sprintf("Unable to connect to %v: %v", d.Origin, err)
+		clockCheck.Detail = "Unable to compare the clock with Alma's."
+		return []DiagnosticCheck{tlsCheck, clockCheck}
+	}
+	resp.Body.Close()
+	rtt := time.Since(start)
+
+	switch {
+	case resp.TLS == nil || len(resp.TLS.PeerCertificates) == 0:
+		tlsCheck.Result, tlsCheck.Detail = DiagnosticFailed, fmt.Sprintf("The connection to %v isn't secure.", d.Origin)
+	case time.Until(resp.TLS.PeerCertificates[0].NotAfter) < MinCertificateLife:
+		tlsCheck.Result = DiagnosticFailed
+		tlsCheck.Detail = fmt.Sprintf("Alma's certificate expires on %v.", resp.TLS.PeerCertificates[0].NotAfter.Format("2006-01-02"))
+	default:
+		tlsCheck.Result = DiagnosticOK
+		tlsCheck.Detail = fmt.Sprintf("The certificate is valid until %v.", resp.TLS.PeerCertificates[0].NotAfter.Format("2006-01-02"))
+	}
+
+	almaTime, err := http.ParseTime(resp.Header.Get("Date"))
+	if err != nil {
+		clockCheck.Detail = "Alma didn't say what time it is."
+		return []DiagnosticCheck{tlsCheck, clockCheck}
+	}
+	// Alma's Date header has a resolution of one second, and was sent
+	// somewhere during the round trip, so allow for both.
+	skew := start.Add(rtt / 2).Sub(almaTime)
+	if skew < 0 {
+		skew = -skew
+	}
+	if skew > MaxClockSkew+time.Second+rtt {
+		clockCheck.Result = DiagnosticFailed
+		clockCheck.Detail = fmt.Sprintf("This computer's clock is %v off from Alma's.", skew.Round(time.Second))
+	} else {
+		clockCheck.Result = DiagnosticOK
+		clockCheck.Detail = "This computer's clock agrees with Alma's."
+	}
+	return []DiagnosticCheck{tlsCheck, clockCheck}
+}
+
+// checkVersion reports the running version, and whether there's a newer one.
+func (d *Diagnostics) checkVersion(_ context.Context) []DiagnosticCheck {
+	info := GetBuildInfo()
+	built := info.BuildDate
+	if built == "" {
+		built = "at an unknown time"
+	}
+	check := DiagnosticCheck{Name: "Version", Result: DiagnosticUnknown}
+	status := d.Updates.Status()
+	switch {
+	case d.Updates == nil:
+		check.Detail = fmt.Sprintf("almarfidintercept %v, built %v. Checking for updates is not configured.", info.Version, built)
+	case status.Available:
+		check.Result = DiagnosticFailed
+		check.Detail = fmt.Sprintf("almarfidintercept %v, built %v. Version %v is available, at %v.", info.Version, built, status.Latest, status.ReleaseURL)
+	case status.Latest != "":
+		check.Result = DiagnosticOK
+		check.Detail = fmt.Sprintf("almarfidintercept %v, built %v. The latest release is %v.", info.Version, built, status.Latest)
+	case status.Error != "":
+		check.Detail = fmt.Sprintf("almarfidintercept %v, built %v. Unable to check for updates: %v", info.Version, built, status.Error)
+	default:
+		check.Detail = fmt.Sprintf("almarfidintercept %v, built %v. Updates haven't been checked for yet.", info.Version, built)
+	}
+	return []DiagnosticCheck{check}
+}
+
+// ServeHTTP runs the checks and renders them, as JSON if asked for, HTML otherwise.
+func (d *Diagnostics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	checks := d.Run(r.Context())
+	w.Header().Set("Cache-Control", "no-store")
+	if strings.Contains(r.Header.Get("Accept"), "application/json") {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(checks)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err := d.page.Execute(w, map[string]any{
+		"Checks":  checks,
+		"Station": d.Station,
+		"Time":    time.Now(),
+	})
+	if err != nil {
+		slog.Error("Unable to render diagnostics page.", "error", err)
+	}
+}
@@ -0,0 +1,198 @@
+// Copyright 2023 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DigestSlowest is the number of slowest operations listed in a digest.
+const DigestSlowest = 5
+
+// Digest logs a summary of the day's requests at the same time each day,
+// and optionally posts it to a webhook, so each desk can be checked on
+// without a dashboard.
+type Digest struct {
+	Metrics *Metrics
+	Station string
+	At      time.Duration // The time of day the digest is made, after midnight local time.
+	Webhook *url.URL      // Where the digest is posted, if set.
+	Token   string        // The bearer token for the webhook, if any.
+
+	client *http.Client
+}
+
+// DigestReport summarizes the requests served between From and To.
+type DigestReport struct {
+	Station        string            `json:"station"`
+	From           time.Time         `json:"from"`
+	To             time.Time         `json:"to"`
+	Uptime         string            `json:"uptime"`
+	Requests       int64             `json:"requests"`
+	Responses      map[string]int64  `json:"responses"`
+	Preflights     int64             `json:"preflights"`
+	UpstreamErrors map[string]int64  `json:"upstream_errors"`
+	Slowest        []DigestOperation `json:"slowest"`
+	Objectives     []ObjectiveReport `json:"latency_objectives,omitempty"`
+}
+
+// DigestOperation is the mean upstream latency of one operation over a digest's period.
+type DigestOperation struct {
+	Operation   string `json:"operation"`
+	Requests    int64  `json:"requests"`
+	MeanLatency string `json:"mean_latency"`
+
+	mean time.Duration
+}
+
+// ParseDigestTime parses a time of day like 17:30, returning the time after midnight.
+func ParseDigestTime(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("bad digest time %q, use a 24 hour time like 17:30: %w", s, err)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// NewDigest returns a Digest made at the given time of day. The webhook is optional.
+func NewDigest(metrics *Metrics, station string, at time.Duration, webhook, token string) (*Digest, error) {
+	d := &Digest{
+		Metrics: metrics,
+		Station: station,
+		At:      at,
+		Token:   token,
+		client:  &http.Client{Timeout: WebhookTimeout},
+	}
+	if webhook != "" {
+		u, err := url.Parse(webhook)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse digest webhook: %w", err)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return nil, fmt.Errorf("digest webhook %v: %w", webhook, ErrNotHTTP)
+		}
+		d.Webhook = u
+	}
+	return d, nil
+}
+
+// Run makes a digest each day until the context is cancelled.
+func (d *Digest) Run(ctx context.Context) {
+	previous := d.Metrics.Snapshot()
+	from := time.Now()
+	for {
+		timer := time.NewTimer(time.Until(nextDaily(time.Now(), d.At)))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		now := time.Now()
+		current := d.Metrics.Snapshot()
+		d.send(NewDigestReport(d.Station, previous, current, from, now))
+		previous, from = current, now
+	}
+}
+
+// send logs the report and posts it to the webhook, if there is one.
+func (d *Digest) send(report DigestReport) {
+	slowest := make([]string, 0, len(report.Slowest))
+	for _, op := range report.Slowest {
+		slowest = append(slowest, op.Operation+" "+op.MeanLatency)
+	}
+	failures := make([]string, 0, len(report.UpstreamErrors))
+	for operation, count := range report.UpstreamErrors {
+		failures = append(failures, fmt.Sprintf("%v %v", operation, count))
+	}
+	sort.Strings(failures)
+	slog.Info("Daily digest.",
+		"requests", report.Requests,
+		"responses", formatCounts(report.Responses),
+		"preflights", report.Preflights,
+		"upstream_errors", strings.Join(failures, ", "),
+		"slowest", strings.Join(slowest, ", "),
+		"uptime", report.Uptime)
+	if d.Webhook == nil {
+		return
+	}
+	err := postJSON(d.client, d.Webhook.String(), d.Token, report)
+	if err != nil {
+		slog.Error("Unable to post daily digest to webhook.", "webhook", d.Webhook.Host, "error", err)
+	}
+}
+
+// NewDigestReport summarizes the difference between two metrics snapshots.
+func NewDigestReport(station string, previous, current MetricsSnapshot, from, to time.Time) DigestReport {
+	report := DigestReport{
+		Station:        station,
+		From:           from,
+		To:             to,
+		Uptime:         current.Uptime,
+		Requests:       current.Requests - previous.Requests,
+		Responses:      make(map[string]int64),
+		Preflights:     current.Preflights - previous.Preflights,
+		UpstreamErrors: make(map[string]int64),
+		Objectives:     current.Objectives,
+	}
+	for class, count := range current.Responses {
+		if diff := count - previous.Responses[class]; diff > 0 {
+			report.Responses[class] = diff
+		}
+	}
+	for operation, stats := range current.Operations {
+		before := previous.Operations[operation]
+		if failures := stats.Failures - before.Failures; failures > 0 {
+			report.UpstreamErrors[operation] = failures
+		}
+		requests := stats.Requests - before.Requests
+		if requests == 0 {
+			continue
+		}
+		mean := (stats.TotalLatency - before.TotalLatency) / time.Duration(requests)
+		report.Slowest = append(report.Slowest, DigestOperation{
+			Operation:   operation,
+			Requests:    requests,
+			MeanLatency: mean.Round(time.Millisecond).String(),
+			mean:        mean,
+		})
+	}
+	sort.Slice(report.Slowest, func(i, j int) bool { return report.Slowest[i].mean > report.Slowest[j].mean })
+	if len(report.Slowest) > DigestSlowest {
+		report.Slowest = report.Slowest[:DigestSlowest]
+	}
+	return report
+}
+
+// nextDaily returns the next time after now that is the given time after midnight.
+func nextDaily(now time.Time, at time.Duration) time.Time {
+	year, month, day := now.Date()
+	next := time.Date(year, month, day, 0, 0, 0, 0, now.Location()).Add(at)
+	if !next.After(now) {
+		next = time.Date(year, month, day+1, 0, 0, 0, 0, now.Location()).Add(at)
+	}
+	return next
+}
+
+// formatCounts formats counts like 2xx=10 5xx=1, sorted by key.
+func formatCounts(counts map[string]int64) string {
+	keys := make([]string, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(keys))
+	for _, key := range keys {
+		parts = append(parts, fmt.Sprintf("%v=%v", key, counts[key]))
+	}
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,214 @@
+// Copyright 2023 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// ErrChecksFailed is returned by doctor when any check fails.
+var ErrChecksFailed = errors.New("checks failed")
+
+// runDoctorCommand checks the computer the proxy runs on, with the same
+// configuration, and prints a pass or fail line for each check, with what to
+// do about failures: the port is free, the RFID software answers, the TLS
+// certificate is valid, the allowed origins are ones browsers will send, and
+// the clock agrees with Alma's. It is meant for first-line IT staff, so the
+// details avoid jargon where they can.
+func runDoctorCommand(args []string, stdout io.Writer) error {
+	config, err := ParseConfig("doctor", args)
+	if err != nil {
+		return err
+	}
+	d := &doctor{get: func(name string) string { return config.fs.Lookup(name).Value.String() }}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*DiagnosticsTimeout)
+	defer cancel()
+
+	checks := []DiagnosticCheck{d.checkPort(ctx)}
+	diagnostics := NewDiagnostics(d.get("proxy"), d.get("origin"), "")
+	checks = append(checks, diagnostics.checkUpstream(ctx)...)
+	checks = append(checks, d.checkCert())
+	checks = append(checks, d.checkOrigins()...)
+	if validateOrigin(d.get("origin")) == nil {
+		checks = append(checks, diagnostics.checkAlma(ctx)...)
+	} else {
+		checks = append(checks, DiagnosticCheck{
+			Name:   "Computer clock is correct",
+			Result: DiagnosticUnknown,
+			Detail: "Unable to compare the clock with Alma's without Alma's address in -origin.",
+		})
+	}
+
+	failed := 0
+	for _, check := range checks {
+		label := "[ ?? ]"
+		switch check.Result {
+		case DiagnosticOK:
+			label = "[PASS]"
+		case DiagnosticFailed:
+			label = "[FAIL]"
+			failed++
+		}
+		fmt.Fprintf(stdout, "%v %v\n       %v\n", label, check.Name, check.Detail)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%w, %d of %d", ErrChecksFailed, failed, len(checks))
+	}
+	fmt.Fprintln(stdout, "All checks passed.")
+	return nil
+}
+
+// doctor runs the checks which need the configuration.
+type doctor struct {
+	get func(name string) string
+}
+
+// https reports whether the proxy is configured to serve HTTPS.
+func (d *doctor) https() bool {
+	return d.get("tls-cert") != "" || d.get("acme-host") != ""
+}
+
+// checkPort checks the proxy can listen on its address. If something is
+// already listening, it passes if that is the proxy itself.
+func (d *doctor) checkPort(ctx context.Context) DiagnosticCheck {
+	check := DiagnosticCheck{Name: "Port is available"}
+	address := d.get("address")
+	listeners, err := Listen(d.get("ip-version"), address)
+	for _, listener := range listeners {
+		listener.Close()
+	}
+	if err == nil {
+		check.Result, check.Detail = DiagnosticOK, fmt.Sprintf("Nothing else is using %v.", address)
+		return check
+	}
+	if running := d.runningVersion(ctx); running != "" {
+		check.Result, check.Detail = DiagnosticOK, fmt.Sprintf("The proxy, version %v, is already running on %v.", running, address)
+		return check
+	}
+	check.Result = DiagnosticFailed
+	check.Detail = fmt.Sprintf("Unable to listen on %v: %v. Another program is using the port. Stop it, or choose another -address.", address, err)
+	return check
+}
+
+// localURL returns the address the proxy is reached at from this computer,
+// like http://localhost:53535.
+func (d *doctor) localURL() string {
+	host, port, err := net.SplitHostPort(d.get("address"))
+	if err != nil {
+		host, port = "", d.get("address")
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "localhost"
+	}
+	scheme := "http"
+	if d.https() {
+		scheme = "https"
+	}
+	return scheme + "://" + net.JoinHostPort(host, port)
+}
+
+// runningVersion returns the version of the proxy answering at an address,
+// or an empty string if it isn't the proxy which answers.
+func (d *doctor) runningVersion(ctx context.Context) string {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, d.localURL()+"/livez", nil)
+	if err != nil {
+		return ""
+	}
+	client := &http.Client{Timeout: DiagnosticsTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return ""
+	}
+	resp.Body.Close()
+	return resp.Header.Get(VersionHeader)
+}
+
+// checkCert checks the TLS certificate can be loaded, is valid for the
+// address, and isn't about to expire.
+func (d *doctor) checkCert() DiagnosticCheck {
+	check := DiagnosticCheck{Name: "TLS certificate is valid", Result: DiagnosticUnknown}
+	certFile, keyFile := d.get("tls-cert"), d.get("tls-key")
+	switch {
+	case d.get("acme-host") != "":
+		check.Detail = "Certificates come from Let's Encrypt, for " + d.get("acme-host") + "."
+		return check
+	case certFile == "":
+		check.Detail = "HTTPS isn't configured, so the proxy is served over HTTP."
+		return check
+	}
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		check.Result, check.Detail = DiagnosticFailed, fmt.Sprintf("Unable to load -tls-cert and -tls-key: %v.", err)
+		return check
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		check.Result, check.Detail = DiagnosticFailed, fmt.Sprintf("Unable to parse -tls-cert: %v.", err)
+		return check
+	}
+	host, _, _ := net.SplitHostPort(d.get("address"))
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "localhost"
+	}
+	now := time.Now()
+	switch {
+	case now.Before(cert.NotBefore):
+		check.Result = DiagnosticFailed
+		check.Detail = fmt.Sprintf("The certificate isn't valid until %v. Check the computer's clock.", cert.NotBefore.Format(time.DateOnly))
+	case now.After(cert.NotAfter):
+		check.Result = DiagnosticFailed
+		check.Detail = fmt.Sprintf("The certificate expired on %v. Renew it, or make a new one with the gencert command.", cert.NotAfter.Format(time.DateOnly))
+	case cert.NotAfter.Sub(now) < CertExpiryWarning:
+		check.Result = DiagnosticFailed
+		check.Detail = fmt.Sprintf("The certificate expires on %v. Renew it soon, or make a new one with the gencert command.", cert.NotAfter.Format(time.DateOnly))
+	case cert.VerifyHostname(host) != nil:
+		check.Result = DiagnosticFailed
+		check.Detail = fmt.Sprintf("The certificate isn't for %v, so browsers will refuse it. Make a new one with the gencert command.", host)
+	default:
+		check.Result = DiagnosticOK
+		check.Detail = fmt.Sprintf("The certificate for %v is valid until %v.", host, cert.NotAfter.Format(time.DateOnly))
+	}
+	return check
+}
+
+// checkOrigins checks the allowed origins are ones browsers will send.
+func (d *doctor) checkOrigins() []DiagnosticCheck {
+	origin := d.get("origin")
+	var checks []DiagnosticCheck
+	if origin == "*" {
+		checks = append(checks, DiagnosticCheck{
+			Name:   "Alma is allowed to use the RFID pad",
+			Result: DiagnosticFailed,
+			Detail: "-origin is *, so any web page can use the RFID pad. Set it to your Alma address, like https://example.alma.exlibrisgroup.com.",
+		})
+	} else {
+		checks = append(checks, (&Diagnostics{Origin: origin}).checkCORS(context.Background())...)
+	}
+	if sandbox := d.get("sandbox-origin"); sandbox != "" {
+		check := (&Diagnostics{Origin: sandbox}).checkCORS(context.Background())[0]
+		check.Name = "The Alma sandbox is allowed to use the RFID pad"
+		checks = append(checks, check)
+	}
+	if path := d.get("institutions"); path != "" {
+		check := DiagnosticCheck{Name: "Institutions file is valid"}
+		institutions, err := LoadInstitutions(path, false)
+		if err != nil {
+			check.Result, check.Detail = DiagnosticFailed, fmt.Sprintf("Unable to load %v: %v.", path, err)
+		} else {
+			institutions.Close()
+			check.Result, check.Detail = DiagnosticOK, fmt.Sprintf("%d institutions are allowed.", len(institutions))
+		}
+		checks = append(checks, check)
+	}
+	return checks
+}
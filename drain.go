@@ -0,0 +1,179 @@
+// Copyright 2023 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultShutdownTimeout is the default time in-flight requests have to
+	// finish during a graceful shutdown, before connections are closed.
+	DefaultShutdownTimeout = 30 * time.Second
+
+	// DrainReportInterval is how often the remaining connections and
+	// requests are logged during a graceful shutdown.
+	DrainReportInterval = 2 * time.Second
+)
+
+// DrainSummary describes how a graceful shutdown went.
+type DrainSummary struct {
+	Duration          time.Duration
+	RequestsCompleted int // Requests which finished while draining.
+	RequestsAbandoned int // Requests still running when connections were closed.
+	ConnsAbandoned    int // Connections open when connections were closed.
+	TimedOut          bool
+}
+
+// String formats the summary for the log.
+func (s DrainSummary) String() string {
+	if !s.TimedOut {
+		return fmt.Sprintf("drained in %v, %v requests completed while draining",
+			s.Duration.Round(time.Millisecond), s.RequestsCompleted)
+	}
+	return fmt.Sprintf("timed out after %v, %v requests completed while draining, "+
+		"%v requests and %v connections abandoned",
+		s.Duration.Round(time.Millisecond), s.RequestsCompleted, s.RequestsAbandoned, s.ConnsAbandoned)
+}
+
+// DrainTracker keeps track of open connections and in-flight requests,
+// so a slow or stuck graceful shutdown can be diagnosed from the log.
+type DrainTracker struct {
+	mu        sync.Mutex
+	conns     map[net.Conn]http.ConnState
+	requests  map[*http.Request]time.Time
+	draining  bool
+	completed int
+}
+
+// NewDrainTracker returns an empty DrainTracker.
+func NewDrainTracker() *DrainTracker {
+	return &DrainTracker{
+		conns:    make(map[net.Conn]http.ConnState),
+		requests: make(map[*http.Request]time.Time),
+	}
+}
+
+// ConnState is an http.Server ConnState hook which tracks connections.
+func (d *DrainTracker) ConnState(conn net.Conn, state http.ConnState) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	switch state {
+	case http.StateClosed, http.StateHijacked:
+		delete(d.conns, conn)
+	case http.StateNew, http.StateActive, http.StateIdle:
+		d.conns[conn] = state
+	}
+}
+
+// Middleware wraps a handler, tracking in-flight requests.
+func (d *DrainTracker) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		d.mu.Lock()
+		d.requests[r] = time.Now()
+		d.mu.Unlock()
+		defer func() {
+			d.mu.Lock()
+			delete(d.requests, r)
+			if d.draining {
+				d.completed++
+			}
+			d.mu.Unlock()
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Draining reports whether the server is shutting down.
+func (d *DrainTracker) Draining() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.draining
+}
+
+// Shutdown gracefully shuts down the server, logging what is still
+// running every DrainReportInterval. If the requests haven't finished
+// within timeout, the remaining connections are closed.
+func (d *DrainTracker) Shutdown(server *http.Server, timeout time.Duration) DrainSummary {
+	start := time.Now()
+	d.mu.Lock()
+	d.draining = true
+	d.mu.Unlock()
+
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- server.Shutdown(ctx)
+	}()
+
+	ticker := time.NewTicker(DrainReportInterval)
+	defer ticker.Stop()
+	var err error
+	for waiting := true; waiting; {
+		select {
+		case err = <-done:
+			waiting = false
+		case <-ticker.C:
+			slog.Info("Draining.", "remaining", d.report())
+		}
+	}
+
+	d.mu.Lock()
+	summary := DrainSummary{
+		Duration:          time.Since(start),
+		RequestsCompleted: d.completed,
+		RequestsAbandoned: len(d.requests),
+		ConnsAbandoned:    len(d.conns),
+	}
+	d.mu.Unlock()
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		summary.TimedOut = true
+		slog.Warn("Drain timed out, closing remaining connections.", "remaining", d.report())
+		err = server.Close()
+	}
+	if err != nil {
+		slog.Error("Unable to shut down server.", "error", err)
+	}
+	return summary
+}
+
+// report describes the connections and requests still open.
+func (d *DrainTracker) report() string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	active := 0
+	for _, state := range d.conns {
+		if state == http.StateActive {
+			active++
+		}
+	}
+	requests := make([]string, 0, len(d.requests))
+	for r, started := range d.requests {
+		requests = append(requests, fmt.Sprintf("%v %v %v for %v",
+			r.RemoteAddr, r.Method, r.URL.Path, time.Since(started).Round(time.Second)))
+	}
+	sort.Strings(requests)
+	report := fmt.Sprintf("%v connections open (%v active), %v requests in flight", len(d.conns), active, len(requests))
+	if len(requests) > 0 {
+		report += ": " + strings.Join(requests, ", ")
+	}
+	return report
+}
@@ -0,0 +1,376 @@
+// Copyright 2023 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EventBufferSize is the number of events buffered for each subscriber
+// before new events are dropped.
+const EventBufferSize = 256
+
+// EventType identifies what happened on the RFID pad.
+type EventType string
+
+const (
+	// EventTagAppear is published when a tag is first seen on the pad.
+	EventTagAppear EventType = "tag.appear"
+
+	// EventTagDisappear is published when a tag is no longer seen on the pad.
+	EventTagDisappear EventType = "tag.disappear"
+
+	// EventSecurityChange is published when the security (EAS) bit of a tag changes.
+	EventSecurityChange EventType = "security.change"
+
+	// EventSecurityFailure is published when the reader service fails to
+	// arm or disarm a tag.
+	EventSecurityFailure EventType = "security.failure"
+
+	// EventBatchComplete is published when the pad is cleared after a
+	// checkout, that is, after at least one tag on it was disarmed.
+	// The event lists every item read while the batch was on the pad.
+	EventBatchComplete EventType = "batch.complete"
+
+	// EventUpstreamAlert is published when the reader service's error rate
+	// or latency breaches the alert thresholds. The reason is in the detail.
+	EventUpstreamAlert EventType = "upstream.alert"
+
+	// EventUpstreamRecovered is published when the reader service is back
+	// within the alert thresholds.
+	EventUpstreamRecovered EventType = "upstream.recovered"
+
+	// EventUpstreamWedged is published when the watchdog finds the reader
+	// service wedged, and tries to recover it. The reason is in the detail.
+	EventUpstreamWedged EventType = "upstream.wedged"
+)
+
+// ErrUnknownEventType is returned when parsing an event type we don't publish.
+var ErrUnknownEventType = errors.New("unknown event type")
+
+// ParseEventTypes parses a comma separated list of event types.
+func ParseEventTypes(list string) ([]EventType, error) {
+	var types []EventType
+	for _, name := range splitList(list) {
+		switch t := EventType(name); t {
+		case EventTagAppear, EventTagDisappear, EventSecurityChange, EventSecurityFailure, EventBatchComplete,
+			EventUpstreamAlert, EventUpstreamRecovered, EventUpstreamWedged:
+			types = append(types, t)
+		default:
+			return nil, fmt.Errorf("%w: %v", ErrUnknownEventType, name)
+		}
+	}
+	return types, nil
+}
+
+// Event describes a change on the RFID pad, as observed in upstream responses.
+type Event struct {
+	Type    EventType `json:"type"`
+	Barcode string    `json:"barcode"`
+	Secure  bool      `json:"secure"`
+	Detail  string    `json:"detail,omitempty"`
+	Items   []string  `json:"items,omitempty"`
+	Time    time.Time `json:"time"`
+
+	// Upstream is the reader service whose pad the event happened on, so
+	// institutions sharing a consortial server can tell their events apart.
+	Upstream string `json:"upstream,omitempty"`
+}
+
+// EventBus fans events out to subscribers without blocking the proxy.
+type EventBus struct {
+	mu     sync.Mutex
+	subs   []chan Event
+	closed bool
+}
+
+// NewEventBus returns an empty EventBus.
+func NewEventBus() *EventBus {
+	return &EventBus{}
+}
+
+// Subscribe returns a channel which receives every published event.
+// The channel is closed when the bus is closed.
+func (b *EventBus) Subscribe() <-chan Event {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ch := make(chan Event, EventBufferSize)
+	if b.closed {
+		close(ch)
+		return ch
+	}
+	b.subs = append(b.subs, ch)
+	return ch
+}
+
+// Unsubscribe stops sending events to a channel returned by Subscribe, and closes it.
+func (b *EventBus) Unsubscribe(ch <-chan Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		// Close already closed every channel.
+		return
+	}
+	for i, sub := range b.subs {
+		if sub == ch {
+			b.subs = append(b.subs[:i], b.subs[i+1:]...)
+			close(sub)
+			return
+		}
+	}
+}
+
+// Publish sends events to all subscribers.
+// A subscriber which has fallen behind misses the event.
+func (b *EventBus) Publish(events ...Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return
+	}
+	for _, e := range events {
+		for _, ch := range b.subs {
+			select {
+			case ch <- e:
+			default:
+				slog.Warn("Event subscriber is not keeping up, dropped event.", "type", e.Type, "barcode", e.Barcode)
+			}
+		}
+	}
+}
+
+// Close closes all subscriber channels.
+func (b *EventBus) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return
+	}
+	b.closed = true
+	for _, ch := range b.subs {
+		close(ch)
+	}
+}
+
+// TagTracker watches upstream responses and works out which tags have
+// appeared, disappeared, or changed security state since the last response.
+// Each reader service has its own pad, so institutions sharing a consortial
+// server don't see each other's tags come and go.
+type TagTracker struct {
+	bus *EventBus
+
+	mu   sync.Mutex
+	pads map[string]*pad // Keyed by reader service address.
+}
+
+// pad is what the tracker knows about the tags on one reader's pad.
+type pad struct {
+	tags       map[string]bool // Barcode to security bit.
+	batch      []string        // Barcodes read since the pad was last empty.
+	checkedOut bool            // Whether anything in the batch was disarmed.
+}
+
+// NewTagTracker returns a TagTracker which publishes to bus.
+func NewTagTracker(bus *EventBus) *TagTracker {
+	return &TagTracker{
+		bus:  bus,
+		pads: make(map[string]*pad),
+	}
+}
+
+// pad returns the pad of a reader service. t.mu must be held.
+func (t *TagTracker) pad(upstream string) *pad {
+	p, ok := t.pads[upstream]
+	if !ok {
+		p = &pad{tags: make(map[string]bool)}
+		t.pads[upstream] = p
+	}
+	return p
+}
+
+// Observe inspects a response from a reader service to the given operation
+// and publishes the events it implies.
+//
+// Responses to getItems describe everything on the pad, so tags missing
+// from them have disappeared. Items in responses to any other operation,
+// like a security update, only report on the tags they mention.
+func (t *TagTracker) Observe(upstream, operation string, body []byte) {
+	items, fault, ok := parseItems(body)
+	if !ok {
+		return
+	}
+	if fault != "" {
+		t.Failed(upstream, operation, fault)
+		return
+	}
+	snapshot := strings.Contains(strings.ToLower(operation), "getitems")
+	now := time.Now()
+
+	var events []Event
+	t.mu.Lock()
+	p := t.pad(upstream)
+	seen := make(map[string]bool, len(items))
+	for _, item := range items {
+		seen[item.Barcode] = true
+		secure, known := p.tags[item.Barcode]
+		switch {
+		case !known && snapshot:
+			events = append(events, Event{Type: EventTagAppear, Barcode: item.Barcode, Secure: item.Secure, Time: now, Upstream: upstream})
+			p.batch = append(p.batch, item.Barcode)
+		case known && secure != item.Secure:
+			events = append(events, Event{Type: EventSecurityChange, Barcode: item.Barcode, Secure: item.Secure, Time: now, Upstream: upstream})
+			if !item.Secure {
+				p.checkedOut = true
+			}
+		case !known:
+			// An item we haven't seen on the pad yet, don't start tracking it.
+			continue
+		}
+		p.tags[item.Barcode] = item.Secure
+	}
+	if snapshot {
+		for barcode, secure := range p.tags {
+			if !seen[barcode] {
+				events = append(events, Event{Type: EventTagDisappear, Barcode: barcode, Secure: secure, Time: now, Upstream: upstream})
+				delete(p.tags, barcode)
+			}
+		}
+		if len(p.tags) == 0 && len(p.batch) > 0 {
+			if p.checkedOut {
+				events = append(events, Event{Type: EventBatchComplete, Items: p.batch, Time: now, Upstream: upstream})
+			}
+			p.batch = nil
+			p.checkedOut = false
+		}
+	}
+	t.mu.Unlock()
+
+	t.bus.Publish(events...)
+}
+
+// Present returns a tag.appear event for each tag on a reader service's pad,
+// in barcode order.
+func (t *TagTracker) Present(upstream string) []Event {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	p := t.pad(upstream)
+	events := make([]Event, 0, len(p.tags))
+	for barcode, secure := range p.tags {
+		events = append(events, Event{Type: EventTagAppear, Barcode: barcode, Secure: secure, Time: now, Upstream: upstream})
+	}
+	sort.Slice(events, func(i, j int) bool { return events[i].Barcode < events[j].Barcode })
+	return events
+}
+
+// Failed records that a call to a reader service for the given operation
+// failed. Only failures of security operations are published.
+func (t *TagTracker) Failed(upstream, operation, detail string) {
+	if !isSecurityOperation(operation) {
+		return
+	}
+	t.bus.Publish(Event{Type: EventSecurityFailure, Detail: detail, Time: time.Now(), Upstream: upstream})
+}
+
+// isSecurityOperation reports whether the operation arms or disarms tags.
+func isSecurityOperation(operation string) bool {
+	operation = strings.ToLower(operation)
+	return strings.Contains(operation, "secur")
+}
+
+// tagItem is an item record found in an upstream response.
+type tagItem struct {
+	Barcode string
+	Secure  bool
+}
+
+// parseItems finds item records in an XML response from the reader service.
+// An item is any element named "item" with a "barcode" child, and optionally
+// an "isSecure" child. Namespaces and case are ignored, since vendors differ.
+// If the body is a SOAP fault, the fault's reason is returned.
+// The last return value is false if the body isn't XML.
+func parseItems(body []byte) ([]tagItem, string, bool) {
+	decoder := xml.NewDecoder(bytes.NewReader(body))
+	var items []tagItem
+	var current *tagItem
+	var field string
+	var fault string
+	inFault := false
+	sawElement := false
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			// io.EOF at the end of a well formed document,
+			// a syntax error otherwise.
+			return items, fault, errors.Is(err, io.EOF) && sawElement
+		}
+		switch el := token.(type) {
+		case xml.StartElement:
+			sawElement = true
+			name := strings.ToLower(el.Name.Local)
+			switch {
+			case name == "item":
+				current = &tagItem{}
+			case name == "fault":
+				inFault = true
+			case current != nil || inFault:
+				field = name
+			}
+		case xml.CharData:
+			value := strings.TrimSpace(string(el))
+			// SOAP 1.1 faults have a faultstring, SOAP 1.2 faults have a Reason/Text.
+			if inFault && fault == "" && (field == "faultstring" || field == "text") {
+				fault = value
+			}
+			if current == nil {
+				continue
+			}
+			switch field {
+			case "barcode":
+				current.Barcode = value
+			case "issecure", "secure":
+				current.Secure, _ = strconv.ParseBool(value)
+			}
+		case xml.EndElement:
+			if strings.EqualFold(el.Name.Local, "item") && current != nil {
+				if current.Barcode != "" {
+					items = append(items, *current)
+				}
+				current = nil
+			}
+			if strings.EqualFold(el.Name.Local, "fault") {
+				inFault = false
+				if fault == "" {
+					fault = "SOAP fault"
+				}
+			}
+			field = ""
+		}
+	}
+}
+
+// operationName returns the name of the reader service operation being
+// called, taken from the SOAPAction header or the last element of the path.
+func operationName(soapAction, urlPath string) string {
+	action := strings.Trim(soapAction, `"`)
+	if action != "" {
+		if i := strings.LastIndexAny(action, "/#"); i >= 0 {
+			action = action[i+1:]
+		}
+		return action
+	}
+	return path.Base(urlPath)
+}
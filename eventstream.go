@@ -0,0 +1,276 @@
+// Copyright 2023 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultEventPollInterval is how often the reader service is polled for tags
+// while a browser is listening to /events.
+const DefaultEventPollInterval = 500 * time.Millisecond
+
+// EventKeepAliveInterval is how often a comment is sent on an idle event stream,
+// so the browser, and anything in between, doesn't give up on the connection.
+const EventKeepAliveInterval = 15 * time.Second
+
+// EventRetry is how long the browser waits before reconnecting a dropped event stream.
+const EventRetry = 2 * time.Second
+
+// ErrEventPoll is returned when the reader service answers a tag poll with an error.
+var ErrEventPoll = errors.New("tag poll failed")
+
+// EventStream serves tag events to browsers as Server-Sent Events, so the Alma
+// Cloud App can listen for tags instead of polling the proxy several times a second.
+// While anyone is listening, the reader service is polled every Interval, and the
+// responses are passed to the Tracker, which publishes the tag events. Polls are
+// skipped while requests are being proxied anyway, since those feed the Tracker too.
+//
+// A browser can ask for some event types only, like /events?types=tag.appear,tag.disappear.
+// When it connects, it is sent a tag.appear event for each tag already on the pad.
+type EventStream struct {
+	Bus        *EventBus
+	Tracker    *TagTracker
+	Client     *http.Client
+	Path       string
+	SOAPAction string
+	Interval   time.Duration // Zero to never poll.
+	Queue      *UpstreamQueue
+
+	// Upstream returns the reader service to poll.
+	Upstream func() string
+
+	// Pad returns the reader service whose tag events are sent to a browser
+	// from an origin. If nil, it is the one polled.
+	Pad func(origin string) string
+
+	// LastRequest returns when a request was last proxied to the reader service.
+	LastRequest func() time.Time
+
+	mu        sync.Mutex
+	listeners int
+	wake      chan struct{} // Signalled when the first browser starts listening.
+	done      chan struct{} // Closed when the server shuts down.
+	closeOnce sync.Once
+}
+
+// NewEventStream returns an EventStream for the events published on bus.
+func NewEventStream(bus *EventBus, tracker *TagTracker) *EventStream {
+	return &EventStream{
+		Bus:     bus,
+		Tracker: tracker,
+		wake:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+}
+
+// ServeHTTP streams events until the browser goes away or the server shuts down.
+func (s *EventStream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+	types, err := ParseEventTypes(r.URL.Query().Get("types"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	wanted := func(t EventType) bool {
+		if len(types) == 0 {
+			return true
+		}
+		for _, want := range types {
+			if t == want {
+				return true
+			}
+		}
+		return false
+	}
+
+	events := s.Bus.Subscribe()
+	defer s.Bus.Unsubscribe(events)
+	s.listen(1)
+	defer s.listen(-1)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// Stop nginx, and proxies like it, from buffering the stream.
+	w.Header().Set("X-Accel-Buffering", "no")
+	rc := http.NewResponseController(w)
+	fmt.Fprintf(w, "retry: %d\n\n", EventRetry.Milliseconds())
+	pad := s.Upstream()
+	if s.Pad != nil {
+		pad = s.Pad(r.Header.Get("Origin"))
+	}
+	for _, e := range s.Tracker.Present(pad) {
+		if wanted(e.Type) {
+			writeEvent(w, e)
+		}
+	}
+	err = rc.Flush()
+	if err != nil {
+		slog.Error("Unable to stream events.", "error", err)
+		return
+	}
+	slog.Debug("Event stream opened.", "client", r.RemoteAddr, "origin", r.Header.Get("Origin"))
+
+	keepAlive := time.NewTicker(EventKeepAliveInterval)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			slog.Debug("Event stream closed by the browser.", "client", r.RemoteAddr)
+			return
+		case <-s.done:
+			return
+		case e, ok := <-events:
+			if !ok {
+				return
+			}
+			// Other institutions' tags are none of this browser's business.
+			if !wanted(e.Type) || (e.Upstream != "" && e.Upstream != pad) {
+				continue
+			}
+			writeEvent(w, e)
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		}
+		err = rc.Flush()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// isEventStream reports whether a request is for a stream of Server-Sent Events,
+// which EventSource asks for with its Accept header.
+func isEventStream(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+}
+
+// writeEvent writes an event in the Server-Sent Events format, with the
+// event type as the event name, and the event as JSON data.
+func writeEvent(w io.Writer, e Event) {
+	data, err := json.Marshal(e)
+	if err != nil {
+		slog.Error("Unable to encode event.", "type", e.Type, "error", err)
+		return
+	}
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data)
+}
+
+// Close ends the event streams, so they don't hold up shutting down the server.
+// It is registered with http.Server.RegisterOnShutdown.
+func (s *EventStream) Close() {
+	s.closeOnce.Do(func() { close(s.done) })
+}
+
+// listen adds to the number of browsers listening, waking the poller for the first.
+func (s *EventStream) listen(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.listeners += n
+	if s.listeners == 1 && n > 0 {
+		select {
+		case s.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// listening reports whether any browsers are listening.
+func (s *EventStream) listening() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.listeners > 0
+}
+
+// Run polls the reader service while browsers are listening, until the context is cancelled.
+func (s *EventStream) Run(ctx context.Context) {
+	if s.Interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(s.Interval)
+	defer ticker.Stop()
+	operation := operationName(s.SOAPAction, s.Path)
+	failing := false
+	for {
+		if !s.listening() {
+			select {
+			case <-ctx.Done():
+				return
+			case <-s.wake:
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if !s.listening() || time.Since(s.LastRequest()) < s.Interval {
+			continue
+		}
+		upstream := s.Upstream()
+		err := s.poll(ctx, upstream, operation)
+		if ctx.Err() != nil {
+			return
+		}
+		switch {
+		case err != nil && !failing:
+			slog.Warn("Unable to poll the reader service for events.", "upstream", upstream, "error", err)
+		case err == nil && failing:
+			slog.Info("Polling the reader service for events again.", "upstream", upstream)
+		}
+		failing = err != nil
+	}
+}
+
+// poll sends one tag poll to upstream, passing the response to the Tracker.
+func (s *EventStream) poll(ctx context.Context, upstream, operation string) error {
+	u, err := url.Parse(upstream)
+	if err != nil {
+		return err
+	}
+	u.Path = s.Path
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	if s.SOAPAction != "" {
+		req.Header.Set("SOAPAction", s.SOAPAction)
+	}
+	release, err := s.Queue.Acquire(ctx, upstream, RequestPriority(operation))
+	if err != nil {
+		return err
+	}
+	defer release()
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		s.Tracker.Failed(upstream, operation, err.Error())
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, WatchedBodyMax))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		s.Tracker.Failed(upstream, operation, "reader service responded "+resp.Status)
+		return fmt.Errorf("%w, reader service responded %v", ErrEventPoll, resp.Status)
+	}
+	s.Tracker.Observe(upstream, operation, body)
+	return nil
+}
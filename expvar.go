@@ -0,0 +1,70 @@
+// Copyright 2023 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"net/http"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// PublishExpvars publishes basic counters with expvar, for troubleshooting
+// with curl where there's no metrics stack: the requests served, the errors
+// by status class, the moving average of upstream latency, and the number of
+// goroutines. It must only be called once.
+func PublishExpvars(m *Metrics) {
+	expvar.Publish("requests", expvar.Func(func() any {
+		return m.Snapshot().Requests
+	}))
+	expvar.Publish("requests_in_flight", expvar.Func(func() any {
+		return m.inFlight.Load()
+	}))
+	expvar.Publish("errors", expvar.Func(func() any {
+		s := m.Snapshot()
+		var upstream int64
+		for _, stats := range s.Operations {
+			upstream += stats.Failures
+		}
+		return map[string]int64{
+			"4xx":      s.Responses["4xx"],
+			"5xx":      s.Responses["5xx"],
+			"upstream": upstream,
+		}
+	}))
+	expvar.Publish("upstream_latency_ewma_ms", expvar.Func(func() any {
+		return float64(m.LatencyEWMA().Microseconds()) / 1000
+	}))
+	expvar.Publish("goroutines", expvar.Func(func() any {
+		return runtime.NumGoroutine()
+	}))
+	expvar.Publish("version", expvar.Func(func() any {
+		return version
+	}))
+}
+
+// ExpvarHandler serves the published variables as JSON, like expvar.Handler,
+// except for the command line, which might hold secrets like tokens.
+func ExpvarHandler(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	var b strings.Builder
+	b.WriteString("{\n")
+	first := true
+	expvar.Do(func(kv expvar.KeyValue) {
+		if kv.Key == "cmdline" {
+			return
+		}
+		if !first {
+			b.WriteString(",\n")
+		}
+		first = false
+		fmt.Fprintf(&b, "%v: %v", strconv.Quote(kv.Key), kv.Value)
+	})
+	b.WriteString("\n}\n")
+	w.Write([]byte(b.String()))
+}
@@ -0,0 +1,130 @@
+// Copyright 2023 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"sync/atomic"
+	"time"
+)
+
+// FallbackDialTimeout is the most time allowed to connect to the primary
+// reader service before the request is sent to the fallback instead. A
+// request gets at most half the time it has left to connect, so the
+// fallback has time to answer.
+const FallbackDialTimeout = 2 * time.Second
+
+// UpstreamFallback sends requests to a second reader service, like another
+// reader interface on the workstation or a networked backup reader, when the
+// primary can't be reached. Since a request the primary refused was never
+// sent, any request can be sent to the fallback, not just those safe to send
+// twice. It only applies to the default reader service, so requests from the
+// sandbox or another institution never reach it.
+type UpstreamFallback struct {
+	// Target is the fallback reader service.
+	Target *url.URL
+}
+
+// NewUpstreamFallback returns an UpstreamFallback sending requests to address.
+// It returns nil if address is empty.
+func NewUpstreamFallback(address string) (*UpstreamFallback, error) {
+	if address == "" {
+		return nil, nil
+	}
+	target, err := parseUpstream(address)
+	if err != nil {
+		return nil, err
+	}
+	return &UpstreamFallback{Target: target}, nil
+}
+
+// Transport wraps a transport, sending requests to the fallback when they
+// can't connect to the primary.
+func (f *UpstreamFallback) Transport(next http.RoundTripper) http.RoundTripper {
+	if f == nil {
+		return next
+	}
+	return &fallbackTransport{fallback: f, next: next}
+}
+
+// fallbackTransport sends requests to the fallback when they can't connect.
+type fallbackTransport struct {
+	fallback *UpstreamFallback
+	next     http.RoundTripper
+}
+
+// RoundTrip sends a request to the primary, and to the fallback if it
+// couldn't connect.
+func (t *fallbackTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	next := t.next
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	// The body is read again for the fallback.
+	var body []byte
+	if req.Body != nil && req.Body != http.NoBody {
+		var err error
+		body, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	// A primary which drops connection attempts would otherwise use up the
+	// request's whole timeout, so connecting is given up on early.
+	dialTimeout := FallbackDialTimeout
+	if deadline, ok := req.Context().Deadline(); ok {
+		dialTimeout = min(dialTimeout, time.Until(deadline)/2)
+	}
+	// Either the request connects, or it gives up, never both, so a request
+	// which might have been sent is never sent to the fallback too.
+	const connecting, connected, gaveUp = 0, 1, 2
+	var state atomic.Int32
+	ctx, cancel := context.WithCancel(req.Context())
+	timer := time.AfterFunc(dialTimeout, func() {
+		if state.CompareAndSwap(connecting, gaveUp) {
+			cancel()
+		}
+	})
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(httptrace.GotConnInfo) {
+			if state.CompareAndSwap(connecting, connected) {
+				timer.Stop()
+			}
+		},
+	})
+	resp, err := next.RoundTrip(req.WithContext(ctx))
+	if err == nil {
+		return resp, nil
+	}
+	timer.Stop()
+	if (!dialFailed(err) && state.Load() != gaveUp) || req.Context().Err() != nil {
+		return nil, err
+	}
+	slog.WarnContext(req.Context(), "Unable to reach the reader service, sending the request to the fallback.", "fallback", t.fallback.Target.Host, "error", err)
+	fallbackReq := req.Clone(req.Context())
+	fallbackReq.URL.Scheme = t.fallback.Target.Scheme
+	fallbackReq.URL.Host = t.fallback.Target.Host
+	if body != nil {
+		fallbackReq.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	return next.RoundTrip(fallbackReq)
+}
+
+// dialFailed reports whether a request failed because it couldn't connect,
+// so it was never sent.
+func dialFailed(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
@@ -0,0 +1,120 @@
+// Copyright 2023 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// deadAddress returns the address of a port nothing is listening on.
+func deadAddress(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener.Close()
+	return "http://" + listener.Addr().String()
+}
+
+// echoServer returns a server which answers with its name and the request body.
+func echoServer(t *testing.T, name string) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		io.WriteString(w, name+" "+string(body))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// serve sends a request through a handler, and returns the response status and body.
+func serve(t *testing.T, h http.Handler, method, path, soapAction string) (int, string) {
+	t.Helper()
+	r := httptest.NewRequest(method, path, strings.NewReader("<Envelope/>"))
+	if soapAction != "" {
+		r.Header.Set("SOAPAction", soapAction)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w.Code, w.Body.String()
+}
+
+func TestUpstreamFallback(t *testing.T) {
+	primary := echoServer(t, "primary")
+	fallback := echoServer(t, "fallback")
+	tests := []struct {
+		name    string
+		primary string
+		method  string
+		want    string
+	}{
+		{"primary answers", primary.URL, http.MethodPost, "primary <Envelope/>"},
+		{"get from a dead primary", deadAddress(t), http.MethodGet, "fallback <Envelope/>"},
+		// A request the primary refused was never sent, so even a write goes to the fallback, with its body.
+		{"post to a dead primary", deadAddress(t), http.MethodPost, "fallback <Envelope/>"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestProxy(tt.primary)
+			var err error
+			p.Fallback, err = NewUpstreamFallback(fallback.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			status, body := serve(t, p, tt.method, "/", "urn:rfid#writeTags")
+			if status != http.StatusOK || body != tt.want {
+				t.Errorf("got %v %q, want 200 %q", status, body, tt.want)
+			}
+		})
+	}
+}
+
+// hangingTransport sends requests to the primary nowhere, like a reader
+// service which drops connection attempts, and the others on to next.
+type hangingTransport struct {
+	primary string
+	next    http.RoundTripper
+}
+
+func (t hangingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Host == t.primary {
+		<-req.Context().Done()
+		return nil, req.Context().Err()
+	}
+	return t.next.RoundTrip(req)
+}
+
+func TestUpstreamFallbackDialTimeout(t *testing.T) {
+	fallback := echoServer(t, "fallback")
+	f, err := NewUpstreamFallback(fallback.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Connecting gets half the request's time, so the fallback has the rest.
+	client := &http.Client{Transport: &timeoutTransport{
+		next:    f.Transport(hangingTransport{primary: "192.0.2.1:21645", next: http.DefaultTransport}),
+		timeout: time.Second,
+	}}
+	start := time.Now()
+	resp, err := client.Post("http://192.0.2.1:21645/", "text/xml", strings.NewReader("<Envelope/>"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "fallback <Envelope/>" {
+		t.Errorf("got %q, want the fallback", body)
+	}
+	if took := time.Since(start); took >= time.Second {
+		t.Errorf("took %v, the whole timeout", took)
+	}
+}
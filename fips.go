@@ -0,0 +1,43 @@
+// Copyright 2023 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+)
+
+// FIPSTLSConfig restricts a TLS configuration to FIPS 140 approved algorithms:
+// TLS 1.2 with ECDHE key exchange over the P-256 and P-384 curves, and AES-GCM.
+// TLS 1.3 is turned off, since its cipher suites can't be restricted, and it
+// allows ChaCha20-Poly1305. The configuration is changed in place and returned.
+// If cfg is nil, a new configuration is returned.
+//
+// This restricts which algorithms are used, but not which implementation.
+// For validated cryptography, build with GOFIPS140=latest (Go 1.24 and later)
+// or GOEXPERIMENT=boringcrypto (earlier releases), see FIPSModule.
+func FIPSTLSConfig(cfg *tls.Config) *tls.Config {
+	if cfg == nil {
+		cfg = &tls.Config{}
+	}
+	cfg.MinVersion = tls.VersionTLS12
+	cfg.MaxVersion = tls.VersionTLS12
+	cfg.CipherSuites = []uint16{
+		tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+		tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+		tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+		tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	}
+	cfg.CurvePreferences = []tls.CurveID{tls.CurveP256, tls.CurveP384}
+	return cfg
+}
+
+// RestrictDefaultTransportToFIPS restricts the TLS used by clients without their
+// own transport, like the webhooks, to FIPS 140 approved algorithms.
+func RestrictDefaultTransportToFIPS() {
+	if transport, ok := http.DefaultTransport.(*http.Transport); ok {
+		transport.TLSClientConfig = FIPSTLSConfig(transport.TLSClientConfig)
+	}
+}
@@ -0,0 +1,20 @@
+// Copyright 2023 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+//go:build boringcrypto && !go1.24
+
+package main
+
+import (
+	"crypto/boring"
+
+	// Restrict TLS to FIPS 140 approved settings in every configuration.
+	_ "crypto/tls/fipsonly"
+)
+
+// FIPSModule reports whether cryptography comes from BoringCrypto,
+// which is FIPS 140 validated. It is used when built with GOEXPERIMENT=boringcrypto.
+func FIPSModule() (string, bool) {
+	return "BoringCrypto", boring.Enabled()
+}
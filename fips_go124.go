@@ -0,0 +1,16 @@
+// Copyright 2023 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+//go:build go1.24
+
+package main
+
+import "crypto/fips140"
+
+// FIPSModule reports whether cryptography comes from the Go Cryptographic Module,
+// which is FIPS 140-3 validated. It is used when built with GOFIPS140 set, or
+// when run with GODEBUG=fips140=on.
+func FIPSModule() (string, bool) {
+	return "Go Cryptographic Module", fips140.Enabled()
+}
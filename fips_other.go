@@ -0,0 +1,13 @@
+// Copyright 2023 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+//go:build !boringcrypto && !go1.24
+
+package main
+
+// FIPSModule reports that cryptography doesn't come from a FIPS 140 validated
+// module. Build with GOEXPERIMENT=boringcrypto for one.
+func FIPSModule() (string, bool) {
+	return "", false
+}
@@ -0,0 +1,58 @@
+// Copyright 2023 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/cu-library/overridefromenv"
+)
+
+// FirewallRuleName is the name of the inbound firewall rule managed by allow-firewall.
+const FirewallRuleName = "almarfidintercept"
+
+// ErrFirewallUnsupported is returned when managing firewall rules isn't supported on this platform.
+var ErrFirewallUnsupported = errors.New("managing firewall rules is only supported on Windows")
+
+// runFirewallCommand creates, or with -remove removes, the inbound firewall rule
+// which allows connections to the port the proxy binds on.
+func runFirewallCommand(args []string, stdout io.Writer) error {
+	fs := flag.NewFlagSet("allow-firewall", flag.ContinueOnError)
+	address := fs.String("address", DefaultAddress, "Address the proxy binds on.")
+	remove := fs.Bool("remove", false, "Remove the rule instead of creating it.")
+	err := fs.Parse(args)
+	if err != nil {
+		return fmt.Errorf("%w, %v", ErrUsage, err)
+	}
+	if fs.NArg() != 0 {
+		return fmt.Errorf("%w, allow-firewall takes no arguments", ErrUsage)
+	}
+	err = overridefromenv.Override(fs, EnvPrefix)
+	if err != nil {
+		return err
+	}
+	if *remove {
+		err = removeFirewallRule(FirewallRuleName)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(stdout, "Removed firewall rule %q.\n", FirewallRuleName)
+		return nil
+	}
+	host, port, err := net.SplitHostPort(*address)
+	if err != nil {
+		return fmt.Errorf("%w, bad address %q: %v", ErrUsage, *address, err)
+	}
+	err = addFirewallRule(FirewallRuleName, host, port)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "Added firewall rule %q allowing inbound TCP connections to %v.\n", FirewallRuleName, *address)
+	return nil
+}
@@ -0,0 +1,17 @@
+// Copyright 2023 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+//go:build !windows
+
+package main
+
+// addFirewallRule isn't supported outside Windows.
+func addFirewallRule(_, _, _ string) error {
+	return ErrFirewallUnsupported
+}
+
+// removeFirewallRule isn't supported outside Windows.
+func removeFirewallRule(_ string) error {
+	return ErrFirewallUnsupported
+}
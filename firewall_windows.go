@@ -0,0 +1,58 @@
+// Copyright 2023 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+//go:build windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// addFirewallRule replaces the named inbound rule with one allowing TCP connections
+// to this executable on the given port. If host is set, only connections to that
+// local address are allowed. The rule is managed through netsh advfirewall, which
+// needs an elevated prompt.
+func addFirewallRule(name, host, port string) error {
+	program, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("unable to find executable: %w", err)
+	}
+	localIP := "any"
+	if host != "" {
+		localIP = host
+	}
+	if host == "localhost" {
+		localIP = "127.0.0.1,::1"
+	}
+	// Remove any existing rule first, so running the command twice doesn't add duplicates.
+	_ = removeFirewallRule(name)
+	return netsh("advfirewall", "firewall", "add", "rule",
+		"name="+name,
+		"dir=in",
+		"action=allow",
+		"protocol=TCP",
+		"localport="+port,
+		"localip="+localIP,
+		"program="+program,
+		"profile=any",
+		"enable=yes")
+}
+
+// removeFirewallRule removes the named inbound rule.
+func removeFirewallRule(name string) error {
+	return netsh("advfirewall", "firewall", "delete", "rule", "name="+name, "dir=in")
+}
+
+// netsh runs netsh, including its output in any error.
+func netsh(args ...string) error {
+	output, err := exec.Command("netsh", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("netsh %v failed, %w: %v", args[0], err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
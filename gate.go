@@ -0,0 +1,101 @@
+// Copyright 2023 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	// GateAttempts is how many times we try to deliver a result to the security gate system.
+	GateAttempts = 3
+
+	// GateRetryDelay is how long we wait before the first retry. It doubles after each attempt.
+	GateRetryDelay = 1 * time.Second
+)
+
+// GateResult is the payload sent to the security gate management system
+// after an item is armed or disarmed at this station.
+type GateResult struct {
+	Station string    `json:"station"`
+	Barcode string    `json:"barcode,omitempty"`
+	Action  string    `json:"action,omitempty"`
+	Success bool      `json:"success"`
+	Detail  string    `json:"detail,omitempty"`
+	Time    time.Time `json:"time"`
+}
+
+// GateForwarder forwards arm and disarm results to a security gate
+// management system, so the gates know which items may leave the building.
+type GateForwarder struct {
+	URL     *url.URL
+	Token   string
+	Station string
+
+	client *http.Client
+}
+
+// NewGateForwarder parses the gate system URL and returns a GateForwarder.
+// The station name identifies this workstation to the gate system.
+func NewGateForwarder(api, token, station string) (*GateForwarder, error) {
+	apiURL, err := url.Parse(api)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse security gate address: %w", err)
+	}
+	if apiURL.Scheme != "http" && apiURL.Scheme != "https" {
+		return nil, fmt.Errorf("security gate address %v: %w", api, ErrNotHTTP)
+	}
+	return &GateForwarder{
+		URL:     apiURL,
+		Token:   token,
+		Station: station,
+		client:  &http.Client{Timeout: WebhookTimeout},
+	}, nil
+}
+
+// Run forwards security events until the channel is closed.
+// Deliveries are retried with backoff, since a missed disarm
+// means a patron sets off the gate on their way out.
+func (g *GateForwarder) Run(events <-chan Event) {
+	for e := range events {
+		result := GateResult{
+			Station: g.Station,
+			Barcode: e.Barcode,
+			Detail:  e.Detail,
+			Time:    e.Time,
+		}
+		switch e.Type {
+		case EventSecurityChange:
+			result.Success = true
+			result.Action = "disarm"
+			if e.Secure {
+				result.Action = "arm"
+			}
+		case EventSecurityFailure:
+			result.Success = false
+		case EventTagAppear, EventTagDisappear, EventBatchComplete, EventUpstreamAlert, EventUpstreamRecovered, EventUpstreamWedged:
+			continue
+		}
+
+		delay := GateRetryDelay
+		for attempt := 1; ; attempt++ {
+			err := postJSON(g.client, g.URL.String(), g.Token, result)
+			if err == nil {
+				break
+			}
+			if attempt == GateAttempts {
+				slog.Error("Unable to forward result to security gate system, giving up.",
+					"type", e.Type, "barcode", e.Barcode, "gate", g.URL.Host, "error", err)
+				break
+			}
+			time.Sleep(delay)
+			delay *= 2
+		}
+	}
+}
@@ -0,0 +1,217 @@
+// Copyright 2023 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"time"
+)
+
+// GELFChunkSize is the largest UDP datagram payload we send, including the chunk header.
+const GELFChunkSize = 8192
+
+// GELFMaxChunks is the most chunks a GELF message can be split into.
+const GELFMaxChunks = 128
+
+// gelfChunkHeader is the size of a chunk's header: magic bytes, message ID, sequence number, and count.
+const gelfChunkHeader = 12
+
+// ErrBadGELFAddress is returned when a GELF address isn't udp://, tcp://, or tls:// with a host and port.
+var ErrBadGELFAddress = errors.New("GELF address must look like udp://host:port, tcp://host:port, or tls://host:port")
+
+// ErrGELFMessageTooBig is returned when a message needs more than GELFMaxChunks chunks.
+var ErrGELFMessageTooBig = errors.New("GELF message too big")
+
+// GELFHandler is a slog.Handler which sends records to Graylog as GELF messages,
+// over UDP, TCP, or TCP with TLS. Messages are sent in the background, so a slow or
+// unreachable Graylog never holds up the proxy. If too many are waiting, new ones are
+// dropped. Fatal messages are sent before returning, since the program exits after.
+type GELFHandler struct {
+	level  slog.Leveler
+	host   string
+	sender *logSender
+	prefix string         // The prefix for field names, from WithGroup.
+	fields map[string]any // The fields from WithAttrs.
+}
+
+// NewGELFHandler returns a GELFHandler sending to an address like udp://graylog:12201.
+// If caFile is set, the certificates in it are trusted for tls:// addresses
+// instead of the system's. With fips, TLS is restricted to FIPS 140 approved algorithms.
+func NewGELFHandler(address, caFile string, fips bool, level slog.Leveler) (*GELFHandler, error) {
+	u, err := url.Parse(address)
+	if err != nil || u.Host == "" || u.Port() == "" {
+		return nil, fmt.Errorf("%w, not %q", ErrBadGELFAddress, address)
+	}
+	if u.Scheme != "udp" && u.Scheme != "tcp" && u.Scheme != "tls" {
+		return nil, fmt.Errorf("%w, not %q", ErrBadGELFAddress, address)
+	}
+	sender, err := newLogSender("Graylog", u, caFile, fips)
+	if err != nil {
+		return nil, err
+	}
+	sender.writeDatagram = writeGELFChunks
+	// Over TCP, messages are uncompressed and end with a null byte.
+	sender.frame = func(message []byte) []byte { return append(message, 0) }
+	go sender.run()
+	return &GELFHandler{level: level, host: hostname(), sender: sender}, nil
+}
+
+// Enabled reports whether messages at level are sent.
+func (h *GELFHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+// Handle queues a record to be sent.
+func (h *GELFHandler) Handle(_ context.Context, r slog.Record) error {
+	message := map[string]any{
+		"version":       "1.1",
+		"host":          h.host,
+		"short_message": r.Message,
+		"level":         gelfLevel(r.Level),
+	}
+	if !r.Time.IsZero() {
+		message["timestamp"] = float64(r.Time.UnixMilli()) / 1000
+	}
+	for key, value := range h.fields {
+		message[key] = value
+	}
+	r.Attrs(func(a slog.Attr) bool {
+		addGELFField(message, h.prefix, a)
+		return true
+	})
+	encoded, err := json.Marshal(message)
+	if err != nil {
+		return fmt.Errorf("unable to encode GELF message: %w", err)
+	}
+	if r.Level >= LevelFatal {
+		return h.sender.send(encoded)
+	}
+	h.sender.enqueue(encoded)
+	return nil
+}
+
+// WithAttrs returns a handler which adds attrs to every message.
+func (h *GELFHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	h2 := *h
+	h2.fields = make(map[string]any, len(h.fields)+len(attrs))
+	for key, value := range h.fields {
+		h2.fields[key] = value
+	}
+	for _, a := range attrs {
+		addGELFField(h2.fields, h.prefix, a)
+	}
+	return &h2
+}
+
+// WithGroup returns a handler which prefixes field names with the group name.
+func (h *GELFHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	h2 := *h
+	h2.prefix += name + "."
+	return &h2
+}
+
+// Close sends the queued messages, waiting up to LogSendTimeout, then closes the connection.
+func (h *GELFHandler) Close() {
+	if h == nil {
+		return
+	}
+	h.sender.close()
+}
+
+// addGELFField adds an attribute to a message as an additional field, flattening
+// groups into dotted names. Additional field names start with an underscore.
+func addGELFField(message map[string]any, prefix string, a slog.Attr) {
+	a.Value = a.Value.Resolve()
+	if a.Equal(slog.Attr{}) {
+		return
+	}
+	if a.Value.Kind() == slog.KindGroup {
+		if a.Key != "" {
+			prefix += a.Key + "."
+		}
+		for _, ga := range a.Value.Group() {
+			addGELFField(message, prefix, ga)
+		}
+		return
+	}
+	key := "_" + prefix + a.Key
+	// _id is reserved by Graylog.
+	if key == "_id" {
+		key = "_id_"
+	}
+	switch a.Value.Kind() {
+	case slog.KindInt64, slog.KindUint64, slog.KindFloat64, slog.KindBool:
+		message[key] = a.Value.Any()
+	case slog.KindTime:
+		message[key] = a.Value.Time().Format(time.RFC3339Nano)
+	default:
+		message[key] = a.Value.String()
+	}
+}
+
+// gelfLevel returns the syslog severity GELF uses for a level.
+func gelfLevel(level slog.Level) int {
+	switch {
+	case level >= LevelFatal:
+		return 2 // Critical.
+	case level >= slog.LevelError:
+		return 3 // Error.
+	case level >= slog.LevelWarn:
+		return 4 // Warning.
+	case level >= slog.LevelInfo:
+		return 6 // Informational.
+	default:
+		return 7 // Debug.
+	}
+}
+
+// writeGELFChunks gzips a message and writes it as one datagram,
+// or as several chunks if it doesn't fit in one.
+func writeGELFChunks(conn net.Conn, message []byte) error {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(message)
+	zw.Close()
+	payload := buf.Bytes()
+	if len(payload) <= GELFChunkSize {
+		_, err := conn.Write(payload)
+		return err
+	}
+	size := GELFChunkSize - gelfChunkHeader
+	count := (len(payload) + size - 1) / size
+	if count > GELFMaxChunks {
+		return fmt.Errorf("%w, %v bytes compressed", ErrGELFMessageTooBig, len(payload))
+	}
+	id := make([]byte, 8)
+	_, err := rand.Read(id)
+	if err != nil {
+		return fmt.Errorf("unable to make GELF message ID: %w", err)
+	}
+	for i := 0; i < count; i++ {
+		chunk := payload[i*size : min(len(payload), (i+1)*size)]
+		datagram := make([]byte, 0, gelfChunkHeader+len(chunk))
+		datagram = append(datagram, 0x1e, 0x0f)
+		datagram = append(datagram, id...)
+		datagram = append(datagram, byte(i), byte(count))
+		datagram = append(datagram, chunk...)
+		_, err = conn.Write(datagram)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,240 @@
+// Copyright 2023 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestGELFLevel(t *testing.T) {
+	tests := []struct {
+		level slog.Level
+		want  int
+	}{
+		{slog.LevelDebug, 7},
+		{slog.LevelInfo, 6},
+		{slog.LevelInfo + 1, 6},
+		{slog.LevelWarn, 4},
+		{slog.LevelError, 3},
+		{LevelFatal, 2},
+	}
+	for _, tt := range tests {
+		if got := gelfLevel(tt.level); got != tt.want {
+			t.Errorf("gelfLevel(%v) = %v, want %v", tt.level, got, tt.want)
+		}
+	}
+}
+
+func TestAddGELFField(t *testing.T) {
+	when := time.Date(2023, 9, 1, 12, 30, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		prefix string
+		attr   slog.Attr
+		want   map[string]any
+	}{
+		{"string", "", slog.String("operation", "getItems"), map[string]any{"_operation": "getItems"}},
+		{"int", "", slog.Int("status", 200), map[string]any{"_status": int64(200)}},
+		{"bool", "", slog.Bool("secure", true), map[string]any{"_secure": true}},
+		{"duration", "", slog.Duration("took", time.Second), map[string]any{"_took": "1s"}},
+		{"time", "", slog.Time("at", when), map[string]any{"_at": "2023-09-01T12:30:00Z"}},
+		{"reserved id", "", slog.Int("id", 1), map[string]any{"_id_": int64(1)}},
+		{"prefix", "request.", slog.String("id", "abc"), map[string]any{"_request.id": "abc"}},
+		{"group", "", slog.Group("upstream", slog.String("host", "localhost"), slog.Int("port", 21645)),
+			map[string]any{"_upstream.host": "localhost", "_upstream.port": int64(21645)}},
+		{"empty", "", slog.Attr{}, map[string]any{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := map[string]any{}
+			addGELFField(got, tt.prefix, tt.attr)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// datagramConn is a net.Conn which records each write as a datagram.
+type datagramConn struct {
+	net.Conn
+	datagrams [][]byte
+}
+
+func (c *datagramConn) Write(b []byte) (int, error) {
+	c.datagrams = append(c.datagrams, append([]byte{}, b...))
+	return len(b), nil
+}
+
+// gunzip decompresses a GELF payload.
+func gunzip(t *testing.T, b []byte) []byte {
+	t.Helper()
+	zr, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	message, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return message
+}
+
+// randomBytes returns n random bytes, which gzip can't compress.
+func randomBytes(t *testing.T, n int) []byte {
+	t.Helper()
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestWriteGELFChunks(t *testing.T) {
+	tests := []struct {
+		name    string
+		message []byte
+		chunks  int
+		wantErr error
+	}{
+		{"one datagram", []byte(`{"version":"1.1","short_message":"hello"}`), 0, nil},
+		{"compressible", bytes.Repeat([]byte("a"), 4*GELFChunkSize), 0, nil},
+		{"chunked", randomBytes(t, 3*GELFChunkSize), 4, nil},
+		{"too many chunks", randomBytes(t, GELFMaxChunks*GELFChunkSize), 0, ErrGELFMessageTooBig},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := &datagramConn{}
+			err := writeGELFChunks(conn, tt.message)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if tt.chunks == 0 {
+				if len(conn.datagrams) != 1 {
+					t.Fatalf("got %v datagrams, want 1", len(conn.datagrams))
+				}
+				if got := gunzip(t, conn.datagrams[0]); !bytes.Equal(got, tt.message) {
+					t.Errorf("got message %.40q, want %.40q", got, tt.message)
+				}
+				return
+			}
+			if len(conn.datagrams) != tt.chunks {
+				t.Fatalf("got %v chunks, want %v", len(conn.datagrams), tt.chunks)
+			}
+			var payload []byte
+			id := conn.datagrams[0][2:10]
+			for i, chunk := range conn.datagrams {
+				if len(chunk) > GELFChunkSize {
+					t.Errorf("chunk %v is %v bytes, over %v", i, len(chunk), GELFChunkSize)
+				}
+				// Magic bytes, message ID, sequence number, and sequence count.
+				header := append(append([]byte{0x1e, 0x0f}, id...), byte(i), byte(tt.chunks))
+				if !bytes.Equal(chunk[:gelfChunkHeader], header) {
+					t.Errorf("chunk %v header is % x, want % x", i, chunk[:gelfChunkHeader], header)
+				}
+				payload = append(payload, chunk[gelfChunkHeader:]...)
+			}
+			if got := gunzip(t, payload); !bytes.Equal(got, tt.message) {
+				t.Error("reassembled chunks don't match the message")
+			}
+		})
+	}
+}
+
+func TestGELFHandler(t *testing.T) {
+	tests := []struct {
+		network string
+		// read returns the next message the listener received.
+		read func(t *testing.T, address string) (string, func() []byte)
+	}{
+		{"udp", func(t *testing.T, address string) (string, func() []byte) {
+			conn, err := net.ListenPacket("udp", address)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { conn.Close() })
+			return conn.LocalAddr().String(), func() []byte {
+				conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+				buf := make([]byte, GELFChunkSize)
+				n, _, err := conn.ReadFrom(buf)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return gunzip(t, buf[:n])
+			}
+		}},
+		{"tcp", func(t *testing.T, address string) (string, func() []byte) {
+			listener, err := net.Listen("tcp", address)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { listener.Close() })
+			return listener.Addr().String(), func() []byte {
+				conn, err := listener.Accept()
+				if err != nil {
+					t.Fatal(err)
+				}
+				t.Cleanup(func() { conn.Close() })
+				conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+				// Over TCP, each message ends with a null byte.
+				message, err := bufio.NewReader(conn).ReadBytes(0)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return bytes.TrimSuffix(message, []byte{0})
+			}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.network, func(t *testing.T) {
+			address, read := tt.read(t, "127.0.0.1:0")
+			h, err := NewGELFHandler(tt.network+"://"+address, "", false, slog.LevelInfo)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer h.Close()
+			when := time.Date(2023, 9, 1, 12, 30, 0, 500_000_000, time.UTC)
+			r := slog.NewRecord(when, slog.LevelWarn, "Reader service slow.", 0)
+			r.AddAttrs(slog.String("operation", "getItems"))
+			err = h.WithAttrs([]slog.Attr{slog.Int("id", 7)}).Handle(context.Background(), r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got map[string]any
+			err = json.Unmarshal(read(), &got)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := map[string]any{
+				"version":       "1.1",
+				"host":          h.host,
+				"short_message": "Reader service slow.",
+				"level":         float64(4),
+				"timestamp":     1693571400.5,
+				"_operation":    "getItems",
+				"_id_":          float64(7),
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got %v, want %v", got, want)
+			}
+		})
+	}
+}
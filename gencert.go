@@ -0,0 +1,119 @@
+// Copyright 2023 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"time"
+
+	"github.com/cu-library/overridefromenv"
+)
+
+const (
+	// DefaultCertFile is the default file gencert writes the certificate to.
+	DefaultCertFile = "localhost.pem"
+
+	// DefaultKeyFile is the default file gencert writes the private key to.
+	DefaultKeyFile = "localhost-key.pem"
+
+	// DefaultCertValidity is how long a generated certificate is valid.
+	// Browsers reject certificates valid for longer than 825 days.
+	DefaultCertValidity = 825 * 24 * time.Hour
+)
+
+// ErrTrustStoreUnsupported is returned when installing a certificate into the trust store isn't supported on this platform.
+var ErrTrustStoreUnsupported = errors.New("installing certificates into the trust store is only supported on Windows and macOS")
+
+// runGencertCommand writes a self-signed certificate and key for localhost,
+// and with -install, adds the certificate to the user's trust store.
+func runGencertCommand(args []string, stdout io.Writer) error {
+	fs := flag.NewFlagSet("gencert", flag.ContinueOnError)
+	certFile := fs.String("cert", DefaultCertFile, "File the PEM certificate is written to.")
+	keyFile := fs.String("key", DefaultKeyFile, "File the PEM private key is written to.")
+	validity := fs.Duration("validity", DefaultCertValidity, "How long the certificate is valid.")
+	install := fs.Bool("install", false, "Add the certificate to the current user's trust store, so browsers trust it.")
+	err := fs.Parse(args)
+	if err != nil {
+		return fmt.Errorf("%w, %v", ErrUsage, err)
+	}
+	if fs.NArg() != 0 {
+		return fmt.Errorf("%w, gencert takes no arguments", ErrUsage)
+	}
+	err = overridefromenv.Override(fs, EnvPrefix)
+	if err != nil {
+		return err
+	}
+	err = writeLocalhostCert(*certFile, *keyFile, *validity)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "Wrote certificate %v and key %v, for localhost, 127.0.0.1, and ::1.\n", *certFile, *keyFile)
+	if *install {
+		err = installTrustedCert(*certFile)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(stdout, "Added %v to the trust store.\n", *certFile)
+	}
+	fmt.Fprintf(stdout, "Serve HTTPS with -tls-cert %v -tls-key %v.\n", *certFile, *keyFile)
+	return nil
+}
+
+// writeLocalhostCert generates a self-signed certificate for localhost, 127.0.0.1,
+// and ::1, writing it and its private key to PEM files.
+func writeLocalhostCert(certFile, keyFile string, validity time.Duration) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return fmt.Errorf("unable to generate key: %w", err)
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return fmt.Errorf("unable to generate serial number: %w", err)
+	}
+	notBefore := time.Now().Add(-time.Hour)
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			CommonName:   "localhost",
+			Organization: []string{"almarfidintercept on " + hostname()},
+		},
+		NotBefore:             notBefore,
+		NotAfter:              notBefore.Add(validity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return fmt.Errorf("unable to create certificate: %w", err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return fmt.Errorf("unable to encode key: %w", err)
+	}
+	err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0o600)
+	if err != nil {
+		return fmt.Errorf("unable to write key: %w", err)
+	}
+	err = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644)
+	if err != nil {
+		return fmt.Errorf("unable to write certificate: %w", err)
+	}
+	return nil
+}
@@ -2,4 +2,16 @@ module github.com/cu-library/almarfidintercept
 
 go 1.21.1
 
-require github.com/cu-library/overridefromenv v1.2.0 // indirect
+require (
+	fyne.io/systray v1.11.0
+	github.com/BurntSushi/toml v1.5.0
+	github.com/cu-library/overridefromenv v1.2.0
+	golang.org/x/crypto v0.31.0
+	golang.org/x/sys v0.28.0
+)
+
+require (
+	github.com/godbus/dbus/v5 v5.1.0 // indirect
+	golang.org/x/net v0.21.0 // indirect
+	golang.org/x/text v0.21.0 // indirect
+)
@@ -0,0 +1,234 @@
+// Copyright 2023 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	// HealthCheckTimeout is how long the reader service has to answer a health check.
+	HealthCheckTimeout = 2 * time.Second
+
+	// RequireUpstreamWait is how long -require-upstream waits for the reader
+	// service to answer at startup, since it may be starting too.
+	RequireUpstreamWait = 15 * time.Second
+)
+
+// The statuses reported by health checks.
+const (
+	HealthOK   = "ok"
+	HealthDown = "down"
+)
+
+// Health answers health checks at /healthz, /livez, and /readyz.
+//
+// At /healthz, the proxy reports itself, and sends a quick request to the
+// reader service, so monitoring, and the Alma plugin, can tell the proxy not
+// running, when there's no answer at all, from the vendor's RFID software not
+// running, when the upstream is down. If the reader service answers at all,
+// even with an error status, it is running. The response is 200 when both are
+// up, and 503 when the upstream is down.
+//
+// At /livez, the response is always 200 while the process is running, so a
+// supervisor only restarts the proxy when it stops answering. At /readyz, the
+// response is 200 when the proxy can serve requests: the reader service
+// answers, the TLS certificate is loaded and hasn't expired, and the server
+// isn't shutting down. Otherwise it is 503, so traffic and monitoring can wait
+// out startup and shutdown.
+type Health struct {
+	Client  *http.Client
+	Station string
+
+	// Upstream returns the reader service to check.
+	Upstream func() string
+
+	// TLS returns an error if the certificate served isn't usable. It may be
+	// nil, when HTTPS isn't served from certificate files.
+	TLS func() error
+
+	// Draining reports whether the server is shutting down. It may be nil.
+	Draining func() bool
+
+	// Environments says whether requests are proxied to a sandbox, so the
+	// tray icon can tell staff. It may be nil, for production.
+	Environments Environments
+
+	started time.Time
+}
+
+// HealthReport is the JSON response to a health check.
+type HealthReport struct {
+	Status   string         `json:"status"`
+	Proxy    ProxyHealth    `json:"proxy"`
+	Upstream UpstreamHealth `json:"upstream"`
+}
+
+// ProxyHealth is the proxy's part of a HealthReport.
+type ProxyHealth struct {
+	Status  string `json:"status"`
+	Version string `json:"version"`
+	Station string `json:"station"`
+	Uptime  string `json:"uptime"`
+
+	// Environment is the environment of the default reader service,
+	// production or sandbox.
+	Environment string `json:"environment"`
+
+	// SandboxOrigins are the other origins proxied to a sandbox.
+	SandboxOrigins []string `json:"sandbox_origins,omitempty"`
+}
+
+// UpstreamHealth is the reader service's part of a HealthReport.
+type UpstreamHealth struct {
+	Status     string `json:"status"`
+	Address    string `json:"address"`
+	HTTPStatus int    `json:"http_status,omitempty"`
+	LatencyMS  int64  `json:"latency_ms"`
+	Error      string `json:"error,omitempty"`
+}
+
+// ReadinessReport is the JSON response to a readiness check. Each check is
+// ok, or says what's wrong.
+type ReadinessReport struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
+}
+
+// NewHealth returns a Health checking the upstream with client.
+func NewHealth(client *http.Client, upstream func() string, station string) *Health {
+	return &Health{
+		Client:   client,
+		Station:  station,
+		Upstream: upstream,
+		started:  time.Now(),
+	}
+}
+
+// ServeHTTP checks the reader service, and reports the result as JSON.
+func (h *Health) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+	environment, sandboxOrigins := environmentsOf(h.Environments)
+	report := HealthReport{
+		Status: HealthOK,
+		Proxy: ProxyHealth{
+			Status:         HealthOK,
+			Version:        version,
+			Station:        h.Station,
+			Uptime:         time.Since(h.started).Round(time.Second).String(),
+			Environment:    environment,
+			SandboxOrigins: sandboxOrigins,
+		},
+		Upstream: h.CheckUpstream(r.Context()),
+	}
+	status := http.StatusOK
+	if report.Upstream.Status != HealthOK {
+		report.Status = HealthDown
+		status = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(report)
+}
+
+// ServeLive answers liveness checks, with the version, so the doctor command
+// can tell the proxy is what's using its port.
+func (h *Health) ServeLive(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set(VersionHeader, version)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	fmt.Fprintln(w, HealthOK)
+}
+
+// ServeReady answers readiness checks, reporting each check as JSON.
+func (h *Health) ServeReady(w http.ResponseWriter, r *http.Request) {
+	report := ReadinessReport{Status: HealthOK, Checks: map[string]string{}}
+	fail := func(check, problem string) {
+		report.Status = HealthDown
+		report.Checks[check] = problem
+	}
+	report.Checks["draining"] = HealthOK
+	if h.Draining != nil && h.Draining() {
+		fail("draining", "shutting down")
+	}
+	if h.TLS != nil {
+		report.Checks["tls"] = HealthOK
+		if err := h.TLS(); err != nil {
+			fail("tls", err.Error())
+		}
+	}
+	report.Checks["upstream"] = HealthOK
+	if upstream := h.CheckUpstream(r.Context()); upstream.Status != HealthOK {
+		fail("upstream", upstream.Error)
+	}
+	status := http.StatusOK
+	if report.Status != HealthOK {
+		status = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(report)
+}
+
+// CheckUpstream sends a request to the reader service, and reports whether it answered.
+func (h *Health) CheckUpstream(ctx context.Context) UpstreamHealth {
+	return h.checkAddress(ctx, h.Upstream())
+}
+
+// ProbeUpstreams checks each reader service answers, trying again every
+// second until wait has passed, for -require-upstream. It returns the first
+// which doesn't answer, with why, or nil if they all do.
+func (h *Health) ProbeUpstreams(ctx context.Context, upstreams []string, wait time.Duration) *UpstreamHealth {
+	deadline := time.Now().Add(wait)
+	for _, upstream := range upstreams {
+		for {
+			health := h.checkAddress(ctx, upstream)
+			if health.Status == HealthOK {
+				break
+			}
+			if time.Now().After(deadline) || ctx.Err() != nil {
+				return &health
+			}
+			select {
+			case <-ctx.Done():
+			case <-time.After(time.Second):
+			}
+		}
+	}
+	return nil
+}
+
+// checkAddress sends a request to a reader service, and reports whether it answered.
+func (h *Health) checkAddress(ctx context.Context, address string) UpstreamHealth {
+	health := UpstreamHealth{Status: HealthDown, Address: address}
+	ctx, cancel := context.WithTimeout(ctx, HealthCheckTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, health.Address, nil)
+	if err != nil {
+		health.Error = err.Error()
+		return health
+	}
+	start := time.Now()
+	resp, err := h.Client.Do(req)
+	health.LatencyMS = time.Since(start).Milliseconds()
+	if err != nil {
+		health.Error = err.Error()
+		return health
+	}
+	resp.Body.Close()
+	health.Status = HealthOK
+	health.HTTPStatus = resp.StatusCode
+	return health
+}
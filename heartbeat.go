@@ -0,0 +1,103 @@
+// Copyright 2023 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// DefaultHeartbeatPath is the path of the default heartbeat request,
+// the same tag poll the client helper sends.
+const DefaultHeartbeatPath = "/getItems"
+
+// ErrHeartbeat is returned when the reader service answers a heartbeat with an error.
+var ErrHeartbeat = errors.New("heartbeat failed")
+
+// Heartbeat sends a request to each reader service whenever it has been idle for
+// Interval, since some vendor software drops its reader session when idle, and
+// the first request after it does is slow or fails. Unlike the Warmer, which only
+// keeps the connection open, it sends a real operation. It waits its turn in the
+// Queue, behind any requests from staff.
+type Heartbeat struct {
+	Client     *http.Client
+	Upstreams  func() []string
+	Path       string
+	SOAPAction string
+	Interval   time.Duration
+	Queue      *UpstreamQueue
+
+	// LastRequest returns when a request was last proxied to the reader service.
+	LastRequest func() time.Time
+}
+
+// Run sends heartbeats until the context is cancelled.
+func (h *Heartbeat) Run(ctx context.Context) {
+	ticker := time.NewTicker(h.Interval)
+	defer ticker.Stop()
+	failing := make(map[string]bool)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if time.Since(h.LastRequest()) < h.Interval {
+			continue
+		}
+		for _, upstream := range h.Upstreams() {
+			err := h.beat(ctx, upstream)
+			if ctx.Err() != nil {
+				return
+			}
+			switch {
+			case err != nil && !failing[upstream]:
+				slog.Warn("Heartbeat to the reader service failed.", "upstream", upstream, "error", err)
+			case err == nil && failing[upstream]:
+				slog.Info("Heartbeat to the reader service succeeded again.", "upstream", upstream)
+			case err == nil:
+				slog.Debug("Heartbeat sent.", "upstream", upstream)
+			}
+			failing[upstream] = err != nil
+		}
+	}
+}
+
+// beat sends one heartbeat request.
+func (h *Heartbeat) beat(ctx context.Context, upstream string) error {
+	u, err := url.Parse(upstream)
+	if err != nil {
+		return err
+	}
+	u.Path = h.Path
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	if h.SOAPAction != "" {
+		req.Header.Set("SOAPAction", h.SOAPAction)
+	}
+	release, err := h.Queue.Acquire(ctx, upstream, PriorityBackground)
+	if err != nil {
+		return err
+	}
+	defer release()
+	resp, err := h.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("%w, reader service responded %v", ErrHeartbeat, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+// Copyright 2023 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// IdempotencyKeyHeader is the request header which makes a write operation safe to retry.
+	IdempotencyKeyHeader = "Idempotency-Key"
+
+	// IdempotentReplayedHeader is set on responses replayed from the cache.
+	IdempotentReplayedHeader = "Idempotent-Replayed"
+
+	// DefaultIdempotencyTTL is the default time the outcome of a write operation is kept.
+	DefaultIdempotencyTTL = 10 * time.Minute
+
+	// IdempotencyMaxEntries is the most outcomes kept at once.
+	IdempotencyMaxEntries = 1000
+)
+
+// IdempotencyCache makes write operations, like setting an item's security bit,
+// safe for the browser to retry. The first request with an Idempotency-Key header
+// is proxied, and its response is kept for TTL. Retries with the same key, from
+// the same origin, get that response back instead of being proxied again, so a
+// retry after a flaky response can't flip an item's security state twice. A retry
+// which arrives while the first request is still in flight waits for its response.
+//
+// Responses which say to try again, like 503 when the reader service is down or
+// 429 when rate limited, aren't kept, so a retry is proxied.
+type IdempotencyCache struct {
+	TTL time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*idempotencyEntry
+}
+
+// idempotencyEntry is the outcome of one write operation.
+type idempotencyEntry struct {
+	done    chan struct{} // Closed when the response is recorded, or abandoned.
+	ok      bool          // Whether a response was recorded.
+	status  int
+	header  http.Header
+	body    []byte
+	expires time.Time
+}
+
+// NewIdempotencyCache returns an empty IdempotencyCache which keeps outcomes for ttl.
+func NewIdempotencyCache(ttl time.Duration) *IdempotencyCache {
+	return &IdempotencyCache{TTL: ttl, entries: make(map[string]*idempotencyEntry)}
+}
+
+// Middleware wraps a handler, replaying the responses to write operations
+// with an Idempotency-Key header. Other requests are passed through.
+func (c *IdempotencyCache) Middleware(next http.Handler) http.Handler {
+	if c == nil || c.TTL <= 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(IdempotencyKeyHeader)
+		operation := operationName(r.Header.Get("SOAPAction"), r.URL.Path)
+		if key == "" || r.Method == http.MethodOptions || !isWriteOperation(operation) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		key = r.Header.Get("Origin") + " " + key
+
+		for {
+			entry, owner := c.claim(key)
+			if owner {
+				c.record(key, entry, w, r, next)
+				return
+			}
+			select {
+			case <-entry.done:
+			case <-r.Context().Done():
+				return
+			}
+			if entry.ok {
+				slog.Info("Replaying response to a retried write operation.", "operation", operation, "status", entry.status)
+				entry.replay(w)
+				return
+			}
+			// The first request's response wasn't kept, so try again ourselves.
+		}
+	})
+}
+
+// claim returns the entry for a key. If there isn't one, it creates one and
+// returns owner set, and the caller must record the response.
+func (c *IdempotencyCache) claim(key string) (*idempotencyEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if entry, ok := c.entries[key]; ok && (!entry.ok || now.Before(entry.expires)) {
+		return entry, false
+	}
+	if len(c.entries) >= IdempotencyMaxEntries {
+		for k, entry := range c.entries {
+			if entry.ok && !now.Before(entry.expires) {
+				delete(c.entries, k)
+			}
+		}
+	}
+	entry := &idempotencyEntry{done: make(chan struct{})}
+	if len(c.entries) < IdempotencyMaxEntries {
+		c.entries[key] = entry
+	}
+	return entry, true
+}
+
+// record serves a request, keeping the response in the entry if it shouldn't be retried.
+func (c *IdempotencyCache) record(key string, entry *idempotencyEntry, w http.ResponseWriter, r *http.Request, next http.Handler) {
+	recorder := &bodyRecorder{responseRecorder: responseRecorder{ResponseWriter: w, status: http.StatusOK}}
+	defer func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		status := recorder.status
+		if status < 500 && status != http.StatusTooManyRequests && r.Context().Err() == nil {
+			entry.ok = true
+			entry.status = status
+			entry.header = w.Header().Clone()
+			entry.body = recorder.body.Bytes()
+			entry.expires = time.Now().Add(c.TTL)
+		} else if c.entries[key] == entry {
+			delete(c.entries, key)
+		}
+		close(entry.done)
+	}()
+	next.ServeHTTP(recorder, r)
+}
+
+// replay writes a kept response.
+func (e *idempotencyEntry) replay(w http.ResponseWriter) {
+	for name, values := range e.header {
+		w.Header()[name] = values
+	}
+	w.Header().Set(IdempotentReplayedHeader, "true")
+	w.WriteHeader(e.status)
+	w.Write(e.body)
+}
+
+// bodyRecorder records the status and body of a response.
+type bodyRecorder struct {
+	responseRecorder
+	body bytes.Buffer
+}
+
+// Write keeps a copy of the body, then writes it.
+func (r *bodyRecorder) Write(p []byte) (int, error) {
+	r.body.Write(p)
+	return r.responseRecorder.Write(p)
+}
+
+// isWriteOperation reports whether the operation changes an item, by setting
+// its security bit or writing its tag, so it must not be repeated by accident.
+func isWriteOperation(operation string) bool {
+	return isSecurityOperation(operation) || strings.Contains(strings.ToLower(operation), "write")
+}
@@ -0,0 +1,110 @@
+// Copyright 2023 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestIdempotencyCache(t *testing.T) {
+	const alma = "https://example.alma.exlibrisgroup.com"
+	tests := []struct {
+		name        string
+		soapAction  string
+		keys        [2]string
+		origins     [2]string
+		status      int
+		wantCalls   int32
+		wantReplays bool
+	}{
+		{"retried write", "urn:rfid#writeTags", [2]string{"a", "a"}, [2]string{alma, alma}, http.StatusOK, 1, true},
+		{"retried security change", "urn:rfid#setSecurity", [2]string{"a", "a"}, [2]string{alma, alma}, http.StatusOK, 1, true},
+		{"client error kept", "urn:rfid#writeTags", [2]string{"a", "a"}, [2]string{alma, alma}, http.StatusBadRequest, 1, true},
+		{"other key", "urn:rfid#writeTags", [2]string{"a", "b"}, [2]string{alma, alma}, http.StatusOK, 2, false},
+		{"other origin", "urn:rfid#writeTags", [2]string{"a", "a"}, [2]string{alma, "https://other.example.com"}, http.StatusOK, 2, false},
+		{"no key", "urn:rfid#writeTags", [2]string{"", ""}, [2]string{alma, alma}, http.StatusOK, 2, false},
+		{"read", "urn:rfid#getItems", [2]string{"a", "a"}, [2]string{alma, alma}, http.StatusOK, 2, false},
+		{"unavailable not kept", "urn:rfid#writeTags", [2]string{"a", "a"}, [2]string{alma, alma}, http.StatusServiceUnavailable, 2, false},
+		{"rate limited not kept", "urn:rfid#writeTags", [2]string{"a", "a"}, [2]string{alma, alma}, http.StatusTooManyRequests, 2, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls atomic.Int32
+			h := NewIdempotencyCache(time.Minute).Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/xml")
+				w.WriteHeader(tt.status)
+				fmt.Fprintf(w, "call %v", calls.Add(1))
+			}))
+			var bodies [2]string
+			for i := range bodies {
+				r := httptest.NewRequest(http.MethodPost, "/", nil)
+				r.Header.Set("SOAPAction", tt.soapAction)
+				r.Header.Set("Origin", tt.origins[i])
+				if tt.keys[i] != "" {
+					r.Header.Set(IdempotencyKeyHeader, tt.keys[i])
+				}
+				w := httptest.NewRecorder()
+				h.ServeHTTP(w, r)
+				if w.Code != tt.status {
+					t.Errorf("request %v got status %v, want %v", i, w.Code, tt.status)
+				}
+				if replayed := w.Header().Get(IdempotentReplayedHeader) == "true"; replayed != (i == 1 && tt.wantReplays) {
+					t.Errorf("request %v replayed %v", i, replayed)
+				}
+				if i == 1 && tt.wantReplays && w.Header().Get("Content-Type") != "text/xml" {
+					t.Errorf("replayed without the headers, got %v", w.Header())
+				}
+				bodies[i] = w.Body.String()
+			}
+			if got := calls.Load(); got != tt.wantCalls {
+				t.Errorf("got %v calls, want %v", got, tt.wantCalls)
+			}
+			if tt.wantReplays && bodies[1] != bodies[0] {
+				t.Errorf("replayed %q, want %q", bodies[1], bodies[0])
+			}
+		})
+	}
+}
+
+func TestIdempotencyCacheInFlight(t *testing.T) {
+	var calls atomic.Int32
+	arrived := make(chan struct{})
+	finish := make(chan struct{})
+	h := NewIdempotencyCache(time.Minute).Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		close(arrived)
+		<-finish
+		w.Write([]byte("written"))
+	}))
+	request := func() *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/", nil)
+		r.Header.Set("SOAPAction", "urn:rfid#writeTags")
+		r.Header.Set(IdempotencyKeyHeader, "a")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+	first := make(chan *httptest.ResponseRecorder)
+	go func() { first <- request() }()
+	<-arrived
+	// The retry waits for the first request's response, rather than writing again.
+	retry := make(chan *httptest.ResponseRecorder)
+	go func() { retry <- request() }()
+	close(finish)
+	if w := <-first; w.Body.String() != "written" {
+		t.Errorf("first got %q", w.Body.String())
+	}
+	if w := <-retry; w.Body.String() != "written" || w.Header().Get(IdempotentReplayedHeader) != "true" {
+		t.Errorf("retry got %q, %v", w.Body.String(), w.Header())
+	}
+	if got := calls.Load(); got != 1 {
+		t.Errorf("got %v calls, want 1", got)
+	}
+}
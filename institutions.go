@@ -0,0 +1,354 @@
+// Copyright 2023 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// EnvironmentProduction labels origins and upstreams used for real circulation.
+	EnvironmentProduction = "production"
+
+	// EnvironmentSandbox labels origins and upstreams used for testing.
+	EnvironmentSandbox = "sandbox"
+
+	// EnvironmentHeader is the response header which tells the browser
+	// which environment handled a request.
+	EnvironmentHeader = "X-RFID-Intercept-Environment"
+)
+
+// ErrBadEnvironment is returned when an environment label isn't production or sandbox.
+var ErrBadEnvironment = errors.New("environment must be production or sandbox")
+
+// ErrBadOrigin is returned when an origin isn't a scheme and host, like https://example.com.
+var ErrBadOrigin = errors.New("origin must be a scheme and host, like https://example.alma.exlibrisgroup.com")
+
+// InstitutionsFile is the format of the file passed to -institutions.
+// It maps each institution's Alma origin to the policies for requests from it,
+// so one file can be deployed unchanged at every member library.
+type InstitutionsFile struct {
+	Institutions map[string]Institution `json:"institutions" desc:"Policies for each institution, keyed by Alma origin, like https://ocul-crl.alma.exlibrisgroup.com."`
+}
+
+// Institution holds the policies for requests from one Alma origin.
+type Institution struct {
+	// Name is a human friendly name for the institution, used in logs.
+	Name string `json:"name" desc:"A human friendly name for the institution, used in logs."`
+
+	// Upstream is the reader service requests from this origin are proxied to.
+	// If empty, the -proxy address is used.
+	Upstream string `json:"upstream,omitempty" desc:"The reader service requests from this origin are proxied to. Defaults to the -proxy address."`
+
+	// Environment is either production or sandbox. It defaults to production.
+	Environment string `json:"environment,omitempty" desc:"Either production or sandbox. Defaults to production." enum:"production,sandbox"`
+
+	// RateLimit is the sustained number of requests per second allowed
+	// from this origin. Zero means no limit.
+	RateLimit float64 `json:"rate_limit,omitempty" desc:"Sustained requests per second allowed from this origin. Zero means no limit."`
+
+	// RateBurst is the number of requests allowed in a burst above RateLimit.
+	// It defaults to RateLimit, rounded up.
+	RateBurst int `json:"rate_burst,omitempty" desc:"Requests allowed in a burst above rate_limit. Defaults to rate_limit, rounded up."`
+
+	// AuditLog is a file which security operations from this origin are
+	// appended to, one JSON object per line. Auditing is disabled if empty.
+	AuditLog string `json:"audit_log,omitempty" desc:"File security operations from this origin are appended to as JSON lines."`
+
+	// AuditAll records every request in the audit log, not just security operations.
+	AuditAll bool `json:"audit_all,omitempty" desc:"Record every request in the audit log, not just security operations."`
+
+	origin  string
+	limiter *RateLimiter
+	audit   *AuditLog
+}
+
+// Institutions is the loaded set of institution policies, keyed by origin.
+type Institutions map[string]*Institution
+
+// LoadInstitutions reads and validates an institutions file.
+// Audit logs named in the file are opened for appending, and
+// timestamp their records in UTC if auditUTC is true.
+func LoadInstitutions(path string, auditUTC bool) (Institutions, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read institutions file: %w", err)
+	}
+	var file InstitutionsFile
+	err = json.Unmarshal(data, &file)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse institutions file %v: %w", path, err)
+	}
+
+	institutions := make(Institutions, len(file.Institutions))
+	for origin, inst := range file.Institutions {
+		inst := inst
+		err := validateOrigin(origin)
+		if err != nil {
+			institutions.Close()
+			return nil, fmt.Errorf("institution %v: %w", origin, err)
+		}
+		if inst.Upstream != "" {
+			_, err := parseUpstream(inst.Upstream)
+			if err != nil {
+				institutions.Close()
+				return nil, fmt.Errorf("institution %v: %w", origin, err)
+			}
+		}
+		if inst.Name == "" {
+			inst.Name = origin
+		}
+		if inst.Environment == "" {
+			inst.Environment = EnvironmentProduction
+		}
+		err = validateEnvironment(inst.Environment)
+		if err != nil {
+			institutions.Close()
+			return nil, fmt.Errorf("institution %v: %w", origin, err)
+		}
+		inst.origin = origin
+		if inst.RateLimit > 0 {
+			inst.limiter = NewRateLimiter(inst.RateLimit, inst.RateBurst)
+		}
+		if inst.AuditLog != "" {
+			inst.audit, err = OpenAuditLog(inst.AuditLog, auditUTC)
+			if err != nil {
+				institutions.Close()
+				return nil, fmt.Errorf("institution %v: %w", origin, err)
+			}
+		}
+		institutions[origin] = &inst
+	}
+	return institutions, nil
+}
+
+// NewProfile returns the policies for a single origin and upstream, with no
+// rate limit or auditing. It is used for the origins configured by flags.
+func NewProfile(name, origin, upstream, environment string) *Institution {
+	return &Institution{
+		Name:        name,
+		Upstream:    upstream,
+		Environment: environment,
+		origin:      origin,
+	}
+}
+
+// Lookup returns the policies for an origin, or nil if the origin isn't
+// one of the institutions.
+func (i Institutions) Lookup(origin string) *Institution {
+	return i[origin]
+}
+
+// Close closes any open audit logs.
+func (i Institutions) Close() {
+	for _, inst := range i {
+		if inst.audit != nil {
+			inst.audit.Close()
+		}
+	}
+}
+
+// TakeOver makes reloaded institutions carry on from the old ones: audit logs
+// for the same file are shared, so records from requests in flight during a
+// reload aren't lost, and rate limiters with the same limits keep their state.
+// The audit logs the institutions opened for those files are closed.
+func (i Institutions) TakeOver(old Institutions) {
+	audits := map[string]*AuditLog{}
+	for _, inst := range old {
+		if inst.audit != nil {
+			audits[inst.AuditLog] = inst.audit
+		}
+	}
+	for origin, inst := range i {
+		if audit, ok := audits[inst.AuditLog]; ok && inst.audit != nil && inst.audit != audit {
+			inst.audit.Close()
+			inst.audit = audit
+		}
+		previous := old.Lookup(origin)
+		if previous != nil && previous.limiter != nil && inst.limiter != nil &&
+			previous.RateLimit == inst.RateLimit && previous.RateBurst == inst.RateBurst {
+			inst.limiter = previous.limiter
+		}
+	}
+}
+
+// CloseUnused closes the audit logs which the next institutions didn't take over.
+func (i Institutions) CloseUnused(next Institutions) {
+	used := map[*AuditLog]bool{}
+	for _, inst := range next {
+		used[inst.audit] = true
+	}
+	for _, inst := range i {
+		if inst.audit != nil && !used[inst.audit] {
+			used[inst.audit] = true
+			inst.audit.Close()
+		}
+	}
+}
+
+// Allow reports whether a request from this institution is within its rate limit.
+func (inst *Institution) Allow() bool {
+	return inst.limiter == nil || inst.limiter.Allow()
+}
+
+// Audit records a proxied request in the institution's audit log, if it has one.
+func (inst *Institution) Audit(r *http.Request, operation string, status int) {
+	if inst.audit == nil || (!inst.AuditAll && !isSecurityOperation(operation)) {
+		return
+	}
+	inst.audit.Record(AuditRecord{
+		Time:        time.Now(),
+		Institution: inst.Name,
+		Origin:      inst.origin,
+		Client:      r.RemoteAddr,
+		Method:      r.Method,
+		Path:        r.URL.Path,
+		Operation:   operation,
+		Status:      status,
+	})
+}
+
+// Environments says which environments requests are proxied to, so the
+// health check, status page, and dashboard can warn when it's a sandbox.
+type Environments interface {
+	// Environment returns the environment of the default reader service.
+	Environment() string
+
+	// SandboxOrigins returns the other origins proxied to a sandbox.
+	SandboxOrigins() []string
+}
+
+// environmentsOf returns the environment of the default reader service, and
+// the origins proxied to a sandbox. It is production, with none, if
+// environments is nil.
+func environmentsOf(environments Environments) (string, []string) {
+	if environments == nil {
+		return EnvironmentProduction, nil
+	}
+	return environments.Environment(), environments.SandboxOrigins()
+}
+
+// validateEnvironment checks that an environment label is one we know.
+func validateEnvironment(environment string) error {
+	if environment != EnvironmentProduction && environment != EnvironmentSandbox {
+		return fmt.Errorf("%w, not %v", ErrBadEnvironment, environment)
+	}
+	return nil
+}
+
+// validateOrigin checks that an origin is a scheme and host, with nothing else.
+// Browsers never send a trailing slash in Origin, so one isn't allowed either.
+func validateOrigin(origin string) error {
+	u, err := url.Parse(origin)
+	if err != nil {
+		return fmt.Errorf("unable to parse origin: %w", err)
+	}
+	if u.Scheme == "" || u.Host == "" || u.Path != "" || u.RawQuery != "" {
+		return ErrBadOrigin
+	}
+	return nil
+}
+
+// RateLimiter is a token bucket. Tokens are added at a steady rate,
+// up to the bucket size, and each request takes one.
+type RateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter returns a full RateLimiter allowing rate requests per second,
+// with bursts of up to burst requests.
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	if burst <= 0 {
+		burst = int(rate)
+		if float64(burst) < rate {
+			burst++
+		}
+	}
+	return &RateLimiter{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// Allow takes a token if one is available.
+func (l *RateLimiter) Allow() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+// AuditRecord is one line in an audit log.
+type AuditRecord struct {
+	Time        time.Time `json:"time"`
+	Institution string    `json:"institution"`
+	Origin      string    `json:"origin"`
+	Client      string    `json:"client"`
+	Method      string    `json:"method"`
+	Path        string    `json:"path"`
+	Operation   string    `json:"operation"`
+	Status      int       `json:"status"`
+}
+
+// AuditLog appends records to a file as JSON lines.
+type AuditLog struct {
+	mu      sync.Mutex
+	file    *os.File
+	encoder *json.Encoder
+	utc     bool
+}
+
+// OpenAuditLog opens an audit log file for appending, creating it if needed.
+// If utc is true, records are timestamped in UTC, rather than local time.
+func OpenAuditLog(path string, utc bool) (*AuditLog, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open audit log: %w", err)
+	}
+	return &AuditLog{file: file, encoder: json.NewEncoder(file), utc: utc}, nil
+}
+
+// Record appends a record to the audit log.
+func (a *AuditLog) Record(record AuditRecord) {
+	if a.utc {
+		record.Time = record.Time.UTC()
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	err := a.encoder.Encode(record)
+	if err != nil {
+		slog.Error("Unable to write to audit log.", "path", a.file.Name(), "error", err)
+	}
+}
+
+// Close closes the audit log file.
+func (a *AuditLog) Close() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.file.Close()
+}
@@ -0,0 +1,81 @@
+// Copyright 2023 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+)
+
+// The IP versions the proxy can listen on.
+const (
+	IPv4   = "4"
+	IPv6   = "6"
+	IPBoth = "both"
+)
+
+// ErrBadIPVersion is returned when the IP version isn't one we know.
+var ErrBadIPVersion = errors.New("IP version must be 4, 6, or both")
+
+// ListenNetwork returns the network to listen on for an IP version.
+func ListenNetwork(ipVersion string) (string, error) {
+	switch ipVersion {
+	case IPv4:
+		return "tcp4", nil
+	case IPv6:
+		return "tcp6", nil
+	case IPBoth:
+		return "tcp", nil
+	default:
+		return "", fmt.Errorf("%w, not %q", ErrBadIPVersion, ipVersion)
+	}
+}
+
+// Listen listens on an address with the given IP versions.
+//
+// Listening on localhost with both IP versions listens on both 127.0.0.1 and
+// ::1, since browsers may use either. If one of them fails, because that IP
+// stack is disabled, the other is still used. Listening on all interfaces
+// with only IPv6 doesn't accept IPv4 connections.
+func Listen(ipVersion, address string) ([]net.Listener, error) {
+	network, err := ListenNetwork(ipVersion)
+	if err != nil {
+		return nil, err
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, fmt.Errorf("bad address %q: %w", address, err)
+	}
+	hosts := []string{host}
+	switch {
+	case host == "localhost" && ipVersion == IPv4:
+		hosts = []string{"127.0.0.1"}
+	case host == "localhost" && ipVersion == IPv6:
+		hosts = []string{"::1"}
+	case host == "localhost":
+		hosts = []string{"127.0.0.1", "::1"}
+	}
+	var listeners []net.Listener
+	var firstErr error
+	for _, h := range hosts {
+		listener, err := net.Listen(network, net.JoinHostPort(h, port))
+		if err != nil {
+			if len(hosts) > 1 {
+				slog.Warn("Unable to listen on one loopback address, is that IP stack disabled?", "address", h, "error", err)
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		listeners = append(listeners, listener)
+	}
+	if len(listeners) == 0 {
+		return nil, firstErr
+	}
+	return listeners, nil
+}
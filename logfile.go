@@ -0,0 +1,167 @@
+// Copyright 2023 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultLogMaxSizeMB is the size, in megabytes, a log file grows to before it is rotated.
+	DefaultLogMaxSizeMB = 10
+
+	// DefaultLogMaxBackups is how many rotated log files are kept.
+	DefaultLogMaxBackups = 5
+
+	// DefaultLogMaxAge is how long rotated log files are kept.
+	DefaultLogMaxAge = 30 * 24 * time.Hour
+
+	// logBackupTime is the layout of the timestamp in rotated log file names.
+	// It sorts in time order, and has no characters Windows forbids in file names.
+	logBackupTime = "2006-01-02T15-04-05.000"
+)
+
+// RotatingFile is a log file which is rotated when it grows too large, for
+// desk machines without journald. It is appended to when opened, so history
+// survives restarts. When a write would make it larger than MaxBytes, it is
+// renamed with a timestamp, like proxy-2024-01-02T15-04-05.000.log, and a new
+// file is started. Then the oldest rotated files are removed, past MaxBackups
+// of them, and any older than MaxAge. Zero disables each limit.
+type RotatingFile struct {
+	Path       string
+	MaxBytes   int64
+	MaxBackups int
+	MaxAge     time.Duration
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+// OpenRotatingFile opens, or creates, the log file at path.
+func OpenRotatingFile(path string, maxBytes int64, maxBackups int, maxAge time.Duration) (*RotatingFile, error) {
+	f := &RotatingFile{Path: path, MaxBytes: maxBytes, MaxBackups: maxBackups, MaxAge: maxAge}
+	err := f.open()
+	if err != nil {
+		return nil, err
+	}
+	f.prune()
+	return f, nil
+}
+
+// Write writes to the log file, rotating it first if it would grow past MaxBytes.
+func (f *RotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.MaxBytes > 0 && f.size > 0 && f.size+int64(len(p)) > f.MaxBytes {
+		err := f.rotate()
+		if err != nil && f.file == nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// Close closes the log file.
+func (f *RotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
+
+// open opens the log file for appending.
+func (f *RotatingFile) open() error {
+	file, err := os.OpenFile(f.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return fmt.Errorf("unable to open log file: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("unable to open log file: %w", err)
+	}
+	f.file = file
+	f.size = info.Size()
+	return nil
+}
+
+// rotate renames the log file with a timestamp, and starts a new one.
+// If the file can't be renamed, for example because another program has
+// it open on Windows, logging carries on in the old one.
+func (f *RotatingFile) rotate() error {
+	f.file.Close()
+	f.file = nil
+	renameErr := os.Rename(f.Path, f.backupName(time.Now()))
+	err := f.open()
+	if err != nil {
+		return err
+	}
+	if renameErr != nil {
+		return fmt.Errorf("unable to rotate log file: %w", renameErr)
+	}
+	f.prune()
+	return nil
+}
+
+// backupName returns the name of the log file rotated at t.
+func (f *RotatingFile) backupName(t time.Time) string {
+	ext := filepath.Ext(f.Path)
+	return strings.TrimSuffix(f.Path, ext) + "-" + t.Format(logBackupTime) + ext
+}
+
+// prune removes rotated log files past MaxBackups, or older than MaxAge.
+// Errors are ignored, the files will be tried again at the next rotation.
+func (f *RotatingFile) prune() {
+	if f.MaxBackups <= 0 && f.MaxAge <= 0 {
+		return
+	}
+	for i, name := range LogBackups(f.Path) {
+		expired := false
+		if f.MaxAge > 0 {
+			info, err := os.Stat(name)
+			expired = err == nil && time.Since(info.ModTime()) > f.MaxAge
+		}
+		if (f.MaxBackups > 0 && i >= f.MaxBackups) || expired {
+			os.Remove(name)
+		}
+	}
+}
+
+// LogBackups returns the rotated files of the log file at path, newest first.
+func LogBackups(path string) []string {
+	ext := filepath.Ext(path)
+	prefix := strings.TrimSuffix(path, ext) + "-"
+	matches, err := filepath.Glob(globEscape(prefix) + "*" + globEscape(ext))
+	if err != nil {
+		return nil
+	}
+	var backups []string
+	for _, name := range matches {
+		stamp := strings.TrimSuffix(strings.TrimPrefix(name, prefix), ext)
+		if _, err := time.Parse(logBackupTime, stamp); err == nil {
+			backups = append(backups, name)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(backups)))
+	return backups
+}
+
+// globEscape escapes the characters in a path which filepath.Glob treats specially.
+func globEscape(path string) string {
+	return strings.NewReplacer("*", `[*]`, "?", `[?]`, "[", `[[]`).Replace(path)
+}
@@ -0,0 +1,379 @@
+// Copyright 2023 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// LevelFatal is the level of messages logged just before the program exits.
+const LevelFatal = slog.LevelError + 4
+
+// The log formats.
+const (
+	// LogFormatAuto is console when stderr is a terminal, plain otherwise.
+	LogFormatAuto = "auto"
+	// LogFormatPlain is the log package's format, for log files and services.
+	LogFormatPlain = "plain"
+	// LogFormatConsole is colored, with aligned fields, for interactive troubleshooting.
+	LogFormatConsole = "console"
+	// LogFormatJSON is one JSON object per line, for shipping to a SIEM.
+	LogFormatJSON = "json"
+	// LogFormatText is key=value pairs, including the time, level, and message, for log collectors.
+	LogFormatText = "text"
+)
+
+// ConsoleMessageWidth is the width messages are padded to in the console format,
+// so the attributes which follow line up.
+const ConsoleMessageWidth = 48
+
+// ANSI escape sequences used by the console format.
+const (
+	ansiReset  = "\x1b[0m"
+	ansiFaint  = "\x1b[2m"
+	ansiRed    = "\x1b[31m"
+	ansiYellow = "\x1b[33m"
+	ansiBlue   = "\x1b[34m"
+	ansiCyan   = "\x1b[36m"
+	ansiBold   = "\x1b[1m"
+)
+
+// RFC3339Milli is RFC 3339 with milliseconds, used for log timestamps with -log-rfc3339.
+const RFC3339Milli = "2006-01-02T15:04:05.000Z07:00"
+
+// ErrBadLogFormat is returned when the log format isn't one we know.
+var ErrBadLogFormat = errors.New("log format must be auto, plain, console, json, or text")
+
+// ResolveLogFormat checks a log format, resolving auto to console if
+// out is a terminal and to plain if it isn't.
+func ResolveLogFormat(format string, out *os.File) (string, error) {
+	switch format {
+	case LogFormatPlain, LogFormatConsole, LogFormatJSON, LogFormatText:
+		return format, nil
+	case LogFormatAuto:
+		// Respect https://no-color.org.
+		if os.Getenv("NO_COLOR") == "" && isTerminal(out) {
+			return LogFormatConsole, nil
+		}
+		return LogFormatPlain, nil
+	default:
+		return "", fmt.Errorf("%w, not %q", ErrBadLogFormat, format)
+	}
+}
+
+// isTerminal reports whether f is a terminal, rather than a file or pipe.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// LogHandler is a slog.Handler which writes one line per record. In the plain format,
+// lines look like the log package's, a timestamp and the message, followed by any
+// attributes as key=value pairs. Warnings and errors are prefixed with their level.
+// In the console format, every line has a colored level, and messages are padded
+// so their attributes line up.
+type LogHandler struct {
+	w      io.Writer
+	mu     *sync.Mutex
+	opts   LogOptions
+	prefix string // The prefix for attribute keys, from WithGroup.
+	attrs  []byte // The attributes from WithAttrs, already formatted.
+}
+
+// LogOptions configure a LogHandler.
+type LogOptions struct {
+	// Level is the minimum level written.
+	Level slog.Leveler
+	// Format is plain or console. See NewFormatHandler for json and text.
+	Format string
+	// UTC writes timestamps in UTC, rather than local time.
+	UTC bool
+	// RFC3339 writes full RFC 3339 timestamps with milliseconds,
+	// rather than the log package's format.
+	RFC3339 bool
+}
+
+// NewLogHandler returns a LogHandler writing to w.
+func NewLogHandler(w io.Writer, opts LogOptions) *LogHandler {
+	return &LogHandler{w: w, mu: &sync.Mutex{}, opts: opts}
+}
+
+// NewFormatHandler returns a handler writing to w in the format in opts. Plain
+// and console are written by a LogHandler. JSON and text are written by the
+// slog package's handlers, with every record's time, level, and message as
+// fields, so they can be filtered by a log collector.
+func NewFormatHandler(w io.Writer, opts LogOptions) slog.Handler {
+	if opts.Format != LogFormatJSON && opts.Format != LogFormatText {
+		return NewLogHandler(w, opts)
+	}
+	handlerOptions := &slog.HandlerOptions{
+		Level: opts.Level,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if len(groups) > 0 {
+				return a
+			}
+			switch a.Key {
+			case slog.TimeKey:
+				if opts.UTC {
+					a.Value = slog.TimeValue(a.Value.Time().UTC())
+				}
+			case slog.LevelKey:
+				if level, ok := a.Value.Any().(slog.Level); ok {
+					a.Value = slog.StringValue(levelName(level))
+				}
+			}
+			return a
+		},
+	}
+	if opts.Format == LogFormatJSON {
+		return slog.NewJSONHandler(w, handlerOptions)
+	}
+	return slog.NewTextHandler(w, handlerOptions)
+}
+
+// Enabled reports whether messages at level are written.
+func (h *LogHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.opts.Level.Level()
+}
+
+// Handle writes a record as one line.
+func (h *LogHandler) Handle(_ context.Context, r slog.Record) error {
+	buf := h.format(r)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := h.w.Write(buf)
+	return err
+}
+
+// format returns a record as one line, ending with a newline.
+func (h *LogHandler) format(r slog.Record) []byte {
+	buf := make([]byte, 0, 256)
+	if h.console() {
+		buf = h.appendConsoleHeader(buf, r)
+	} else {
+		if !r.Time.IsZero() {
+			buf = h.appendTime(buf, r.Time, "2006/01/02 15:04:05")
+			buf = append(buf, ' ')
+		}
+		buf = append(buf, levelPrefix(r.Level)...)
+		buf = append(buf, r.Message...)
+	}
+	buf = append(buf, h.attrs...)
+	r.Attrs(func(a slog.Attr) bool {
+		buf = h.appendAttr(buf, h.prefix, a)
+		return true
+	})
+	return append(buf, '\n')
+}
+
+// WithAttrs returns a handler which includes attrs on every line.
+func (h *LogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	h2 := *h
+	h2.attrs = append([]byte{}, h.attrs...)
+	for _, a := range attrs {
+		h2.attrs = h.appendAttr(h2.attrs, h.prefix, a)
+	}
+	return &h2
+}
+
+// WithGroup returns a handler which prefixes attribute keys with the group name.
+func (h *LogHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	h2 := *h
+	h2.prefix += name + "."
+	return &h2
+}
+
+// console reports whether the handler writes the console format.
+func (h *LogHandler) console() bool {
+	return h.opts.Format == LogFormatConsole
+}
+
+// appendTime appends a timestamp in the configured time zone, using layout
+// unless RFC 3339 timestamps were asked for.
+func (h *LogHandler) appendTime(buf []byte, t time.Time, layout string) []byte {
+	if h.opts.UTC {
+		t = t.UTC()
+	}
+	if h.opts.RFC3339 {
+		layout = RFC3339Milli
+	}
+	return t.AppendFormat(buf, layout)
+}
+
+// appendConsoleHeader appends the time, colored level, and padded message.
+func (h *LogHandler) appendConsoleHeader(buf []byte, r slog.Record) []byte {
+	buf = append(buf, ansiFaint...)
+	buf = h.appendTime(buf, r.Time, "15:04:05.000")
+	buf = append(buf, ansiReset...)
+	buf = append(buf, ' ')
+	var color string
+	switch {
+	case r.Level >= LevelFatal:
+		color = ansiBold + ansiRed
+	case r.Level >= slog.LevelError:
+		color = ansiRed
+	case r.Level >= slog.LevelWarn:
+		color = ansiYellow
+	case r.Level >= slog.LevelInfo:
+		color = ansiBlue
+	default:
+		color = ansiFaint
+	}
+	buf = append(buf, color...)
+	buf = fmt.Appendf(buf, "%-5s", levelName(r.Level))
+	buf = append(buf, ansiReset...)
+	buf = append(buf, ' ')
+	if len(h.attrs) == 0 && r.NumAttrs() == 0 {
+		return append(buf, r.Message...)
+	}
+	return fmt.Appendf(buf, "%-*s", ConsoleMessageWidth, r.Message)
+}
+
+// levelName returns the name of a level, like WARN, with FATAL for LevelFatal.
+func levelName(level slog.Level) string {
+	switch {
+	case level >= LevelFatal:
+		return "FATAL"
+	case level >= slog.LevelError:
+		return "ERROR"
+	case level >= slog.LevelWarn:
+		return "WARN"
+	case level >= slog.LevelInfo:
+		return "INFO"
+	default:
+		return "DEBUG"
+	}
+}
+
+// levelPrefix returns the prefix for messages logged at level.
+func levelPrefix(level slog.Level) string {
+	switch {
+	case level >= LevelFatal:
+		return "FATAL: "
+	case level >= slog.LevelError:
+		return "ERROR: "
+	case level >= slog.LevelWarn:
+		return "WARNING: "
+	case level < slog.LevelInfo:
+		return "DEBUG: "
+	default:
+		return ""
+	}
+}
+
+// appendAttr appends an attribute as key=value, flattening groups into dotted keys.
+// In the console format, the key is colored.
+func (h *LogHandler) appendAttr(buf []byte, prefix string, a slog.Attr) []byte {
+	a.Value = a.Value.Resolve()
+	if a.Equal(slog.Attr{}) {
+		return buf
+	}
+	if a.Value.Kind() == slog.KindGroup {
+		if a.Key != "" {
+			prefix += a.Key + "."
+		}
+		for _, ga := range a.Value.Group() {
+			buf = h.appendAttr(buf, prefix, ga)
+		}
+		return buf
+	}
+	buf = append(buf, ' ')
+	if h.console() {
+		buf = append(buf, ansiCyan...)
+	}
+	buf = append(buf, prefix...)
+	buf = append(buf, a.Key...)
+	buf = append(buf, '=')
+	if h.console() {
+		buf = append(buf, ansiReset...)
+	}
+	var s string
+	if a.Value.Kind() == slog.KindTime {
+		s = string(h.appendTime(nil, a.Value.Time(), time.RFC3339))
+	} else {
+		s = a.Value.String()
+	}
+	if needsQuoting(s) {
+		return strconv.AppendQuote(buf, s)
+	}
+	return append(buf, s...)
+}
+
+// needsQuoting reports whether a value must be quoted to be read back unambiguously.
+func needsQuoting(s string) bool {
+	if s == "" {
+		return true
+	}
+	for _, r := range s {
+		if r == ' ' || r == '"' || r == '=' || !unicode.IsPrint(r) {
+			return true
+		}
+	}
+	return false
+}
+
+// MultiHandler is a slog.Handler which passes records to several handlers.
+type MultiHandler []slog.Handler
+
+// Enabled reports whether any of the handlers is enabled for level.
+func (m MultiHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	for _, h := range m {
+		if h.Enabled(ctx, level) {
+			return true
+		}
+	}
+	return false
+}
+
+// Handle passes a record to each enabled handler, returning the first error.
+func (m MultiHandler) Handle(ctx context.Context, r slog.Record) error {
+	var first error
+	for _, h := range m {
+		if !h.Enabled(ctx, r.Level) {
+			continue
+		}
+		err := h.Handle(ctx, r.Clone())
+		if err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// WithAttrs returns a MultiHandler with attrs added to each handler.
+func (m MultiHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	m2 := make(MultiHandler, 0, len(m))
+	for _, h := range m {
+		m2 = append(m2, h.WithAttrs(attrs))
+	}
+	return m2
+}
+
+// WithGroup returns a MultiHandler with the group added to each handler.
+func (m MultiHandler) WithGroup(name string) slog.Handler {
+	m2 := make(MultiHandler, 0, len(m))
+	for _, h := range m {
+		m2 = append(m2, h.WithGroup(name))
+	}
+	return m2
+}
+
+// fatal logs a message at LevelFatal, then exits.
+func fatal(msg string, args ...any) {
+	slog.Log(context.Background(), LevelFatal, msg, args...)
+	os.Exit(1)
+}
@@ -0,0 +1,192 @@
+// Copyright 2023 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// LogSendQueueSize is how many messages wait to be sent to a log collector
+// before new ones are dropped.
+const LogSendQueueSize = 1024
+
+// LogSendTimeout limits connecting to and writing to a log collector.
+const LogSendTimeout = 5 * time.Second
+
+// logSender sends log messages to a collector, like Graylog or rsyslog, at one
+// address, over UDP, TCP, or TCP with TLS. Messages are sent in the background
+// by run, so a slow or unreachable collector never holds up the proxy.
+type logSender struct {
+	service string // The collector's name in our own log messages, like Graylog.
+	network string // udp or tcp.
+	address string
+	tls     *tls.Config
+
+	// writeDatagram writes a message over UDP.
+	writeDatagram func(conn net.Conn, message []byte) error
+	// frame marks where a message ends over TCP.
+	frame func(message []byte) []byte
+
+	queueMu sync.Mutex
+	queue   chan []byte
+	closed  bool
+	done    chan struct{}
+	dropped atomic.Int64
+
+	mu      sync.Mutex
+	conn    net.Conn
+	failing bool
+}
+
+// newLogSender returns a logSender for a udp://, tcp://, or tls:// URL, which
+// the caller has checked. If caFile is set, the certificates in it are trusted
+// for tls:// addresses instead of the system's. With fips, TLS is restricted to
+// FIPS 140 approved algorithms. Messages are written as they are, until the
+// caller sets writeDatagram and frame.
+func newLogSender(service string, u *url.URL, caFile string, fips bool) (*logSender, error) {
+	s := &logSender{
+		service: service,
+		network: "tcp",
+		address: u.Host,
+		queue:   make(chan []byte, LogSendQueueSize),
+		done:    make(chan struct{}),
+		writeDatagram: func(conn net.Conn, message []byte) error {
+			_, err := conn.Write(message)
+			return err
+		},
+		frame: func(message []byte) []byte { return message },
+	}
+	switch u.Scheme {
+	case "udp":
+		s.network = "udp"
+	case "tls":
+		s.tls = &tls.Config{ServerName: u.Hostname(), MinVersion: tls.VersionTLS12}
+		if caFile != "" {
+			pem, err := os.ReadFile(caFile)
+			if err != nil {
+				return nil, fmt.Errorf("unable to read %v CA file: %w", service, err)
+			}
+			s.tls.RootCAs = x509.NewCertPool()
+			if !s.tls.RootCAs.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("%w in %v", ErrNoClientCAs, caFile)
+			}
+		}
+		if fips {
+			s.tls = FIPSTLSConfig(s.tls)
+		}
+	}
+	return s, nil
+}
+
+// enqueue queues a message, dropping it if the queue is full or closed.
+func (s *logSender) enqueue(message []byte) {
+	s.queueMu.Lock()
+	defer s.queueMu.Unlock()
+	if s.closed {
+		s.dropped.Add(1)
+		return
+	}
+	select {
+	case s.queue <- message:
+	default:
+		s.dropped.Add(1)
+	}
+}
+
+// run sends queued messages until the queue is closed.
+func (s *logSender) run() {
+	defer close(s.done)
+	for message := range s.queue {
+		// Failures are logged by send.
+		s.send(message)
+	}
+}
+
+// close sends the queued messages, waiting up to LogSendTimeout, then closes the connection.
+func (s *logSender) close() {
+	s.queueMu.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.queue)
+	}
+	s.queueMu.Unlock()
+	select {
+	case <-s.done:
+	case <-time.After(LogSendTimeout):
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+}
+
+// send sends one message, reconnecting once if a TCP connection was lost.
+// The first failure, and the recovery after it, are logged.
+func (s *logSender) send(message []byte) error {
+	s.mu.Lock()
+	err := s.write(message)
+	if err != nil && s.network == "tcp" {
+		err = s.write(message)
+	}
+	var report func()
+	switch {
+	case err != nil && !s.failing:
+		s.failing = true
+		report = func() { slog.Warn("Unable to send logs to "+s.service+".", "address", s.address, "error", err) }
+	case err != nil:
+		s.dropped.Add(1)
+	case s.failing:
+		s.failing = false
+		dropped := s.dropped.Swap(0)
+		report = func() { slog.Info("Sending logs to "+s.service+" again.", "address", s.address, "dropped", dropped) }
+	}
+	s.mu.Unlock()
+	// Report without holding the lock, since the report is itself sent to the collector.
+	if report != nil {
+		report()
+	}
+	return err
+}
+
+// write writes one message, connecting first if needed. s.mu must be held.
+func (s *logSender) write(message []byte) error {
+	if s.conn == nil {
+		dialer := &net.Dialer{Timeout: LogSendTimeout}
+		var conn net.Conn
+		var err error
+		if s.tls != nil {
+			conn, err = tls.DialWithDialer(dialer, s.network, s.address, s.tls)
+		} else {
+			conn, err = dialer.Dial(s.network, s.address)
+		}
+		if err != nil {
+			return fmt.Errorf("unable to connect: %w", err)
+		}
+		s.conn = conn
+	}
+	s.conn.SetWriteDeadline(time.Now().Add(LogSendTimeout))
+	var err error
+	if s.network == "udp" {
+		err = s.writeDatagram(s.conn, message)
+	} else {
+		_, err = s.conn.Write(s.frame(message))
+	}
+	if err != nil && s.network == "tcp" {
+		s.conn.Close()
+		s.conn = nil
+	}
+	return err
+}
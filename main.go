@@ -6,13 +6,15 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
+	"net"
 	"net/http"
-	"net/url"
 	"os"
 	"os/signal"
 	"runtime"
@@ -22,11 +24,19 @@ import (
 	"time"
 
 	"github.com/cu-library/overridefromenv"
+	"golang.org/x/crypto/acme/autocert"
 )
 
 // A version flag, which should be overwritten when building using ldflags.
 var version = "devel"
 
+// The commit and build date, which goreleaser sets using ldflags.
+// If they aren't set, they are read from the VCS stamp Go embeds.
+var (
+	commit = ""
+	date   = ""
+)
+
 const (
 	// EnvPrefix is the prefix for environment variables which override unset flags.
 	EnvPrefix string = "ALMA_RFID_INTERCEPT"
@@ -40,68 +50,154 @@ const (
 	// DefaultOrigin is the default origin this proxy will allow CORS requests from.
 	// Effectively, this is your Alma domain.
 	DefaultOrigin string = "https://ocul-crl.alma.exlibrisgroup.com"
-)
-
-// ServeProxy returns a simple status OK if the server is up.
-func ServeProxy(origin, proxy string) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		if r.Header.Get("Origin") != "" {
-			w.Header().Set("Access-Control-Allow-Origin", origin)
-			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-			w.Header().Set("Access-Control-Allow-Credentials", "true")
-			w.Header().Set("Access-Control-Allow-Headers", "SOAPAction,X-CustomHeader,Keep-Alive,User-Agent,X-Requested-With,If-Modified-Since,Cache-Control,Content-Type")
-			if r.Method == "OPTIONS" {
-				w.Header().Set("Access-Control-Allow-Private-Network", "true")
-				w.Header().Set("Access-Control-Max-Age", "1728000")
-				w.Header().Set("Content-Type", "text/plain charset=UTF-8")
-				http.Error(w, "", http.StatusNoContent)
-				return
-			}
-		}
-		// Build the auth headers and send a request to the Summon API.
-		client := new(http.Client)
 
-		// Add a timeout to the http client.
-		client.Timeout = 5 * time.Second
+	// DefaultMQTTTopic is the default topic prefix for tag events published to MQTT.
+	DefaultMQTTTopic string = "almarfidintercept"
 
-		// Build the API Request.
-		proxyURL, err := url.Parse(proxy)
-		if err != nil {
-			// This should never happen, since we already parsed in main.
-			http.Error(w, "Bad internal proxy address", http.StatusInternalServerError)
-			return
-		}
-		proxyURL.Path = r.URL.Path
-		proxyURL.RawQuery = r.URL.RawQuery
-
-		// Create the request struct.
-		proxyRequest, err := http.NewRequest("GET", proxyURL.String(), nil)
-		if err != nil {
-			http.Error(w, "Unable to build API Request.", http.StatusInternalServerError)
-			return
-		}
-
-		// Close the connection after sending the request.
-		proxyRequest.Close = true
-
-		// Send the request.
-		proxyResp, err := client.Do(proxyRequest)
-		if err != nil {
-			http.Error(w, fmt.Sprintf("Error sending API Request: %v", err), http.StatusInternalServerError)
-			return
-		}
-
-		w.WriteHeader(proxyResp.StatusCode)
-		io.Copy(w, proxyResp.Body)
-		proxyResp.Body.Close()
-	}
-}
+	// ServerIdleTimeout is how long an idle keep-alive connection from a browser is kept open.
+	ServerIdleTimeout = 120 * time.Second
+)
 
 func main() {
 	// Define the command line flags.
+	configPath := flag.String("config", "", "TOML file of settings, named for the flags, like address = \":53535\". Flags and environment variables take precedence. Origins, upstream, log level, and TLS certificates are read again on SIGHUP.")
+	showVersion := flag.Bool("version", false, "Print the version, revision, build date, and platform, then exit.")
+	quiet := flag.Bool("quiet", false, "Only log errors, overriding -log-level.")
+	logLevel := flag.String("log-level", "info", "Minimum level logged, debug, info, warn, or error. Preflight requests are logged at debug.")
+	alertErrorRate := flag.Float64("alert-error-rate", 0, "Raise an alert when more than this fraction of requests to the reader service fail, like 0.2. 0 disables.")
+	alertLatency := flag.Duration("alert-latency", 0, "Raise an alert when the 95th percentile latency of the reader service is above this. 0 disables.")
+	alertWindow := flag.Duration("alert-window", DefaultAlertWindow, "Window over which the alert error rate and latency are measured.")
+	latencyObjectives := flag.String("latency-objectives", "", "Comma separated upstream latency objectives, like getitems:p95=300ms, reported in the metrics and status page.")
+	otlpEndpoint := flag.String("otlp-endpoint", "", "OpenTelemetry collector URL, like http://collector:4318, traces of proxied requests and reader service calls are sent to with OTLP over HTTP. Disabled if empty.")
+	otlpServiceName := flag.String("otlp-service-name", "almarfidintercept", "Service name traces are sent with.")
+	statsDAddr := flag.String("statsd-addr", "", "StatsD server, like localhost:8125, request, latency, and error metrics are sent to over UDP. Disabled if empty.")
+	statsDPrefix := flag.String("statsd-prefix", DefaultStatsDPrefix, "Prefix of the metric names sent to StatsD.")
+	dogStatsD := flag.Bool("dogstatsd", false, "Send the status and operation to StatsD as DogStatsD tags, rather than in the metric names.")
+	digestAt := flag.String("digest-at", "", "Time of day, like 17:30, to log a summary of the day's requests. Disabled if empty.")
+	digestWebhook := flag.String("digest-webhook", "", "URL the daily digest is posted to as JSON, if set.")
+	digestToken := flag.String("digest-token", "", "Bearer token for the daily digest webhook.")
+	recentRequests := flag.Int("recent-requests", DefaultRecentRequests, "Number of recent proxied requests, with the start of their bodies, shown at /admin/recent. 0 disables.")
+	recentResponses := flag.Int("recent-responses", DefaultRecentResponses, "Number of recent reader service responses shown at /admin/responses. 0 disables.")
+	allowedPaths := flag.String("allowed-paths", "", "Only forward requests for paths matching these comma separated patterns, like /getItems,/setSecurity. "+
+		"Others get a 404. Browser noise, like /favicon.ico, always gets a 404.")
+	upstreamTimeout := flag.Duration("upstream-timeout", DefaultUpstreamTimeout, "Time the reader service has to respond.")
+	flushInterval := flag.Duration("flush-interval", DefaultFlushInterval, "How often responses are flushed to the browser while they stream from the reader service. Negative to flush every write.")
+	maxRequestBytes := flag.Int64("max-request-bytes", DefaultMaxRequestBytes, "Largest request body accepted. Larger requests are refused with 413. Zero disables the limit.")
+	maxResponseBytes := flag.Int64("max-response-bytes", DefaultMaxResponseBytes, "Largest response accepted from the reader service. Larger responses are refused with 502, or cut off if already streaming. Zero disables the limit.")
+	upstreamIdleConns := flag.Int("upstream-idle-conns", DefaultUpstreamIdleConns, "Idle connections to each reader service kept open for reuse.")
+	upstreamIdleTimeout := flag.Duration("upstream-idle-timeout", DefaultUpstreamIdleTimeout, "How long an idle connection to the reader service is kept open.")
+	operationTimeouts := flag.String("operation-timeouts", "", "Comma separated upstream timeouts for particular operations, like writeTags=60s,setSecurity=20s, overriding -upstream-timeout.")
+	upstreamResolver := flag.String("upstream-resolver", "", "DNS server used to look up the reader service's host name, like 10.0.0.53. The system's resolver is used if empty.")
+	upstreamResolveTimeout := flag.Duration("upstream-resolve-timeout", DefaultResolveTimeout, "Time allowed to look up the reader service's host name.")
+	warmUpInterval := flag.Duration("warm-up-interval", DefaultWarmUpInterval, "Open a connection to the reader service at startup, and keep it open with a request this often. 0 disables.")
+	accessLog := flag.Bool("access-log", false, "Log every request.")
+	redactFields := flag.String("redact-fields", DefaultRedactFields, "Comma separated names whose values are masked in the logs, in query strings, XML, JSON, and log fields. Any name containing one matches, ignoring case. Empty to log them.")
+	redactPatterns := flag.String("redact-patterns", "", "Space separated regular expressions masked wherever they appear in the logs, like a patron ID format.")
+	debugDumpFlag := flag.Bool("debug-dump", false, "Log each request from the browser, the request sent to the reader service, and its response, with headers and bodies.")
+	debugDumpBytes := flag.Int("debug-dump-bytes", DefaultDebugDumpBytes, "How much of each body -debug-dump logs.")
+	accessLogFormat := flag.String("access-log-format", AccessLogFormatLog, "Access log format, log to include requests in the proxy's log, or common, combined, or json to write them to stdout.")
+	accessLogInclude := flag.String("access-log-include", "", "Only log requests for paths matching these comma separated patterns, like /api/*.")
+	accessLogExclude := flag.String("access-log-exclude", "", "Don't log requests for paths matching these comma separated patterns, like /poll/*.")
+	logUTC := flag.Bool("log-utc", false, "Timestamp logs, audit logs, and crash reports in UTC, rather than local time.")
+	logRFC3339 := flag.Bool("log-rfc3339", false, "Write log timestamps in RFC 3339 format, with the date and UTC offset.")
+	logFormat := flag.String("log-format", LogFormatAuto, "Log format, plain, console for colors and aligned fields, or json or text for log collectors. auto is console when stderr is a terminal.")
 	addr := flag.String("address", DefaultAddress, "Address to bind on.")
+	perfCounters := flag.Bool("perf-counters", false, "Publish request rate, error rate, and upstream latency as Windows performance counters. Register them first with the perf-counters command.")
+	snmpAddress := flag.String("snmp-address", "", "UDP address to answer SNMP v1 and v2c requests on, like :1161. Off when empty.")
+	snmpCommunity := flag.String("snmp-community", DefaultSNMPCommunity, "SNMP community string.")
+	snmpBaseOID := flag.String("snmp-base-oid", DefaultSNMPBaseOID, "OID the SNMP objects are published under.")
+	syslogAddress := flag.String("syslog-addr", "", "Also send logs to a syslog collector, like rsyslog, at an address like udp://rsyslog:514, tcp://rsyslog:514, or tls://rsyslog:6514.")
+	syslogFacility := flag.String("syslog-facility", DefaultSyslogFacility, "Syslog facility, like daemon or local0.")
+	syslogCA := flag.String("syslog-ca", "", "PEM file of CA certificates to trust for a tls:// syslog address, instead of the system's.")
+	logFile := flag.String("log-file", "", "Write the log to this file, rather than stderr, rotating it when it grows too large.")
+	logMaxSize := flag.Int("log-max-size", DefaultLogMaxSizeMB, "Megabytes the log file grows to before it is rotated. 0 disables rotation.")
+	logMaxBackups := flag.Int("log-max-backups", DefaultLogMaxBackups, "Rotated log files kept. 0 keeps them all, unless they're older than -log-max-age.")
+	logMaxAge := flag.Duration("log-max-age", DefaultLogMaxAge, "How long rotated log files are kept. 0 keeps them, unless there are more than -log-max-backups.")
+	gelfAddress := flag.String("gelf-address", "", "Also send logs to Graylog as GELF, at an address like udp://graylog:12201, tcp://graylog:12201, or tls://graylog:12201.")
+	gelfCA := flag.String("gelf-ca", "", "PEM file of CA certificates to trust for a tls:// GELF address, instead of the system's.")
+	upstreamConcurrency := flag.Int("upstream-concurrency", 0, "Requests sent to each reader service at once. Others wait, with security operations ahead of tag polls. 0 for no limit.")
+	updateCheckInterval := flag.Duration("update-check-interval", 0, "Check for a newer release this often, like 24h, logging and showing on /admin when there is one. 0 for never.")
+	updateURL := flag.String("update-url", DefaultUpdateURL, "Address of the latest release, in the form of the Gitea or GitHub releases API, checked for updates.")
+	readerCommand := flag.String("reader-command", "", "Command starting the vendor's RFID software, like \"C:\\Program Files\\Vendor\\service.exe\" -port 21645, which is restarted if it exits. Not started if empty.")
+	readerRestartDelay := flag.Duration("reader-restart-delay", DefaultReaderRestartDelay, "Time to wait before restarting the RFID software after it exits, which doubles while it keeps exiting.")
+	breakerFailures := flag.Int("breaker-failures", DefaultBreakerFailures, "Upstream requests in a row which must fail to get a response before requests are refused with 503 for -breaker-cooldown. 0 for no circuit breaker.")
+	breakerCooldown := flag.Duration("breaker-cooldown", DefaultBreakerCooldown, "Time requests are refused once -breaker-failures is reached, before one is let through to see if the reader service is back.")
+	upstreamRetries := flag.Int("upstream-retries", DefaultUpstreamRetries, "Times a request to the reader service is retried when it can't connect, only for GET, HEAD, OPTIONS, PUT, DELETE, and requests with an Idempotency-Key. 0 for none.")
+	upstreamRetryBackoff := flag.Duration("upstream-retry-backoff", DefaultUpstreamRetryBackoff, "Time to wait before retrying a request to the reader service, which doubles for each retry.")
+	requireUpstream := flag.Bool("require-upstream", false, "Exit at startup if the reader service doesn't answer within 15 seconds, so a service manager shows the misconfiguration right away.")
+	watchdogTimeouts := flag.Int("watchdog-timeouts", 0, "Upstream requests in a row which must time out before the reader service is recovered, with -watchdog-command or by restarting -reader-command. 0 for no watchdog.")
+	watchdogCommand := flag.String("watchdog-command", "", "Command recovering a wedged reader service, like a script restarting the vendor's service or resetting its USB device. The reader service's address is in "+WatchdogUpstreamEnv+".")
+	watchdogCooldown := flag.Duration("watchdog-cooldown", DefaultWatchdogCooldown, "Time to wait after recovering the reader service before recovering it again.")
+	heartbeatInterval := flag.Duration("heartbeat-interval", 0, "Send a heartbeat request to the reader service after it has been idle this long, to keep the vendor's reader session alive. 0 for none.")
+	heartbeatPath := flag.String("heartbeat-path", DefaultHeartbeatPath, "Path of the heartbeat request.")
+	heartbeatSOAPAction := flag.String("heartbeat-soapaction", "", "SOAPAction header of the heartbeat request, if the reader service needs one.")
+	eventsPollInterval := flag.Duration("events-poll-interval", DefaultEventPollInterval, "How often the reader service is polled for tags while a browser listens to /events. 0 to only use the requests proxied anyway.")
+	eventsPollPath := flag.String("events-poll-path", DefaultHeartbeatPath, "Path of the tag poll sent for /events.")
+	eventsPollSOAPAction := flag.String("events-poll-soapaction", "", "SOAPAction header of the tag poll sent for /events, if the reader service needs one.")
+	upstreamLocalAddress := flag.String("upstream-local-address", "", "Local IP address, or network interface name, to connect to the reader service from. The operating system picks if empty.")
+	fips := flag.Bool("fips", false, "Restrict TLS to FIPS 140 approved algorithms, for institutions with federal compliance requirements.")
+	idempotencyTTL := flag.Duration("idempotency-ttl", DefaultIdempotencyTTL, "Time the response to a security or tag write request with an Idempotency-Key header is kept, and replayed to retries. 0 disables.")
+	coalesce := flag.Bool("coalesce", true, "Share one call to the reader service between identical GET requests in flight at the same time, like polls from several tabs.")
+	forwardHeaders := flag.String("forward-headers", DefaultForwardHeaders, "Comma separated request headers forwarded to the reader service, or * for all of them. Listed headers are also allowed by CORS.")
+	corsAllowMethods := flag.String("cors-allow-methods", DefaultCORSAllowMethods, "Comma separated methods browsers may use, sent as Access-Control-Allow-Methods.")
+	corsAllowHeaders := flag.String("cors-allow-headers", DefaultCORSAllowHeaders, "Comma separated request headers browsers may send, sent as Access-Control-Allow-Headers. The -forward-headers are allowed too.")
+	corsExposeHeaders := flag.String("cors-expose-headers", DefaultCORSExposeHeaders, "Comma separated response headers scripts may read, sent as Access-Control-Expose-Headers. The reader service's own headers are always exposed.")
+	corsMaxAge := flag.Duration("cors-max-age", DefaultPreflightMaxAge, "How long browsers may cache a preflight response. Shorten it while debugging CORS, browsers cap it anyway.")
+	privateNetworkAccess := flag.Bool("private-network-access", true, "Approve Private Network Access preflights, which browsers send before a public page like Alma may reach localhost.")
+	tlsCert := flag.String("tls-cert", "", "PEM certificate file. With -tls-key, the proxy is served over HTTPS, like https://localhost:53535.")
+	tlsKey := flag.String("tls-key", "", "PEM private key file for -tls-cert.")
+	clientCA := flag.String("client-ca", "", "PEM file of CA certificates. Callers must present a certificate signed by one of them, or nothing is proxied. Needs HTTPS.")
+	acmeHost := flag.String("acme-host", "", "Comma separated host names, like rfid.library.example.edu, to get certificates for from Let's Encrypt and serve HTTPS with. Use instead of -tls-cert.")
+	acmeCache := flag.String("acme-cache", DefaultACMECacheDir(), "Directory certificates from Let's Encrypt are kept in, so they survive restarts.")
+	acmeEmail := flag.String("acme-email", "", "Email address Let's Encrypt sends expiry and account notices to.")
+	acmeDirectory := flag.String("acme-directory", "", "ACME directory URL of another certificate authority, like Let's Encrypt's staging environment or an institutional CA. Let's Encrypt if empty.")
+	acmeHTTPAddress := flag.String("acme-http-address", DefaultACMEHTTPAddress, "Address to answer ACME HTTP challenges on. Empty to only use TLS challenges, which need the proxy served on port 443.")
+	ipVersion := flag.String("ip-version", IPBoth, "IP versions to listen on, 4, 6, or both. With both, localhost means 127.0.0.1 and ::1.")
 	proxy := flag.String("proxy", DefaultProxy, "Address we are proxying.")
+	routesFlag := flag.String("routes", "", "Comma separated path prefixes sent to other services on the workstation instead of the reader service, like /printer/=http://localhost:9100/. The address's path replaces the prefix.")
+	actionRoutes := flag.String("action-routes", "", "Comma separated SOAP operations sent to other reader services, like writeTags=http://localhost:21646, for vendor stacks which split reads and writes.")
+	proxyPool := flag.String("proxy-pool", "", "Comma separated addresses of more reader services, like http://sorter2:21645, which share requests with the -proxy address.")
+	balance := flag.String("balance", BalanceRoundRobin, "How requests are shared across -proxy-pool, round-robin or least-connections.")
+	proxyFallback := flag.String("proxy-fallback", "", "Address requests are proxied to when the -proxy address can't be reached, like a second reader interface or a networked backup reader.")
 	origin := flag.String("origin", DefaultOrigin, "The allowed origin for CORS. To allow any origin to connect, use '*'.")
+	environment := flag.String("environment", EnvironmentProduction, "Environment of the allowed origin and proxied address, production or sandbox.")
+	sandboxOrigin := flag.String("sandbox-origin", "", "The origin of your Alma sandbox, which is allowed and proxied separately from the production origin.")
+	sandboxProxy := flag.String("sandbox-proxy", "", "Address we are proxying for requests from the sandbox origin.")
+	institutionsPath := flag.String("institutions", "", "JSON file mapping each institution's Alma origin to its upstream, rate limit, and audit log.")
+	mqttBroker := flag.String("mqtt-broker", "", "MQTT broker to publish tag events to, like tcp://broker:1883. Publishing is disabled if empty.")
+	mqttTopic := flag.String("mqtt-topic", DefaultMQTTTopic, "MQTT topic prefix for published tag events.")
+	mqttClientID := flag.String("mqtt-client-id", "", "MQTT client ID. Defaults to the program name and hostname.")
+	mqttUsername := flag.String("mqtt-username", "", "MQTT username.")
+	mqttPassword := flag.String("mqtt-password", "", "MQTT password.")
+	webhooks := flag.String("webhooks", "", "Comma separated list of URLs which receive tag events as JSON POST requests.")
+	webhookEvents := flag.String("webhook-events", DefaultWebhookEvents, "Comma separated list of event types sent to webhooks. "+
+		"Event types are tag.appear, tag.disappear, security.change, security.failure, batch.complete, upstream.alert, upstream.recovered, and upstream.wedged.")
+	gateAPI := flag.String("gate-api", "", "Security gate management system URL which receives arm and disarm results. Forwarding is disabled if empty.")
+	gateToken := flag.String("gate-token", "", "Bearer token for the security gate management system.")
+	station := flag.String("station", "", "Name of this workstation, sent with security gate results and printed on slips. Defaults to the hostname.")
+	receiptPrinter := flag.String("receipt-printer", "", "Address of a network ESC/POS printer, like printer:9100, which prints a slip after each checkout batch.")
+	receiptSpool := flag.String("receipt-spool", "", "Directory where ESC/POS checkout slips are written after each checkout batch.")
+	maxInFlight := flag.Int64("max-inflight", DefaultMaxInFlight, "Requests handled at once before new requests are rejected with 503. Zero disables the limit.")
+	maxGoroutines := flag.Int("max-goroutines", DefaultMaxGoroutines, "Goroutines running before requests are rejected with 503. Zero disables the limit.")
+	maxHeapMB := flag.Uint64("max-heap-mb", DefaultMaxHeapMB, "Heap usage in megabytes before requests are rejected with 503. Zero disables the limit.")
+	clientTimeout := flag.Duration("client-timeout", DefaultClientTimeout, "Time a client has to send its request and receive the response, extended for operations with a longer -operation-timeouts. Zero disables the timeout.")
+	minClientRate := flag.Int64("min-client-rate", DefaultMinClientRate, "Minimum rate, in bytes per second, at which a client must accept the response. Zero disables the check.")
+	enablePprof := flag.Bool("enable-pprof", false, "Serve Go profiles, like heap and goroutine, at /debug/pprof/ on the admin address. Without -admin-address, only to this computer.")
+	adminAddress := flag.String("admin-address", "", "Address to serve the Prometheus /metrics, /debug/vars, and any profiles on, like :9153, instead of the proxy's address, where they are only served to this computer.")
+	shutdownTimeout := flag.Duration("shutdown-timeout", DefaultShutdownTimeout, "Time in-flight requests have to finish when shutting down. Zero waits forever.")
+	pidFile := flag.String("pidfile", "", "File the process ID is written to, for init scripts. Starting fails if the process in it is still running.")
+	detach := flag.Bool("detach", false, "Start in the background, without a terminal, and print the process ID. Set -log-file, since output is discarded.")
+	crashDir := flag.String("crash-dir", DefaultCrashDir(), "Directory crash reports are written to.")
+	restartHelp := flag.String("restart-help", DefaultRestartHelp, "Instructions shown to staff when the RFID software can't be reached.")
+	receiptTitle := flag.String("receipt-title", DefaultReceiptTitle, "Heading printed on checkout slips.")
+
+	// Run a subcommand, if one was given.
+	// Subcommands may use the flag definitions above.
+	if len(os.Args) > 1 {
+		if command := FindCommand(os.Args[1]); command != nil {
+			RunCommand(command, os.Args[2:])
+		}
+	}
 
 	// Define the Usage function, which prints to Stderr
 	// helpful information about the tool.
@@ -109,6 +205,12 @@ func main() {
 		fmt.Fprintf(os.Stderr, "almarfidintercept:\n")
 		fmt.Fprintf(os.Stderr, "Version %v\n", version)
 		fmt.Fprintf(flag.CommandLine.Output(), "Compiled with %v\n", runtime.Version())
+		fmt.Fprintf(os.Stderr, "Usage: almarfidintercept [flags] or almarfidintercept <command> [arguments]\n")
+		fmt.Fprintln(os.Stderr, "  Commands:")
+		for _, command := range Commands() {
+			fmt.Fprintf(os.Stderr, "  %v\n    \t%v\n", command.Name, command.Usage)
+		}
+		fmt.Fprintln(os.Stderr, "  Flags:")
 		flag.PrintDefaults()
 		fmt.Fprintln(os.Stderr, "  Environment variables read when flag is unset:")
 
@@ -120,73 +222,1022 @@ func main() {
 	// Process the flags.
 	flag.Parse()
 
+	if *showVersion {
+		fmt.Print(GetBuildInfo())
+		os.Exit(0)
+	}
+
+	// When started by the Windows service control manager, report to it,
+	// and shut down when it asks.
+	serviceStop, serviceStopped, err := runAsService()
+	if err != nil {
+		log.Fatalln(err)
+	}
+
 	// If any flags have not been set, see if there are
 	// environment variables that set them.
-	err := overridefromenv.Override(flag.CommandLine, EnvPrefix)
+	err = overridefromenv.Override(flag.CommandLine, EnvPrefix)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	// Flags which are still unset can be set by the config file.
+	configFile := NewConfigFile(*configPath, flag.CommandLine, EnvPrefix)
+	fromConfigFile, err := configFile.Load()
 	if err != nil {
 		log.Fatalln(err)
 	}
 
-	log.Printf("Serving on address: %v\n", *addr)
-	log.Printf("Allowed origin: %v\n", *origin)
+	// Start again in the background, if asked to, for init scripts.
+	if *detach {
+		err = Detach(os.Args[1:], os.Stdout)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		os.Exit(0)
+	}
+	if *pidFile != "" {
+		err = WritePIDFile(*pidFile)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	// Keep the recent log output, and write a crash report
+	// if the program panics or fails.
+	// With -quiet, only errors are logged.
+	// The level can change when the configuration is reloaded.
+	reloadable := ReloadableSettings{
+		Origin:      *origin,
+		Upstream:    *proxy,
+		Environment: *environment,
+		LogLevel:    *logLevel,
+		Quiet:       *quiet,
+		TLSCert:     *tlsCert,
+		TLSKey:      *tlsKey,
+	}
+	level := new(slog.LevelVar)
+	initialLevel, err := reloadable.Level()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	level.Set(initialLevel)
+	// Write the log to a file, if asked to, since Windows desk machines
+	// have no journald to keep it.
+	var logOut io.Writer = os.Stderr
+	if *logFile != "" {
+		rotating, err := OpenRotatingFile(*logFile, int64(*logMaxSize)<<20, *logMaxBackups, *logMaxAge)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		defer rotating.Close()
+		logOut = rotating
+	}
+	format, err := ResolveLogFormat(*logFormat, os.Stderr)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if *logFile != "" && format == LogFormatConsole && *logFormat == LogFormatAuto {
+		// Colors belong on a terminal, not in a file.
+		format = LogFormatPlain
+	}
+	// The log tail for crash reports is always plain, without colors.
+	tail := &LogTail{}
+	logOptions := LogOptions{Level: level, Format: format, UTC: *logUTC, RFC3339: *logRFC3339}
+	tailOptions := logOptions
+	tailOptions.Format = LogFormatPlain
+	if *station == "" {
+		*station = hostname()
+	}
+	var stderrHandler slog.Handler = NewFormatHandler(logOut, logOptions)
+	if format == LogFormatJSON || format == LogFormatText {
+		// Logs from many desks end up in one place, so say which this is.
+		stderrHandler = stderrHandler.WithAttrs([]slog.Attr{slog.String("station", *station)})
+	}
+	handlers := MultiHandler{
+		stderrHandler,
+		NewLogHandler(tail, tailOptions),
+	}
+	// Also send logs to Graylog, if an address was set.
+	var gelf *GELFHandler
+	if *gelfAddress != "" {
+		gelf, err = NewGELFHandler(*gelfAddress, *gelfCA, *fips, level)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		handlers = append(handlers, gelf)
+	}
+	// And to syslog.
+	var syslog *SyslogHandler
+	if *syslogAddress != "" {
+		syslog, err = NewSyslogHandler(*syslogAddress, *syslogFacility, *syslogCA, *fips, level)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		handlers = append(handlers, syslog)
+	}
+	// Keep barcodes and patron identifiers out of the logs.
+	redactor, err := NewRedactor(*redactFields, *redactPatterns)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	// Log messages about a request say which one.
+	slog.SetDefault(slog.New(RequestIDHandler{RedactHandler{Handler: handlers, Redactor: redactor}}))
+	// Restrict TLS to FIPS 140 approved algorithms, if asked to.
+	if *fips {
+		RestrictDefaultTransportToFIPS()
+		if module, ok := FIPSModule(); ok {
+			slog.Info("FIPS mode, TLS is restricted to approved algorithms.", "module", module)
+		} else {
+			slog.Warn("FIPS mode, TLS is restricted to approved algorithms, but this build doesn't use a validated cryptographic module. Build with GOFIPS140 or GOEXPERIMENT=boringcrypto, or run with GODEBUG=fips140=on.")
+		}
+	}
+	reporter := &CrashReporter{
+		Dir:   *crashDir,
+		Tail:  tail,
+		Flags: flag.CommandLine,
+		UTC:   *logUTC,
+	}
+	defer reporter.Recover()
+
+	// Check the settings a reload can change the same way a reload does.
+	err = reloadable.Validate()
+	if err != nil {
+		fatal(err.Error())
+	}
+
+	if *configPath != "" {
+		slog.Info("Read the config file.", "path", *configPath, "settings", fromConfigFile)
+	}
+	slog.Info("Serving on address.", "address", *addr)
+	slog.Info("Allowed origin.", "origin", *origin, "environment", *environment)
+	if *environment == EnvironmentSandbox {
+		slog.Warn("This is a SANDBOX environment, do not use it for real circulation.")
+	}
+
+	// The sandbox origin gets its own profile, so testing against
+	// the sandbox never drives the production reader.
+	if *sandboxOrigin != "" {
+		err := validateOrigin(*sandboxOrigin)
+		if err != nil {
+			fatal("Bad sandbox origin.", "error", err)
+		}
+		if *sandboxProxy == "" {
+			fatal("A sandbox origin needs its own proxied address, set with -sandbox-proxy.")
+		}
+		if *sandboxProxy == *proxy {
+			slog.Warn("The sandbox and production origins are proxied to the same address.")
+		}
+	}
+
+	// In consortium mode, each institution's origin has its own policies.
+	// The institutions file is read again when the configuration is reloaded.
+	loadInstitutions := func() (Institutions, error) {
+		institutions := Institutions{}
+		if *institutionsPath != "" {
+			var err error
+			institutions, err = LoadInstitutions(*institutionsPath, *logUTC)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if *sandboxOrigin != "" {
+			institutions[*sandboxOrigin] = NewProfile("Sandbox", *sandboxOrigin, *sandboxProxy, EnvironmentSandbox)
+		}
+		return institutions, nil
+	}
+	institutions, err := loadInstitutions()
+	if err != nil {
+		fatal(err.Error())
+	}
+	for _, inst := range institutions {
+		slog.Info("Allowed institution.", "name", inst.Name, "origin", inst.origin, "environment", inst.Environment)
+	}
+
+	// Tag events seen in upstream responses are published on the bus.
+	bus := NewEventBus()
+	tracker := NewTagTracker(bus)
+
+	// Raise an alert when the reader service fails too often or is too slow.
+	if *alertErrorRate < 0 || *alertErrorRate > 1 {
+		fatal("The alert error rate must be between 0 and 1.", "rate", *alertErrorRate)
+	}
+	alarm := &UpstreamAlarm{
+		ErrorRate: *alertErrorRate,
+		Latency:   *alertLatency,
+		Window:    *alertWindow,
+		Bus:       bus,
+	}
+	if alarm.Enabled() {
+		slog.Info("Alerting on upstream errors and latency.",
+			"error_rate", *alertErrorRate, "latency", *alertLatency, "window", *alertWindow)
+	}
+
+	// Run the vendor's RFID software, if asked to, once the server starts.
+	var supervisor *Supervisor
+	if *readerCommand != "" {
+		supervisor, err = NewSupervisor(*readerCommand, *readerRestartDelay)
+		if err != nil {
+			fatal("Unable to parse -reader-command.", "error", err)
+		}
+	}
+
+	// Recover the reader service when its requests keep timing out.
+	watchdog := &Watchdog{Timeouts: *watchdogTimeouts, Supervisor: supervisor, Cooldown: *watchdogCooldown, Bus: bus}
+	if *watchdogCommand != "" {
+		watchdog.Command, err = SplitCommand(*watchdogCommand)
+		if err != nil {
+			fatal("Unable to parse -watchdog-command.", "error", err)
+		}
+	}
+	if watchdog.Enabled() {
+		slog.Info("Recovering the reader service when its requests keep timing out.", "timeouts", *watchdogTimeouts, "command", *watchdogCommand)
+	}
+
+	// Send some paths to other services on the workstation.
+	routes, err := ParseRoutes(*routesFlag)
+	if err != nil {
+		fatal("Bad routes.", "error", err)
+	}
+	if len(routes) > 0 {
+		slog.Info("Routing paths to other services.", "routes", routes.String())
+	}
+
+	// Send some SOAP operations to other reader services.
+	parsedActionRoutes, err := ParseActionRoutes(*actionRoutes)
+	if err != nil {
+		fatal("Bad action routes.", "error", err)
+	}
+	if len(parsedActionRoutes) > 0 {
+		slog.Info("Routing SOAP operations to other reader services.", "action_routes", *actionRoutes)
+	}
+
+	// Share requests across several reader services.
+	pool, err := NewUpstreamPool(append([]string{*proxy}, splitList(*proxyPool)...), *balance)
+	if err != nil {
+		fatal("Bad reader service pool.", "error", err)
+	}
+	if pool != nil {
+		slog.Info("Balancing requests across reader services.", "proxy", *proxy, "pool", *proxyPool, "balance", *balance)
+	}
+
+	// Fail over to a second reader service when the first can't be reached.
+	fallback, err := NewUpstreamFallback(*proxyFallback)
+	if err != nil {
+		fatal("Bad fallback address.", "error", err)
+	}
+	if fallback != nil {
+		if *proxyFallback == *proxy {
+			slog.Warn("The fallback address is the same as the proxied address.")
+		}
+		slog.Info("Failing over when the reader service can't be reached.", "fallback", *proxyFallback)
+	}
+
+	// Measure upstream latency against the latency objectives.
+	parsedObjectives, err := ParseLatencyObjectives(*latencyObjectives)
+	if err != nil {
+		fatal(err.Error())
+	}
+	var objectives *ObjectiveTracker
+	if len(parsedObjectives) > 0 {
+		objectives = NewObjectiveTracker(parsedObjectives)
+		for _, objective := range parsedObjectives {
+			slog.Info("Latency objective.", "operation", objective.Operation, "objective", objective)
+		}
+	}
 
 	// Use an explicit request multiplexer.
 	mux := http.NewServeMux()
-	mux.HandleFunc("/", ServeProxy(*origin, *proxy))
+	metrics := NewMetrics()
+	metrics.Objectives = objectives
+	responses := NewRecentResponses(*recentResponses, redactor)
+	recent := NewRecentRequests(*recentRequests, redactor)
+	// Send metrics to StatsD too, for sites without Prometheus.
+	if *statsDAddr != "" {
+		metrics.StatsD, err = NewStatsD(*statsDAddr, *statsDPrefix, *dogStatsD)
+		if err != nil {
+			fatal(err.Error())
+		}
+		metrics.StatsD.Metrics = metrics
+		slog.Info("Sending metrics to StatsD.", "address", *statsDAddr)
+	}
+	if *upstreamLocalAddress != "" {
+		if _, err := net.InterfaceByName(*upstreamLocalAddress); err != nil && net.ParseIP(*upstreamLocalAddress) == nil {
+			fatal("Upstream local address is not an IP address or network interface.", "address", *upstreamLocalAddress)
+		}
+		slog.Info("Connecting to the reader service from a local address.", "address", *upstreamLocalAddress)
+	}
+	upstreamClient := NewUpstreamClient(UpstreamOptions{
+		Resolver:       ResolverAddress(*upstreamResolver),
+		ResolveTimeout: *upstreamResolveTimeout,
+		LocalAddress:   *upstreamLocalAddress,
+		FIPS:           *fips,
+		Timeout:        *upstreamTimeout,
+		IdleConns:      *upstreamIdleConns,
+		IdleTimeout:    *upstreamIdleTimeout,
+	})
+	// Dump whole requests and responses, for diagnosing the reader service, if asked to.
+	var debugDump *DebugDump
+	if *debugDumpFlag {
+		if *debugDumpBytes < 0 {
+			fatal("The debug dump size can't be negative.", "bytes", *debugDumpBytes)
+		}
+		debugDump = &DebugDump{MaxBytes: *debugDumpBytes}
+		upstreamClient.Transport = debugDump.Transport(upstreamClient.Transport)
+		slog.Warn("Logging whole requests and responses, which may include patron information.")
+	}
+	// Trace proxied requests, and the calls to the reader service they make, if asked to.
+	var tracer *Tracer
+	if *otlpEndpoint != "" {
+		tracer, err = NewTracer(*otlpEndpoint, *otlpServiceName, *station)
+		if err != nil {
+			fatal(err.Error())
+		}
+		upstreamClient.Transport = tracer.Transport(upstreamClient.Transport)
+		slog.Info("Sending traces to an OpenTelemetry collector.", "endpoint", tracer.Endpoint.String())
+	}
+	if *warmUpInterval >= *upstreamIdleTimeout {
+		slog.Warn("The warm up interval is longer than the upstream idle timeout, so the warmed up connection will be closed between requests.",
+			"warm_up_interval", *warmUpInterval, "idle_timeout", *upstreamIdleTimeout)
+	}
+	timeouts, err := ParseOperationTimeouts(*operationTimeouts)
+	if err != nil {
+		fatal(err.Error())
+	}
+	if *corsMaxAge < 0 {
+		fatal("The CORS max age can't be negative.", "max_age", *corsMaxAge)
+	}
+	proxyHandler := &Proxy{
+		Defaults:            NewProfile("Default", *origin, *proxy, *environment),
+		Client:              upstreamClient,
+		Institutions:        institutions,
+		Tracker:             tracker,
+		Maintenance:         NewMaintenancePage(*restartHelp, *station),
+		Alarm:               alarm,
+		Watchdog:            watchdog,
+		Routes:              routes,
+		ActionRoutes:        parsedActionRoutes,
+		Pool:                pool,
+		Fallback:            fallback,
+		Breaker:             &CircuitBreaker{Failures: *breakerFailures, Cooldown: *breakerCooldown},
+		Retry:               &UpstreamRetry{Attempts: *upstreamRetries, Backoff: *upstreamRetryBackoff},
+		Objectives:          objectives,
+		Metrics:             metrics,
+		Responses:           responses,
+		Timeouts:            timeouts,
+		FlushInterval:       *flushInterval,
+		MaxResponseBytes:    *maxResponseBytes,
+		MaxRequestBytes:     *maxRequestBytes,
+		Queue:               &UpstreamQueue{Limit: *upstreamConcurrency},
+		ForwardHeaders:      ParseForwardHeaders(*forwardHeaders),
+		AllowMethods:        splitList(strings.ToUpper(*corsAllowMethods)),
+		AllowHeaders:        splitList(*corsAllowHeaders),
+		ExposeHeaders:       splitList(*corsExposeHeaders),
+		PreflightMaxAge:     *corsMaxAge,
+		AllowPrivateNetwork: *privateNetworkAccess,
+	}
+	// The RFID software run by -reader-command is the default reader service.
+	watchdog.Supervised = proxyHandler.DefaultUpstream
+	filter, err := NewPathFilter(*allowedPaths)
+	if err != nil {
+		fatal(err.Error())
+	}
+	// Retried write operations with an Idempotency-Key get the first response back.
+	idempotency := NewIdempotencyCache(*idempotencyTTL)
+	// Identical polls in flight at the same time, from several tabs, share one upstream call.
+	var coalescer *Coalescer
+	if *coalesce {
+		coalescer = NewCoalescer()
+	}
+	mux.Handle("/", tracer.Middleware(debugDump.Middleware(recent.Middleware(filter.Middleware(metrics.Middleware(idempotency.Middleware(coalescer.Middleware(proxyHandler))))))))
+	// Push tag events to browsers, so they don't have to poll.
+	eventStream := NewEventStream(bus, tracker)
+	eventStream.Client = upstreamClient
+	eventStream.Upstream = proxyHandler.DefaultUpstream
+	eventStream.Pad = proxyHandler.PadUpstream
+	eventStream.Path = *eventsPollPath
+	eventStream.SOAPAction = *eventsPollSOAPAction
+	eventStream.Interval = *eventsPollInterval
+	eventStream.Queue = proxyHandler.Queue
+	eventStream.LastRequest = proxyHandler.LastUpstream
+	mux.Handle("/events", proxyHandler.CORS(eventStream))
+	// Tell monitoring, and the Alma plugin, whether the reader service is up.
+	health := NewHealth(upstreamClient, proxyHandler.DefaultUpstream, *station)
+	health.Environments = proxyHandler
+	mux.Handle("/healthz", proxyHandler.CORS(health))
+	mux.HandleFunc("/livez", health.ServeLive)
+	mux.HandleFunc("/readyz", health.ServeReady)
+	mux.Handle("/version", VersionHandler{Station: *station})
+	mux.Handle(AdminPrefix+"metrics", AdminOnly(metrics))
+	// Serve Prometheus metrics for scraping, on the admin address if there is
+	// one, or otherwise only to this computer.
+	adminMux := mux
+	if *adminAddress != "" {
+		adminMux = http.NewServeMux()
+	}
+	var prometheus http.Handler = PrometheusHandler{Metrics: metrics}
+	if *adminAddress == "" {
+		prometheus = AdminOnly(prometheus)
+	}
+	adminMux.Handle("/metrics", prometheus)
+	if adminMux != mux {
+		adminMux.Handle("/version", VersionHandler{Station: *station})
+	}
+	// Publish a few counters with expvar, for a quick look with curl.
+	PublishExpvars(metrics)
+	var vars http.Handler = http.HandlerFunc(ExpvarHandler)
+	if *adminAddress == "" {
+		vars = AdminOnly(vars)
+	}
+	adminMux.Handle("/debug/vars", vars)
+	// Serve profiles, for finding leaks on a workstation, if asked to.
+	if *enablePprof {
+		profiles := PprofHandler()
+		if *adminAddress == "" {
+			profiles = AdminOnly(profiles)
+		}
+		adminMux.Handle("/debug/pprof/", profiles)
+		slog.Warn("Serving Go profiles at /debug/pprof/.")
+	}
+	mux.HandleFunc("/client.js", ServeClientJS)
+	var updates *UpdateChecker
+	if *updateCheckInterval > 0 {
+		updates, err = NewUpdateChecker(*updateURL, *updateCheckInterval)
+		if err != nil {
+			fatal("Unable to check for updates.", "error", err)
+		}
+	}
+	diagnostics := NewDiagnostics(proxyHandler.Defaults.Upstream, *origin, *station)
+	diagnostics.Updates = updates
+	mux.Handle("/diagnostics", AdminOnly(diagnostics))
+	selfTest := AdminOnly(NewSelfTest(proxyHandler, *station))
+	mux.Handle(SelfTestPrefix, selfTest)
+	mux.Handle(SelfTestPrefix+"/", selfTest)
+	mux.Handle(AdminPrefix+"responses", AdminOnly(responses))
+	mux.Handle(AdminPrefix+"recent", AdminOnly(recent))
+	statusPage := NewStatusPage(metrics, alarm, *station)
+	statusPage.Environments = proxyHandler
+	mux.Handle(AdminPrefix+"status", AdminOnly(statusPage))
+	dashboard := NewDashboard(health, metrics, alarm, recent, flag.CommandLine, *station)
+	dashboard.Updates = updates
+	mux.Handle("/admin", AdminOnly(dashboard))
+	mux.Handle(AdminPrefix+"bundle", AdminOnly(&Bundle{Config: configFile, Redactor: redactor, Tail: tail, LogFile: *logFile, Started: time.Now()}))
+	mux.Handle(AdminPrefix, AdminOnly(dashboard))
+
+	// Shed load once the process is over capacity.
+	shedder := &LoadShedder{
+		MaxInFlight:   *maxInFlight,
+		MaxGoroutines: *maxGoroutines,
+		MaxHeapBytes:  *maxHeapMB << 20,
+		CORS:          proxyHandler.CORS,
+	}
+
+	// Don't let slow clients hold on to requests.
+	guard := &SlowClientGuard{
+		Timeout:  *clientTimeout,
+		MinRate:  *minClientRate,
+		Timeouts: timeouts,
+	}
+
+	// Track connections and requests, so we can report on them while shutting down.
+	drain := NewDrainTracker()
+	health.Draining = drain.Draining
+
+	handler := shedder.Middleware(guard.Middleware(mux))
+	if *accessLog {
+		access, err := NewAccessLog(*accessLogInclude, *accessLogExclude, *accessLogFormat, os.Stdout)
+		if err != nil {
+			fatal(err.Error())
+		}
+		access.Redactor = redactor
+		handler = access.Middleware(handler)
+	}
+	// Every request gets an ID, for matching errors to the logs.
+	handler = RequestIDMiddleware(handler)
 
 	server := http.Server{
 		Addr:              *addr,
-		Handler:           mux,
+		Handler:           drain.Middleware(handler),
 		ReadHeaderTimeout: 5 * time.Second,
+		IdleTimeout:       ServerIdleTimeout,
+		ConnState:         drain.ConnState,
+	}
+
+	// End the event streams when shutting down, rather than waiting for browsers to close them.
+	server.RegisterOnShutdown(eventStream.Close)
+
+	// Serve HTTPS, if a certificate was given. The handshake must finish
+	// within the ReadHeaderTimeout.
+	// The certificate is loaded again when the configuration is reloaded.
+	var certReloader *CertReloader
+	if *tlsCert != "" || *tlsKey != "" {
+		if *acmeHost != "" {
+			fatal("Use either -acme-host or -tls-cert, not both.")
+		}
+		if *tlsCert == "" || *tlsKey == "" {
+			fatal("Both -tls-cert and -tls-key are needed to serve HTTPS.")
+		}
+		certReloader, err = NewCertReloader(*tlsCert, *tlsKey)
+		if err != nil {
+			fatal(err.Error())
+		}
+		server.TLSConfig = NewServerTLSConfig(certReloader, *fips)
+		health.TLS = certReloader.Check
+	}
+
+	// Or get certificates from Let's Encrypt, for a proxy with a real host name.
+	var acmeManager *autocert.Manager
+	if *acmeHost != "" {
+		acmeManager, err = NewACMEManager(splitList(*acmeHost), *acmeCache, *acmeEmail, *acmeDirectory)
+		if err != nil {
+			fatal(err.Error())
+		}
+		server.TLSConfig = NewACMETLSConfig(acmeManager, *fips)
+		slog.Info("Getting TLS certificates with ACME.", "hosts", *acmeHost, "cache", *acmeCache)
+	}
+
+	// Require callers to present a client certificate from our CA, if asked to.
+	if *clientCA != "" {
+		if server.TLSConfig == nil {
+			fatal("Client certificates can only be required over HTTPS, with -tls-cert and -tls-key, or -acme-host.")
+		}
+		err = RequireClientCerts(server.TLSConfig, *clientCA)
+		if err != nil {
+			fatal(err.Error())
+		}
+		slog.Info("Requiring client certificates.", "ca", *clientCA)
 	}
 
 	// Keep track of child goroutines.
 	var running sync.WaitGroup
 
+	// Background monitors run until this context is cancelled.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	running.Add(1)
+	go func() {
+		defer running.Done()
+		defer reporter.Recover()
+		shedder.Monitor(ctx)
+	}()
+
+	if metrics.StatsD != nil {
+		running.Add(1)
+		go func() {
+			defer running.Done()
+			defer reporter.Recover()
+			metrics.StatsD.Run(ctx)
+		}()
+	}
+
+	if tracer != nil {
+		running.Add(1)
+		go func() {
+			defer running.Done()
+			defer reporter.Recover()
+			tracer.Run(ctx)
+		}()
+	}
+
+	// Publish Windows performance counters, if asked to.
+	if *perfCounters {
+		counters, err := NewPerfCounters(metrics)
+		if err != nil {
+			fatal(err.Error())
+		}
+		slog.Info("Publishing performance counters.")
+		running.Add(1)
+		go func() {
+			defer running.Done()
+			defer reporter.Recover()
+			counters.Run(ctx)
+		}()
+	}
+
+	// Answer ACME HTTP challenges, so certificates can be issued and renewed.
+	if acmeManager != nil && *acmeHTTPAddress != "" {
+		listener, err := net.Listen("tcp", *acmeHTTPAddress)
+		if err != nil {
+			fatal("Unable to listen for ACME challenges.", "address", *acmeHTTPAddress, "error", err)
+		}
+		running.Add(1)
+		go func() {
+			defer running.Done()
+			defer reporter.Recover()
+			ServeACMEChallenges(ctx, acmeManager, listener)
+		}()
+	}
+
+	// Serve the admin endpoints on their own address, if one was set.
+	if *adminAddress != "" {
+		listener, err := net.Listen("tcp", *adminAddress)
+		if err != nil {
+			fatal("Unable to listen on the admin address.", "address", *adminAddress, "error", err)
+		}
+		slog.Info("Serving admin endpoints.", "address", listener.Addr())
+		running.Add(1)
+		go func() {
+			defer running.Done()
+			defer reporter.Recover()
+			ServeAdmin(ctx, adminMux, listener)
+		}()
+	}
+
+	// Answer SNMP requests, if an address was set.
+	if *snmpAddress != "" {
+		agent, err := NewSNMPAgent(*snmpAddress, *snmpCommunity, *snmpBaseOID, metrics, alarm)
+		if err != nil {
+			fatal(err.Error())
+		}
+		slog.Info("Answering SNMP requests.", "address", agent.Addr(), "base_oid", *snmpBaseOID)
+		running.Add(1)
+		go func() {
+			defer running.Done()
+			defer reporter.Recover()
+			agent.Run(ctx)
+		}()
+	}
+
+	// Log a summary of the day's requests, if a time was set.
+	if *digestAt != "" {
+		at, err := ParseDigestTime(*digestAt)
+		if err != nil {
+			fatal(err.Error())
+		}
+		digest, err := NewDigest(metrics, *station, at, *digestWebhook, *digestToken)
+		if err != nil {
+			fatal(err.Error())
+		}
+		slog.Info("Making a daily digest.", "at", *digestAt)
+		running.Add(1)
+		go func() {
+			defer running.Done()
+			defer reporter.Recover()
+			digest.Run(ctx)
+		}()
+	}
+
 	// Graceful shutdown on SIGINT or SIGTERM.
 	shutdown := make(chan struct{})
 
 	// Ungraceful shutdown on internal error.
 	errshutdown := make(chan struct{})
 
-	// Run a goroutine to respond to SIGINT and SIGTERM signals.
+	// Publish tag events to an MQTT broker, if one was configured.
+	if *mqttBroker != "" {
+		clientID := *mqttClientID
+		if clientID == "" {
+			clientID = "almarfidintercept-" + hostname()
+		}
+		publisher, err := NewMQTTPublisher(*mqttBroker, *mqttTopic, clientID, *mqttUsername, *mqttPassword)
+		if err != nil {
+			fatal(err.Error())
+		}
+		publisher.FIPS = *fips
+		slog.Info("Publishing tag events to MQTT broker.", "broker", publisher.Broker.Host)
+		events := bus.Subscribe()
+		running.Add(1)
+		go func() {
+			defer running.Done()
+			defer reporter.Recover()
+			publisher.Run(ctx, events)
+		}()
+	}
+
+	// Post tag events to webhooks, if any were configured.
+	if *webhooks != "" {
+		types, err := ParseEventTypes(*webhookEvents)
+		if err != nil {
+			fatal(err.Error())
+		}
+		for _, receiver := range splitList(*webhooks) {
+			webhook, err := NewWebhook(receiver, types)
+			if err != nil {
+				fatal(err.Error())
+			}
+			slog.Info("Posting events to webhook.", "events", *webhookEvents, "webhook", webhook.URL.Host)
+			events := bus.Subscribe()
+			running.Add(1)
+			go func() {
+				defer running.Done()
+				defer reporter.Recover()
+				webhook.Run(events)
+			}()
+		}
+	}
+
+	// Forward arm and disarm results to the security gate system, if one was configured.
+	if *gateAPI != "" {
+		gate, err := NewGateForwarder(*gateAPI, *gateToken, *station)
+		if err != nil {
+			fatal(err.Error())
+		}
+		slog.Info("Forwarding security results to security gate system.", "gate", gate.URL.Host)
+		events := bus.Subscribe()
+		running.Add(1)
+		go func() {
+			defer running.Done()
+			defer reporter.Recover()
+			gate.Run(events)
+		}()
+	}
+
+	// Print checkout slips, if a printer or spool directory was configured.
+	if *receiptPrinter != "" || *receiptSpool != "" {
+		if *receiptSpool != "" {
+			info, err := os.Stat(*receiptSpool)
+			if err != nil {
+				fatal(err.Error())
+			}
+			if !info.IsDir() {
+				fatal("Receipt spool is not a directory.", "spool", *receiptSpool)
+			}
+		}
+		printer := &ReceiptPrinter{
+			Printer: *receiptPrinter,
+			Spool:   *receiptSpool,
+			Title:   *receiptTitle,
+			Station: *station,
+		}
+		slog.Info("Printing checkout slips.")
+		events := bus.Subscribe()
+		running.Add(1)
+		go func() {
+			defer running.Done()
+			defer reporter.Recover()
+			printer.Run(events)
+		}()
+	}
+
+	// reload applies the config file and institutions file again. Requests in
+	// flight finish with the configuration they started with. Everything is
+	// loaded before anything is applied, so a bad file changes nothing.
+	reload := func() {
+		values, err := configFile.Reload()
+		if err != nil {
+			slog.Error("Unable to reload configuration, keeping the current configuration.", "error", err)
+			return
+		}
+		settings, err := NewReloadableSettings(values)
+		if err != nil {
+			slog.Error("Unable to reload configuration, keeping the current configuration.", "error", err)
+			return
+		}
+		if (settings.TLSCert != "") != (certReloader != nil) {
+			slog.Error("Turning HTTPS on or off needs a restart, keeping the current configuration.", "tls_cert", settings.TLSCert)
+			return
+		}
+		// The default reader service is the first in the pool, so the pool
+		// is rebuilt when it changes.
+		var pool *UpstreamPool
+		poolChanged := settings.Upstream != reloadable.Upstream
+		if poolChanged {
+			pool, err = NewUpstreamPool(append([]string{settings.Upstream}, splitList(*proxyPool)...), *balance)
+			if err != nil {
+				slog.Error("Unable to reload configuration, keeping the current configuration.", "error", err)
+				return
+			}
+		}
+		reloaded, err := loadInstitutions()
+		if err != nil {
+			slog.Error("Unable to reload configuration, keeping the current configuration.", "error", err)
+			return
+		}
+		// The certificate is swapped in as it loads, so it goes last.
+		if certReloader != nil {
+			err = certReloader.Reload(settings.TLSCert, settings.TLSKey)
+			if err != nil {
+				reloaded.Close()
+				slog.Error("Unable to reload configuration, keeping the current configuration.", "error", err)
+				return
+			}
+		}
+		newLevel, _ := settings.Level()
+		level.Set(newLevel)
+		proxyHandler.SetDefaults(NewProfile("Default", settings.Origin, settings.Upstream, settings.Environment))
+		if poolChanged {
+			proxyHandler.SetPool(pool)
+		}
+		diagnostics.SetTarget(settings.Upstream, settings.Origin)
+		old := proxyHandler.SetInstitutions(reloaded)
+		logConfigChanges(map[string]any{"settings": reloadable, "institutions": old},
+			map[string]any{"settings": settings, "institutions": reloaded})
+		reloadable = settings
+		old.CloseUnused(reloaded)
+	}
+
+	// Run a goroutine to reload the configuration on SIGHUP.
 	running.Add(1)
 	go func() {
 		defer running.Done()
+		defer reporter.Recover()
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		for {
+			select {
+			case <-hup:
+				slog.Info("Received SIGHUP, reloading.", "config", *configPath, "institutions", *institutionsPath)
+				reload()
+			case <-shutdown:
+				return
+			case <-errshutdown:
+				return
+			}
+		}
+	}()
+
+	// Run a goroutine to respond to SIGINT and SIGTERM signals,
+	// and to the Windows service being stopped.
+	running.Add(1)
+	go func() {
+		defer running.Done()
+		defer reporter.Recover()
 		sigs := make(chan os.Signal, 1)
 		signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
 		select {
 		case <-sigs:
-			err := server.Shutdown(context.Background())
-			if err != nil {
-				log.Printf("Error shutting down server, %v.\n", err)
-			}
-			close(shutdown)
+		case <-serviceStop:
 		case <-errshutdown:
+			return
+		}
+		slog.Info("Shutting down, waiting for in-flight requests to finish.")
+		err := SystemdNotify("STOPPING=1\nSTATUS=Waiting for in-flight requests to finish.")
+		if err != nil {
+			slog.Warn("Unable to tell systemd the proxy is stopping.", "error", err)
 		}
+		summary := drain.Shutdown(&server, *shutdownTimeout)
+		slog.Info("Drain finished.", "summary", summary)
+		close(shutdown)
 	}()
 
-	log.Println("Starting server.")
-	err = server.ListenAndServe()
-	// ListenAndServe() always returns a non-nil error.
+	// Start the vendor's RFID software, and keep it running, if asked to.
+	var supervised sync.WaitGroup
+	if supervisor != nil {
+		running.Add(1)
+		supervised.Add(1)
+		go func() {
+			defer running.Done()
+			defer supervised.Done()
+			defer reporter.Recover()
+			supervisor.Run(ctx)
+		}()
+	}
+
+	// Check the reader service answers, if asked to, once any RFID
+	// software run by the supervisor has had time to start.
+	if *requireUpstream {
+		if down := health.ProbeUpstreams(ctx, proxyHandler.Upstreams(), RequireUpstreamWait); down != nil {
+			// Stop the RFID software, rather than leave it running without the proxy.
+			cancel()
+			supervised.Wait()
+			fatal("The reader service isn't answering, and -require-upstream is set. Check the RFID software is running, and -proxy is its address.",
+				"upstream", down.Address, "error", down.Error)
+		}
+		slog.Info("The reader service is answering.", "upstreams", proxyHandler.Upstreams())
+	}
+
+	slog.Info("Starting server.")
+	// Use the sockets systemd passed with socket activation, if it did.
+	listeners, err := SystemdListeners()
+	switch {
+	case err == nil && listeners != nil:
+		slog.Info("Using the sockets passed by systemd, instead of -address.", "sockets", len(listeners))
+	case err == nil:
+		listeners, err = Listen(*ipVersion, server.Addr)
+	}
+	if err == nil {
+		scheme := "http"
+		if server.TLSConfig != nil {
+			scheme = "https"
+		}
+		for i, listener := range listeners {
+			if server.TLSConfig != nil {
+				listeners[i] = tls.NewListener(listener, server.TLSConfig)
+			}
+			slog.Info("Listening.", "address", listener.Addr(), "scheme", scheme)
+		}
+		// Once we are listening, open connections to the reader services,
+		// and keep them open, so they are ready for the first request.
+		if *warmUpInterval > 0 {
+			warmer := &Warmer{Client: upstreamClient, Upstreams: proxyHandler.Upstreams, Interval: *warmUpInterval}
+			running.Add(1)
+			go func() {
+				defer running.Done()
+				defer reporter.Recover()
+				warmer.Run(ctx)
+			}()
+		}
+		// Poll for tags while browsers are listening for events.
+		running.Add(1)
+		go func() {
+			defer running.Done()
+			defer reporter.Recover()
+			eventStream.Run(ctx)
+		}()
+		// Check for newer releases, if asked to.
+		if updates != nil {
+			running.Add(1)
+			go func() {
+				defer running.Done()
+				defer reporter.Recover()
+				updates.Run(ctx)
+			}()
+		}
+		// Keep the vendor's reader session alive when idle, if asked to.
+		if *heartbeatInterval > 0 {
+			heartbeat := &Heartbeat{
+				Client:      upstreamClient,
+				Upstreams:   proxyHandler.Upstreams,
+				Path:        *heartbeatPath,
+				SOAPAction:  *heartbeatSOAPAction,
+				Interval:    *heartbeatInterval,
+				Queue:       proxyHandler.Queue,
+				LastRequest: proxyHandler.LastUpstream,
+			}
+			slog.Info("Sending heartbeats to the reader service when idle.", "interval", *heartbeatInterval, "path", *heartbeatPath)
+			running.Add(1)
+			go func() {
+				defer running.Done()
+				defer reporter.Recover()
+				heartbeat.Run(ctx)
+			}()
+		}
+		// Serve any extra listeners, like ::1 as well as 127.0.0.1, alongside the first.
+		for _, listener := range listeners[1:] {
+			listener := listener
+			running.Add(1)
+			go func() {
+				defer running.Done()
+				defer reporter.Recover()
+				err := server.Serve(listener)
+				if !errors.Is(err, http.ErrServerClosed) {
+					slog.Error("Unable to serve.", "address", listener.Addr(), "error", err)
+				}
+			}()
+		}
+		// Tell systemd, with a Type=notify unit, that the proxy is ready.
+		notifyErr := SystemdNotify("READY=1\nSTATUS=Serving requests.")
+		if notifyErr != nil {
+			slog.Warn("Unable to tell systemd the proxy is ready.", "error", notifyErr)
+		}
+		err = server.Serve(listeners[0])
+	}
+	// Serve() always returns a non-nil error.
 	// The expected error here is ErrServerClosed, which is
 	// returned when Shutdown() is called after SIGINT or SIGTERM
 	// are captured.
 	if !errors.Is(err, http.ErrServerClosed) {
-		log.Printf("FATAL: Server error, %v.\n", err)
+		reporter.Report(fmt.Sprintf("Server error, %v.", err))
+		server.Close()
 		close(errshutdown)
+		cancel()
+		bus.Close()
 		running.Wait()
+		gelf.Close()
+		syslog.Close()
+		if *pidFile != "" {
+			RemovePIDFile(*pidFile)
+		}
 		os.Exit(1)
 	}
 
 	// Wait for subprocesses to exit.
-	// Since ListenAndServe() returned ErrServerClosed,
+	// Since Serve() returned ErrServerClosed,
 	// Shutdown() was called from the signal handler above.
 	// That handler will wait for Shutdown() to return.
 	// Then, it will close the shutdown channel and exit,
 	// which also causes the SIGHUP handler to exit.
 	// When the two handlers exit, the waitgroup counter will be zero,
 	// and the call to Wait() will stop blocking.
+	// Cancelling the context stops the monitors, and closing the
+	// event bus lets the event publishers drain and exit.
+	cancel()
+	bus.Close()
 	running.Wait()
-	log.Println("Server stopped.")
+	proxyHandler.SetInstitutions(nil).Close()
+	slog.Info("Server stopped.")
+	gelf.Close()
+	syslog.Close()
+	if *pidFile != "" {
+		RemovePIDFile(*pidFile)
+	}
+	serviceStopped()
+}
+
+// logConfigChanges logs what differs between two configurations.
+func logConfigChanges(old, new any) {
+	changes, err := DiffConfig(old, new)
+	if err != nil {
+		slog.Error("Unable to compare configurations.", "error", err)
+		return
+	}
+	if len(changes) == 0 {
+		slog.Info("Configuration reloaded, nothing changed.")
+		return
+	}
+	slog.Info("Configuration reloaded.", "changes", len(changes))
+	for _, change := range changes {
+		slog.Info("Configuration change.", "change", change)
+	}
 }
@@ -0,0 +1,117 @@
+// Copyright 2023 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// DefaultRestartHelp tells staff how to get the reader service running again.
+const DefaultRestartHelp = "Restart the RFID software on this computer, or restart the computer. " +
+	"If the problem continues, contact the help desk."
+
+// maintenancePage is shown to staff when the reader service can't be reached.
+const maintenancePage = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>RFID unavailable</title>
+<style>
+body { font-family: sans-serif; max-width: 40em; margin: 2em auto; padding: 0 1em; }
+.box { border: 2px solid #c00; border-radius: 6px; padding: 1em 1.5em; }
+h1 { color: #c00; font-size: 1.4em; }
+.details { color: #555; font-size: 0.9em; }
+</style>
+</head>
+<body>
+<div class="box">
+<h1>The RFID software on this computer isn't running</h1>
+<p>The RFID pad can't be used until it is running again.</p>
+<p><strong>{{.Help}}</strong></p>
+<p class="details">Computer: {{.Station}}<br>
+Reason: {{.Reason}}<br>
+{{with .RequestID}}Request ID: {{.}}<br>
+{{end}}Time: {{.Time.Format "2006-01-02 15:04:05"}}</p>
+</div>
+</body>
+</html>
+`
+
+// Unavailable is the payload sent to the browser when the reader service can't be reached.
+type Unavailable struct {
+	Error     string    `json:"error"`
+	Reason    string    `json:"reason"`
+	Help      string    `json:"help"`
+	Station   string    `json:"station"`
+	RequestID string    `json:"request_id,omitempty"`
+	Time      time.Time `json:"time"`
+}
+
+// MaintenancePage serves a short explanation of what's wrong and how to fix it,
+// instead of a bare error, when the reader service is down.
+type MaintenancePage struct {
+	Help    string
+	Station string
+
+	page *template.Template
+}
+
+// NewMaintenancePage returns a MaintenancePage with the given restart instructions.
+func NewMaintenancePage(help, station string) *MaintenancePage {
+	return &MaintenancePage{
+		Help:    help,
+		Station: station,
+		page:    template.Must(template.New("maintenance").Parse(maintenancePage)),
+	}
+}
+
+// Serve writes the maintenance payload with a 503 status. Browsers asking for
+// HTML get a page staff can read, everything else, like the Alma RFID
+// integration's XHR calls, gets JSON.
+func (m *MaintenancePage) Serve(w http.ResponseWriter, r *http.Request, reason string) {
+	payload := Unavailable{
+		Error:     "RFID software unavailable",
+		Reason:    reason,
+		Help:      m.Help,
+		Station:   m.Station,
+		RequestID: RequestID(r.Context()),
+		Time:      time.Now(),
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	// The circuit breaker knows better when to try again.
+	if w.Header().Get("Retry-After") == "" {
+		w.Header().Set("Retry-After", "5")
+	}
+	if strings.Contains(r.Header.Get("Accept"), "text/html") {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		err := m.page.Execute(w, payload)
+		if err != nil {
+			slog.Error("Unable to render maintenance page.", "error", err)
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	err := json.NewEncoder(w).Encode(payload)
+	if err != nil {
+		slog.Error("Unable to write maintenance response.", "error", err)
+	}
+}
+
+// hostname returns the name of this computer, or an empty string if it can't be found.
+func hostname() string {
+	name, err := os.Hostname()
+	if err != nil {
+		return ""
+	}
+	return name
+}
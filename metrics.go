@@ -0,0 +1,211 @@
+// Copyright 2023 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Metrics counts the requests the proxy serves.
+//
+// CORS preflight requests are counted separately from the requests they
+// precede, by the method they ask permission for, since most CORS problems
+// show up as failing preflights which never reach the reader service.
+type Metrics struct {
+	// Objectives, if set, are reported with the metrics.
+	Objectives *ObjectiveTracker
+
+	// StatsD, if set, is sent each request and upstream call as well.
+	StatsD *StatsD
+
+	start time.Time
+
+	inFlight atomic.Int64
+
+	mu                 sync.Mutex
+	requests           int64
+	responses          map[string]int64 // By status class, like 2xx.
+	statuses           map[int]int64    // By status code.
+	preflights         int64
+	preflightMethods   map[string]int64
+	preflightResponses map[string]int64
+	operations         map[string]*OperationStats
+	latencyEWMA        time.Duration // Of every upstream request.
+}
+
+// OperationStats count the upstream requests for one operation, like getitems.
+type OperationStats struct {
+	Requests     int64         `json:"requests"`
+	Failures     int64         `json:"failures"`
+	TotalLatency time.Duration `json:"-"`
+	MeanLatency  string        `json:"mean_latency"`
+	Buckets      []int64       `json:"-"` // Requests at or under each of LatencyBuckets.
+}
+
+// LatencyEWMAWeight is the weight of each upstream request in the
+// exponentially weighted moving average of upstream latency.
+const LatencyEWMAWeight = 0.1
+
+// LatencyBuckets returns the upper bounds of the upstream latency histogram buckets.
+func LatencyBuckets() []time.Duration {
+	return []time.Duration{
+		5 * time.Millisecond, 10 * time.Millisecond, 25 * time.Millisecond, 50 * time.Millisecond,
+		100 * time.Millisecond, 250 * time.Millisecond, 500 * time.Millisecond,
+		time.Second, 2500 * time.Millisecond, 5 * time.Second, 10 * time.Second,
+	}
+}
+
+// MetricsSnapshot is a copy of the metrics at one point in time.
+type MetricsSnapshot struct {
+	Uptime             string                    `json:"uptime"`
+	Requests           int64                     `json:"requests"`
+	Responses          map[string]int64          `json:"responses"`
+	Statuses           map[int]int64             `json:"statuses"`
+	InFlight           int64                     `json:"in_flight"`
+	Preflights         int64                     `json:"preflights"`
+	PreflightMethods   map[string]int64          `json:"preflight_methods"`
+	PreflightResponses map[string]int64          `json:"preflight_responses"`
+	Operations         map[string]OperationStats `json:"operations"`
+	Objectives         []ObjectiveReport         `json:"latency_objectives,omitempty"`
+}
+
+// NewMetrics returns Metrics with every count at zero.
+func NewMetrics() *Metrics {
+	return &Metrics{
+		start:              time.Now(),
+		responses:          make(map[string]int64),
+		statuses:           make(map[int]int64),
+		preflightMethods:   make(map[string]int64),
+		preflightResponses: make(map[string]int64),
+		operations:         make(map[string]*OperationStats),
+	}
+}
+
+// ObserveUpstream counts an upstream request for an operation, and how long it took.
+func (m *Metrics) ObserveUpstream(operation string, latency time.Duration, failed bool) {
+	if m == nil {
+		return
+	}
+	m.StatsD.Upstream(operation, latency, failed)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stats, ok := m.operations[operation]
+	if !ok {
+		stats = &OperationStats{Buckets: make([]int64, len(LatencyBuckets()))}
+		m.operations[operation] = stats
+	}
+	if m.latencyEWMA == 0 {
+		m.latencyEWMA = latency
+	} else {
+		m.latencyEWMA += time.Duration(LatencyEWMAWeight * float64(latency-m.latencyEWMA))
+	}
+	stats.Requests++
+	stats.TotalLatency += latency
+	for i, bound := range LatencyBuckets() {
+		if latency <= bound {
+			stats.Buckets[i]++
+		}
+	}
+	if failed {
+		stats.Failures++
+	}
+}
+
+// Middleware wraps a handler, counting its requests and responses,
+// and the requests in flight.
+func (m *Metrics) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		recorder := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		m.inFlight.Add(1)
+		next.ServeHTTP(recorder, r)
+		m.inFlight.Add(-1)
+		class := fmt.Sprintf("%dxx", recorder.status/100)
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if isPreflight(r) {
+			m.preflights++
+			m.preflightMethods[r.Header.Get("Access-Control-Request-Method")]++
+			m.preflightResponses[class]++
+			return
+		}
+		m.StatsD.Request(recorder.status)
+		m.requests++
+		m.responses[class]++
+		m.statuses[recorder.status]++
+	})
+}
+
+// Snapshot returns a copy of the metrics.
+func (m *Metrics) Snapshot() MetricsSnapshot {
+	objectives := m.Objectives.Report()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := MetricsSnapshot{
+		Uptime:             time.Since(m.start).Round(time.Second).String(),
+		Requests:           m.requests,
+		Responses:          copyCounts(m.responses),
+		Statuses:           make(map[int]int64, len(m.statuses)),
+		InFlight:           m.inFlight.Load(),
+		Preflights:         m.preflights,
+		PreflightMethods:   copyCounts(m.preflightMethods),
+		PreflightResponses: copyCounts(m.preflightResponses),
+		Operations:         make(map[string]OperationStats, len(m.operations)),
+		Objectives:         objectives,
+	}
+	for status, count := range m.statuses {
+		s.Statuses[status] = count
+	}
+	for operation, stats := range m.operations {
+		s.Operations[operation] = stats.withMean()
+	}
+	return s
+}
+
+// LatencyEWMA returns the exponentially weighted moving average of upstream
+// latency, which follows recent requests more closely than the mean.
+func (m *Metrics) LatencyEWMA() time.Duration {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.latencyEWMA
+}
+
+// ServeHTTP writes a snapshot of the metrics as JSON.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.SetEscapeHTML(false)
+	encoder.Encode(m.Snapshot())
+}
+
+// withMean returns a copy of the stats with the mean latency filled in.
+// The buckets are copied too.
+func (o OperationStats) withMean() OperationStats {
+	o.Buckets = append([]int64(nil), o.Buckets...)
+	if o.Requests > 0 {
+		o.MeanLatency = (o.TotalLatency / time.Duration(o.Requests)).Round(time.Millisecond).String()
+	}
+	return o
+}
+
+// copyCounts returns a copy of a map of counts.
+func copyCounts(counts map[string]int64) map[string]int64 {
+	c := make(map[string]int64, len(counts))
+	for key, count := range counts {
+		c[key] = count
+	}
+	return c
+}
+
+// isPreflight reports whether a request is a CORS preflight request.
+func isPreflight(r *http.Request) bool {
+	return r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+}
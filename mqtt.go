@@ -0,0 +1,273 @@
+// Copyright 2023 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// MQTTKeepAlive is how often we ping the broker when no events are published.
+	MQTTKeepAlive = 60 * time.Second
+
+	// MQTTDialTimeout is how long we wait to connect to the broker.
+	MQTTDialTimeout = 5 * time.Second
+
+	// MQTTWriteTimeout is how long we wait for the broker to take a packet.
+	MQTTWriteTimeout = 10 * time.Second
+
+	// MQTT 3.1.1 control packet types, pre-shifted into the high nibble.
+	mqttConnect    byte = 0x10
+	mqttConnack    byte = 0x20
+	mqttPublish    byte = 0x30
+	mqttPingreq    byte = 0xC0
+	mqttDisconnect byte = 0xE0
+)
+
+// ErrMQTTConnectRefused is returned when the broker rejects our connection.
+var ErrMQTTConnectRefused = errors.New("mqtt broker refused connection")
+
+// ErrMQTTScheme is returned when the broker URL has an unknown scheme.
+var ErrMQTTScheme = errors.New("mqtt broker scheme must be tcp, mqtt, ssl, tls, or mqtts")
+
+// MQTTPublisher publishes events to an MQTT broker at QoS 0.
+// Each event is sent as JSON to Topic/<event type>, with the dots in
+// the event type replaced by slashes, like Topic/tag/appear.
+type MQTTPublisher struct {
+	Broker   *url.URL
+	Topic    string
+	ClientID string
+	Username string
+	Password string
+
+	// FIPS restricts TLS to FIPS 140 approved algorithms.
+	FIPS bool
+
+	mu   sync.Mutex // Guards conn, which is closed from another goroutine on shutdown.
+	conn net.Conn
+}
+
+// NewMQTTPublisher parses the broker URL and returns a publisher for it.
+func NewMQTTPublisher(broker, topic, clientID, username, password string) (*MQTTPublisher, error) {
+	brokerURL, err := url.Parse(broker)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse mqtt broker address: %w", err)
+	}
+	switch brokerURL.Scheme {
+	case "tcp", "mqtt", "ssl", "tls", "mqtts":
+	default:
+		return nil, ErrMQTTScheme
+	}
+	return &MQTTPublisher{
+		Broker:   brokerURL,
+		Topic:    strings.TrimSuffix(topic, "/"),
+		ClientID: clientID,
+		Username: username,
+		Password: password,
+	}, nil
+}
+
+// Run publishes events until the channel is closed.
+// Connection failures are logged, and the event that failed is dropped.
+// When ctx is cancelled, the connection is closed, so a broker which has
+// stopped reading can't hold up shutdown, and the remaining events are dropped.
+func (p *MQTTPublisher) Run(ctx context.Context, events <-chan Event) {
+	ping := time.NewTicker(MQTTKeepAlive / 2)
+	defer ping.Stop()
+	defer p.close(true)
+	stop := context.AfterFunc(ctx, func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if p.conn != nil {
+			p.conn.Close()
+		}
+	})
+	defer stop()
+	for {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				return
+			}
+			if ctx.Err() != nil {
+				continue
+			}
+			payload, err := json.Marshal(e)
+			if err != nil {
+				slog.Error("Unable to encode event for MQTT.", "type", e.Type, "error", err)
+				continue
+			}
+			topic := p.Topic + "/" + strings.ReplaceAll(string(e.Type), ".", "/")
+			err = p.send(mqttPublish, encodeMQTTString(topic), payload)
+			if err != nil {
+				slog.Error("Unable to publish event to MQTT broker.", "type", e.Type, "broker", p.Broker.Host, "error", err)
+			}
+		case <-ping.C:
+			if p.conn != nil && ctx.Err() == nil {
+				err := p.send(mqttPingreq)
+				if err != nil {
+					slog.Error("Unable to ping MQTT broker.", "broker", p.Broker.Host, "error", err)
+				}
+			}
+		}
+	}
+}
+
+// send writes a packet to the broker, connecting first if needed.
+// If the write fails, or takes longer than MQTTWriteTimeout, the connection
+// is dropped so the next send reconnects.
+func (p *MQTTPublisher) send(packetType byte, parts ...[]byte) error {
+	if p.conn == nil {
+		err := p.connect()
+		if err != nil {
+			return err
+		}
+	}
+	err := p.conn.SetWriteDeadline(time.Now().Add(MQTTWriteTimeout))
+	if err == nil {
+		_, err = p.conn.Write(encodeMQTTPacket(packetType, parts...))
+	}
+	if err != nil {
+		p.close(false)
+	}
+	return err
+}
+
+// connect dials the broker and completes the MQTT handshake.
+func (p *MQTTPublisher) connect() error {
+	host := p.Broker.Host
+	secure := p.Broker.Scheme == "ssl" || p.Broker.Scheme == "tls" || p.Broker.Scheme == "mqtts"
+	if p.Broker.Port() == "" {
+		if secure {
+			host = net.JoinHostPort(host, "8883")
+		} else {
+			host = net.JoinHostPort(host, "1883")
+		}
+	}
+
+	dialer := &net.Dialer{Timeout: MQTTDialTimeout}
+	var conn net.Conn
+	var err error
+	if secure {
+		config := &tls.Config{
+			ServerName: p.Broker.Hostname(),
+			MinVersion: tls.VersionTLS12,
+		}
+		if p.FIPS {
+			config = FIPSTLSConfig(config)
+		}
+		conn, err = tls.DialWithDialer(dialer, "tcp", host, config)
+	} else {
+		conn, err = dialer.Dial("tcp", host)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to connect: %w", err)
+	}
+
+	// Protocol name, protocol level 4 (3.1.1), connect flags, keep alive.
+	flags := byte(0x02) // Clean session.
+	payload := [][]byte{encodeMQTTString(p.ClientID)}
+	if p.Username != "" {
+		flags |= 0x80
+		payload = append(payload, encodeMQTTString(p.Username))
+		if p.Password != "" {
+			flags |= 0x40
+			payload = append(payload, encodeMQTTString(p.Password))
+		}
+	}
+	keepAlive := uint16(MQTTKeepAlive / time.Second)
+	variable := append(encodeMQTTString("MQTT"), 4, flags, byte(keepAlive>>8), byte(keepAlive))
+
+	err = conn.SetDeadline(time.Now().Add(MQTTDialTimeout))
+	if err == nil {
+		_, err = conn.Write(encodeMQTTPacket(mqttConnect, append([][]byte{variable}, payload...)...))
+	}
+	connack := make([]byte, 4)
+	if err == nil {
+		_, err = io.ReadFull(conn, connack)
+	}
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("unable to complete handshake: %w", err)
+	}
+	if connack[0] != mqttConnack || connack[3] != 0 {
+		conn.Close()
+		return fmt.Errorf("%w, return code %v", ErrMQTTConnectRefused, connack[3])
+	}
+	err = conn.SetDeadline(time.Time{})
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("unable to clear handshake deadline: %w", err)
+	}
+
+	// We publish at QoS 0, so the only thing the broker sends us
+	// from here on are ping responses. Discard them.
+	go io.Copy(io.Discard, conn)
+
+	p.mu.Lock()
+	p.conn = conn
+	p.mu.Unlock()
+	slog.Info("Connected to MQTT broker.", "broker", p.Broker.Host)
+	return nil
+}
+
+// close drops the connection to the broker,
+// politely disconnecting first if requested.
+func (p *MQTTPublisher) close(disconnect bool) {
+	if p.conn == nil {
+		return
+	}
+	if disconnect {
+		p.conn.SetWriteDeadline(time.Now().Add(MQTTWriteTimeout))
+		p.conn.Write(encodeMQTTPacket(mqttDisconnect))
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.conn.Close()
+	p.conn = nil
+}
+
+// encodeMQTTPacket builds a control packet from a fixed header type and the
+// concatenated variable header and payload parts.
+func encodeMQTTPacket(packetType byte, parts ...[]byte) []byte {
+	length := 0
+	for _, part := range parts {
+		length += len(part)
+	}
+	packet := []byte{packetType}
+	// The remaining length is a variable length integer,
+	// seven bits per byte, with the high bit as a continuation flag.
+	for {
+		digit := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			digit |= 0x80
+		}
+		packet = append(packet, digit)
+		if length == 0 {
+			break
+		}
+	}
+	for _, part := range parts {
+		packet = append(packet, part...)
+	}
+	return packet
+}
+
+// encodeMQTTString encodes a string as a two byte length followed by the bytes.
+func encodeMQTTString(s string) []byte {
+	return append([]byte{byte(len(s) >> 8), byte(len(s))}, s...)
+}
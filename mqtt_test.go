@@ -0,0 +1,202 @@
+// Copyright 2023 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEncodeMQTTString(t *testing.T) {
+	tests := []struct {
+		s    string
+		want []byte
+	}{
+		{"", []byte{0x00, 0x00}},
+		{"MQTT", []byte{0x00, 0x04, 'M', 'Q', 'T', 'T'}},
+		{strings.Repeat("a", 300), append([]byte{0x01, 0x2c}, strings.Repeat("a", 300)...)},
+	}
+	for _, tt := range tests {
+		if got := encodeMQTTString(tt.s); !bytes.Equal(got, tt.want) {
+			t.Errorf("encodeMQTTString(%.8q...) = % x, want % x", tt.s, got[:min(len(got), 8)], tt.want[:min(len(tt.want), 8)])
+		}
+	}
+}
+
+func TestEncodeMQTTPacket(t *testing.T) {
+	// The remaining length examples are from section 2.2.3 of the MQTT 3.1.1 spec.
+	tests := []struct {
+		name       string
+		packetType byte
+		length     int
+		header     []byte
+	}{
+		{"disconnect", mqttDisconnect, 0, []byte{0xe0, 0x00}},
+		{"one byte length", mqttPublish, 127, []byte{0x30, 0x7f}},
+		{"two byte length", mqttPublish, 128, []byte{0x30, 0x80, 0x01}},
+		{"largest two byte length", mqttPublish, 16383, []byte{0x30, 0xff, 0x7f}},
+		{"three byte length", mqttPublish, 16384, []byte{0x30, 0x80, 0x80, 0x01}},
+		{"largest three byte length", mqttPublish, 2097151, []byte{0x30, 0xff, 0xff, 0x7f}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := bytes.Repeat([]byte{0xaa}, tt.length)
+			// Split the body, since the parts are concatenated.
+			got := encodeMQTTPacket(tt.packetType, body[:tt.length/2], body[tt.length/2:])
+			want := append(append([]byte{}, tt.header...), body...)
+			if !bytes.Equal(got, want) {
+				t.Errorf("got header % x, want % x", got[:min(len(got), len(tt.header))], tt.header)
+			}
+		})
+	}
+}
+
+// fakeMQTTBroker accepts one connection, checks the CONNECT packet, and accepts it.
+// The connection is sent on the returned channel, for the caller to close.
+func fakeMQTTBroker(t *testing.T, wantConnect []byte) (string, <-chan net.Conn) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	conns := make(chan net.Conn, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		connect := make([]byte, len(wantConnect))
+		_, err = io.ReadFull(conn, connect)
+		if err != nil {
+			t.Errorf("unable to read CONNECT: %v", err)
+			return
+		}
+		if !bytes.Equal(connect, wantConnect) {
+			t.Errorf("got CONNECT % x, want % x", connect, wantConnect)
+		}
+		conn.Write([]byte{0x20, 0x02, 0x00, 0x00})
+		conns <- conn
+	}()
+	return "tcp://" + listener.Addr().String(), conns
+}
+
+func TestMQTTPublisherPublish(t *testing.T) {
+	tests := []struct {
+		name     string
+		username string
+		password string
+		connect  []byte
+	}{
+		{
+			name: "anonymous",
+			connect: []byte{
+				0x10, 0x0d, // CONNECT, remaining length 13.
+				0x00, 0x04, 'M', 'Q', 'T', 'T', 0x04, 0x02, 0x00, 0x3c, // Protocol level 4, clean session, keep alive 60s.
+				0x00, 0x01, 'c', // Client ID.
+			},
+		},
+		{
+			name:     "username and password",
+			username: "u",
+			password: "pw",
+			connect: []byte{
+				0x10, 0x14, // CONNECT, remaining length 20.
+				0x00, 0x04, 'M', 'Q', 'T', 'T', 0x04, 0xc2, 0x00, 0x3c, // With username and password flags.
+				0x00, 0x01, 'c',
+				0x00, 0x01, 'u',
+				0x00, 0x02, 'p', 'w',
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			broker, conns := fakeMQTTBroker(t, tt.connect)
+			p, err := NewMQTTPublisher(broker, "rfid/", "c", tt.username, tt.password)
+			if err != nil {
+				t.Fatal(err)
+			}
+			events := make(chan Event, 1)
+			events <- Event{Type: EventTagAppear, Barcode: "39999000001"}
+			close(events)
+			go p.Run(context.Background(), events)
+
+			var conn net.Conn
+			select {
+			case conn = <-conns:
+			case <-time.After(5 * time.Second):
+				t.Fatal("publisher didn't connect")
+			}
+			defer conn.Close()
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			header := make([]byte, 2)
+			_, err = io.ReadFull(conn, header)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if header[0] != mqttPublish {
+				t.Fatalf("got packet type %#x, want PUBLISH", header[0])
+			}
+			// The event is small, so the remaining length is one byte.
+			publish := make([]byte, header[1])
+			_, err = io.ReadFull(conn, publish)
+			if err != nil {
+				t.Fatal(err)
+			}
+			topic := encodeMQTTString("rfid/tag/appear")
+			if !bytes.HasPrefix(publish, topic) {
+				t.Fatalf("got PUBLISH % x, want topic % x", publish, topic)
+			}
+			if payload := string(publish[len(topic):]); !strings.Contains(payload, `"barcode":"39999000001"`) {
+				t.Errorf("got payload %v, want the event", payload)
+			}
+			disconnect := make([]byte, 2)
+			_, err = io.ReadFull(conn, disconnect)
+			if err != nil || !bytes.Equal(disconnect, []byte{0xe0, 0x00}) {
+				t.Errorf("got % x, %v, want DISCONNECT", disconnect, err)
+			}
+		})
+	}
+}
+
+func TestMQTTPublisherShutdown(t *testing.T) {
+	connect := append([]byte{0x10, 0x0d}, 0x00, 0x04, 'M', 'Q', 'T', 'T', 0x04, 0x02, 0x00, 0x3c, 0x00, 0x01, 'c')
+	broker, conns := fakeMQTTBroker(t, connect)
+	p, err := NewMQTTPublisher(broker, "rfid", "c", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The broker never reads the events, which are big enough to fill the
+	// socket buffers, so publishing blocks.
+	events := make(chan Event, 8)
+	for i := 0; i < cap(events); i++ {
+		events <- Event{Type: EventTagAppear, Detail: strings.Repeat("x", 1<<20)}
+	}
+	close(events)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		p.Run(ctx, events)
+		close(done)
+	}()
+	select {
+	case conn := <-conns:
+		defer conn.Close()
+	case <-time.After(5 * time.Second):
+		t.Fatal("publisher didn't connect")
+	}
+	time.Sleep(200 * time.Millisecond)
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(MQTTWriteTimeout / 2):
+		t.Fatal("Run didn't return after the context was cancelled")
+	}
+}
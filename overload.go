@@ -0,0 +1,153 @@
+// Copyright 2023 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"runtime"
+	"runtime/metrics"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DefaultMaxInFlight is the default limit on requests being handled at once.
+	DefaultMaxInFlight = 100
+
+	// DefaultMaxGoroutines is the default limit on goroutines before load is shed.
+	DefaultMaxGoroutines = 2000
+
+	// DefaultMaxHeapMB is the default limit on heap usage, in megabytes, before load is shed.
+	DefaultMaxHeapMB = 256
+
+	// LoadSampleInterval is how often goroutine count and heap usage are sampled.
+	LoadSampleInterval = 1 * time.Second
+
+	// CapacityWarningInterval is the minimum time between capacity warnings in the log.
+	CapacityWarningInterval = 10 * time.Second
+
+	// heapMetric is the runtime metric for memory occupied by live and
+	// unswept heap objects. Unlike runtime.ReadMemStats, reading it
+	// doesn't stop the world.
+	heapMetric = "/memory/classes/heap/objects:bytes"
+)
+
+// LoadShedder rejects requests with 503 Service Unavailable once the
+// process is over capacity, so a stuck upstream can't balloon the process.
+// A limit of zero disables that check. Event streams, upgrades, the
+// liveness and readiness checks, and admin endpoints are never shed, so
+// monitoring and troubleshooting still work while the proxy is overloaded.
+type LoadShedder struct {
+	MaxInFlight   int64
+	MaxGoroutines int
+	MaxHeapBytes  uint64
+
+	// CORS, if set, adds CORS headers to the 503, so browsers can read it.
+	CORS func(http.Handler) http.Handler
+
+	inFlight atomic.Int64
+
+	mu          sync.Mutex
+	overloaded  string // Why the last sample was over capacity, empty if it wasn't.
+	shed        int    // Requests shed since the last warning.
+	lastWarning time.Time
+}
+
+// Monitor samples the goroutine count and heap usage until ctx is done.
+func (l *LoadShedder) Monitor(ctx context.Context) {
+	if l.MaxGoroutines <= 0 && l.MaxHeapBytes == 0 {
+		return
+	}
+	sample := []metrics.Sample{{Name: heapMetric}}
+	ticker := time.NewTicker(LoadSampleInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		reason := ""
+		if goroutines := runtime.NumGoroutine(); l.MaxGoroutines > 0 && goroutines > l.MaxGoroutines {
+			reason = fmt.Sprintf("%v goroutines, limit is %v", goroutines, l.MaxGoroutines)
+		}
+		if l.MaxHeapBytes > 0 {
+			metrics.Read(sample)
+			if sample[0].Value.Kind() == metrics.KindUint64 {
+				if heap := sample[0].Value.Uint64(); heap > l.MaxHeapBytes {
+					reason = fmt.Sprintf("%v MB of heap in use, limit is %v MB", heap>>20, l.MaxHeapBytes>>20)
+				}
+			}
+		}
+		l.mu.Lock()
+		if reason != "" && l.overloaded == "" {
+			slog.Warn("Over capacity, shedding load.", "reason", reason)
+		} else if reason == "" && l.overloaded != "" {
+			slog.Info("Capacity recovered, no longer shedding load.")
+		}
+		l.overloaded = reason
+		l.mu.Unlock()
+	}
+}
+
+// Middleware wraps a handler with load shedding.
+func (l *LoadShedder) Middleware(next http.Handler) http.Handler {
+	var overloaded http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "The RFID proxy is over capacity, try again shortly.", http.StatusServiceUnavailable)
+	})
+	if l.CORS != nil {
+		overloaded = l.CORS(overloaded)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if shedExempt(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		inFlight := l.inFlight.Add(1)
+		defer l.inFlight.Add(-1)
+
+		l.mu.Lock()
+		reason := l.overloaded
+		if reason == "" && l.MaxInFlight > 0 && inFlight > l.MaxInFlight {
+			reason = fmt.Sprintf("%v requests in flight, limit is %v", inFlight, l.MaxInFlight)
+		}
+		if reason != "" {
+			l.shed++
+			if time.Since(l.lastWarning) >= CapacityWarningInterval {
+				slog.Warn("Over capacity, shed requests.", "shed", l.shed, "reason", reason)
+				l.shed = 0
+				l.lastWarning = time.Now()
+			}
+		}
+		l.mu.Unlock()
+
+		if reason != "" {
+			overloaded.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// shedExempt reports whether a request is never shed. Event streams and
+// upgrades are long-lived, so they aren't counted as in flight either.
+func shedExempt(r *http.Request) bool {
+	if isEventStream(r) || isUpgrade(r) {
+		return true
+	}
+	switch path := r.URL.Path; {
+	case path == "/events", path == "/livez", path == "/readyz", path == "/admin", path == "/diagnostics", path == "/metrics":
+		return true
+	case strings.HasPrefix(path, AdminPrefix), strings.HasPrefix(path, "/debug/"), path == SelfTestPrefix, strings.HasPrefix(path, SelfTestPrefix+"/"):
+		return true
+	}
+	return false
+}
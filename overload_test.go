@@ -0,0 +1,58 @@
+// Copyright 2023 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestLoadShedderExempt(t *testing.T) {
+	l := &LoadShedder{CORS: newTestProxy("http://localhost:21645").CORS}
+	l.overloaded = "test"
+	h := l.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	tests := []struct {
+		name   string
+		path   string
+		header string
+		value  string
+		want   int
+	}{
+		{"reader service", "/getItems", "", "", http.StatusServiceUnavailable},
+		{"client script", "/client.js", "", "", http.StatusServiceUnavailable},
+		{"event stream", "/events", "Accept", "text/event-stream", http.StatusOK},
+		{"upgrade", "/socket", "Upgrade", "websocket", http.StatusOK},
+		{"liveness", "/livez", "", "", http.StatusOK},
+		{"readiness", "/readyz", "", "", http.StatusOK},
+		{"dashboard", "/admin", "", "", http.StatusOK},
+		{"admin", AdminPrefix + "status", "", "", http.StatusOK},
+		{"metrics", "/metrics", "", "", http.StatusOK},
+		{"profiles", "/debug/pprof/", "", "", http.StatusOK},
+		{"self-test", SelfTestPrefix + "/run", "", "", http.StatusOK},
+		{"admin lookalike", "/administrator", "", "", http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			r.Header.Set("Origin", "https://example.alma.exlibrisgroup.com")
+			if tt.header != "" {
+				r.Header.Set(tt.header, tt.value)
+			}
+			if tt.header == "Upgrade" {
+				r.Header.Set("Connection", "Upgrade")
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != tt.want {
+				t.Fatalf("got status %v, want %v", w.Code, tt.want)
+			}
+			// Browsers can only read the 503 if it has CORS headers.
+			if w.Code == http.StatusServiceUnavailable && w.Header().Get("Access-Control-Allow-Origin") == "" {
+				t.Error("the 503 has no Access-Control-Allow-Origin")
+			}
+		})
+	}
+}
@@ -0,0 +1,59 @@
+// Copyright 2023 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"path"
+)
+
+// BrowserNoise are the paths browsers and their developer tools request on their
+// own, which the reader service never serves, as path.Match patterns.
+const BrowserNoise = "/favicon.ico,/robots.txt,/apple-touch-icon*.png,/.well-known/*,/.well-known/*/*," +
+	"/json,/json/*,/sitemap.xml,/manifest.json,/sw.js"
+
+// PathFilter answers requests for paths the reader service doesn't serve
+// with a 404, rather than forwarding them.
+//
+// BrowserNoise is always answered with a 404. If Allowed isn't empty,
+// only paths matching one of its path.Match patterns are forwarded.
+type PathFilter struct {
+	Allowed []string
+	noise   []string
+}
+
+// NewPathFilter returns a PathFilter for the comma separated allowed patterns.
+func NewPathFilter(allowed string) (*PathFilter, error) {
+	f := &PathFilter{Allowed: splitList(allowed), noise: splitList(BrowserNoise)}
+	for _, pattern := range f.Allowed {
+		_, err := path.Match(pattern, "")
+		if err != nil {
+			return nil, fmt.Errorf("bad allowed path pattern %q: %w", pattern, err)
+		}
+	}
+	return f, nil
+}
+
+// Forwarded reports whether requests for a URL path are forwarded.
+func (f *PathFilter) Forwarded(urlPath string) bool {
+	if matchAny(f.noise, urlPath) {
+		return false
+	}
+	return len(f.Allowed) == 0 || matchAny(f.Allowed, urlPath)
+}
+
+// Middleware wraps a handler, answering requests for paths which aren't forwarded with a 404.
+func (f *PathFilter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !f.Forwarded(r.URL.Path) {
+			slog.Debug("Not forwarding request for unknown path.", "path", r.URL.Path)
+			http.NotFound(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
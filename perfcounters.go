@@ -0,0 +1,182 @@
+// Copyright 2023 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"log/slog"
+	"os"
+	"time"
+)
+
+// The GUIDs which identify our performance counter provider and counter set.
+// They are in the manifest registered with lodctr, so they must never change.
+const (
+	PerfProviderGUID   = "4a079d6e-a777-478e-9704-def7f605ad2e"
+	PerfCounterSetGUID = "b4bb6184-fe2d-4014-ba3f-9acdd03b8757"
+)
+
+// PerfCounterInterval is how often the performance counters are updated.
+const PerfCounterInterval = time.Second
+
+// The IDs of the performance counters in the counter set.
+const (
+	perfCounterRequests = iota + 1
+	perfCounterErrors
+	perfCounterUpstreamLatency
+)
+
+// The Windows performance counter types we use.
+const (
+	// perfCounterBulkCount is a 64 bit count which Windows shows as a rate per second.
+	perfCounterBulkCount = 0x10410500
+	// perfCounterLargeRawCount is a 64 bit value which Windows shows as is.
+	perfCounterLargeRawCount = 0x00010100
+)
+
+// ErrPerfCountersUnsupported is returned when publishing performance counters isn't supported on this platform.
+var ErrPerfCountersUnsupported = errors.New("performance counters are only supported on Windows")
+
+// perfCounter describes one counter in the counter set.
+type perfCounter struct {
+	ID          uint32
+	Type        uint32
+	Name        string
+	Description string
+}
+
+// perfCounters returns the counters in the counter set, in the order of their IDs.
+func perfCounters() []perfCounter {
+	return []perfCounter{
+		{perfCounterRequests, perfCounterBulkCount, "Requests/sec", "Requests served, not counting CORS preflights."},
+		{perfCounterErrors, perfCounterBulkCount, "Errors/sec", "Requests answered with a 5xx status."},
+		{perfCounterUpstreamLatency, perfCounterLargeRawCount, "Upstream Latency (ms)", "Mean upstream latency over the last second, in milliseconds."},
+	}
+}
+
+// PerfCounters publishes request rate, error rate, and upstream latency as Windows
+// performance counters, so desktop monitoring like SCOM can watch the proxy.
+// The counter set must first be registered with the manifest written by the
+// perf-counters command.
+type PerfCounters struct {
+	Metrics  *Metrics
+	Interval time.Duration
+
+	set *perfCounterSet
+}
+
+// NewPerfCounters starts the performance counter provider.
+func NewPerfCounters(metrics *Metrics) (*PerfCounters, error) {
+	set, err := openPerfCounterSet()
+	if err != nil {
+		return nil, err
+	}
+	return &PerfCounters{Metrics: metrics, Interval: PerfCounterInterval, set: set}, nil
+}
+
+// Run updates the counters every interval until ctx is cancelled, then stops the provider.
+func (p *PerfCounters) Run(ctx context.Context) {
+	defer p.set.close()
+	ticker := time.NewTicker(p.Interval)
+	defer ticker.Stop()
+	var last MetricsSnapshot
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		snapshot := p.Metrics.Snapshot()
+		err := p.update(snapshot, last)
+		if err != nil {
+			slog.Warn("Unable to update performance counters.", "error", err)
+		}
+		last = snapshot
+	}
+}
+
+// update sets the counters from a snapshot of the metrics and the one before it.
+func (p *PerfCounters) update(snapshot, last MetricsSnapshot) error {
+	var requests int64
+	var latency time.Duration
+	for operation, stats := range snapshot.Operations {
+		previous := last.Operations[operation]
+		requests += stats.Requests - previous.Requests
+		latency += stats.TotalLatency - previous.TotalLatency
+	}
+	var meanLatency uint64
+	if requests > 0 {
+		meanLatency = uint64((latency / time.Duration(requests)).Milliseconds())
+	}
+	values := map[uint32]uint64{
+		perfCounterRequests:        uint64(snapshot.Requests),
+		perfCounterErrors:          uint64(snapshot.Responses["5xx"]),
+		perfCounterUpstreamLatency: meanLatency,
+	}
+	for id, value := range values {
+		err := p.set.setValue(id, value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runPerfCountersCommand writes the instrumentation manifest which registers the
+// counter set with Windows. It names this executable, so run it after installing.
+func runPerfCountersCommand(args []string, stdout io.Writer) error {
+	if len(args) != 0 {
+		return fmt.Errorf("%w, perf-counters takes no arguments", ErrUsage)
+	}
+	program, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("unable to find executable: %w", err)
+	}
+	return WritePerfCounterManifest(stdout, program)
+}
+
+// WritePerfCounterManifest writes an instrumentation manifest for the counter set,
+// for registering with lodctr /m:<manifest>.
+func WritePerfCounterManifest(w io.Writer, program string) error {
+	_, err := fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?>
+<instrumentationManifest xmlns="http://schemas.microsoft.com/win/2004/08/events" xmlns:win="http://manifests.microsoft.com/win/2004/08/windows/events" xmlns:xs="http://www.w3.org/2001/XMLSchema">
+  <instrumentation>
+    <counters xmlns="http://schemas.microsoft.com/win/2005/12/counters" schemaVersion="2.0">
+      <provider providerName="almarfidintercept" providerGuid="{%v}" providerType="userMode" applicationIdentity="%v" symbol="AlmaRFIDIntercept">
+        <counterSet guid="{%v}" uri="CarletonUniversityLibrary.AlmaRFIDIntercept" name="Alma RFID Intercept" description="Requests through the Alma RFID intercept proxy." instances="single" symbol="AlmaRFIDInterceptCounterSet">
+`, PerfProviderGUID, html.EscapeString(program), PerfCounterSetGUID)
+	if err != nil {
+		return fmt.Errorf("unable to write manifest: %w", err)
+	}
+	for _, counter := range perfCounters() {
+		_, err = fmt.Fprintf(w, `          <counter id="%v" uri="CarletonUniversityLibrary.AlmaRFIDIntercept.Counter%v" name="%v" description="%v" type="%v" detailLevel="standard" />
+`, counter.ID, counter.ID, html.EscapeString(counter.Name), html.EscapeString(counter.Description), perfCounterTypeName(counter.Type))
+		if err != nil {
+			return fmt.Errorf("unable to write manifest: %w", err)
+		}
+	}
+	_, err = io.WriteString(w, `        </counterSet>
+      </provider>
+    </counters>
+  </instrumentation>
+</instrumentationManifest>
+`)
+	if err != nil {
+		return fmt.Errorf("unable to write manifest: %w", err)
+	}
+	return nil
+}
+
+// perfCounterTypeName returns the name a manifest uses for a counter type.
+func perfCounterTypeName(counterType uint32) string {
+	if counterType == perfCounterBulkCount {
+		return "perf_counter_bulk_count"
+	}
+	return "perf_counter_large_rawcount"
+}
@@ -0,0 +1,23 @@
+// Copyright 2023 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+//go:build !windows
+
+package main
+
+// perfCounterSet is a stand in for the Windows performance counter set.
+type perfCounterSet struct{}
+
+// openPerfCounterSet returns ErrPerfCountersUnsupported.
+func openPerfCounterSet() (*perfCounterSet, error) {
+	return nil, ErrPerfCountersUnsupported
+}
+
+// setValue returns ErrPerfCountersUnsupported.
+func (s *perfCounterSet) setValue(_ uint32, _ uint64) error {
+	return ErrPerfCountersUnsupported
+}
+
+// close does nothing.
+func (s *perfCounterSet) close() {}
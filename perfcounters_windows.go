@@ -0,0 +1,164 @@
+// Copyright 2023 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+//go:build windows
+
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// perfCounterSetSingleInstance is PERF_COUNTERSET_SINGLE_INSTANCE.
+const perfCounterSetSingleInstance = 0
+
+// perfDetailNovice is PERF_DETAIL_NOVICE, shown to every user.
+const perfDetailNovice = 100
+
+// guid is a Windows GUID.
+type guid struct {
+	Data1 uint32
+	Data2 uint16
+	Data3 uint16
+	Data4 [8]byte
+}
+
+// perfCounterSetInfo is PERF_COUNTERSET_INFO.
+type perfCounterSetInfo struct {
+	CounterSetGUID guid
+	ProviderGUID   guid
+	NumCounters    uint32
+	InstanceType   uint32
+}
+
+// perfCounterInfo is PERF_COUNTER_INFO.
+type perfCounterInfo struct {
+	CounterID   uint32
+	Type        uint32
+	Attrib      uint64
+	Size        uint32
+	DetailLevel uint32
+	Scale       int32
+	Offset      uint32
+}
+
+// perfCounterSetTemplate is a PERF_COUNTERSET_INFO followed by its counters.
+type perfCounterSetTemplate struct {
+	Info     perfCounterSetInfo
+	Counters [3]perfCounterInfo
+}
+
+// perfCounterSet is our registered counter set and its one instance.
+// Counters are published with the PerfLib version 2 functions in advapi32.dll.
+type perfCounterSet struct {
+	advapi32 *syscall.LazyDLL
+	provider uintptr
+	instance uintptr
+}
+
+// openPerfCounterSet starts the provider and creates the counter set instance.
+func openPerfCounterSet() (*perfCounterSet, error) {
+	s := &perfCounterSet{advapi32: syscall.NewLazyDLL("advapi32.dll")}
+	err := s.advapi32.NewProc("PerfStartProvider").Find()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrPerfCountersUnsupported, err)
+	}
+	providerGUID := parseGUID(PerfProviderGUID)
+	counterSetGUID := parseGUID(PerfCounterSetGUID)
+
+	status, _, _ := s.call("PerfStartProvider",
+		uintptr(unsafe.Pointer(&providerGUID)), 0, uintptr(unsafe.Pointer(&s.provider)))
+	if status != 0 {
+		return nil, fmt.Errorf("unable to start performance counter provider: %w", syscall.Errno(status))
+	}
+
+	template := perfCounterSetTemplate{
+		Info: perfCounterSetInfo{
+			CounterSetGUID: counterSetGUID,
+			ProviderGUID:   providerGUID,
+			NumCounters:    uint32(len(perfCounters())),
+			InstanceType:   perfCounterSetSingleInstance,
+		},
+	}
+	for i, counter := range perfCounters() {
+		template.Counters[i] = perfCounterInfo{
+			CounterID:   counter.ID,
+			Type:        counter.Type,
+			Size:        8,
+			DetailLevel: perfDetailNovice,
+			Offset:      uint32(i * 8),
+		}
+	}
+	status, _, _ = s.call("PerfSetCounterSetInfo",
+		s.provider, uintptr(unsafe.Pointer(&template)), unsafe.Sizeof(template))
+	if status != 0 {
+		s.close()
+		return nil, fmt.Errorf("unable to set performance counter set, was the manifest registered with lodctr? %w", syscall.Errno(status))
+	}
+
+	name, err := syscall.UTF16PtrFromString("almarfidintercept")
+	if err != nil {
+		s.close()
+		return nil, err
+	}
+	instance, _, err := s.call("PerfCreateInstance",
+		s.provider, uintptr(unsafe.Pointer(&counterSetGUID)), uintptr(unsafe.Pointer(name)), 0)
+	if instance == 0 {
+		s.close()
+		return nil, fmt.Errorf("unable to create performance counter instance: %w", err)
+	}
+	s.instance = instance
+	return s, nil
+}
+
+// setValue sets a counter's value.
+func (s *perfCounterSet) setValue(id uint32, value uint64) error {
+	args := []uintptr{s.provider, s.instance, uintptr(id)}
+	if unsafe.Sizeof(uintptr(0)) == 4 {
+		// On 32 bit Windows, a ULONGLONG argument takes two words, low first.
+		args = append(args, uintptr(uint32(value)), uintptr(value>>32))
+	} else {
+		args = append(args, uintptr(value))
+	}
+	status, _, _ := s.call("PerfSetULongLongCounterValue", args...)
+	if status != 0 {
+		return fmt.Errorf("unable to set performance counter %v: %w", id, syscall.Errno(status))
+	}
+	return nil
+}
+
+// close deletes the instance and stops the provider.
+func (s *perfCounterSet) close() {
+	if s.instance != 0 {
+		s.call("PerfDeleteInstance", s.provider, s.instance)
+		s.instance = 0
+	}
+	if s.provider != 0 {
+		s.call("PerfStopProvider", s.provider)
+		s.provider = 0
+	}
+}
+
+// call calls a function in advapi32.dll.
+func (s *perfCounterSet) call(name string, args ...uintptr) (uintptr, uintptr, error) {
+	return s.advapi32.NewProc(name).Call(args...)
+}
+
+// parseGUID parses one of our GUID constants, like 4a079d6e-a777-478e-9704-def7f605ad2e.
+func parseGUID(s string) guid {
+	b, err := hex.DecodeString(strings.ReplaceAll(s, "-", ""))
+	if err != nil || len(b) != 16 {
+		panic("bad GUID " + s)
+	}
+	var g guid
+	g.Data1 = uint32(b[0])<<24 | uint32(b[1])<<16 | uint32(b[2])<<8 | uint32(b[3])
+	g.Data2 = uint16(b[4])<<8 | uint16(b[5])
+	g.Data3 = uint16(b[6])<<8 | uint16(b[7])
+	copy(g.Data4[:], b[8:])
+	return g
+}
@@ -0,0 +1,116 @@
+// Copyright 2023 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// DetachWait is how long -detach waits to see the proxy started.
+const DetachWait = time.Second
+
+var (
+	// ErrAlreadyRunning is returned when the -pidfile names a running process.
+	ErrAlreadyRunning = errors.New("the proxy is already running")
+
+	// ErrStoppedEarly is returned when the proxy started with -detach stops right away.
+	ErrStoppedEarly = errors.New("the proxy stopped right after starting")
+)
+
+// WritePIDFile writes this process's ID to path, for init scripts to find
+// it. If path has the ID of a process which is still running, it is left
+// alone, and ErrAlreadyRunning is returned. A file left by a process which
+// has exited is replaced.
+func WritePIDFile(path string) error {
+	content, err := os.ReadFile(path)
+	if err == nil {
+		pid, err := strconv.Atoi(strings.TrimSpace(string(content)))
+		if err == nil && pid != os.Getpid() && processRunning(pid) {
+			return fmt.Errorf("%w, as process %d in %v", ErrAlreadyRunning, pid, path)
+		}
+	}
+	err = os.WriteFile(path, []byte(strconv.Itoa(os.Getpid())+"\n"), 0o644)
+	if err != nil {
+		return fmt.Errorf("unable to write -pidfile: %w", err)
+	}
+	return nil
+}
+
+// RemovePIDFile removes path, if it still has this process's ID.
+func RemovePIDFile(path string) {
+	content, err := os.ReadFile(path)
+	if err != nil || strings.TrimSpace(string(content)) != strconv.Itoa(os.Getpid()) {
+		return
+	}
+	os.Remove(path)
+}
+
+// processRunning reports whether a process with the ID is running.
+func processRunning(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	defer p.Release()
+	// Finding a process on Windows opens it, which fails if it has exited.
+	if runtime.GOOS == "windows" {
+		return true
+	}
+	return p.Signal(syscall.Signal(0)) == nil
+}
+
+// Detach starts the proxy again in the background, with the same arguments
+// except -detach, and without a terminal, so an init script can start it
+// and carry on. Its output is discarded, so -log-file or -syslog-address
+// should be set. If the proxy exits within DetachWait, because of a bad
+// setting, an error is returned. Otherwise, its process ID is printed.
+func Detach(args []string, stdout io.Writer) error {
+	executable, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("unable to find executable: %w", err)
+	}
+	var childArgs []string
+	for _, arg := range args {
+		name, _, _ := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if strings.HasPrefix(arg, "-") && name == "detach" {
+			continue
+		}
+		childArgs = append(childArgs, arg)
+	}
+	attr, err := detachAttr()
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(executable, childArgs...)
+	// The environment and config file can also set -detach, but the
+	// environment takes precedence over the config file.
+	cmd.Env = append(os.Environ(), EnvPrefix+"DETACH=false")
+	cmd.SysProcAttr = attr
+	err = cmd.Start()
+	if err != nil {
+		return fmt.Errorf("unable to start the proxy in the background: %w", err)
+	}
+	exited := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		close(exited)
+	}()
+	select {
+	case <-exited:
+		return fmt.Errorf("%w, with %v, check the log", ErrStoppedEarly, cmd.ProcessState)
+	case <-time.After(DetachWait):
+	}
+	fmt.Fprintf(stdout, "Started the proxy in the background, as process %d.\n", cmd.Process.Pid)
+	return nil
+}
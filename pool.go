@@ -0,0 +1,217 @@
+// Copyright 2023 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	// BalanceRoundRobin sends requests to each reader service in the pool in turn.
+	BalanceRoundRobin = "round-robin"
+
+	// BalanceLeastConnections sends requests to the reader service in the
+	// pool with the fewest requests in progress.
+	BalanceLeastConnections = "least-connections"
+
+	// PoolDownTime is how long a reader service in the pool which failed to
+	// connect, or timed out, is skipped before it is tried again.
+	PoolDownTime = 30 * time.Second
+)
+
+// ErrUnknownBalance is returned when the balancing method isn't round-robin or least-connections.
+var ErrUnknownBalance = errors.New("balancing must be round-robin or least-connections")
+
+// UpstreamPool balances requests for the default reader service across
+// several, like the reader endpoints in a sorter room. A reader service which
+// can't be connected to, or times out, is marked down and skipped for
+// PoolDownTime, unless they all are. A request which couldn't connect is
+// sent to the next reader service in the pool, since it was never sent.
+type UpstreamPool struct {
+	// Balance is BalanceRoundRobin or BalanceLeastConnections.
+	Balance string
+
+	mu      sync.Mutex
+	members []*poolMember
+	next    int // The member round robin starts at.
+}
+
+// poolMember is a reader service in the pool.
+type poolMember struct {
+	target    *url.URL
+	active    int       // Requests in progress.
+	downUntil time.Time // When the member is tried again, if it is down.
+}
+
+// NewUpstreamPool returns an UpstreamPool balancing requests across
+// addresses. It returns nil if there are fewer than two.
+func NewUpstreamPool(addresses []string, balance string) (*UpstreamPool, error) {
+	if balance != BalanceRoundRobin && balance != BalanceLeastConnections {
+		return nil, fmt.Errorf("%w, not %q", ErrUnknownBalance, balance)
+	}
+	if len(addresses) < 2 {
+		return nil, nil
+	}
+	pool := &UpstreamPool{Balance: balance}
+	for _, address := range addresses {
+		target, err := parseUpstream(address)
+		if err != nil {
+			return nil, err
+		}
+		pool.members = append(pool.members, &poolMember{target: target})
+	}
+	return pool, nil
+}
+
+// Transport wraps a transport, sending each request to a reader service in the pool.
+func (u *UpstreamPool) Transport(next http.RoundTripper) http.RoundTripper {
+	if u == nil {
+		return next
+	}
+	return &poolTransport{pool: u, next: next}
+}
+
+// pick chooses a member, which hasn't been tried, for a request, and counts
+// the request against it until it is released. Members which are down are
+// only chosen if all the others are too. Some member must not have been tried.
+func (u *UpstreamPool) pick(tried map[*poolMember]bool) *poolMember {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	now := time.Now()
+	var chosen *poolMember
+	chosenIndex, chosenUp := 0, false
+	for i := range u.members {
+		index := (u.next + i) % len(u.members)
+		member := u.members[index]
+		if tried[member] {
+			continue
+		}
+		up := !now.Before(member.downUntil)
+		better := chosen == nil || (up && !chosenUp) ||
+			(up == chosenUp && u.Balance == BalanceLeastConnections && member.active < chosen.active)
+		if better {
+			chosen, chosenIndex, chosenUp = member, index, up
+		}
+	}
+	u.next = (chosenIndex + 1) % len(u.members)
+	chosen.active++
+	return chosen
+}
+
+// has reports whether host is the address of a member.
+func (u *UpstreamPool) has(host string) bool {
+	for _, member := range u.members {
+		if member.target.Host == host {
+			return true
+		}
+	}
+	return false
+}
+
+// release records a request to a member finished.
+func (u *UpstreamPool) release(member *poolMember) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	member.active--
+}
+
+// report records how a request to a member went, with the error it failed
+// with, or nil, marking the member down, or back up.
+func (u *UpstreamPool) report(member *poolMember, err error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	wasDown := !member.downUntil.IsZero()
+	switch {
+	case err == nil:
+		if wasDown {
+			slog.Info("A reader service in the pool is answering again.", "upstream", member.target.Host)
+		}
+		member.downUntil = time.Time{}
+	case dialFailed(err) || isTimeout(err):
+		if !wasDown {
+			slog.Warn("A reader service in the pool is down, skipping it.", "upstream", member.target.Host, "for", PoolDownTime, "error", err)
+		}
+		member.downUntil = time.Now().Add(PoolDownTime)
+	}
+}
+
+// poolTransport sends each request to a reader service in the pool.
+type poolTransport struct {
+	pool *UpstreamPool
+	next http.RoundTripper
+}
+
+// RoundTrip sends a request to a reader service in the pool, and to the
+// others in turn if it couldn't connect. Requests for other services, like
+// the fallback, are sent as they are.
+func (t *poolTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	next := t.next
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	if !t.pool.has(req.URL.Host) {
+		return next.RoundTrip(req)
+	}
+	// The body is read again for each reader service tried.
+	var body []byte
+	if req.Body != nil && req.Body != http.NoBody {
+		var err error
+		body, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	tried := map[*poolMember]bool{}
+	for {
+		member := t.pool.pick(tried)
+		tried[member] = true
+		memberReq := req.Clone(req.Context())
+		memberReq.URL.Scheme = member.target.Scheme
+		memberReq.URL.Host = member.target.Host
+		if body != nil {
+			memberReq.Body = io.NopCloser(bytes.NewReader(body))
+		}
+		resp, err := next.RoundTrip(memberReq)
+		t.pool.report(member, err)
+		if err == nil && resp.StatusCode == http.StatusSwitchingProtocols {
+			// A tunnel lasts a long time, and its body must stay writable,
+			// so it isn't counted.
+			t.pool.release(member)
+			return resp, nil
+		}
+		if err == nil {
+			// The request is in progress until its response has been read.
+			resp.Body = &poolBody{ReadCloser: resp.Body, done: func() { t.pool.release(member) }}
+			return resp, nil
+		}
+		t.pool.release(member)
+		if !dialFailed(err) || req.Context().Err() != nil || len(tried) == len(t.pool.members) {
+			return nil, err
+		}
+		slog.InfoContext(req.Context(), "Unable to reach a reader service in the pool, trying another.", "upstream", member.target.Host, "error", err)
+	}
+}
+
+// poolBody tells the pool a request finished when its response body is closed.
+type poolBody struct {
+	io.ReadCloser
+	once sync.Once
+	done func()
+}
+
+// Close closes the body, and tells the pool the request finished.
+func (b *poolBody) Close() error {
+	b.once.Do(b.done)
+	return b.ReadCloser.Close()
+}
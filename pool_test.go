@@ -0,0 +1,143 @@
+// Copyright 2023 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// namedServer returns a server which answers with its name and the path requested.
+func namedServer(t *testing.T, name string) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, name+" "+r.URL.Path)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestNewUpstreamPool(t *testing.T) {
+	tests := []struct {
+		name      string
+		addresses []string
+		balance   string
+		wantPool  bool
+		wantErr   bool
+	}{
+		{"one reader service", []string{"http://localhost:21645"}, BalanceRoundRobin, false, false},
+		{"two reader services", []string{"http://localhost:21645", "http://localhost:21646"}, BalanceLeastConnections, true, false},
+		{"unknown balancing", []string{"http://localhost:21645", "http://localhost:21646"}, "random", false, true},
+		{"bad address", []string{"http://localhost:21645", "localhost:21646"}, BalanceRoundRobin, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pool, err := NewUpstreamPool(tt.addresses, tt.balance)
+			if (err != nil) != tt.wantErr || (pool != nil) != tt.wantPool {
+				t.Errorf("got %v, error %v, want pool %v, error %v", pool, err, tt.wantPool, tt.wantErr)
+			}
+		})
+	}
+}
+
+// poolProxy returns a test Proxy balancing across addresses, the first of
+// which is the default reader service.
+func poolProxy(t *testing.T, balance string, addresses ...string) *Proxy {
+	t.Helper()
+	pool, err := NewUpstreamPool(addresses, balance)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := newTestProxy(addresses[0])
+	p.SetPool(pool)
+	return p
+}
+
+func TestUpstreamPoolRoundRobin(t *testing.T) {
+	a := namedServer(t, "a")
+	b := namedServer(t, "b")
+	tests := []struct {
+		name      string
+		addresses []string
+		want      []string
+	}{
+		{"in turn", []string{a.URL, b.URL}, []string{"a", "b", "a", "b"}},
+		// The dead reader service is tried once, then skipped while it is down.
+		{"dead member skipped", []string{a.URL, deadAddress(t), b.URL}, []string{"a", "b", "a", "b"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := poolProxy(t, BalanceRoundRobin, tt.addresses...)
+			var got []string
+			for range tt.want {
+				status, body := serve(t, p, http.MethodPost, "/getItems", "")
+				if status != http.StatusOK {
+					t.Fatalf("got status %v, %q", status, body)
+				}
+				name, _, _ := strings.Cut(body, " ")
+				got = append(got, name)
+			}
+			if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUpstreamPoolLeastConnections(t *testing.T) {
+	arrived := make(chan struct{})
+	finish := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		arrived <- struct{}{}
+		<-finish
+		w.Write([]byte("slow"))
+	}))
+	defer slow.Close()
+	fast := namedServer(t, "fast")
+	p := poolProxy(t, BalanceLeastConnections, slow.URL, fast.URL)
+
+	done := make(chan string)
+	go func() {
+		_, body := serve(t, p, http.MethodPost, "/getItems", "")
+		done <- body
+	}()
+	<-arrived
+	// Round robin would send the second of these to the slow reader service,
+	// but it still has a request in progress.
+	for i := 0; i < 2; i++ {
+		if _, body := serve(t, p, http.MethodPost, "/getItems", ""); !strings.HasPrefix(body, "fast") {
+			t.Errorf("request %v got %q, want the fast reader service", i, body)
+		}
+	}
+	close(finish)
+	if body := <-done; body != "slow" {
+		t.Errorf("got %q, want the slow reader service", body)
+	}
+}
+
+func TestUpstreamPoolAllDown(t *testing.T) {
+	p := poolProxy(t, BalanceRoundRobin, deadAddress(t), deadAddress(t))
+	if status, _ := serve(t, p, http.MethodPost, "/getItems", ""); status == http.StatusOK {
+		t.Errorf("got status %v, want an error", status)
+	}
+}
+
+func TestUpstreamPoolFallback(t *testing.T) {
+	fallback := echoServer(t, "fallback")
+	p := poolProxy(t, BalanceRoundRobin, deadAddress(t), deadAddress(t))
+	var err error
+	p.Fallback, err = NewUpstreamFallback(fallback.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The fallback is only used once every reader service in the pool has been tried.
+	status, body := serve(t, p, http.MethodPost, "/", "urn:rfid#writeTags")
+	if status != http.StatusOK || body != "fallback <Envelope/>" {
+		t.Errorf("got %v %q, want 200 from the fallback", status, body)
+	}
+}
@@ -0,0 +1,46 @@
+// Copyright 2023 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// runPrintConfigCommand prints the configuration the proxy would start with,
+// from the same flags, environment variables, and config file, with where each
+// value came from. Secrets are masked. The output is TOML, so it can be used as
+// the start of a config file.
+func runPrintConfigCommand(args []string, stdout io.Writer) error {
+	config, err := ParseConfig("print-config", args)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(stdout, config.Effective())
+	return err
+}
+
+// Effective returns the configuration as TOML, with where each value came
+// from. Secrets are masked.
+func (c *ConfigFile) Effective() string {
+	var b strings.Builder
+	if c.Path != "" {
+		fmt.Fprintf(&b, "# Config file: %v\n", c.Path)
+	}
+	c.fs.VisitAll(func(f *flag.Flag) {
+		if f.Name == "config" || f.Name == "version" {
+			return
+		}
+		source := c.Source(f.Name)
+		if source == SourceEnv {
+			source += " " + EnvPrefix + strings.ToUpper(f.Name)
+		}
+		fmt.Fprintf(&b, "%v = %v  # %v\n", f.Name, strconv.Quote(flagValue(f)), source)
+	})
+	return b.String()
+}
@@ -0,0 +1,154 @@
+// Copyright 2023 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// Priority is a class of request, which decides its place in the UpstreamQueue.
+type Priority int
+
+// The request priorities, highest first.
+const (
+	// PriorityInteractive is for operations a staff member is waiting on,
+	// like arming or disarming an item.
+	PriorityInteractive Priority = iota
+	// PriorityBackground is for everything else, mostly tag polls.
+	PriorityBackground
+)
+
+// String returns the name of the priority, for logging.
+func (p Priority) String() string {
+	if p == PriorityInteractive {
+		return "interactive"
+	}
+	return "background"
+}
+
+// RequestPriority classifies an operation. Operations which set an item's
+// security bit are interactive, everything else is background.
+func RequestPriority(operation string) Priority {
+	if isSecurityOperation(operation) {
+		return PriorityInteractive
+	}
+	return PriorityBackground
+}
+
+// UpstreamQueue limits how many requests are sent to a reader service at once.
+// Requests beyond the limit wait, and interactive requests are let through ahead
+// of background ones, so a burst of tag polls never delays a staff member waiting
+// to desensitize an item. Requests of the same priority go in arrival order.
+// Each reader service, like those of the institutions sharing a consortial
+// server, has its own limit and line, so one institution's burst doesn't hold
+// up another's. A nil UpstreamQueue, or one with a Limit of zero, lets every
+// request through.
+type UpstreamQueue struct {
+	Limit int
+
+	mu    sync.Mutex
+	lanes map[string]*lane // Keyed by reader service address.
+}
+
+// lane is the queue for one reader service.
+type lane struct {
+	active  int
+	waiting [PriorityBackground + 1][]chan struct{}
+}
+
+// Acquire waits for a turn to send a request to a reader service, until ctx
+// is done. Call release once the request is finished.
+func (q *UpstreamQueue) Acquire(ctx context.Context, upstream string, priority Priority) (release func(), err error) {
+	if q == nil || q.Limit <= 0 {
+		return func() {}, nil
+	}
+	q.mu.Lock()
+	l := q.lane(upstream)
+	release = func() { q.release(l) }
+	if l.active < q.Limit && l.queued() == 0 {
+		l.active++
+		q.mu.Unlock()
+		return release, nil
+	}
+	turn := make(chan struct{})
+	l.waiting[priority] = append(l.waiting[priority], turn)
+	q.mu.Unlock()
+
+	select {
+	case <-turn:
+		return release, nil
+	case <-ctx.Done():
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		for i, waiter := range l.waiting[priority] {
+			if waiter == turn {
+				l.waiting[priority] = append(l.waiting[priority][:i], l.waiting[priority][i+1:]...)
+				return nil, ctx.Err()
+			}
+		}
+		// Our turn came as ctx was done, so pass it on.
+		l.active--
+		l.next(q.Limit)
+		return nil, ctx.Err()
+	}
+}
+
+// Queued returns how many requests are waiting for every reader service, by priority.
+func (q *UpstreamQueue) Queued() (interactive, background int) {
+	if q == nil {
+		return 0, 0
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, l := range q.lanes {
+		interactive += len(l.waiting[PriorityInteractive])
+		background += len(l.waiting[PriorityBackground])
+	}
+	return interactive, background
+}
+
+// lane returns the queue for a reader service. q.mu must be held.
+func (q *UpstreamQueue) lane(upstream string) *lane {
+	if q.lanes == nil {
+		q.lanes = map[string]*lane{}
+	}
+	l, ok := q.lanes[upstream]
+	if !ok {
+		l = &lane{}
+		q.lanes[upstream] = l
+	}
+	return l
+}
+
+// release ends a request, letting the next waiting one through.
+func (q *UpstreamQueue) release(l *lane) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	l.active--
+	l.next(q.Limit)
+}
+
+// next lets waiting requests through while there's room under limit,
+// highest priority first. The queue's mu must be held.
+func (l *lane) next(limit int) {
+	for priority := range l.waiting {
+		for l.active < limit && len(l.waiting[priority]) > 0 {
+			turn := l.waiting[priority][0]
+			l.waiting[priority] = l.waiting[priority][1:]
+			l.active++
+			close(turn)
+		}
+	}
+}
+
+// queued returns how many requests are waiting. The queue's mu must be held.
+func (l *lane) queued() int {
+	n := 0
+	for _, waiters := range l.waiting {
+		n += len(waiters)
+	}
+	return n
+}
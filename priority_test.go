@@ -0,0 +1,64 @@
+// Copyright 2023 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestUpstreamQueuePerUpstream(t *testing.T) {
+	q := &UpstreamQueue{Limit: 1}
+	releaseA, err := q.Acquire(context.Background(), "http://a", PriorityBackground)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Another reader service has its own limit.
+	releaseB, err := q.Acquire(context.Background(), "http://b", PriorityBackground)
+	if err != nil {
+		t.Fatalf("request to another reader service waited: %v", err)
+	}
+	releaseB()
+	// The same reader service is at its limit.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = q.Acquire(ctx, "http://a", PriorityInteractive)
+	if err == nil {
+		t.Fatal("second request to the same reader service didn't wait")
+	}
+	releaseA()
+	release, err := q.Acquire(context.Background(), "http://a", PriorityInteractive)
+	if err != nil {
+		t.Fatalf("request after release waited: %v", err)
+	}
+	release()
+}
+
+func TestUpstreamQueuePriority(t *testing.T) {
+	q := &UpstreamQueue{Limit: 1}
+	release, err := q.Acquire(context.Background(), "http://a", PriorityBackground)
+	if err != nil {
+		t.Fatal(err)
+	}
+	order := make(chan Priority, 2)
+	for _, priority := range []Priority{PriorityBackground, PriorityInteractive} {
+		go func(priority Priority) {
+			release, err := q.Acquire(context.Background(), "http://a", priority)
+			if err != nil {
+				return
+			}
+			order <- priority
+			release()
+		}(priority)
+		// Let each wait in turn.
+		time.Sleep(20 * time.Millisecond)
+	}
+	release()
+	if first := <-order; first != PriorityInteractive {
+		t.Errorf("got %v first, want interactive", first)
+	}
+	<-order
+}
@@ -0,0 +1,116 @@
+// Copyright 2023 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PrometheusContentType is the content type of the Prometheus text exposition format.
+const PrometheusContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// PrometheusHandler serves the metrics in the Prometheus text format, for
+// scraping into a monitoring system.
+type PrometheusHandler struct {
+	Metrics *Metrics
+}
+
+// ServeHTTP writes the metrics.
+func (h PrometheusHandler) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", PrometheusContentType)
+	w.Header().Set("Cache-Control", "no-store")
+	h.Metrics.WritePrometheus(w)
+}
+
+// WritePrometheus writes the metrics in the Prometheus text format.
+func (m *Metrics) WritePrometheus(out io.Writer) error {
+	s := m.Snapshot()
+	var b strings.Builder
+	metric := func(name, kind, help string) {
+		fmt.Fprintf(&b, "# HELP %v %v\n# TYPE %v %v\n", name, help, name, kind)
+	}
+
+	metric("almarfidintercept_build_info", "gauge", "The version of the proxy, and the Go it was built with.")
+	fmt.Fprintf(&b, "almarfidintercept_build_info{version=%v,goversion=%v} 1\n",
+		quoteLabel(version), quoteLabel(runtime.Version()))
+
+	metric("almarfidintercept_uptime_seconds", "gauge", "Time since the proxy started.")
+	fmt.Fprintf(&b, "almarfidintercept_uptime_seconds %v\n", formatFloat(time.Since(m.start).Seconds()))
+
+	metric("almarfidintercept_requests_in_flight", "gauge", "Requests being proxied now.")
+	fmt.Fprintf(&b, "almarfidintercept_requests_in_flight %d\n", s.InFlight)
+
+	metric("almarfidintercept_requests_total", "counter", "Requests served, besides CORS preflights, by status code.")
+	statuses := make([]int, 0, len(s.Statuses))
+	for status := range s.Statuses {
+		statuses = append(statuses, status)
+	}
+	sort.Ints(statuses)
+	for _, status := range statuses {
+		fmt.Fprintf(&b, "almarfidintercept_requests_total{code=\"%d\"} %d\n", status, s.Statuses[status])
+	}
+
+	metric("almarfidintercept_preflight_requests_total", "counter", "CORS preflight requests, by the method they ask permission for.")
+	for _, method := range sortedCountKeys(s.PreflightMethods) {
+		fmt.Fprintf(&b, "almarfidintercept_preflight_requests_total{method=%v} %d\n", quoteLabel(method), s.PreflightMethods[method])
+	}
+
+	operations := make([]string, 0, len(s.Operations))
+	for operation := range s.Operations {
+		operations = append(operations, operation)
+	}
+	sort.Strings(operations)
+
+	metric("almarfidintercept_upstream_requests_total", "counter", "Requests sent to the reader service, by operation.")
+	for _, operation := range operations {
+		fmt.Fprintf(&b, "almarfidintercept_upstream_requests_total{operation=%v} %d\n", quoteLabel(operation), s.Operations[operation].Requests)
+	}
+	metric("almarfidintercept_upstream_errors_total", "counter", "Requests to the reader service which failed, by operation.")
+	for _, operation := range operations {
+		fmt.Fprintf(&b, "almarfidintercept_upstream_errors_total{operation=%v} %d\n", quoteLabel(operation), s.Operations[operation].Failures)
+	}
+	metric("almarfidintercept_upstream_latency_seconds", "histogram", "Time the reader service took to respond, by operation.")
+	for _, operation := range operations {
+		stats := s.Operations[operation]
+		label := quoteLabel(operation)
+		for i, bound := range LatencyBuckets() {
+			fmt.Fprintf(&b, "almarfidintercept_upstream_latency_seconds_bucket{operation=%v,le=\"%v\"} %d\n", label, formatFloat(bound.Seconds()), stats.Buckets[i])
+		}
+		fmt.Fprintf(&b, "almarfidintercept_upstream_latency_seconds_bucket{operation=%v,le=\"+Inf\"} %d\n", label, stats.Requests)
+		fmt.Fprintf(&b, "almarfidintercept_upstream_latency_seconds_sum{operation=%v} %v\n", label, formatFloat(stats.TotalLatency.Seconds()))
+		fmt.Fprintf(&b, "almarfidintercept_upstream_latency_seconds_count{operation=%v} %d\n", label, stats.Requests)
+	}
+
+	_, err := io.WriteString(out, b.String())
+	return err
+}
+
+// quoteLabel quotes a Prometheus label value, escaping backslashes, quotes, and newlines.
+func quoteLabel(value string) string {
+	value = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+	return `"` + value + `"`
+}
+
+// formatFloat formats a sample value.
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// sortedCountKeys returns the keys of a map of counts, in order.
+func sortedCountKeys(counts map[string]int64) []string {
+	keys := make([]string, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
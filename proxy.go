@@ -0,0 +1,832 @@
+// Copyright 2023 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultForwardHeaders are the request headers forwarded to the reader service by default.
+const DefaultForwardHeaders = "SOAPAction,Content-Type,Accept,X-CustomHeader,X-Requested-With,User-Agent,If-Modified-Since,Cache-Control"
+
+// DefaultMaxResponseBytes is the default size limit of a response from the reader service.
+const DefaultMaxResponseBytes = 16 << 20
+
+// DefaultMaxRequestBytes is the default size limit of a request body.
+const DefaultMaxRequestBytes = 1 << 20
+
+// ErrResponseTooLarge is returned when the reader service's response is larger than the limit.
+var ErrResponseTooLarge = errors.New("the reader service's response is too large")
+
+// DefaultFlushInterval is how often a streaming response is flushed to the browser by default.
+const DefaultFlushInterval = 100 * time.Millisecond
+
+// DefaultPreflightMaxAge is how long browsers may cache a preflight response by default.
+// Browsers cap it, Chrome at two hours and Firefox at a day.
+const DefaultPreflightMaxAge = 20 * 24 * time.Hour
+
+// DefaultCORSAllowMethods are the methods browsers may use by default.
+const DefaultCORSAllowMethods = "GET,POST,PUT,OPTIONS"
+
+// DefaultCORSAllowHeaders are the request headers browsers may send by default,
+// whether or not they are forwarded.
+const DefaultCORSAllowHeaders = "SOAPAction,X-CustomHeader,Keep-Alive,User-Agent,X-Requested-With,If-Modified-Since,Cache-Control,Content-Type," + IdempotencyKeyHeader
+
+// DefaultCORSExposeHeaders are our response headers scripts may read by default.
+// The reader service's own headers are always exposed.
+const DefaultCORSExposeHeaders = EnvironmentHeader + "," + VersionHeader + "," + IdempotentReplayedHeader + "," + CoalescedHeader + "," + RequestIDHeader
+
+// Proxy forwards requests from Alma to the reader service.
+type Proxy struct {
+	// Defaults are the policies for requests from origins which aren't
+	// one of the Institutions. They are replaced with SetDefaults when the
+	// configuration is reloaded.
+	Defaults *Institution
+
+	// Institutions have their own policies, keyed by origin.
+	// They are replaced with SetInstitutions when the configuration is reloaded.
+	Institutions Institutions
+
+	// Client sends requests to the reader service, reusing connections.
+	Client *http.Client
+
+	// ForwardHeaders are the request headers forwarded to the reader service,
+	// in canonical form. If nil, every header is forwarded. The WebSocket
+	// handshake headers, and the Idempotency-Key, are always forwarded.
+	ForwardHeaders []string
+
+	// AllowMethods, AllowHeaders, and ExposeHeaders are the CORS
+	// Access-Control-Allow-Methods, Access-Control-Allow-Headers, and
+	// Access-Control-Expose-Headers lists. If nil, the defaults are used.
+	// The ForwardHeaders are always allowed too.
+	AllowMethods  []string
+	AllowHeaders  []string
+	ExposeHeaders []string
+
+	// AllowPrivateNetwork approves Private Network Access preflights, which
+	// browsers send before a public page, like Alma, may reach a private
+	// address, like localhost.
+	AllowPrivateNetwork bool
+
+	// PreflightMaxAge is how long browsers may cache a preflight response,
+	// sent as Access-Control-Max-Age in whole seconds.
+	PreflightMaxAge time.Duration
+
+	// Timeouts override the Client's timeout for particular operations, like
+	// tag writes on a stack of items, keyed by lower case operation name.
+	Timeouts map[string]time.Duration
+
+	// MaxRequestBytes limits the size of a request body. Larger requests are
+	// refused with 413, before they're relayed to the reader service.
+	// Zero means no limit.
+	MaxRequestBytes int64
+
+	// MaxResponseBytes limits the size of a response from the reader service.
+	// Larger responses with a known length are refused with 502. Responses of
+	// unknown length are cut off at the limit, since they're already streaming
+	// to the browser. Zero means no limit.
+	MaxResponseBytes int64
+
+	// FlushInterval is how often the response is flushed to the browser while
+	// it streams from the reader service, so partial results, like those of a
+	// long inventory scan, show up as they arrive. If negative, every write is
+	// flushed. Responses of unknown length are always flushed on every write.
+	FlushInterval time.Duration
+
+	// Queue limits how many requests are sent to each reader service at once,
+	// letting interactive operations through first. It may be nil.
+	Queue *UpstreamQueue
+
+	// Tracker is passed successful upstream responses,
+	// and publishes any tag events they imply.
+	Tracker *TagTracker
+
+	// Maintenance is served when the reader service can't be reached.
+	Maintenance *MaintenancePage
+
+	// Alarm is told how each upstream request went, and raises an alert
+	// when too many fail or are too slow. It may be nil.
+	Alarm *UpstreamAlarm
+
+	// Retry retries requests which fail to get a response from the reader
+	// service, when they are safe to send twice. It may be nil.
+	Retry *UpstreamRetry
+
+	// Routes send requests for some paths to other services on the
+	// workstation, like a receipt printer service.
+	Routes Routes
+
+	// ActionRoutes send SOAP operations for the default reader service to
+	// other reader services, like a separate service for writes.
+	ActionRoutes ActionRoutes
+
+	// Pool balances requests for the default reader service across several.
+	// It may be nil. It is replaced with SetPool when the configuration is
+	// reloaded, since the default reader service is one of them.
+	Pool *UpstreamPool
+
+	// Fallback is sent requests for the default reader service when it
+	// can't be reached. It may be nil.
+	Fallback *UpstreamFallback
+
+	// Breaker refuses requests to a reader service while it keeps failing,
+	// instead of letting each wait out the timeout. It may be nil.
+	Breaker *CircuitBreaker
+
+	// Watchdog is told how each upstream request went, and recovers a
+	// reader service when too many of its requests in a row time out.
+	// It may be nil.
+	Watchdog *Watchdog
+
+	// Metrics counts upstream requests by operation. It may be nil.
+	Metrics *Metrics
+
+	// Responses keeps recent upstream responses for debugging. It may be nil.
+	Responses *RecentResponses
+
+	// Objectives is told the latency of each upstream request,
+	// to measure it against the latency objectives. It may be nil.
+	Objectives *ObjectiveTracker
+
+	mu sync.RWMutex
+
+	once          sync.Once
+	handler       http.Handler // CORS wrapped around forward.
+	allowMethods  string       // The Access-Control-Allow-Methods value.
+	allowHeaders  string       // The Access-Control-Allow-Headers value.
+	exposeHeaders string       // The Access-Control-Expose-Headers value.
+
+	lastUpstream atomic.Int64 // When the last upstream request was sent, in Unix nanoseconds.
+}
+
+// SetInstitutions replaces the institution policies, returning the old ones.
+// The new ones take over the old ones' audit logs and rate limiters where
+// they are unchanged, see Institutions.TakeOver.
+func (p *Proxy) SetInstitutions(institutions Institutions) Institutions {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	old := p.Institutions
+	institutions.TakeOver(old)
+	p.Institutions = institutions
+	return old
+}
+
+// SetDefaults replaces the default policies, returning the old ones.
+func (p *Proxy) SetDefaults(defaults *Institution) *Institution {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	old := p.Defaults
+	p.Defaults = defaults
+	return old
+}
+
+// SetPool replaces the pool of default reader services, returning the old one.
+func (p *Proxy) SetPool(pool *UpstreamPool) *UpstreamPool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	old := p.Pool
+	p.Pool = pool
+	return old
+}
+
+// pool returns the pool of default reader services, or nil.
+func (p *Proxy) pool() *UpstreamPool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.Pool
+}
+
+// DefaultUpstream returns the reader service requests from origins which
+// aren't one of the institutions are proxied to.
+func (p *Proxy) DefaultUpstream() string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.Defaults.Upstream
+}
+
+// Origins returns the allowed origins, sorted: the default origin, which may
+// be *, and the institutions' origins.
+func (p *Proxy) Origins() []string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	origins := make([]string, 0, len(p.Institutions)+1)
+	if p.Defaults.origin != "" {
+		origins = append(origins, p.Defaults.origin)
+	}
+	for origin := range p.Institutions {
+		if origin != p.Defaults.origin {
+			origins = append(origins, origin)
+		}
+	}
+	sort.Strings(origins)
+	return origins
+}
+
+// Environment returns the environment of the default reader service,
+// production or sandbox.
+func (p *Proxy) Environment() string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.Defaults.Environment
+}
+
+// SandboxOrigins returns the institutions' origins which are proxied to a
+// sandbox, sorted.
+func (p *Proxy) SandboxOrigins() []string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	var origins []string
+	for origin, inst := range p.Institutions {
+		if inst.Environment == EnvironmentSandbox {
+			origins = append(origins, origin)
+		}
+	}
+	sort.Strings(origins)
+	return origins
+}
+
+// ServeHTTP proxies a request to the reader service. Requests from an origin
+// listed in Institutions are allowed, proxied, rate limited and audited
+// according to that institution's policies. Other requests use the Defaults.
+// The CORS headers are added by the CORS middleware, around the forwarding.
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.once.Do(p.setup)
+	p.handler.ServeHTTP(w, r)
+}
+
+// setup builds the handler and the CORS header values, the first time they're needed.
+func (p *Proxy) setup() {
+	p.handler = p.CORS(http.HandlerFunc(p.forward))
+	methods := p.AllowMethods
+	if methods == nil {
+		methods = splitList(DefaultCORSAllowMethods)
+	}
+	allow := p.AllowHeaders
+	if allow == nil {
+		allow = splitList(DefaultCORSAllowHeaders)
+	}
+	expose := p.ExposeHeaders
+	if expose == nil {
+		expose = splitList(DefaultCORSExposeHeaders)
+	}
+	p.allowMethods = joinHeaderList(methods)
+	p.allowHeaders = joinHeaderList(append(append([]string{}, allow...), p.ForwardHeaders...))
+	p.exposeHeaders = joinHeaderList(expose)
+}
+
+// institution returns the policies for requests from an origin.
+func (p *Proxy) institution(origin string) *Institution {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if inst := p.Institutions.Lookup(origin); inst != nil {
+		return inst
+	}
+	return p.Defaults
+}
+
+// allowed reports whether requests from an origin are allowed: it is one of
+// the institutions, or the default origin, or the default origin is *.
+func (p *Proxy) allowed(origin string) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.Institutions.Lookup(origin) != nil || p.Defaults.origin == "*" || p.Defaults.origin == origin
+}
+
+// CORS wraps a handler, adding the CORS headers for the request's origin,
+// and answering preflight requests itself. Requests from origins which aren't
+// allowed are refused, without any CORS headers. Requests without an Origin
+// header, which don't come from a browser page, are passed through.
+// It also wraps handlers besides the proxy, like /events.
+func (p *Proxy) CORS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p.once.Do(p.setup)
+		origin := r.Header.Get("Origin")
+		inst := p.institution(origin)
+		w.Header().Set(EnvironmentHeader, inst.Environment)
+		w.Header().Set(VersionHeader, version)
+		// The CORS headers depend on the origin, so caches must not share responses between origins.
+		w.Header().Add("Vary", "Origin")
+		if origin != "" {
+			if !p.allowed(origin) {
+				slog.WarnContext(r.Context(), "Refused a request from an origin which isn't allowed.", "origin", origin, "method", r.Method, "path", r.URL.Path)
+				httpError(w, r, fmt.Sprintf("Origin %v is not allowed.", origin), http.StatusForbidden)
+				return
+			}
+			// Echo the origin, even when any origin is allowed, since browsers
+			// refuse credentialed responses with Access-Control-Allow-Origin: *.
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Allow-Methods", p.allowMethods)
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+			w.Header().Set("Access-Control-Allow-Headers", p.allowHeaders)
+			if p.exposeHeaders != "" {
+				w.Header().Set("Access-Control-Expose-Headers", p.exposeHeaders)
+			}
+			if r.Method == "OPTIONS" {
+				slog.DebugContext(r.Context(), "Preflight request.",
+					"origin", r.Header.Get("Origin"),
+					"method", r.Header.Get("Access-Control-Request-Method"),
+					"headers", r.Header.Get("Access-Control-Request-Headers"))
+				// Only approve Private Network Access when the browser asks for it.
+				if r.Header.Get("Access-Control-Request-Private-Network") == "true" {
+					if p.AllowPrivateNetwork {
+						w.Header().Set("Access-Control-Allow-Private-Network", "true")
+					} else {
+						slog.DebugContext(r.Context(), "Private Network Access not approved.", "origin", origin)
+					}
+				}
+				w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(p.PreflightMaxAge.Seconds())))
+				w.Header().Set("Content-Type", "text/plain charset=UTF-8")
+				http.Error(w, "", http.StatusNoContent)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// forward proxies a request to the reader service with httputil.ReverseProxy,
+// which passes the method, headers, body, and trailers through, and streams the
+// response back. The response is watched as it streams, for the metrics, the
+// tag tracker, and the audit log. The upstream request uses the request's
+// context, so if the browser goes away, like when a tab is closed, the
+// request to the reader service is cancelled too.
+func (p *Proxy) forward(w http.ResponseWriter, r *http.Request) {
+	inst := p.institution(r.Header.Get("Origin"))
+	upstream := inst.Upstream
+	if upstream == "" {
+		upstream = p.DefaultUpstream()
+	}
+	// Tags are tracked on the institution's pad, wherever its requests are routed.
+	pad := upstream
+	// Requests for routed paths go to another service on the workstation,
+	// which doesn't share the reader service's queue, breaker, or watchdog.
+	route, routedPath, routed := p.Routes.Match(r.URL.Path)
+	queue, breaker, watchdog := p.Queue, p.Breaker, p.Watchdog
+	if routed {
+		upstream = route.Target.Scheme + "://" + route.Target.Host
+		queue, breaker, watchdog = nil, nil, nil
+	} else if target, ok := p.ActionRoutes.Match(r.Header.Get("SOAPAction")); ok && upstream == p.DefaultUpstream() {
+		upstream = target.String()
+	}
+	if !inst.Allow() {
+		w.Header().Set("Retry-After", "1")
+		httpError(w, r, fmt.Sprintf("Rate limit for %v exceeded.", inst.Name), http.StatusTooManyRequests)
+		return
+	}
+	operation := operationName(r.Header.Get("SOAPAction"), r.URL.Path)
+
+	// Refuse oversized bodies, like accidental file uploads, up front if we
+	// know their size, or once they pass the limit while being relayed.
+	if p.MaxRequestBytes > 0 {
+		if r.ContentLength > p.MaxRequestBytes {
+			slog.WarnContext(r.Context(), "Refused a request body over the size limit.", "operation", operation, "bytes", r.ContentLength, "limit", p.MaxRequestBytes)
+			httpError(w, r, fmt.Sprintf("Request body larger than the limit of %v bytes.", p.MaxRequestBytes), http.StatusRequestEntityTooLarge)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, p.MaxRequestBytes)
+	}
+
+	target, err := url.Parse(upstream)
+	if err != nil {
+		// This should never happen, since we already parsed in main.
+		httpError(w, r, "Bad internal proxy address.", http.StatusInternalServerError)
+		return
+	}
+
+	// Answer straight away while the reader service keeps failing.
+	if ok, wait := breaker.Allow(upstream); !ok {
+		slog.DebugContext(r.Context(), "Circuit breaker refused a request.", "operation", operation, "wait", wait)
+		inst.Audit(r, operation, http.StatusServiceUnavailable)
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		p.Maintenance.Serve(w, r, "the reader service keeps failing, so requests are paused for "+wait.Round(time.Second).String())
+		return
+	}
+
+	// Wait for a turn. The turn ends when the response has been read.
+	priority := RequestPriority(operation)
+	queued := time.Now()
+	release, err := queue.Acquire(r.Context(), upstream, priority)
+	if err != nil {
+		// The client went away while waiting.
+		slog.DebugContext(r.Context(), "Request abandoned while queued.", "operation", operation, "priority", priority, "waited", time.Since(queued))
+		return
+	}
+	if waited := time.Since(queued); waited > time.Millisecond {
+		slog.DebugContext(r.Context(), "Request queued.", "operation", operation, "priority", priority, "waited", waited)
+	}
+	var releaseOnce sync.Once
+	done := func() { releaseOnce.Do(release) }
+	defer done()
+
+	// Only the default reader service is balanced and fails over, so the
+	// sandbox and other institutions never reach the pool or the fallback.
+	transport := p.Client.Transport
+	if upstream == p.DefaultUpstream() {
+		transport = p.pool().Transport(transport)
+	}
+	transport = p.Retry.Transport(transport)
+	if upstream == p.DefaultUpstream() {
+		transport = p.Fallback.Transport(transport)
+	}
+
+	// WebSocket connections, for continuous tag reads, are tunnelled to the
+	// reader service once it agrees to switch protocols.
+	upgrade := isUpgrade(r)
+	tunnelled := false
+
+	start := time.Now()
+	p.lastUpstream.Store(start.UnixNano())
+	reverse := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.Out.URL.Scheme = target.Scheme
+			pr.Out.URL.Host = target.Host
+			pr.Out.Host = ""
+			if routed {
+				pr.Out.URL.Path = routedPath
+				pr.Out.URL.RawPath = ""
+			}
+			if p.ForwardHeaders != nil {
+				forwarded := make(http.Header, len(p.ForwardHeaders))
+				for _, name := range p.ForwardHeaders {
+					if values, ok := pr.Out.Header[name]; ok {
+						forwarded[name] = values
+					}
+				}
+				// A WebSocket handshake needs its own headers, whatever is forwarded.
+				if upgrade {
+					for name, values := range pr.Out.Header {
+						if name == "Connection" || name == "Upgrade" || strings.HasPrefix(name, "Sec-Websocket-") {
+							forwarded[name] = values
+						}
+					}
+				}
+				// The retry sends keyed writes twice, so the key must survive too.
+				if values, ok := pr.Out.Header[IdempotencyKeyHeader]; ok {
+					forwarded[IdempotencyKeyHeader] = values
+				}
+				pr.Out.Header = forwarded
+			}
+			// The reader service's logs can be matched with ours.
+			if id := RequestID(r.Context()); id != "" {
+				pr.Out.Header.Set(RequestIDHeader, id)
+			}
+		},
+		Transport: &timeoutTransport{next: transport, timeout: p.timeout(operation)},
+		ModifyResponse: func(resp *http.Response) error {
+			recordUpstreamLatency(r.Context(), time.Since(start))
+			// Our CORS headers are the only ones the browser should see.
+			for name := range resp.Header {
+				if strings.HasPrefix(name, "Access-Control-") {
+					resp.Header.Del(name)
+				}
+			}
+			// The tunnel is copied directly, so there's no body to watch, and
+			// the queue slot is given up, since the connection lasts a long time.
+			if resp.StatusCode == http.StatusSwitchingProtocols {
+				done()
+				tunnelled = true
+				p.observeUpstream(operation, time.Since(start), false)
+				watchdog.Observe(upstream, nil)
+				breaker.Observe(upstream, nil)
+				slog.InfoContext(r.Context(), "WebSocket connection opened.", "operation", operation, "origin", r.Header.Get("Origin"))
+				return nil
+			}
+			// The reader service's headers are copied to the response. Let the
+			// Alma plugin read the vendor specific ones, too.
+			if r.Header.Get("Origin") != "" {
+				if exposed := exposableHeaders(resp.Header); len(exposed) > 0 {
+					resp.Header.Set("Access-Control-Expose-Headers", strings.Join(exposed, ", "))
+				}
+			}
+			// A misbehaving reader service can send enough to wedge the browser.
+			if p.MaxResponseBytes > 0 {
+				if resp.ContentLength > p.MaxResponseBytes {
+					return fmt.Errorf("%w, %v bytes, more than the limit of %v", ErrResponseTooLarge, resp.ContentLength, p.MaxResponseBytes)
+				}
+				resp.Body = &limitedBody{ReadCloser: resp.Body, remaining: p.MaxResponseBytes}
+			}
+			// Without a Content-Type, browsers won't parse XML responses as XML.
+			if resp.Header.Get("Content-Type") == "" {
+				body := bufio.NewReader(resp.Body)
+				if start, _ := body.Peek(512); looksLikeXML(start) {
+					resp.Header.Set("Content-Type", "text/xml; charset=utf-8")
+				}
+				resp.Body = struct {
+					io.Reader
+					io.Closer
+				}{body, resp.Body}
+			}
+			resp.Body = &watchedBody{ReadCloser: resp.Body, done: func(body []byte, complete bool, err error) {
+				done()
+				if err != nil && r.Context().Err() != nil {
+					// The browser went away, and the upstream request was cancelled with it.
+					// That says nothing about the reader service, so it isn't counted as a failure.
+					slog.DebugContext(r.Context(), "Client disconnected, cancelled the upstream request.", "operation", operation, "after", time.Since(start))
+					inst.Audit(r, operation, resp.StatusCode)
+					return
+				}
+				p.observeUpstream(operation, time.Since(start), err != nil || resp.StatusCode >= 500)
+				watchdog.Observe(upstream, err)
+				breaker.Observe(upstream, err)
+				if err != nil {
+					slog.ErrorContext(r.Context(), "Error reading API Response.", "operation", operation, "error", err)
+				}
+				p.Responses.Record(operation, resp.StatusCode, body)
+				inst.Audit(r, operation, resp.StatusCode)
+				switch {
+				case resp.StatusCode < 200 || resp.StatusCode >= 300:
+					p.Tracker.Failed(pad, operation, "reader service responded "+resp.Status)
+				case complete:
+					p.Tracker.Observe(pad, operation, body)
+				}
+			}}
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			done()
+			recordUpstreamLatency(r.Context(), time.Since(start))
+			if r.Context().Err() != nil {
+				// The client went away, so there's no one to tell.
+				slog.DebugContext(r.Context(), "Client disconnected, cancelled the upstream request.", "operation", operation, "after", time.Since(start))
+				return
+			}
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				// The request was at fault, not the reader service.
+				slog.WarnContext(r.Context(), "Refused a request body over the size limit.", "operation", operation, "limit", tooLarge.Limit)
+				httpError(w, r, fmt.Sprintf("Request body larger than the limit of %v bytes.", tooLarge.Limit), http.StatusRequestEntityTooLarge)
+				return
+			}
+			p.observeUpstream(operation, time.Since(start), true)
+			watchdog.Observe(upstream, err)
+			breaker.Observe(upstream, err)
+			p.Tracker.Failed(pad, operation, err.Error())
+			if errors.Is(err, ErrResponseTooLarge) {
+				slog.ErrorContext(r.Context(), "Refused a response from the reader service.", "operation", operation, "error", err)
+				inst.Audit(r, operation, http.StatusBadGateway)
+				httpError(w, r, "Refused the response from the RFID software: "+err.Error()+".", http.StatusBadGateway)
+				return
+			}
+			slog.ErrorContext(r.Context(), "Unable to send API request.", "operation", operation, "error", err)
+			inst.Audit(r, operation, http.StatusServiceUnavailable)
+			p.Maintenance.Serve(w, r, err.Error())
+		},
+		ErrorLog:      slog.NewLogLogger(slog.Default().Handler(), slog.LevelError),
+		FlushInterval: p.FlushInterval,
+	}
+	reverse.ServeHTTP(w, r)
+	if tunnelled {
+		slog.InfoContext(r.Context(), "WebSocket connection closed.", "operation", operation, "duration", time.Since(start).Round(time.Millisecond))
+	}
+}
+
+// isUpgrade reports whether a request asks to switch protocols, like a WebSocket handshake.
+func isUpgrade(r *http.Request) bool {
+	if r.Header.Get("Upgrade") == "" {
+		return false
+	}
+	for _, value := range r.Header["Connection"] {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "Upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// timeout returns the time the reader service has to respond to an operation.
+func (p *Proxy) timeout(operation string) time.Duration {
+	if timeout, ok := p.Timeouts[strings.ToLower(operation)]; ok {
+		return timeout
+	}
+	return p.Client.Timeout
+}
+
+// PadUpstream returns the reader service requests from an origin are
+// proxied to, whose pad its tag events come from.
+func (p *Proxy) PadUpstream(origin string) string {
+	if upstream := p.institution(origin).Upstream; upstream != "" {
+		return upstream
+	}
+	return p.DefaultUpstream()
+}
+
+// LastUpstream returns when a request was last sent to the reader service.
+func (p *Proxy) LastUpstream() time.Time {
+	return time.Unix(0, p.lastUpstream.Load())
+}
+
+// Upstreams returns the distinct reader service addresses requests are proxied to.
+func (p *Proxy) Upstreams() []string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	upstreams := []string{p.Defaults.Upstream}
+	seen := map[string]bool{p.Defaults.Upstream: true}
+	for _, inst := range p.Institutions {
+		if inst.Upstream != "" && !seen[inst.Upstream] {
+			seen[inst.Upstream] = true
+			upstreams = append(upstreams, inst.Upstream)
+		}
+	}
+	return upstreams
+}
+
+// observeUpstream tells the alarm, metrics, and latency objectives how an upstream request went.
+// Failed requests don't count against the latency objectives, since they often fail fast.
+func (p *Proxy) observeUpstream(operation string, latency time.Duration, failed bool) {
+	p.Alarm.Observe(latency, failed)
+	p.Metrics.ObserveUpstream(operation, latency, failed)
+	if !failed {
+		p.Objectives.Observe(operation, latency)
+	}
+}
+
+// ParseForwardHeaders parses a comma separated list of request headers to forward.
+// It returns nil, which forwards every header, for *.
+func ParseForwardHeaders(list string) []string {
+	if strings.TrimSpace(list) == "*" {
+		return nil
+	}
+	names := []string{}
+	for _, name := range splitList(list) {
+		names = append(names, http.CanonicalHeaderKey(name))
+	}
+	return names
+}
+
+// joinHeaderList joins a list of header names or methods for a CORS header,
+// leaving out duplicates, which are compared without regard to case.
+func joinHeaderList(names []string) string {
+	seen := make(map[string]bool, len(names))
+	kept := make([]string, 0, len(names))
+	for _, name := range names {
+		if key := strings.ToLower(name); !seen[key] {
+			seen[key] = true
+			kept = append(kept, name)
+		}
+	}
+	return strings.Join(kept, ", ")
+}
+
+// exposableHeaders returns the names of the headers in h which the browser
+// only lets scripts read if they're listed in Access-Control-Expose-Headers.
+func exposableHeaders(h http.Header) []string {
+	var names []string
+	for name := range h {
+		switch name {
+		case "Cache-Control", "Content-Language", "Content-Length", "Content-Type", "Expires", "Last-Modified", "Pragma",
+			"Date", "Server", "Set-Cookie":
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// looksLikeXML reports whether the start of a body looks like an XML document.
+func looksLikeXML(start []byte) bool {
+	start = bytes.TrimLeft(start, "\ufeff \t\r\n")
+	return len(start) > 1 && start[0] == '<' && (start[1] == '?' || start[1] == '!' || isNameStart(start[1]))
+}
+
+// isNameStart reports whether an ASCII byte can start an XML element name.
+func isNameStart(c byte) bool {
+	return c == '_' || c == ':' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c >= 0x80
+}
+
+// WatchedBodyMax is the most of a response body kept for the tag tracker and
+// recent responses. Larger responses are still streamed to the browser.
+const WatchedBodyMax = 1 << 20
+
+// watchedBody is a response body which keeps a copy of what is read, up to
+// WatchedBodyMax, and calls done once when it is read to the end or closed.
+// complete is set if the whole body was read and kept.
+type watchedBody struct {
+	io.ReadCloser
+	buf       bytes.Buffer
+	truncated bool
+	err       error
+	eof       bool
+	once      sync.Once
+	done      func(body []byte, complete bool, err error)
+}
+
+// Read reads from the body, keeping a copy.
+func (b *watchedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if b.buf.Len()+n <= WatchedBodyMax {
+		b.buf.Write(p[:n])
+	} else {
+		b.truncated = true
+	}
+	if errors.Is(err, io.EOF) {
+		b.eof = true
+		b.finish()
+	} else if err != nil {
+		b.err = err
+		b.finish()
+	}
+	return n, err
+}
+
+// Close closes the body.
+func (b *watchedBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.finish()
+	return err
+}
+
+// finish calls done, once.
+func (b *watchedBody) finish() {
+	b.once.Do(func() {
+		err := b.err
+		if err == nil && !b.eof {
+			err = io.ErrUnexpectedEOF
+		}
+		b.done(b.buf.Bytes(), b.eof && !b.truncated, err)
+	})
+}
+
+// limitedBody is a response body which fails with ErrResponseTooLarge once more
+// than remaining bytes would be read.
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+}
+
+// Read reads from the body, up to the limit.
+func (b *limitedBody) Read(p []byte) (int, error) {
+	// Read one byte past the limit, to tell a body of exactly the limit from a larger one.
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	if int64(n) <= b.remaining {
+		b.remaining -= int64(n)
+		return n, err
+	}
+	n = int(b.remaining)
+	b.remaining = 0
+	return n, ErrResponseTooLarge
+}
+
+// timeoutTransport limits the time a request and the reading of its response
+// may take, like http.Client.Timeout, which httputil.ReverseProxy doesn't use.
+type timeoutTransport struct {
+	next    http.RoundTripper
+	timeout time.Duration
+}
+
+// RoundTrip sends a request, cancelling it if it takes longer than the timeout.
+// Requests to switch protocols aren't limited.
+func (t *timeoutTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	next := t.next
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	// A WebSocket connection lasts as long as the page is open.
+	if t.timeout <= 0 || isUpgrade(req) {
+		return next.RoundTrip(req)
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), t.timeout)
+	resp, err := next.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// cancelBody is a response body which cancels its request's context when closed.
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+// Close closes the body, then cancels the context.
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
@@ -0,0 +1,212 @@
+// Copyright 2023 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestProxy returns a Proxy sending requests from any origin to upstream,
+// forwarding the default headers.
+func newTestProxy(upstream string) *Proxy {
+	return &Proxy{
+		Defaults:       NewProfile("Default", "*", upstream, EnvironmentProduction),
+		Client:         &http.Client{Transport: http.DefaultTransport, Timeout: 5 * time.Second},
+		ForwardHeaders: ParseForwardHeaders(DefaultForwardHeaders),
+		Tracker:        NewTagTracker(NewEventBus()),
+		Maintenance:    NewMaintenancePage("", "test"),
+	}
+}
+
+func TestProxyForwardHeaders(t *testing.T) {
+	var got http.Header
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+	}))
+	defer upstream.Close()
+	p := newTestProxy(upstream.URL)
+	tests := []struct {
+		header string
+		want   bool
+	}{
+		{"SOAPAction", true},
+		{"Content-Type", true},
+		{IdempotencyKeyHeader, true},
+		{"Cookie", false},
+		{"Authorization", false},
+	}
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("<Envelope/>"))
+	for _, tt := range tests {
+		r.Header.Set(tt.header, "value")
+	}
+	p.ServeHTTP(httptest.NewRecorder(), r)
+	for _, tt := range tests {
+		if forwarded := got.Get(tt.header) != ""; forwarded != tt.want {
+			t.Errorf("%v forwarded %v, want %v", tt.header, forwarded, tt.want)
+		}
+	}
+}
+
+func TestProxyCORS(t *testing.T) {
+	const alma = "https://example.alma.exlibrisgroup.com"
+	const other = "https://other.alma.exlibrisgroup.com"
+	upstream := namedServer(t, "reader")
+	tests := []struct {
+		name          string
+		defaultOrigin string
+		origin        string
+		wantStatus    int
+		wantAllow     string
+	}{
+		{"default origin", alma, alma, http.StatusOK, alma},
+		{"institution", alma, other, http.StatusOK, other},
+		{"not allowed", alma, "https://evil.example.com", http.StatusForbidden, ""},
+		{"trailing slash", alma, alma + "/", http.StatusForbidden, ""},
+		{"no origin", alma, "", http.StatusOK, ""},
+		// Browsers refuse credentialed responses allowing *, so the origin is echoed.
+		{"any origin", "*", "https://evil.example.com", http.StatusOK, "https://evil.example.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestProxy(upstream.URL)
+			p.Defaults = NewProfile("Default", tt.defaultOrigin, upstream.URL, EnvironmentProduction)
+			p.Institutions = Institutions{other: NewProfile("Other", other, "", EnvironmentSandbox)}
+			r := httptest.NewRequest(http.MethodPost, "/getItems", strings.NewReader("<Envelope/>"))
+			if tt.origin != "" {
+				r.Header.Set("Origin", tt.origin)
+			}
+			w := httptest.NewRecorder()
+			p.ServeHTTP(w, r)
+			if w.Code != tt.wantStatus {
+				t.Errorf("got status %v, want %v", w.Code, tt.wantStatus)
+			}
+			if got := w.Header().Get("Access-Control-Allow-Origin"); got != tt.wantAllow {
+				t.Errorf("got Access-Control-Allow-Origin %q, want %q", got, tt.wantAllow)
+			}
+			if got := w.Header().Get("Access-Control-Allow-Credentials"); (got == "true") != (tt.wantAllow != "") {
+				t.Errorf("got Access-Control-Allow-Credentials %q", got)
+			}
+			// Every response depends on the origin, even refusals and requests without one.
+			if got := w.Header().Values("Vary"); !slices.Contains(got, "Origin") {
+				t.Errorf("got Vary %q, want Origin", got)
+			}
+		})
+	}
+}
+
+func TestProxyPrivateNetworkAccess(t *testing.T) {
+	const alma = "https://example.alma.exlibrisgroup.com"
+	tests := []struct {
+		name      string
+		allow     bool
+		origin    string
+		requested bool
+		want      bool
+	}{
+		{"approved", true, alma, true, true},
+		{"not asked", true, alma, false, false},
+		{"not allowed", false, alma, true, false},
+		{"origin not allowed", true, "https://evil.example.com", true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestProxy("http://localhost:21645")
+			p.Defaults = NewProfile("Default", alma, "http://localhost:21645", EnvironmentProduction)
+			p.AllowPrivateNetwork = tt.allow
+			r := httptest.NewRequest(http.MethodOptions, "/", nil)
+			r.Header.Set("Origin", tt.origin)
+			r.Header.Set("Access-Control-Request-Method", http.MethodPost)
+			if tt.requested {
+				r.Header.Set("Access-Control-Request-Private-Network", "true")
+			}
+			w := httptest.NewRecorder()
+			p.ServeHTTP(w, r)
+			if got := w.Header().Get("Access-Control-Allow-Private-Network") == "true"; got != tt.want {
+				t.Errorf("got Private Network Access approved %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProxyMaxResponseBytes(t *testing.T) {
+	const limit = 1024
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		size, _ := strconv.Atoi(r.URL.Query().Get("size"))
+		body := "<" + strings.Repeat("a", size-1)
+		if r.URL.Query().Get("streamed") == "" {
+			w.Header().Set("Content-Length", strconv.Itoa(size))
+		} else {
+			w.(http.Flusher).Flush()
+		}
+		io.WriteString(w, body)
+	}))
+	defer upstream.Close()
+	tests := []struct {
+		name       string
+		query      string
+		wantStatus int
+		wantBytes  int
+	}{
+		{"under the limit", "size=1000", http.StatusOK, 1000},
+		{"at the limit", "size=1024", http.StatusOK, 1024},
+		{"over the limit", "size=1025", http.StatusBadGateway, 0},
+		{"streamed under the limit", "size=1024&streamed=1", http.StatusOK, 1024},
+		// Once streaming, the status has been sent, so the response is cut off at the limit.
+		{"streamed over the limit", "size=100000&streamed=1", http.StatusOK, 1024},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestProxy(upstream.URL)
+			p.MaxResponseBytes = limit
+			status, body := serve(t, p, http.MethodGet, "/getItems?"+tt.query, "")
+			if status != tt.wantStatus {
+				t.Errorf("got status %v, want %v", status, tt.wantStatus)
+			}
+			if status == http.StatusOK && len(body) != tt.wantBytes {
+				t.Errorf("got %v bytes, want %v", len(body), tt.wantBytes)
+			}
+		})
+	}
+}
+
+func TestProxyMaxRequestBytes(t *testing.T) {
+	upstream := echoServer(t, "reader")
+	tests := []struct {
+		name    string
+		size    int
+		chunked bool
+		want    int
+	}{
+		{"under the limit", 1000, false, http.StatusOK},
+		{"at the limit", 1024, false, http.StatusOK},
+		{"over the limit", 1025, false, http.StatusRequestEntityTooLarge},
+		{"chunked under the limit", 1024, true, http.StatusOK},
+		// Without a Content-Length, the body is refused once it passes the limit.
+		{"chunked over the limit", 100000, true, http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestProxy(upstream.URL)
+			p.MaxRequestBytes = 1024
+			var body io.Reader = strings.NewReader(strings.Repeat("a", tt.size))
+			if tt.chunked {
+				body = io.MultiReader(body)
+			}
+			r := httptest.NewRequest(http.MethodPost, "/", body)
+			w := httptest.NewRecorder()
+			p.ServeHTTP(w, r)
+			if w.Code != tt.want {
+				t.Errorf("got status %v, want %v", w.Code, tt.want)
+			}
+		})
+	}
+}
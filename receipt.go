@@ -0,0 +1,121 @@
+// Copyright 2023 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// ReceiptPrinterTimeout is how long we wait to connect and send a slip to a network printer.
+	ReceiptPrinterTimeout = 5 * time.Second
+
+	// DefaultReceiptTitle is the default heading printed on checkout slips.
+	DefaultReceiptTitle = "Items checked out"
+)
+
+// ReceiptPrinter prints a slip listing the items in each completed
+// checkout batch. Slips are ESC/POS encoded, and are either sent to a raw
+// network printer (usually on port 9100) or written to a spool directory.
+type ReceiptPrinter struct {
+	Printer string
+	Spool   string
+	Title   string
+	Station string
+}
+
+// Run prints a slip for every batch.complete event until the channel is closed.
+func (p *ReceiptPrinter) Run(events <-chan Event) {
+	for e := range events {
+		if e.Type != EventBatchComplete {
+			continue
+		}
+		slip := p.format(e)
+		if p.Printer != "" {
+			err := p.print(slip)
+			if err != nil {
+				slog.Error("Unable to print checkout slip.", "printer", p.Printer, "error", err)
+			}
+		}
+		if p.Spool != "" {
+			err := p.spool(slip, e.Time)
+			if err != nil {
+				slog.Error("Unable to spool checkout slip.", "spool", p.Spool, "error", err)
+			}
+		}
+	}
+}
+
+// format renders a batch as an ESC/POS print job.
+func (p *ReceiptPrinter) format(e Event) []byte {
+	var b bytes.Buffer
+	b.WriteString("\x1b@")     // Initialize the printer.
+	b.WriteString("\x1ba\x01") // Center.
+	b.WriteString("\x1bE\x01") // Bold on.
+	fmt.Fprintf(&b, "%v\n", p.Title)
+	b.WriteString("\x1bE\x00") // Bold off.
+	fmt.Fprintf(&b, "%v\n", e.Time.Local().Format("2006-01-02 15:04"))
+	if p.Station != "" {
+		fmt.Fprintf(&b, "%v\n", p.Station)
+	}
+	b.WriteString("\x1ba\x00") // Left.
+	b.WriteString("\n")
+	for i, barcode := range e.Items {
+		fmt.Fprintf(&b, "%3d. %v\n", i+1, barcode)
+	}
+	fmt.Fprintf(&b, "\nTotal items: %v\n", len(e.Items))
+	b.WriteString("\x1bd\x04")  // Feed four lines.
+	b.WriteString("\x1dVB\x00") // Feed to the cutter and cut.
+	return b.Bytes()
+}
+
+// print sends a slip to the network printer.
+func (p *ReceiptPrinter) print(slip []byte) error {
+	conn, err := net.DialTimeout("tcp", p.Printer, ReceiptPrinterTimeout)
+	if err != nil {
+		return fmt.Errorf("unable to connect: %w", err)
+	}
+	defer conn.Close()
+	err = conn.SetDeadline(time.Now().Add(ReceiptPrinterTimeout))
+	if err != nil {
+		return fmt.Errorf("unable to set deadline: %w", err)
+	}
+	_, err = conn.Write(slip)
+	if err != nil {
+		return fmt.Errorf("unable to send slip: %w", err)
+	}
+	return nil
+}
+
+// spool writes a slip to the spool directory. The slip is written to a
+// temporary file first and then renamed, so whatever watches the spool
+// directory never picks up a partial job.
+func (p *ReceiptPrinter) spool(slip []byte, at time.Time) error {
+	name := fmt.Sprintf("receipt-%v.prn", at.Format("20060102-150405.000000000"))
+	tmp, err := os.CreateTemp(p.Spool, ".receipt-*")
+	if err != nil {
+		return fmt.Errorf("unable to create spool file: %w", err)
+	}
+	_, err = tmp.Write(slip)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("unable to write spool file: %w", err)
+	}
+	err = os.Rename(tmp.Name(), filepath.Join(p.Spool, name))
+	if err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("unable to rename spool file: %w", err)
+	}
+	return nil
+}
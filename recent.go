@@ -0,0 +1,229 @@
+// Copyright 2023 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"html/template"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultRecentRequests is the default number of proxied requests kept for support staff.
+	DefaultRecentRequests = 50
+
+	// RecentRequestMaxBody is the most of each request and response body kept.
+	RecentRequestMaxBody = 4 * 1024
+)
+
+// recentPage shows the recent proxied requests.
+const recentPage = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Recent requests</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+.request { border: 1px solid #ccc; border-radius: 6px; padding: 0 1em; margin-bottom: 1em; }
+.failed { border: 2px solid #c00; }
+.details { color: #555; font-size: 0.9em; }
+pre { background: #f6f6f6; padding: 0.5em; overflow-x: auto; white-space: pre-wrap; }
+</style>
+</head>
+<body>
+<h1>Recent requests</h1>
+<p>Newest first. {{len .}} requests.</p>
+{{range .}}<div class="request{{if ge .Status 400}} failed{{end}}">
+<p><strong>{{.Method}} {{.Path}}</strong>, status {{.Status}}, {{.Time.Format "15:04:05.000"}}</p>
+<p class="details">Took {{.DurationMS}} ms{{if .UpstreamMS}}, {{.UpstreamMS}} ms at the reader service{{end}}.
+{{with .Origin}}Origin {{.}}.{{end}} {{with .RequestID}}Request ID {{.}}.{{end}}</p>
+{{if .RequestBody}}<p>Request{{if .RequestTruncated}}, truncated{{end}}:</p>
+<pre>{{.RequestBody}}</pre>{{end}}
+{{if .ResponseBody}}<p>Response{{if .ResponseTruncated}}, truncated{{end}}:</p>
+<pre>{{.ResponseBody}}</pre>{{end}}
+</div>
+{{end}}
+</body>
+</html>
+`
+
+// RecentRequest is a proxied request kept for support staff.
+type RecentRequest struct {
+	Time              time.Time `json:"time"`
+	RequestID         string    `json:"request_id,omitempty"`
+	Method            string    `json:"method"`
+	Path              string    `json:"path"`
+	Origin            string    `json:"origin,omitempty"`
+	Status            int       `json:"status"`
+	DurationMS        float64   `json:"duration_ms"`
+	UpstreamMS        float64   `json:"upstream_ms,omitempty"`
+	RequestBody       string    `json:"request_body,omitempty"`
+	RequestTruncated  bool      `json:"request_truncated,omitempty"`
+	ResponseBody      string    `json:"response_body,omitempty"`
+	ResponseTruncated bool      `json:"response_truncated,omitempty"`
+}
+
+// RecentRequests keeps the last few proxied requests in memory, with the start
+// of their bodies, and serves them at /admin/recent, so support staff can see
+// what just happened at a desk without turning on logging. Barcodes and patron
+// identifiers are masked by the Redactor before the requests are kept.
+type RecentRequests struct {
+	Redactor *Redactor
+
+	mu       sync.Mutex
+	requests []RecentRequest
+	next     int
+	size     int
+	page     *template.Template
+}
+
+// NewRecentRequests returns a RecentRequests which keeps size requests.
+func NewRecentRequests(size int, redactor *Redactor) *RecentRequests {
+	return &RecentRequests{
+		Redactor: redactor,
+		size:     size,
+		page:     template.Must(template.New("recent").Parse(recentPage)),
+	}
+}
+
+// Middleware wraps a handler, keeping the requests it serves.
+// CORS preflight requests aren't kept.
+func (rr *RecentRequests) Middleware(next http.Handler) http.Handler {
+	if rr == nil || rr.size <= 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isPreflight(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		start := time.Now()
+		timing, ok := r.Context().Value(upstreamTimingKey{}).(*upstreamTiming)
+		if !ok {
+			timing = &upstreamTiming{}
+			r = r.WithContext(context.WithValue(r.Context(), upstreamTimingKey{}, timing))
+		}
+		var body *keptBody
+		if r.Body != nil && r.Body != http.NoBody {
+			body = &keptBody{ReadCloser: r.Body}
+			r.Body = body
+		}
+		recorder := &keptResponse{responseRecorder: &responseRecorder{ResponseWriter: w, status: http.StatusOK}}
+		next.ServeHTTP(recorder, r)
+		request := RecentRequest{
+			Time:       start,
+			RequestID:  RequestID(r.Context()),
+			Method:     r.Method,
+			Path:       rr.Redactor.Redact(r.URL.RequestURI()),
+			Origin:     r.Header.Get("Origin"),
+			Status:     recorder.status,
+			DurationMS: milliseconds(time.Since(start)),
+			UpstreamMS: milliseconds(timing.latency),
+		}
+		request.ResponseBody, request.ResponseTruncated = rr.bodyText(recorder.kept)
+		if body != nil {
+			request.RequestBody, request.RequestTruncated = rr.bodyText(body.Kept())
+		}
+		rr.record(request)
+	})
+}
+
+// bodyText returns the start of a body as text, with barcodes and patron
+// identifiers masked, and whether it was cut off.
+func (rr *RecentRequests) bodyText(kept []byte) (string, bool) {
+	truncated := len(kept) > RecentRequestMaxBody
+	if truncated {
+		kept = kept[:RecentRequestMaxBody]
+	}
+	return rr.Redactor.Redact(strings.ToValidUTF8(string(kept), "�")), truncated
+}
+
+// record keeps a request, replacing the oldest if there are already size requests.
+func (rr *RecentRequests) record(request RecentRequest) {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	if len(rr.requests) < rr.size {
+		rr.requests = append(rr.requests, request)
+		return
+	}
+	rr.requests[rr.next] = request
+	rr.next = (rr.next + 1) % rr.size
+}
+
+// Recent returns the kept requests, newest first.
+func (rr *RecentRequests) Recent() []RecentRequest {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	recent := make([]RecentRequest, 0, len(rr.requests))
+	for i := len(rr.requests) - 1; i >= 0; i-- {
+		recent = append(recent, rr.requests[(rr.next+i)%len(rr.requests)])
+	}
+	return recent
+}
+
+// ServeHTTP serves the recent requests, as JSON to clients which ask for it,
+// and as a page otherwise.
+func (rr *RecentRequests) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	recent := rr.Recent()
+	w.Header().Set("Cache-Control", "no-store")
+	if strings.Contains(r.Header.Get("Accept"), "application/json") || r.URL.Query().Get("format") == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(recent)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err := rr.page.Execute(w, recent)
+	if err != nil {
+		slog.Error("Unable to render recent requests.", "error", err)
+	}
+}
+
+// keptBody keeps the start of a request body as it is read.
+type keptBody struct {
+	io.ReadCloser
+
+	mu   sync.Mutex
+	kept []byte
+}
+
+// Read reads from the body, keeping the start of it.
+func (b *keptBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if room := RecentRequestMaxBody + 1 - len(b.kept); room > 0 {
+		b.kept = append(b.kept, p[:min(n, room)]...)
+	}
+	return n, err
+}
+
+// Kept returns the start of the body read so far.
+func (b *keptBody) Kept() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.kept
+}
+
+// keptResponse records a response's status, and keeps the start of its body.
+type keptResponse struct {
+	*responseRecorder
+	kept []byte
+}
+
+// Write keeps the start of the body, then writes it.
+func (r *keptResponse) Write(p []byte) (int, error) {
+	if room := RecentRequestMaxBody + 1 - len(r.kept); room > 0 {
+		r.kept = append(r.kept, p[:min(len(p), room)]...)
+	}
+	return r.responseRecorder.Write(p)
+}
@@ -0,0 +1,160 @@
+// Copyright 2023 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strings"
+)
+
+// DefaultRedactFields are the parts of names whose values are masked in logs by default.
+const DefaultRedactFields = "barcode,patron,userid,user_id,cardnumber"
+
+// Redactor masks item barcodes and patron identifiers, to keep them out of
+// the logs. A field is any name containing one of Fields, ignoring case, so
+// barcode covers itemBarcode and BARCODE. Field values are masked in query
+// strings and form bodies, XML elements and attributes, JSON, and log
+// attributes. Anything matching one of the Patterns is masked wherever it is.
+type Redactor struct {
+	Fields   []string
+	Patterns []*regexp.Regexp
+
+	rules []redactRule
+}
+
+// redactRule replaces each match of a regular expression with a template, as
+// in regexp.Regexp.ReplaceAllString.
+type redactRule struct {
+	re       *regexp.Regexp
+	template string
+}
+
+// NewRedactor returns a Redactor for the comma separated field names, and the
+// space separated regular expressions. It returns nil, which redacts nothing,
+// if both are empty.
+func NewRedactor(fields, patterns string) (*Redactor, error) {
+	r := &Redactor{}
+	for _, field := range splitList(fields) {
+		r.Fields = append(r.Fields, strings.ToLower(field))
+	}
+	for _, pattern := range strings.Fields(patterns) {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("bad redaction pattern %q: %w", pattern, err)
+		}
+		r.Patterns = append(r.Patterns, re)
+	}
+	if len(r.Fields) == 0 && len(r.Patterns) == 0 {
+		return nil, nil
+	}
+	if len(r.Fields) > 0 {
+		quoted := make([]string, len(r.Fields))
+		for i, field := range r.Fields {
+			quoted[i] = regexp.QuoteMeta(field)
+		}
+		name := `[\w.:-]*(?:` + strings.Join(quoted, "|") + `)[\w.-]*`
+		r.rules = []redactRule{
+			// XML elements, like <barcode>123</barcode>, with or without a namespace prefix.
+			{regexp.MustCompile(`(?i)(<` + name + `(?:\s[^>]*)?>)[^<]+`), "${1}" + Masked},
+			// XML attributes, like barcode="123".
+			{regexp.MustCompile(`(?i)(\b` + name + `\s*=\s*")[^"]*"`), "${1}" + Masked + `"`},
+			{regexp.MustCompile(`(?i)(\b` + name + `\s*=\s*')[^']*'`), "${1}" + Masked + `'`},
+			// JSON strings and numbers, like "barcode": "123".
+			{regexp.MustCompile(`(?i)("` + name + `"\s*:\s*)(?:"(?:[^"\\]|\\.)*"|[\d.]+)`), "${1}\"" + Masked + `"`},
+			// Query strings and form bodies, like barcode=123.
+			{regexp.MustCompile(`(?i)(\b` + name + `=)[^&\s"'<>;#]+`), "${1}" + Masked},
+		}
+	}
+	for _, re := range r.Patterns {
+		r.rules = append(r.rules, redactRule{re, Masked})
+	}
+	return r, nil
+}
+
+// Redact returns s with the fields and patterns masked.
+func (r *Redactor) Redact(s string) string {
+	if r == nil {
+		return s
+	}
+	for _, rule := range r.rules {
+		s = rule.re.ReplaceAllString(s, rule.template)
+	}
+	return s
+}
+
+// Field reports whether values with this name are masked.
+func (r *Redactor) Field(name string) bool {
+	if r == nil {
+		return false
+	}
+	name = strings.ToLower(name)
+	for _, field := range r.Fields {
+		if strings.Contains(name, field) {
+			return true
+		}
+	}
+	return false
+}
+
+// attr returns an attribute with its value masked if its key is a field, or
+// with the fields and patterns in it masked if it is a string.
+func (r *Redactor) attr(a slog.Attr) slog.Attr {
+	a.Value = a.Value.Resolve()
+	switch {
+	case a.Value.Kind() == slog.KindGroup:
+		group := a.Value.Group()
+		redacted := make([]any, len(group))
+		for i, ga := range group {
+			redacted[i] = r.attr(ga)
+		}
+		return slog.Group(a.Key, redacted...)
+	case r.Field(a.Key):
+		return slog.String(a.Key, Masked)
+	case a.Value.Kind() == slog.KindString:
+		return slog.String(a.Key, r.Redact(a.Value.String()))
+	case a.Value.Kind() == slog.KindAny:
+		if err, ok := a.Value.Any().(error); ok {
+			return slog.String(a.Key, r.Redact(err.Error()))
+		}
+	}
+	return a
+}
+
+// RedactHandler is a slog.Handler which masks barcodes and patron
+// identifiers in each record's attributes before passing it on.
+type RedactHandler struct {
+	slog.Handler
+	Redactor *Redactor
+}
+
+// Handle masks the record's attributes, then passes it on.
+func (h RedactHandler) Handle(ctx context.Context, r slog.Record) error {
+	if h.Redactor == nil {
+		return h.Handler.Handle(ctx, r)
+	}
+	redacted := slog.NewRecord(r.Time, r.Level, r.Message, r.PC)
+	r.Attrs(func(a slog.Attr) bool {
+		redacted.AddAttrs(h.Redactor.attr(a))
+		return true
+	})
+	return h.Handler.Handle(ctx, redacted)
+}
+
+// WithAttrs returns a handler which adds the masked attrs to every record.
+func (h RedactHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	redacted := make([]slog.Attr, len(attrs))
+	for i, a := range attrs {
+		redacted[i] = h.Redactor.attr(a)
+	}
+	return RedactHandler{Handler: h.Handler.WithAttrs(redacted), Redactor: h.Redactor}
+}
+
+// WithGroup returns a handler which puts the record's attributes in a group.
+func (h RedactHandler) WithGroup(name string) slog.Handler {
+	return RedactHandler{Handler: h.Handler.WithGroup(name), Redactor: h.Redactor}
+}
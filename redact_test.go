@@ -0,0 +1,79 @@
+// Copyright 2023 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestRedact(t *testing.T) {
+	redactor, err := NewRedactor(DefaultRedactFields, `\b\d{14}\b`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"element", "<barcode>123</barcode>", "<barcode>" + Masked + "</barcode>"},
+		{"element containing a field", "<itemBarcode>123</itemBarcode>", "<itemBarcode>" + Masked + "</itemBarcode>"},
+		{"namespaced element", `<ns:patronId xmlns:ns="urn:rfid">jsmith</ns:patronId>`, `<ns:patronId xmlns:ns="urn:rfid">` + Masked + "</ns:patronId>"},
+		{"upper case", "<BARCODE>123</BARCODE>", "<BARCODE>" + Masked + "</BARCODE>"},
+		{"attribute", `<item barcode="123" title="Dune"/>`, `<item barcode="` + Masked + `" title="Dune"/>`},
+		{"single quoted attribute", `<item barcode='123'/>`, `<item barcode='` + Masked + `'/>`},
+		{"JSON string", `{"userId": "jsmith", "title": "Dune"}`, `{"userId": "` + Masked + `", "title": "Dune"}`},
+		{"JSON number", `{"cardNumber": 12345}`, `{"cardNumber": "` + Masked + `"}`},
+		{"query string", "/getItems?barcode=123&reader=1", "/getItems?barcode=" + Masked + "&reader=1"},
+		{"pattern", "scanned 39424012345678 at the desk", "scanned " + Masked + " at the desk"},
+		{"other fields", "<title>Dune</title>", "<title>Dune</title>"},
+	}
+	for _, tt := range tests {
+		if got := redactor.Redact(tt.in); got != tt.want {
+			t.Errorf("%v: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestNewRedactor(t *testing.T) {
+	redactor, err := NewRedactor("", "")
+	if redactor != nil || err != nil {
+		t.Errorf("got %v, %v, want nil, which redacts nothing", redactor, err)
+	}
+	if got := redactor.Redact("<barcode>123</barcode>"); got != "<barcode>123</barcode>" {
+		t.Errorf("nil redacted %q", got)
+	}
+	_, err = NewRedactor("", "(")
+	if err == nil {
+		t.Error("a bad pattern didn't fail")
+	}
+}
+
+func TestRedactHandler(t *testing.T) {
+	redactor, err := NewRedactor(DefaultRedactFields, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	logger := slog.New(RedactHandler{Handler: slog.NewTextHandler(&b, nil), Redactor: redactor})
+	logger.With("patron", "jsmith").Info("Proxied.",
+		"barcode", 39424012345678,
+		"path", "/getItems?barcode=item123",
+		"error", errors.New("no item <barcode>item456</barcode>"),
+		slog.Group("request", slog.String("userId", "jdoe"), slog.String("operation", "getItems")))
+	got := b.String()
+	for _, secret := range []string{"jsmith", "39424012345678", "item123", "item456", "jdoe"} {
+		if strings.Contains(got, secret) {
+			t.Errorf("logged %q in %q", secret, got)
+		}
+	}
+	if !strings.Contains(got, "request.operation=getItems") {
+		t.Errorf("masked too much, got %q", got)
+	}
+}
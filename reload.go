@@ -0,0 +1,87 @@
+// Copyright 2023 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"strconv"
+)
+
+// ReloadableSettings are the settings which change when the configuration is
+// reloaded on SIGHUP. The others need a restart.
+type ReloadableSettings struct {
+	Origin      string `json:"origin"`
+	Upstream    string `json:"proxy"`
+	Environment string `json:"environment"`
+	LogLevel    string `json:"log-level"`
+	Quiet       bool   `json:"quiet"`
+	TLSCert     string `json:"tls-cert"`
+	TLSKey      string `json:"tls-key"`
+}
+
+// NewReloadableSettings returns the reloadable settings from flag values,
+// like those from ConfigFile.Reload, checking they can be used.
+func NewReloadableSettings(values map[string]string) (ReloadableSettings, error) {
+	settings := ReloadableSettings{
+		Origin:      values["origin"],
+		Upstream:    values["proxy"],
+		Environment: values["environment"],
+		LogLevel:    values["log-level"],
+		TLSCert:     values["tls-cert"],
+		TLSKey:      values["tls-key"],
+	}
+	var err error
+	settings.Quiet, err = strconv.ParseBool(values["quiet"])
+	if err != nil {
+		return ReloadableSettings{}, fmt.Errorf("bad value for quiet: %w", err)
+	}
+	err = settings.Validate()
+	if err != nil {
+		return ReloadableSettings{}, err
+	}
+	return settings, nil
+}
+
+// Validate checks the settings can be used: the log level, the environment,
+// the origin, which may be *, the reader service's address, and that the TLS
+// certificate and key are set together.
+func (s ReloadableSettings) Validate() error {
+	_, err := s.Level()
+	if err != nil {
+		return err
+	}
+	err = validateEnvironment(s.Environment)
+	if err != nil {
+		return err
+	}
+	if s.Origin != "*" {
+		err = validateOrigin(s.Origin)
+		if err != nil {
+			return fmt.Errorf("bad origin %q: %w", s.Origin, err)
+		}
+	}
+	_, err = parseUpstream(s.Upstream)
+	if err != nil {
+		return err
+	}
+	if (s.TLSCert == "") != (s.TLSKey == "") {
+		return ErrIncompleteTLS
+	}
+	return nil
+}
+
+// Level returns the minimum level logged. With Quiet, only errors are logged.
+func (s ReloadableSettings) Level() (slog.Level, error) {
+	var level slog.Level
+	err := level.UnmarshalText([]byte(s.LogLevel))
+	if err != nil {
+		return level, err
+	}
+	if s.Quiet {
+		level = slog.LevelError
+	}
+	return level, nil
+}
@@ -0,0 +1,112 @@
+// Copyright 2023 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestNewReloadableSettings(t *testing.T) {
+	valid := func() map[string]string {
+		return map[string]string{
+			"origin":      DefaultOrigin,
+			"proxy":       DefaultProxy,
+			"environment": EnvironmentProduction,
+			"log-level":   "info",
+			"quiet":       "false",
+		}
+	}
+	tests := []struct {
+		name    string
+		setting string
+		value   string
+		wantErr bool
+	}{
+		{"defaults", "", "", false},
+		{"any origin", "origin", "*", false},
+		{"origin with a path", "origin", "https://example.alma.exlibrisgroup.com/discovery", true},
+		{"origin without a scheme", "origin", "example.alma.exlibrisgroup.com", true},
+		{"proxy without a scheme", "proxy", "localhost:21645", true},
+		{"proxy with another scheme", "proxy", "ftp://localhost:21645", true},
+		{"https proxy", "proxy", "https://reader.example.com", false},
+		{"unknown environment", "environment", "staging", true},
+		{"unknown log level", "log-level", "loud", true},
+		{"certificate without a key", "tls-cert", "cert.pem", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			values := valid()
+			if tt.setting != "" {
+				values[tt.setting] = tt.value
+			}
+			_, err := NewReloadableSettings(values)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("got error %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestInstitutionsTakeOver(t *testing.T) {
+	dir := t.TempDir()
+	const alma = "https://example.alma.exlibrisgroup.com"
+	const other = "https://other.alma.exlibrisgroup.com"
+	audit := filepath.Join(dir, "audit.jsonl")
+	load := func(institutions string) Institutions {
+		t.Helper()
+		path := filepath.Join(dir, "institutions.json")
+		err := os.WriteFile(path, []byte(institutions), 0o600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		loaded, err := LoadInstitutions(path, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return loaded
+	}
+	p := newTestProxy("http://localhost:21645")
+	p.SetInstitutions(load(`{"institutions": {
+		"` + alma + `": {"audit_log": ` + strconv.Quote(audit) + `, "rate_limit": 1},
+		"` + other + `": {"audit_log": ` + strconv.Quote(filepath.Join(dir, "other.jsonl")) + `, "rate_limit": 1}
+	}}`))
+	inFlight := p.institution(alma)
+	if !inFlight.Allow() {
+		t.Fatal("the first request was rate limited")
+	}
+
+	reloaded := load(`{"institutions": {
+		"` + alma + `": {"audit_log": ` + strconv.Quote(audit) + `, "rate_limit": 1},
+		"` + other + `": {"rate_limit": 2}
+	}}`)
+	old := p.SetInstitutions(reloaded)
+	old.CloseUnused(reloaded)
+	if reloaded[alma].audit != old[alma].audit {
+		t.Error("the audit log for the same file wasn't taken over")
+	}
+	if reloaded[alma].limiter != old[alma].limiter || reloaded[alma].Allow() {
+		t.Error("the rate limiter with the same limits was reset")
+	}
+	if reloaded[other].limiter == old[other].limiter {
+		t.Error("the rate limiter with new limits was taken over")
+	}
+
+	// A request which started before the reload is still audited when it finishes.
+	inFlight.Audit(httptest.NewRequest(http.MethodPost, "/", nil), "setSecurity", http.StatusOK)
+	p.SetInstitutions(nil).Close()
+	content, err := os.ReadFile(audit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(content), `"operation":"setSecurity"`) {
+		t.Errorf("the audit record was lost, got %q", content)
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright 2023 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+)
+
+// RequestIDHeader carries the request ID in requests and responses.
+const RequestIDHeader = "X-Request-ID"
+
+// MaxRequestIDLength is the longest request ID accepted from a client.
+const MaxRequestIDLength = 128
+
+// requestIDKey is the context key of the request ID.
+type requestIDKey struct{}
+
+// RequestIDMiddleware wraps a handler, giving each request an ID. It is sent
+// back in the X-Request-ID response header, shown in error responses, logged
+// with the request's log messages, and forwarded to the reader service, so a
+// screenshot of an error at a desk can be matched to the proxy's and the
+// vendor's logs. A request which already has a reasonable X-Request-ID, from
+// a load balancer for example, keeps it.
+func RequestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+			r.Header.Set(RequestIDHeader, id)
+		}
+		w.Header().Set(RequestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+// RequestID returns the ID of the request a context belongs to, or an empty
+// string if it has none.
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// RequestIDHandler is a slog.Handler which adds the request ID, when there is
+// one in the context, to each record before passing it on.
+type RequestIDHandler struct {
+	slog.Handler
+}
+
+// Handle adds the request ID, then passes the record on.
+func (h RequestIDHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id := RequestID(ctx); id != "" {
+		r.AddAttrs(slog.String("request_id", id))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+// WithAttrs returns a handler which adds attrs to every record.
+func (h RequestIDHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return RequestIDHandler{h.Handler.WithAttrs(attrs)}
+}
+
+// WithGroup returns a handler which puts the record's attributes in a group.
+func (h RequestIDHandler) WithGroup(name string) slog.Handler {
+	return RequestIDHandler{h.Handler.WithGroup(name)}
+}
+
+// httpError replies with an error message, like http.Error, ending with the
+// request ID, so it can be quoted to support.
+func httpError(w http.ResponseWriter, r *http.Request, message string, status int) {
+	if id := RequestID(r.Context()); id != "" {
+		message += " Request ID: " + id + "."
+	}
+	http.Error(w, message, status)
+}
+
+// newRequestID returns a random request ID, short enough to read out.
+func newRequestID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// validRequestID reports whether a client's request ID can be used. It must
+// be short, and only letters, digits, and a little punctuation, so it is
+// safe to log and echo back.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > MaxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.' || c == ':') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,187 @@
+// Copyright 2023 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"html/template"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultRecentResponses is the default number of upstream responses kept for debugging.
+	DefaultRecentResponses = 20
+
+	// RecentResponseMaxBody is the most of each response body kept for debugging.
+	RecentResponseMaxBody = 64 * 1024
+)
+
+// ErrNoXMLElements is returned when pretty-printing a response with no XML elements.
+var ErrNoXMLElements = errors.New("no XML elements")
+
+// responsesPage shows the recent upstream responses.
+const responsesPage = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Recent reader service responses</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+.response { border: 1px solid #ccc; border-radius: 6px; padding: 0 1em; margin-bottom: 1em; }
+.bad { border: 2px solid #c00; }
+.error { color: #c00; font-weight: bold; }
+pre { background: #f6f6f6; padding: 0.5em; overflow-x: auto; }
+</style>
+</head>
+<body>
+<h1>Recent reader service responses</h1>
+<p>Newest first. {{len .}} responses.</p>
+{{range .}}<div class="response{{if .Error}} bad{{end}}">
+<p><strong>{{.Operation}}</strong>, status {{.Status}}, {{.Time.Format "15:04:05.000"}}{{if .Truncated}}, truncated{{end}}</p>
+{{if .Error}}<p class="error">Malformed XML: {{.Error}}</p>{{end}}
+<pre>{{.Pretty}}</pre>
+</div>
+{{end}}
+</body>
+</html>
+`
+
+// RecentResponse is an upstream response kept for debugging.
+type RecentResponse struct {
+	Time      time.Time
+	Operation string
+	Status    int
+	Body      []byte
+	Truncated bool
+}
+
+// RecentResponses keeps the last few upstream responses, and serves them
+// pretty-printed and checked, so malformed XML from the reader service is
+// easy to spot. Barcodes and patron identifiers are masked by the Redactor
+// before the responses are kept.
+type RecentResponses struct {
+	Redactor *Redactor
+
+	mu        sync.Mutex
+	responses []RecentResponse
+	next      int
+	size      int
+	page      *template.Template
+}
+
+// NewRecentResponses returns a RecentResponses which keeps size responses,
+// masked with redactor.
+func NewRecentResponses(size int, redactor *Redactor) *RecentResponses {
+	return &RecentResponses{
+		Redactor: redactor,
+		size:     size,
+		page:     template.Must(template.New("responses").Parse(responsesPage)),
+	}
+}
+
+// Record keeps a response, replacing the oldest if there are already size responses.
+func (rr *RecentResponses) Record(operation string, status int, body []byte) {
+	if rr == nil || rr.size <= 0 {
+		return
+	}
+	response := RecentResponse{Time: time.Now(), Operation: operation, Status: status}
+	if len(body) > RecentResponseMaxBody {
+		body = body[:RecentResponseMaxBody]
+		response.Truncated = true
+	}
+	response.Body = []byte(rr.Redactor.Redact(string(body)))
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	if len(rr.responses) < rr.size {
+		rr.responses = append(rr.responses, response)
+		return
+	}
+	rr.responses[rr.next] = response
+	rr.next = (rr.next + 1) % rr.size
+}
+
+// Recent returns the kept responses, newest first.
+func (rr *RecentResponses) Recent() []RecentResponse {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	recent := make([]RecentResponse, 0, len(rr.responses))
+	for i := len(rr.responses) - 1; i >= 0; i-- {
+		recent = append(recent, rr.responses[(rr.next+i)%len(rr.responses)])
+	}
+	return recent
+}
+
+// ServeHTTP renders the recent responses, pretty-printed.
+func (rr *RecentResponses) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	type view struct {
+		RecentResponse
+		Pretty string
+		Error  string
+	}
+	var views []view
+	for _, response := range rr.Recent() {
+		v := view{RecentResponse: response}
+		pretty, err := prettyXML(response.Body)
+		if err != nil {
+			v.Pretty = string(response.Body)
+			v.Error = err.Error()
+		} else {
+			v.Pretty = pretty
+		}
+		views = append(views, v)
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	err := rr.page.Execute(w, views)
+	if err != nil {
+		slog.Error("Unable to render recent responses.", "error", err)
+	}
+}
+
+// prettyXML indents an XML document, returning an error if it isn't well formed.
+func prettyXML(body []byte) (string, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(body))
+	var b strings.Builder
+	encoder := xml.NewEncoder(&b)
+	encoder.Indent("", "  ")
+	sawElement := false
+	for {
+		token, err := decoder.Token()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			sawElement = true
+		case xml.CharData:
+			// Drop the whitespace between elements, the encoder adds its own.
+			if len(bytes.TrimSpace(t)) == 0 {
+				continue
+			}
+		}
+		err = encoder.EncodeToken(xml.CopyToken(token))
+		if err != nil {
+			return "", err
+		}
+	}
+	if !sawElement {
+		return "", ErrNoXMLElements
+	}
+	err := encoder.Flush()
+	if err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,33 @@
+// Copyright 2023 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRecentResponsesRedact(t *testing.T) {
+	redactor, err := NewRedactor(DefaultRedactFields, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := NewRecentResponses(2, redactor)
+	rr.Record("getItems", 200, []byte("<items><item><barcode>39424012345678</barcode><title>Dune</title></item></items>"))
+	rr.Record("getPatron", 200, []byte(`<patron id="7"><userId>jsmith</userId></patron>`))
+	rr.Record("getItems", 200, []byte("<items/>"))
+	recent := rr.Recent()
+	if len(recent) != 2 {
+		t.Fatalf("got %v responses, want 2", len(recent))
+	}
+	if got := string(recent[1].Body); got != "<patron id=\"7\"><userId>"+Masked+"</userId></patron>" {
+		t.Errorf("got %q, want the user ID masked", got)
+	}
+	for _, response := range recent {
+		if strings.Contains(string(response.Body), "39424012345678") || strings.Contains(string(response.Body), "jsmith") {
+			t.Errorf("kept %q unmasked", response.Body)
+		}
+	}
+}
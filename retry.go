@@ -0,0 +1,122 @@
+// Copyright 2023 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+)
+
+const (
+	// DefaultUpstreamRetries is how many times a request to the reader
+	// service is retried after it fails to connect.
+	DefaultUpstreamRetries = 2
+
+	// DefaultUpstreamRetryBackoff is how long to wait before the first retry.
+	DefaultUpstreamRetryBackoff = 100 * time.Millisecond
+)
+
+// UpstreamRetry retries requests to the reader service which fail to get
+// any response, like the "connection refused" while the vendor's service
+// restarts, instead of answering the browser with an error straight away.
+// Only requests which are safe to send twice are retried: GET, HEAD,
+// OPTIONS, PUT, and DELETE, and requests with an Idempotency-Key header.
+// The wait before each retry doubles, starting at Backoff. Retries count
+// against the upstream timeout.
+type UpstreamRetry struct {
+	// Attempts is how many times a request is retried. Zero disables retries.
+	Attempts int
+
+	// Backoff is how long to wait before the first retry.
+	Backoff time.Duration
+}
+
+// Transport wraps a transport, retrying requests which fail to get a response.
+func (u *UpstreamRetry) Transport(next http.RoundTripper) http.RoundTripper {
+	if u == nil || u.Attempts <= 0 {
+		return next
+	}
+	return &retryTransport{retry: u, next: next}
+}
+
+// retryTransport retries requests which fail to get a response.
+type retryTransport struct {
+	retry *UpstreamRetry
+	next  http.RoundTripper
+}
+
+// RoundTrip sends a request, retrying it if it is safe to send twice and
+// fails to get a response.
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	next := t.next
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	if !retryable(req) {
+		return next.RoundTrip(req)
+	}
+	// The body is read again for each attempt.
+	var body []byte
+	if req.Body != nil && req.Body != http.NoBody {
+		var err error
+		body, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	ctx := req.Context()
+	backoff := t.retry.Backoff
+	for attempt := 0; ; attempt++ {
+		attemptReq := req
+		if body != nil {
+			attemptReq = req.Clone(ctx)
+			attemptReq.Body = io.NopCloser(bytes.NewReader(body))
+		}
+		resp, err := next.RoundTrip(attemptReq)
+		if err == nil || attempt == t.retry.Attempts || !transientError(err) {
+			return resp, err
+		}
+		slog.InfoContext(ctx, "Retrying a request to the reader service.", "attempt", attempt+1, "after", backoff, "error", err)
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// retryable reports whether a request is safe to send twice.
+func retryable(req *http.Request) bool {
+	if isUpgrade(req) {
+		return false
+	}
+	if req.Header.Get(IdempotencyKeyHeader) != "" {
+		return true
+	}
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// transientError reports whether a request failed in a way a retry may fix:
+// it couldn't connect, or the connection was closed before the response.
+// Timeouts aren't retried, since the wait has already been spent.
+func transientError(err error) bool {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" && !opErr.Timeout() {
+		return true
+	}
+	return errors.Is(err, syscall.ECONNRESET) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
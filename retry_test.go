@@ -0,0 +1,74 @@
+// Copyright 2023 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// refusingTransport refuses the first Refusals requests, like a reader
+// service which is restarting, and sends the rest on.
+type refusingTransport struct {
+	Refusals int64
+	attempts atomic.Int64
+}
+
+// RoundTrip refuses the request, or sends it with the default transport.
+func (t *refusingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.attempts.Add(1) <= t.Refusals {
+		return nil, &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}
+	}
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestUpstreamRetry(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(w, r.Body)
+	}))
+	defer upstream.Close()
+	tests := []struct {
+		name         string
+		method       string
+		key          string
+		wantStatus   int
+		wantAttempts int64
+	}{
+		{"get is retried", http.MethodGet, "", http.StatusOK, 2},
+		{"keyed post is retried", http.MethodPost, "a1b2c3", http.StatusOK, 2},
+		{"post isn't retried", http.MethodPost, "", http.StatusServiceUnavailable, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			refusing := &refusingTransport{Refusals: 1}
+			// The default forward headers don't list the idempotency key.
+			p := newTestProxy(upstream.URL)
+			p.Client.Transport = refusing
+			p.Retry = &UpstreamRetry{Attempts: DefaultUpstreamRetries, Backoff: time.Millisecond}
+			r := httptest.NewRequest(tt.method, "/writeTags", strings.NewReader("<Envelope/>"))
+			if tt.key != "" {
+				r.Header.Set(IdempotencyKeyHeader, tt.key)
+			}
+			w := httptest.NewRecorder()
+			p.ServeHTTP(w, r)
+			if w.Code != tt.wantStatus {
+				t.Errorf("got status %v, want %v", w.Code, tt.wantStatus)
+			}
+			if got := refusing.attempts.Load(); got != tt.wantAttempts {
+				t.Errorf("got %v attempts, want %v", got, tt.wantAttempts)
+			}
+			if tt.wantStatus == http.StatusOK && w.Body.String() != "<Envelope/>" {
+				t.Errorf("got body %q, want the request body echoed", w.Body.String())
+			}
+		})
+	}
+}
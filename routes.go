@@ -0,0 +1,119 @@
+// Copyright 2023 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+var (
+	// ErrBadRoute is returned when a route isn't like /printer/=http://localhost:9100/.
+	ErrBadRoute = errors.New("routes must look like /printer/=http://localhost:9100/")
+
+	// ErrBadActionRoute is returned when an action route isn't like writeTags=http://localhost:21646.
+	ErrBadActionRoute = errors.New("action routes must look like writeTags=http://localhost:21646")
+)
+
+// Route sends requests for paths under Prefix to another service on the
+// workstation, like a receipt printer service, instead of the reader service.
+type Route struct {
+	// Prefix is the start of the paths routed, like /printer/.
+	Prefix string
+
+	// Target is the service's address. Its path replaces the Prefix.
+	Target *url.URL
+}
+
+// Routes send requests for some paths to other services on the workstation,
+// so one proxy, and one CORS exemption, covers every peripheral on the desk.
+// The longest matching prefix wins. Requests for other paths go to the
+// reader service, as usual. Routes apply to requests from every origin.
+type Routes []Route
+
+// ParseRoutes parses comma separated routes, like
+// /printer/=http://localhost:9100/,/scale/=http://localhost:8008/scale/.
+func ParseRoutes(list string) (Routes, error) {
+	var routes Routes
+	for _, element := range splitList(list) {
+		prefix, address, ok := strings.Cut(element, "=")
+		prefix = strings.TrimSpace(prefix)
+		if !ok || !strings.HasPrefix(prefix, "/") {
+			return nil, fmt.Errorf("%w, not %q", ErrBadRoute, element)
+		}
+		target, err := parseUpstream(strings.TrimSpace(address))
+		if err != nil {
+			return nil, fmt.Errorf("bad route %q: %w", element, err)
+		}
+		routes = append(routes, Route{Prefix: prefix, Target: target})
+	}
+	sort.SliceStable(routes, func(i, j int) bool {
+		return len(routes[i].Prefix) > len(routes[j].Prefix)
+	})
+	return routes, nil
+}
+
+// Match returns the route for a URL path, and the path to request from its
+// service, with the prefix replaced by the target's path. A prefix matches
+// whole path segments, so /printer/ and /printer match /printer and
+// /printer/print, but not /printers.
+func (routes Routes) Match(urlPath string) (Route, string, bool) {
+	for _, route := range routes {
+		prefix := strings.TrimSuffix(route.Prefix, "/")
+		if urlPath != prefix && !strings.HasPrefix(urlPath, prefix+"/") {
+			continue
+		}
+		rest := strings.TrimPrefix(strings.TrimPrefix(urlPath, prefix), "/")
+		return route, strings.TrimSuffix(route.Target.Path, "/") + "/" + rest, true
+	}
+	return Route{}, "", false
+}
+
+// String returns the routes as they are written in the -routes flag.
+func (routes Routes) String() string {
+	elements := make([]string, len(routes))
+	for i, route := range routes {
+		elements[i] = route.Prefix + "=" + route.Target.String()
+	}
+	return strings.Join(elements, ",")
+}
+
+// ActionRoutes send SOAP operations to particular reader services, for
+// vendor stacks which split reads and writes across two local services,
+// keyed by lower case operation name, from the SOAPAction header. They only
+// apply to requests for the default reader service, so requests from the
+// sandbox or another institution go to their own.
+type ActionRoutes map[string]*url.URL
+
+// ParseActionRoutes parses comma separated action routes, like
+// writeTags=http://localhost:21646,setSecurity=http://localhost:21646.
+func ParseActionRoutes(list string) (ActionRoutes, error) {
+	routes := ActionRoutes{}
+	for _, element := range splitList(list) {
+		operation, address, ok := strings.Cut(element, "=")
+		operation = strings.TrimSpace(operation)
+		if !ok || operation == "" {
+			return nil, fmt.Errorf("%w, not %q", ErrBadActionRoute, element)
+		}
+		target, err := parseUpstream(strings.TrimSpace(address))
+		if err != nil {
+			return nil, fmt.Errorf("bad action route %q: %w", element, err)
+		}
+		routes[strings.ToLower(operation)] = target
+	}
+	return routes, nil
+}
+
+// Match returns the reader service for a SOAPAction header, if it has a route.
+func (routes ActionRoutes) Match(soapAction string) (*url.URL, bool) {
+	if soapAction == "" {
+		return nil, false
+	}
+	target, ok := routes[strings.ToLower(operationName(soapAction, ""))]
+	return target, ok
+}
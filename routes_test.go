@@ -0,0 +1,151 @@
+// Copyright 2023 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestParseRoutes(t *testing.T) {
+	tests := []struct {
+		name    string
+		list    string
+		want    string
+		wantErr bool
+	}{
+		{"empty", "", "", false},
+		{"one", "/printer/=http://localhost:9100/", "/printer/=http://localhost:9100/", false},
+		{"longest first", "/a/=http://localhost:1/,/a/b/=http://localhost:2/", "/a/b/=http://localhost:2/,/a/=http://localhost:1/", false},
+		{"spaces", " /scale/ = http://localhost:8008/scale/ ", "/scale/=http://localhost:8008/scale/", false},
+		{"no equals", "/printer/", "", true},
+		{"relative prefix", "printer/=http://localhost:9100/", "", true},
+		{"bad target", "/printer/=localhost:9100", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			routes, err := ParseRoutes(tt.list)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if got := routes.String(); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRoutesMatch(t *testing.T) {
+	routes, err := ParseRoutes("/printer/=http://localhost:9100/,/printer/label/=http://localhost:9200/labels/,/scale=http://localhost:8008")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		path       string
+		wantTarget string
+		wantPath   string
+	}{
+		{"/printer", "http://localhost:9100/", "/"},
+		{"/printer/", "http://localhost:9100/", "/"},
+		{"/printer/print", "http://localhost:9100/", "/print"},
+		{"/printer/label/print", "http://localhost:9200/labels/", "/labels/print"},
+		{"/scale/weight", "http://localhost:8008", "/weight"},
+		{"/printers", "", ""},
+		{"/getItems", "", ""},
+	}
+	for _, tt := range tests {
+		route, path, ok := routes.Match(tt.path)
+		if ok != (tt.wantTarget != "") {
+			t.Errorf("Match(%q) matched %v, want %v", tt.path, ok, !ok)
+			continue
+		}
+		if ok && (route.Target.String() != tt.wantTarget || path != tt.wantPath) {
+			t.Errorf("Match(%q) = %v, %q, want %v, %q", tt.path, route.Target, path, tt.wantTarget, tt.wantPath)
+		}
+	}
+}
+
+func TestActionRoutesMatch(t *testing.T) {
+	routes, err := ParseActionRoutes("writeTags=http://localhost:21646")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		soapAction string
+		want       bool
+	}{
+		{"", false},
+		{"writeTags", true},
+		{`"urn:rfid#WriteTags"`, true},
+		{"urn:rfid#getItems", false},
+	}
+	for _, tt := range tests {
+		if _, ok := routes.Match(tt.soapAction); ok != tt.want {
+			t.Errorf("Match(%q) = %v, want %v", tt.soapAction, ok, tt.want)
+		}
+	}
+	for _, list := range []string{"writeTags", "=http://localhost:21646", "writeTags=localhost"} {
+		if _, err := ParseActionRoutes(list); err == nil {
+			t.Errorf("ParseActionRoutes(%q) didn't fail", list)
+		}
+	}
+}
+
+func TestProxyRoutes(t *testing.T) {
+	reader := namedServer(t, "reader")
+	writer := namedServer(t, "writer")
+	printer := namedServer(t, "printer")
+	p := newTestProxy(reader.URL)
+	var err error
+	p.Routes, err = ParseRoutes("/printer/=" + printer.URL + "/api/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.ActionRoutes, err = ParseActionRoutes("writeTags=" + writer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name       string
+		path       string
+		soapAction string
+		want       string
+	}{
+		{"reader service", "/getItems", "", "reader /getItems"},
+		{"routed path", "/printer/print", "", "printer /api/print"},
+		{"routed prefix", "/printer", "", "printer /api/"},
+		{"not a whole segment", "/printers", "", "reader /printers"},
+		{"action route", "/", "urn:rfid#writeTags", "writer /"},
+		{"other action", "/", "urn:rfid#getItems", "reader /"},
+		{"routed path wins over action route", "/printer/print", "urn:rfid#writeTags", "printer /api/print"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, body := serve(t, p, http.MethodPost, tt.path, tt.soapAction)
+			if status != http.StatusOK || body != tt.want {
+				t.Errorf("got %v %q, want 200 %q", status, body, tt.want)
+			}
+		})
+	}
+}
+
+func TestProxyRoutesDontFailOver(t *testing.T) {
+	reader := echoServer(t, "reader")
+	fallback := echoServer(t, "fallback")
+	p := newTestProxy(reader.URL)
+	var err error
+	p.Fallback, err = NewUpstreamFallback(fallback.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Routes, err = ParseRoutes("/printer/=" + deadAddress(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Routed services aren't the reader service, so they don't fail over.
+	if status, body := serve(t, p, http.MethodPost, "/printer/print", ""); status == http.StatusOK {
+		t.Errorf("got %v %q from a dead routed service, want an error", status, body)
+	}
+}
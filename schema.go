@@ -0,0 +1,196 @@
+// Copyright 2023 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// SchemaDialect is the JSON Schema version of generated schemas.
+const SchemaDialect = "https://json-schema.org/draft/2020-12/schema"
+
+// GenerateSchema returns a JSON Schema describing the JSON encoding of v.
+// Properties are named by their json struct tags, described by their
+// desc struct tags, and limited to the comma separated values in their
+// enum struct tags.
+func GenerateSchema(title string, v any) map[string]any {
+	schema := schemaFor(reflect.TypeOf(v))
+	// Allow files to name their schema, for editors.
+	if properties, ok := schema["properties"].(map[string]any); ok {
+		properties["$schema"] = map[string]any{"type": "string"}
+	}
+	schema["$schema"] = SchemaDialect
+	schema["title"] = title
+	return schema
+}
+
+// WriteSchema writes the schema for the institutions file as indented JSON.
+func WriteSchema(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	err := encoder.Encode(GenerateSchema("almarfidintercept institutions file", InstitutionsFile{}))
+	if err != nil {
+		return fmt.Errorf("unable to write schema: %w", err)
+	}
+	return nil
+}
+
+// WriteConfigSchema writes the schema for the config file passed to -config,
+// with a setting for each flag in fs, as indented JSON. TOML editors which
+// read JSON Schema, like Taplo, use it with a #:schema comment at the top of
+// the file, since a $schema key isn't a setting.
+func WriteConfigSchema(w io.Writer, fs *flag.FlagSet) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	err := encoder.Encode(GenerateConfigSchema("almarfidintercept config file", fs))
+	if err != nil {
+		return fmt.Errorf("unable to write schema: %w", err)
+	}
+	return nil
+}
+
+// GenerateConfigSchema returns a JSON Schema describing a config file of
+// settings for the flags in fs, described by their usage. As in ConfigFile,
+// a setting can be named for its flag, or grouped in a table by a prefix of
+// its name, so tls-cert can also be cert in a [tls] table.
+func GenerateConfigSchema(title string, fs *flag.FlagSet) map[string]any {
+	settings := map[string]map[string]any{}
+	fs.VisitAll(func(f *flag.Flag) {
+		if f.Name == "config" {
+			return
+		}
+		setting := settingSchema(f)
+		setting["description"] = f.Usage
+		settings[f.Name] = setting
+	})
+	schema := tableSchema(settings)
+	schema["$schema"] = SchemaDialect
+	schema["title"] = title
+	return schema
+}
+
+// tableSchema returns the schema for a table of settings, keyed by name.
+// Settings sharing a prefix, up to a hyphen, can also be in a table named
+// for the prefix. A name which is both a setting and a prefix can be either.
+func tableSchema(settings map[string]map[string]any) map[string]any {
+	properties := map[string]any{}
+	tables := map[string]map[string]map[string]any{}
+	for name, setting := range settings {
+		properties[name] = setting
+		parts := strings.Split(name, "-")
+		for i := 1; i < len(parts); i++ {
+			prefix := strings.Join(parts[:i], "-")
+			if tables[prefix] == nil {
+				tables[prefix] = map[string]map[string]any{}
+			}
+			tables[prefix][strings.Join(parts[i:], "-")] = setting
+		}
+	}
+	prefixes := make([]string, 0, len(tables))
+	for prefix := range tables {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+	for _, prefix := range prefixes {
+		table := tableSchema(tables[prefix])
+		if setting, ok := properties[prefix]; ok {
+			properties[prefix] = map[string]any{"anyOf": []any{setting, table}}
+			continue
+		}
+		properties[prefix] = table
+	}
+	return map[string]any{
+		"type":                 "object",
+		"properties":           properties,
+		"additionalProperties": false,
+	}
+}
+
+// settingSchema returns the schema for a flag's setting in a config file.
+// Strings can be arrays too, which are joined with commas, for lists.
+func settingSchema(f *flag.Flag) map[string]any {
+	getter, ok := f.Value.(flag.Getter)
+	if !ok {
+		return map[string]any{}
+	}
+	value := getter.Get()
+	if value == nil {
+		return map[string]any{}
+	}
+	if _, ok := value.(string); ok {
+		return map[string]any{
+			"anyOf": []any{
+				map[string]any{"type": "string"},
+				map[string]any{"type": "array", "items": map[string]any{"type": "string"}},
+			},
+		}
+	}
+	return schemaFor(reflect.TypeOf(value))
+}
+
+// schemaFor returns the schema for a Go type.
+func schemaFor(t reflect.Type) map[string]any {
+	if t == reflect.TypeOf(time.Duration(0)) {
+		return map[string]any{
+			"type":        "string",
+			"description": "A duration, like 300ms, 5s, or 1h30m.",
+			"pattern":     `^([0-9]+(\.[0-9]+)?(ns|us|µs|ms|s|m|h))+$`,
+		}
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		return schemaFor(t.Elem())
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return map[string]any{"type": "array", "items": schemaFor(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": schemaFor(t.Elem())}
+	case reflect.Struct:
+		properties := make(map[string]any)
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if !field.IsExported() {
+				continue
+			}
+			name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+			if name == "-" {
+				continue
+			}
+			if name == "" {
+				name = field.Name
+			}
+			property := schemaFor(field.Type)
+			if desc := field.Tag.Get("desc"); desc != "" {
+				property["description"] = desc
+			}
+			if enum := field.Tag.Get("enum"); enum != "" {
+				property["enum"] = strings.Split(enum, ",")
+			}
+			properties[name] = property
+		}
+		return map[string]any{
+			"type":                 "object",
+			"properties":           properties,
+			"additionalProperties": false,
+		}
+	default:
+		return map[string]any{}
+	}
+}
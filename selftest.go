@@ -0,0 +1,286 @@
+// Copyright 2023 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"net/url"
+)
+
+// SelfTestPrefix is the path of the self test page, and the prefix of its helpers.
+const SelfTestPrefix = "/selftest"
+
+// selfTestPage runs the self test in the browser, one step at a time, and
+// shows which step failed.
+const selfTestPage = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>RFID intercept self test</title>
+<style>
+body { font-family: sans-serif; max-width: 48em; margin: 2em auto; padding: 0 1em; }
+table { border-collapse: collapse; width: 100%; }
+td { padding: 0.6em; border-bottom: 1px solid #ddd; vertical-align: top; }
+.ok { background: #e6f4e6; }
+.failed { background: #fbe3e3; }
+.skipped { background: #f3f3f3; }
+.result { font-weight: bold; white-space: nowrap; }
+.ok .result { color: #080; }
+.failed .result { color: #c00; }
+.details { color: #555; font-size: 0.9em; }
+</style>
+</head>
+<body>
+<h1>RFID intercept self test</h1>
+<p>This runs the same steps as the Alma page: a CORS preflight from the Alma
+origin, then a request through the proxy to the reader service. It stops at
+the first step which fails.</p>
+<form id="form">
+<label>Alma origin: <input id="origin" list="origins" size="50" required></label>
+<datalist id="origins"></datalist>
+<button type="submit">Run the test</button>
+</form>
+<table id="steps"></table>
+<p class="details">Computer: {{.Station}}<br>
+Version: {{.Version}}</p>
+<script>
+(function () {
+  'use strict';
+
+  var origins = {{.Origins}};
+  var input = document.getElementById('origin');
+  var list = document.getElementById('origins');
+  origins.forEach(function (origin) {
+    if (origin === '*') {
+      return;
+    }
+    var option = document.createElement('option');
+    option.value = origin;
+    list.appendChild(option);
+  });
+  input.value = origins.filter(function (origin) { return origin !== '*'; })[0] || '';
+
+  var steps = document.getElementById('steps');
+
+  // show adds a row for a step: ok, failed, or skipped.
+  function show(result, name, detail) {
+    var row = steps.insertRow();
+    row.className = result;
+    var cell = row.insertCell();
+    cell.className = 'result';
+    cell.textContent = result === 'ok' ? '✔ OK' : result === 'failed' ? '✘ Failed' : 'Skipped';
+    cell = row.insertCell();
+    var strong = document.createElement('strong');
+    strong.textContent = name;
+    cell.appendChild(strong);
+    cell.appendChild(document.createElement('br'));
+    cell.appendChild(document.createTextNode(detail));
+    return result === 'ok';
+  }
+
+  // isLocal reports whether a host is this computer or on a private network,
+  // which browsers don't make ask for Private Network Access.
+  function isLocal(host) {
+    return /^(localhost|127\.|\[::1\]|10\.|192\.168\.|172\.(1[6-9]|2\d|3[01])\.)/.test(host);
+  }
+
+  // listed reports whether a comma separated header value lists a name, ignoring case.
+  function listed(value, name) {
+    return (value || '').split(',').some(function (item) {
+      item = item.trim().toLowerCase();
+      return item === '*' || item === name.toLowerCase();
+    });
+  }
+
+  function run(origin) {
+    steps.innerHTML = '';
+    var url;
+    try {
+      url = new URL(origin);
+    } catch (e) {
+      show('failed', 'Alma origin', origin + ' isn\'t an origin, like https://example.alma.exlibrisgroup.com.');
+      return;
+    }
+    origin = url.origin;
+    if (url.protocol === 'https:' && location.protocol !== 'https:' && !/^(localhost|127\.|\[::1\])/.test(location.hostname)) {
+      show('failed', 'Secure connection', 'Alma is served over HTTPS, so the browser blocks requests to the proxy at ' + location.origin + ' over plain HTTP. Use HTTPS, or localhost.');
+      return;
+    }
+    show('ok', 'Secure connection', 'The browser allows requests from ' + origin + ' to ' + location.origin + '.');
+    fetch('{{.Prefix}}/preflight?origin=' + encodeURIComponent(origin), { cache: 'no-store' })
+      .then(function (response) {
+        if (!response.ok) {
+          throw new Error('status ' + response.status);
+        }
+        return response.json();
+      })
+      .then(function (preflight) {
+        var headers = preflight.headers;
+        var allowed = headers['Access-Control-Allow-Origin'];
+        if (preflight.status >= 300 || (allowed !== origin && allowed !== '*')) {
+          show('failed', 'Origin allowed', 'The proxy refuses requests from ' + origin + '. It allows ' + (origins.join(', ') || 'no origins') + '. Check -origin, or the institutions file, for a typo or a missing https://.');
+          return false;
+        }
+        show('ok', 'Origin allowed', 'The proxy allows requests from ' + origin + '.');
+        if (!isLocal(url.hostname) && headers['Access-Control-Allow-Private-Network'] !== 'true') {
+          show('failed', 'Private Network Access', 'The browser asks before a public page like ' + origin + ' may reach this computer, and the proxy doesn\'t approve it. Turn on -private-network-access.');
+          return false;
+        }
+        show('ok', 'Private Network Access', isLocal(url.hostname) ? 'Not needed for ' + origin + '.' : 'The proxy approves requests from ' + origin + ' to this computer.');
+        var methods = headers['Access-Control-Allow-Methods'];
+        var allowHeaders = headers['Access-Control-Allow-Headers'];
+        if (!listed(methods, 'POST') || !listed(allowHeaders, 'Content-Type') || !listed(allowHeaders, 'SOAPAction')) {
+          show('failed', 'Preflight', 'The proxy allows methods ' + (methods || 'none') + ' and headers ' + (allowHeaders || 'none') + ', but Alma sends POST with Content-Type and SOAPAction. Check -cors-allow-methods and -cors-allow-headers.');
+          return false;
+        }
+        show('ok', 'Preflight', 'The proxy allows POST with Content-Type and SOAPAction.');
+        return true;
+      }, function (err) {
+        show('failed', 'Preflight', 'Unable to run the preflight: ' + err.message + '.');
+        return false;
+      })
+      .then(function (passed) {
+        if (!passed) {
+          return;
+        }
+        return fetch('/healthz', { cache: 'no-store' })
+          .then(function (response) { return response.json(); })
+          .then(function (report) {
+            var upstream = report.upstream;
+            if (upstream.status !== 'ok') {
+              show('failed', 'Reader service', 'The reader service at ' + upstream.address + ' isn\'t answering: ' + upstream.error + '. Check the vendor\'s RFID software is running.');
+              return;
+            }
+            show('ok', 'Reader service', 'The reader service at ' + upstream.address + ' answered with status ' + upstream.http_status + ' in ' + upstream.latency_ms + ' ms.');
+          }, function (err) {
+            show('failed', 'Reader service', 'Unable to send a request through the proxy: ' + err.message + '.');
+          });
+      });
+  }
+
+  document.getElementById('form').addEventListener('submit', function (event) {
+    event.preventDefault();
+    run(input.value.trim());
+  });
+  if (input.value) {
+    run(input.value);
+  }
+})();
+</script>
+</body>
+</html>
+`
+
+// SelfTest serves a page at /selftest which checks, from the browser, each
+// step the Alma page takes to reach the reader service, and shows which one
+// failed: a mixed content block, an origin which isn't allowed, a Private
+// Network Access block, a preflight which doesn't allow Alma's request, or
+// the reader service being down.
+//
+// A page can't send a preflight with another site's Origin, so the preflight
+// is sent by the proxy to itself, at /selftest/preflight, and the page checks
+// the response as the browser would.
+type SelfTest struct {
+	Proxy   *Proxy
+	Station string
+
+	page *template.Template
+}
+
+// PreflightResult is the response to a preflight sent by the self test.
+type PreflightResult struct {
+	Origin  string            `json:"origin"`
+	Status  int               `json:"status"`
+	Headers map[string]string `json:"headers"`
+}
+
+// NewSelfTest returns a SelfTest of the proxy.
+func NewSelfTest(proxy *Proxy, station string) *SelfTest {
+	return &SelfTest{
+		Proxy:   proxy,
+		Station: station,
+		page:    template.Must(template.New("selftest").Parse(selfTestPage)),
+	}
+}
+
+// ServeHTTP serves the self test page, and the preflights it asks for.
+func (s *SelfTest) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	switch r.URL.Path {
+	case SelfTestPrefix:
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		err := s.page.Execute(w, map[string]any{
+			"Origins": s.Proxy.Origins(),
+			"Prefix":  SelfTestPrefix,
+			"Station": s.Station,
+			"Version": version,
+		})
+		if err != nil {
+			slog.Error("Unable to render self test page.", "error", err)
+		}
+	case SelfTestPrefix + "/preflight":
+		origin := r.URL.Query().Get("origin")
+		if validateOrigin(origin) != nil {
+			httpError(w, r, "The origin must be a scheme and host, like https://example.alma.exlibrisgroup.com.", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.preflight(r, origin))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// preflight sends the proxy the preflight a browser sends before Alma's
+// requests from origin, and returns the response.
+func (s *SelfTest) preflight(r *http.Request, origin string) PreflightResult {
+	req := r.Clone(r.Context())
+	req.Method = http.MethodOptions
+	req.URL = &url.URL{Path: "/"}
+	req.Body = http.NoBody
+	req.Header = http.Header{}
+	req.Header.Set("Origin", origin)
+	req.Header.Set("Access-Control-Request-Method", http.MethodPost)
+	req.Header.Set("Access-Control-Request-Headers", "content-type,soapaction")
+	req.Header.Set("Access-Control-Request-Private-Network", "true")
+	recorder := &preflightRecorder{header: http.Header{}, status: http.StatusOK}
+	// Preflights are answered by the CORS middleware, and never forwarded.
+	s.Proxy.CORS(http.NotFoundHandler()).ServeHTTP(recorder, req)
+	result := PreflightResult{Origin: origin, Status: recorder.status, Headers: map[string]string{}}
+	for name := range recorder.header {
+		result.Headers[name] = recorder.header.Get(name)
+	}
+	return result
+}
+
+// preflightRecorder keeps the status and headers of a preflight response,
+// discarding the body.
+type preflightRecorder struct {
+	header      http.Header
+	status      int
+	wroteHeader bool
+}
+
+// Header returns the response headers.
+func (r *preflightRecorder) Header() http.Header {
+	return r.header
+}
+
+// WriteHeader records the status.
+func (r *preflightRecorder) WriteHeader(status int) {
+	if !r.wroteHeader {
+		r.status = status
+		r.wroteHeader = true
+	}
+}
+
+// Write discards the body.
+func (r *preflightRecorder) Write(p []byte) (int, error) {
+	r.wroteHeader = true
+	return len(p), nil
+}
@@ -0,0 +1,339 @@
+// Copyright 2023 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/cu-library/overridefromenv"
+)
+
+const (
+	// DefaultServiceName is the name the proxy is installed as a service with.
+	DefaultServiceName = "almarfidintercept"
+
+	// ChecksumsAsset is the release file with the SHA-256 checksums of the others.
+	ChecksumsAsset = "checksums.sha256"
+
+	// SignatureAsset is the release file with the Ed25519 signature of the checksums.
+	SignatureAsset = ChecksumsAsset + ".sig"
+
+	// SelfUpdateTimeout is how long downloading a release may take.
+	SelfUpdateTimeout = 5 * time.Minute
+
+	// maxArchiveBytes is the largest release archive downloaded.
+	maxArchiveBytes = 200 << 20
+)
+
+var (
+	// ErrNoPublicKey is returned when self-update isn't given the key releases are signed with.
+	ErrNoPublicKey = errors.New("-update-public-key must be the PEM file of the key releases are signed with")
+
+	// ErrBadSignature is returned when a release's checksums aren't signed by the release key.
+	ErrBadSignature = errors.New("the release's checksums aren't signed by the release key")
+
+	// ErrBadChecksum is returned when a downloaded archive doesn't match its checksum.
+	ErrBadChecksum = errors.New("the downloaded archive doesn't match its checksum")
+
+	// ErrMissingAsset is returned when a release doesn't have a file self-update needs.
+	ErrMissingAsset = errors.New("the release is missing a file")
+
+	// ErrServiceUnsupported is returned when restarting the service isn't supported on this platform.
+	ErrServiceUnsupported = errors.New("restarting the service is only supported with Windows services, systemd, and launchd")
+)
+
+// runSelfUpdateCommand replaces this executable with the latest release, and
+// restarts the service running it, so unattended desk installs stay current.
+// The release's checksums file must be signed with the key in
+// -update-public-key, and the archive for this platform must match its
+// checksum, before anything is replaced.
+func runSelfUpdateCommand(args []string, stdout io.Writer) error {
+	fs := flag.NewFlagSet("self-update", flag.ContinueOnError)
+	updateURL := fs.String("update-url", DefaultUpdateURL, "Address of the latest release, in the form of the Gitea or GitHub releases API.")
+	publicKey := fs.String("update-public-key", "", "PEM file of the Ed25519 public key releases are signed with.")
+	serviceName := fs.String("service-name", DefaultServiceName, "Service restarted after updating. Empty to not restart.")
+	checkOnly := fs.Bool("check", false, "Only say whether a newer version is available.")
+	err := fs.Parse(args)
+	if err != nil {
+		return fmt.Errorf("%w, %v", ErrUsage, err)
+	}
+	if fs.NArg() != 0 {
+		return fmt.Errorf("%w, self-update takes no arguments", ErrUsage)
+	}
+	err = overridefromenv.Override(fs, EnvPrefix)
+	if err != nil {
+		return err
+	}
+
+	checker, err := NewUpdateChecker(*updateURL, 0)
+	if err != nil {
+		return err
+	}
+	checker.client.Timeout = SelfUpdateTimeout
+	ctx, cancel := context.WithTimeout(context.Background(), SelfUpdateTimeout)
+	defer cancel()
+	latest, err := checker.latest(ctx)
+	if err != nil {
+		return err
+	}
+	version := strings.TrimPrefix(latest.TagName, "v")
+	if !newerVersion(version, checker.current) {
+		fmt.Fprintf(stdout, "Version %v is up to date. The latest release is %v.\n", checker.current, version)
+		return nil
+	}
+	if *checkOnly {
+		fmt.Fprintf(stdout, "Version %v is available, at %v. This is version %v.\n", version, latest.HTMLURL, checker.current)
+		return nil
+	}
+	if *publicKey == "" {
+		return ErrNoPublicKey
+	}
+	key, err := loadReleaseKey(*publicKey)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(stdout, "Updating from version %v to %v.\n", checker.current, version)
+	binary, err := checker.download(ctx, latest, version, key)
+	if err != nil {
+		return err
+	}
+	executable, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("unable to find this executable: %w", err)
+	}
+	executable, err = filepath.EvalSymlinks(executable)
+	if err != nil {
+		return fmt.Errorf("unable to find this executable: %w", err)
+	}
+	err = replaceExecutable(executable, binary)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "Installed version %v at %v.\n", version, executable)
+	if *serviceName == "" {
+		fmt.Fprintln(stdout, "Restart the proxy to use the new version.")
+		return nil
+	}
+	err = restartService(*serviceName)
+	if err != nil {
+		return fmt.Errorf("updated, but unable to restart the %v service, restart it to use the new version: %w", *serviceName, err)
+	}
+	fmt.Fprintf(stdout, "Restarted the %v service.\n", *serviceName)
+	return nil
+}
+
+// loadReleaseKey reads an Ed25519 public key from a PEM file.
+func loadReleaseKey(file string) (ed25519.PublicKey, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read -update-public-key: %w", err)
+	}
+	block, _ := pem.Decode(content)
+	if block == nil {
+		return nil, ErrNoPublicKey
+	}
+	parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse -update-public-key: %w", err)
+	}
+	key, ok := parsed.(ed25519.PublicKey)
+	if !ok {
+		return nil, ErrNoPublicKey
+	}
+	return key, nil
+}
+
+// download fetches the release archive for this platform, checks it against
+// the signed checksums, and returns the executable in it. The tag and the list
+// of files aren't signed, so the archive's name, with the version in it, must
+// be in the signed checksums. Otherwise an older release, with its checksums
+// and signature, could be passed off as a newer one.
+func (u *UpdateChecker) download(ctx context.Context, latest release, version string, key ed25519.PublicKey) ([]byte, error) {
+	assets := map[string]string{}
+	for _, asset := range latest.Assets {
+		assets[asset.Name] = asset.URL
+	}
+	archiveName := releaseArchive(version, runtime.GOOS, runtime.GOARCH)
+	for _, name := range []string{archiveName, ChecksumsAsset, SignatureAsset} {
+		if assets[name] == "" {
+			return nil, fmt.Errorf("%w, %v", ErrMissingAsset, name)
+		}
+	}
+	checksums, err := u.fetch(ctx, assets[ChecksumsAsset], maxReleaseBytes)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := u.fetch(ctx, assets[SignatureAsset], maxReleaseBytes)
+	if err != nil {
+		return nil, err
+	}
+	// The signature is the raw 64 bytes openssl writes, or base64 of them.
+	if len(signature) != ed25519.SignatureSize {
+		decoded, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(signature)))
+		if err == nil {
+			signature = decoded
+		}
+	}
+	if !ed25519.Verify(key, checksums, signature) {
+		return nil, ErrBadSignature
+	}
+	want, err := findChecksum(checksums, archiveName)
+	if err != nil {
+		return nil, err
+	}
+	archive, err := u.fetch(ctx, assets[archiveName], maxArchiveBytes)
+	if err != nil {
+		return nil, err
+	}
+	got := sha256.Sum256(archive)
+	if hex.EncodeToString(got[:]) != want {
+		return nil, fmt.Errorf("%w, %v", ErrBadChecksum, archiveName)
+	}
+	return extractExecutable(archiveName, archive)
+}
+
+// releaseArchive returns the name of the release archive of a version for a
+// platform, as goreleaser names it. Windows archives are zip files.
+func releaseArchive(version, goos, goarch string) string {
+	name := "almarfidintercept_" + version + "_" + goos + "_" + goarch
+	if goos == "windows" {
+		return name + ".zip"
+	}
+	return name + ".tar.gz"
+}
+
+// fetch downloads a release file, up to limit bytes.
+func (u *UpdateChecker) fetch(ctx context.Context, address string, limit int64) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, address, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "almarfidintercept/"+u.current)
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w, %v answered %v", ErrUpdateCheck, address, resp.Status)
+	}
+	content, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return nil, fmt.Errorf("unable to download %v: %w", address, err)
+	}
+	if int64(len(content)) > limit {
+		return nil, fmt.Errorf("%w, %v is larger than %v bytes", ErrUpdateCheck, address, limit)
+	}
+	return content, nil
+}
+
+// findChecksum returns the checksum of a file from a checksums file, in the
+// format of sha256sum.
+func findChecksum(checksums []byte, name string) (string, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(checksums))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && strings.TrimPrefix(fields[1], "*") == name {
+			return strings.ToLower(fields[0]), nil
+		}
+	}
+	return "", fmt.Errorf("%w, the checksum of %v", ErrMissingAsset, name)
+}
+
+// extractExecutable returns the executable from a release archive, a .tar.gz
+// or a .zip, wherever it is in the archive.
+func extractExecutable(archiveName string, archive []byte) ([]byte, error) {
+	name := "almarfidintercept"
+	if runtime.GOOS == "windows" {
+		name += ".exe"
+	}
+	if strings.HasSuffix(archiveName, ".zip") {
+		r, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+		if err != nil {
+			return nil, fmt.Errorf("unable to open %v: %w", archiveName, err)
+		}
+		for _, f := range r.File {
+			if path.Base(f.Name) != name {
+				continue
+			}
+			rc, err := f.Open()
+			if err != nil {
+				return nil, fmt.Errorf("unable to extract %v: %w", name, err)
+			}
+			defer rc.Close()
+			return io.ReadAll(io.LimitReader(rc, maxArchiveBytes))
+		}
+		return nil, fmt.Errorf("%w, %v in %v", ErrMissingAsset, name, archiveName)
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(archive))
+	if err != nil {
+		return nil, fmt.Errorf("unable to open %v: %w", archiveName, err)
+	}
+	r := tar.NewReader(gz)
+	for {
+		header, err := r.Next()
+		if errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("%w, %v in %v", ErrMissingAsset, name, archiveName)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to extract %v: %w", name, err)
+		}
+		if header.Typeflag == tar.TypeReg && path.Base(header.Name) == name {
+			return io.ReadAll(io.LimitReader(r, maxArchiveBytes))
+		}
+	}
+}
+
+// replaceExecutable swaps in a new executable. The new one is written next to
+// the old one, then renamed over it. Windows won't replace a running
+// executable, but will rename it, so the old one is moved aside to .old first.
+func replaceExecutable(executable string, binary []byte) error {
+	next := executable + ".new"
+	err := os.WriteFile(next, binary, 0o755)
+	if err != nil {
+		return fmt.Errorf("unable to write the new executable: %w", err)
+	}
+	old := executable + ".old"
+	if runtime.GOOS == "windows" {
+		os.Remove(old)
+		err = os.Rename(executable, old)
+		if err != nil {
+			os.Remove(next)
+			return fmt.Errorf("unable to move the old executable aside: %w", err)
+		}
+	}
+	err = os.Rename(next, executable)
+	if err != nil {
+		os.Remove(next)
+		if runtime.GOOS == "windows" {
+			os.Rename(old, executable)
+		}
+		return fmt.Errorf("unable to replace the executable: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,35 @@
+// Copyright 2023 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+//go:build !windows
+
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// restartService restarts the named systemd unit, or on macOS, the launchd
+// daemon with the name as its label. It needs root.
+func restartService(name string) error {
+	if runtime.GOOS == "darwin" {
+		output, err := exec.Command("launchctl", "kickstart", "-k", "system/"+name).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("launchctl kickstart %v: %w: %v", name, err, strings.TrimSpace(string(output)))
+		}
+		return nil
+	}
+	systemctl, err := exec.LookPath("systemctl")
+	if err != nil {
+		return ErrServiceUnsupported
+	}
+	output, err := exec.Command(systemctl, "restart", name).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("systemctl restart %v: %w: %v", name, err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
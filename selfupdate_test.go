@@ -0,0 +1,117 @@
+// Copyright 2023 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+)
+
+// releaseArchiveOf returns a release archive for this platform with an executable in it.
+func releaseArchiveOf(t *testing.T, executable []byte) []byte {
+	t.Helper()
+	name := "almarfidintercept"
+	if runtime.GOOS == "windows" {
+		name += ".exe"
+	}
+	var b bytes.Buffer
+	if runtime.GOOS == "windows" {
+		zw := zip.NewWriter(&b)
+		w, err := zw.Create("almarfidintercept/" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(executable)
+		zw.Close()
+		return b.Bytes()
+	}
+	gz := gzip.NewWriter(&b)
+	tw := tar.NewWriter(gz)
+	err := tw.WriteHeader(&tar.Header{Name: "almarfidintercept/" + name, Mode: 0o755, Size: int64(len(executable)), Typeflag: tar.TypeReg})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tw.Write(executable)
+	tw.Close()
+	gz.Close()
+	return b.Bytes()
+}
+
+func TestSelfUpdateDownload(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, otherKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	older := releaseArchive("1.1.0", runtime.GOOS, runtime.GOARCH)
+	newer := releaseArchive("1.2.0", runtime.GOOS, runtime.GOARCH)
+	tests := []struct {
+		name    string
+		version string
+		// The file the archive is published as, the file the signed checksums list, and the signing key.
+		published string
+		signed    string
+		key       ed25519.PrivateKey
+		wantErr   error
+	}{
+		{"signed release", "1.2.0", newer, newer, private, nil},
+		{"other key", "1.2.0", newer, newer, otherKey, ErrBadSignature},
+		// An older release, with its own checksums and signature, published under a newer tag.
+		{"older release retagged", "1.2.0", newer, older, private, ErrMissingAsset},
+		{"older archive name", "1.2.0", older, older, private, ErrMissingAsset},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			archive := releaseArchiveOf(t, []byte("executable"))
+			sum := sha256.Sum256(archive)
+			checksums := []byte(fmt.Sprintf("%v  %v\n", hex.EncodeToString(sum[:]), tt.signed))
+			files := map[string][]byte{
+				tt.published:   archive,
+				ChecksumsAsset: checksums,
+				SignatureAsset: ed25519.Sign(tt.key, checksums),
+			}
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				content, ok := files[r.URL.Path[1:]]
+				if !ok {
+					http.NotFound(w, r)
+					return
+				}
+				w.Write(content)
+			}))
+			defer server.Close()
+			latest := release{TagName: "v" + tt.version}
+			for name := range files {
+				latest.Assets = append(latest.Assets, releaseAsset{Name: name, URL: server.URL + "/" + name})
+			}
+			checker, err := NewUpdateChecker(server.URL, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			binary, err := checker.download(context.Background(), latest, tt.version, public)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && string(binary) != "executable" {
+				t.Errorf("got executable %q", binary)
+			}
+		})
+	}
+}
@@ -0,0 +1,27 @@
+// Copyright 2023 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+//go:build windows
+
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// restartService stops and starts the named Windows service, with net, which
+// waits for the service to stop before returning. It needs an elevated prompt.
+func restartService(name string) error {
+	output, err := exec.Command("net", "stop", name).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("net stop %v: %w: %v", name, err, strings.TrimSpace(string(output)))
+	}
+	output, err = exec.Command("net", "start", name).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("net start %v: %w: %v", name, err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
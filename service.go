@@ -0,0 +1,91 @@
+// Copyright 2023 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/cu-library/overridefromenv"
+)
+
+const (
+	// ServiceDisplayName is the name the Windows service is shown with.
+	ServiceDisplayName = "Alma RFID intercept"
+
+	// ServiceDescription is the description the Windows service is shown with.
+	ServiceDescription = "Proxies Alma's requests to the RFID reader service, adding CORS headers."
+
+	// ServiceRestartDelay is how long Windows waits before restarting the
+	// service after it crashes.
+	ServiceRestartDelay = 5 * time.Second
+
+	// ServiceStopTimeout is how long a stopping service may take, which is
+	// longer than the default -shutdown-timeout, so requests can finish.
+	ServiceStopTimeout = DefaultShutdownTimeout + 15*time.Second
+)
+
+// ErrWindowsServiceUnsupported is returned when managing Windows services isn't supported on this platform.
+var ErrWindowsServiceUnsupported = errors.New("managing services is only supported on Windows, use a systemd unit elsewhere")
+
+// runServiceCommand installs, uninstalls, starts, or stops the Windows
+// service running the proxy. Arguments after the action, and after --, are
+// the flags the service starts the proxy with, like -config. The service
+// starts automatically with Windows, and is restarted if it crashes.
+func runServiceCommand(args []string, stdout io.Writer) error {
+	fs := flag.NewFlagSet("service", flag.ContinueOnError)
+	serviceName := fs.String("service-name", DefaultServiceName, "Name of the Windows service.")
+	err := fs.Parse(args)
+	if err != nil {
+		return fmt.Errorf("%w, %v", ErrUsage, err)
+	}
+	usage := fmt.Errorf("%w, usage: service [-service-name name] install|uninstall|start|stop [-- proxy flags]", ErrUsage)
+	if fs.NArg() == 0 {
+		return usage
+	}
+	err = overridefromenv.Override(fs, EnvPrefix)
+	if err != nil {
+		return err
+	}
+	action, rest := fs.Arg(0), fs.Args()[1:]
+	if len(rest) > 0 && rest[0] == "--" {
+		rest = rest[1:]
+	}
+	if action != "install" && len(rest) != 0 {
+		return fmt.Errorf("%w, service %v takes no proxy flags", ErrUsage, action)
+	}
+	switch action {
+	case "install":
+		err = installService(*serviceName, rest)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(stdout, "Installed the %v service. It starts with Windows, and restarts if it crashes. Start it now with: service start\n", *serviceName)
+	case "uninstall":
+		err = uninstallService(*serviceName)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(stdout, "Uninstalled the %v service.\n", *serviceName)
+	case "start":
+		err = startService(*serviceName)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(stdout, "Started the %v service.\n", *serviceName)
+	case "stop":
+		err = stopService(*serviceName)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(stdout, "Stopped the %v service.\n", *serviceName)
+	default:
+		return usage
+	}
+	return nil
+}
@@ -0,0 +1,33 @@
+// Copyright 2023 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+//go:build !windows
+
+package main
+
+// runAsService does nothing outside Windows. The returned channel is nil, so
+// it never closes.
+func runAsService() (<-chan struct{}, func(), error) {
+	return nil, func() {}, nil
+}
+
+// installService isn't supported outside Windows.
+func installService(_ string, _ []string) error {
+	return ErrWindowsServiceUnsupported
+}
+
+// uninstallService isn't supported outside Windows.
+func uninstallService(_ string) error {
+	return ErrWindowsServiceUnsupported
+}
+
+// startService isn't supported outside Windows.
+func startService(_ string) error {
+	return ErrWindowsServiceUnsupported
+}
+
+// stopService isn't supported outside Windows.
+func stopService(_ string) error {
+	return ErrWindowsServiceUnsupported
+}
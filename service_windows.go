@@ -0,0 +1,196 @@
+// Copyright 2023 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+//go:build windows
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// serviceHandler answers the Windows service control manager.
+type serviceHandler struct {
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+// Execute reports the service is running, and when the service control
+// manager asks it to stop, closes stop and waits for the proxy to stop.
+func (h *serviceHandler) Execute(_ []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+	for {
+		select {
+		case request := <-requests:
+			switch request.Cmd {
+			case svc.Interrogate:
+				status <- request.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				status <- svc.Status{State: svc.StopPending, WaitHint: uint32(ServiceStopTimeout.Milliseconds())}
+				close(h.stop)
+				<-h.stopped
+				return false, 0
+			}
+		case <-h.stopped:
+			return false, 0
+		}
+	}
+}
+
+// runAsService reports to the Windows service control manager, if it started
+// the proxy. The returned channel is closed when the service is asked to
+// stop, and the returned function is called once the proxy has stopped.
+// Services start in the system directory, so the working directory is changed
+// to the executable's, where relative paths like -config are looked for.
+// Outside a service, the channel is nil and the function does nothing.
+func runAsService() (<-chan struct{}, func(), error) {
+	isService, err := svc.IsWindowsService()
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to tell if running as a service: %w", err)
+	}
+	if !isService {
+		return nil, func() {}, nil
+	}
+	executable, err := os.Executable()
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to find executable: %w", err)
+	}
+	err = os.Chdir(filepath.Dir(executable))
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to change to the executable's directory: %w", err)
+	}
+	handler := &serviceHandler{stop: make(chan struct{}), stopped: make(chan struct{})}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// The name is ignored for a service running in its own process.
+		err := svc.Run(DefaultServiceName, handler)
+		if err != nil {
+			fatal("Unable to run as a Windows service.", "error", err)
+		}
+	}()
+	stopped := func() {
+		close(handler.stopped)
+		<-done
+	}
+	return handler.stop, stopped, nil
+}
+
+// installService creates the named service, started automatically with
+// Windows and restarted if it crashes, running this executable with args.
+// It needs an elevated prompt.
+func installService(name string, args []string) error {
+	executable, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("unable to find executable: %w", err)
+	}
+	executable, err = filepath.Abs(executable)
+	if err != nil {
+		return fmt.Errorf("unable to find executable: %w", err)
+	}
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("unable to connect to the service control manager: %w", err)
+	}
+	defer m.Disconnect()
+	s, err := m.OpenService(name)
+	if err == nil {
+		s.Close()
+		return fmt.Errorf("the %v service is already installed, uninstall it first", name)
+	}
+	s, err = m.CreateService(name, executable, mgr.Config{
+		DisplayName:      ServiceDisplayName,
+		Description:      ServiceDescription,
+		StartType:        mgr.StartAutomatic,
+		DelayedAutoStart: true,
+	}, args...)
+	if err != nil {
+		return fmt.Errorf("unable to create the %v service: %w", name, err)
+	}
+	defer s.Close()
+	// Restart after every failure, and forget the failures after a day.
+	restart := mgr.RecoveryAction{Type: mgr.ServiceRestart, Delay: ServiceRestartDelay}
+	err = s.SetRecoveryActions([]mgr.RecoveryAction{restart, restart, restart}, uint32((24 * time.Hour).Seconds()))
+	if err == nil {
+		err = s.SetRecoveryActionsOnNonCrashFailures(true)
+	}
+	if err != nil {
+		s.Delete()
+		return fmt.Errorf("unable to set the %v service to restart on failure: %w", name, err)
+	}
+	return nil
+}
+
+// uninstallService stops and removes the named service. It needs an
+// elevated prompt.
+func uninstallService(name string) error {
+	err := stopService(name)
+	if err != nil {
+		return err
+	}
+	return withService(name, func(s *mgr.Service) error {
+		err := s.Delete()
+		if err != nil {
+			return fmt.Errorf("unable to remove the %v service: %w", name, err)
+		}
+		return nil
+	})
+}
+
+// startService starts the named service.
+func startService(name string) error {
+	return withService(name, func(s *mgr.Service) error {
+		err := s.Start()
+		if err != nil && !errors.Is(err, windows.ERROR_SERVICE_ALREADY_RUNNING) {
+			return fmt.Errorf("unable to start the %v service: %w", name, err)
+		}
+		return nil
+	})
+}
+
+// stopService stops the named service, and waits for it to stop.
+func stopService(name string) error {
+	return withService(name, func(s *mgr.Service) error {
+		status, err := s.Control(svc.Stop)
+		if err != nil && !errors.Is(err, windows.ERROR_SERVICE_NOT_ACTIVE) {
+			return fmt.Errorf("unable to stop the %v service: %w", name, err)
+		}
+		deadline := time.Now().Add(ServiceStopTimeout)
+		for err == nil && status.State != svc.Stopped {
+			if time.Now().After(deadline) {
+				return fmt.Errorf("the %v service didn't stop within %v", name, ServiceStopTimeout)
+			}
+			time.Sleep(300 * time.Millisecond)
+			status, err = s.Query()
+			if err != nil {
+				return fmt.Errorf("unable to check the %v service: %w", name, err)
+			}
+		}
+		return nil
+	})
+}
+
+// withService opens the named service, and calls f with it.
+func withService(name string, f func(s *mgr.Service) error) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("unable to connect to the service control manager: %w", err)
+	}
+	defer m.Disconnect()
+	s, err := m.OpenService(name)
+	if err != nil {
+		return fmt.Errorf("unable to open the %v service: %w", name, err)
+	}
+	defer s.Close()
+	return f(s)
+}
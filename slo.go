@@ -0,0 +1,146 @@
+// Copyright 2023 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ObjectiveSamples is the number of recent upstream requests, per operation,
+// which latency objectives are measured against.
+const ObjectiveSamples = 1000
+
+// ErrBadObjective is returned when a latency objective can't be parsed.
+var ErrBadObjective = errors.New("latency objectives look like getitems:p95=300ms")
+
+// LatencyObjective is a latency target for one operation, like getitems,
+// which the given percentile of its upstream requests should meet.
+type LatencyObjective struct {
+	Operation  string
+	Percentile float64 // From 0 to 1.
+	Target     time.Duration
+}
+
+// String formats the objective like p95 < 300ms.
+func (o LatencyObjective) String() string {
+	return fmt.Sprintf("p%v < %v", strconv.FormatFloat(o.Percentile*100, 'f', -1, 64), o.Target)
+}
+
+// ParseLatencyObjectives parses a comma separated list of objectives, each
+// written operation:pNN=duration, like getitems:p95=300ms. The percentile
+// defaults to p95 if it is left out, as in getitems=300ms.
+func ParseLatencyObjectives(list string) ([]LatencyObjective, error) {
+	var objectives []LatencyObjective
+	for _, spec := range splitList(list) {
+		route, target, found := strings.Cut(spec, "=")
+		if !found {
+			return nil, fmt.Errorf("%w, not %q", ErrBadObjective, spec)
+		}
+		objective := LatencyObjective{Percentile: 0.95}
+		operation, percentile, found := strings.Cut(route, ":")
+		objective.Operation = strings.ToLower(strings.TrimSpace(operation))
+		if objective.Operation == "" {
+			return nil, fmt.Errorf("%w, not %q", ErrBadObjective, spec)
+		}
+		if found {
+			p, err := strconv.ParseFloat(strings.TrimPrefix(strings.TrimSpace(percentile), "p"), 64)
+			if err != nil || p <= 0 || p > 100 {
+				return nil, fmt.Errorf("%w, bad percentile in %q", ErrBadObjective, spec)
+			}
+			objective.Percentile = p / 100
+		}
+		d, err := time.ParseDuration(strings.TrimSpace(target))
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("%w, bad duration in %q", ErrBadObjective, spec)
+		}
+		objective.Target = d
+		objectives = append(objectives, objective)
+	}
+	return objectives, nil
+}
+
+// ObjectiveReport is how an operation is doing against its latency objective.
+type ObjectiveReport struct {
+	Operation string `json:"operation"`
+	Objective string `json:"objective"`
+	Observed  string `json:"observed"`
+	Requests  int    `json:"requests"`
+	Met       bool   `json:"met"`
+}
+
+// ObjectiveTracker measures upstream latency against the latency objectives,
+// over the last ObjectiveSamples requests for each operation.
+type ObjectiveTracker struct {
+	Objectives []LatencyObjective
+
+	mu      sync.Mutex
+	samples map[string][]time.Duration
+	next    map[string]int // Where the next sample goes, once an operation's samples are full.
+}
+
+// NewObjectiveTracker returns a tracker for the given objectives.
+func NewObjectiveTracker(objectives []LatencyObjective) *ObjectiveTracker {
+	return &ObjectiveTracker{
+		Objectives: objectives,
+		samples:    make(map[string][]time.Duration),
+		next:       make(map[string]int),
+	}
+}
+
+// Observe records the latency of an upstream request, if its operation has an objective.
+// Operations are matched case-insensitively.
+func (t *ObjectiveTracker) Observe(operation string, latency time.Duration) {
+	operation = strings.ToLower(operation)
+	if t == nil || !t.tracked(operation) {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	samples := t.samples[operation]
+	if len(samples) < ObjectiveSamples {
+		t.samples[operation] = append(samples, latency)
+		return
+	}
+	samples[t.next[operation]] = latency
+	t.next[operation] = (t.next[operation] + 1) % ObjectiveSamples
+}
+
+// tracked reports whether an operation has an objective.
+func (t *ObjectiveTracker) tracked(operation string) bool {
+	for _, objective := range t.Objectives {
+		if objective.Operation == operation {
+			return true
+		}
+	}
+	return false
+}
+
+// Report returns how each operation is doing against its objective.
+// Operations with no requests yet are reported as meeting their objective.
+func (t *ObjectiveTracker) Report() []ObjectiveReport {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	reports := make([]ObjectiveReport, 0, len(t.Objectives))
+	for _, objective := range t.Objectives {
+		samples := append([]time.Duration{}, t.samples[objective.Operation]...)
+		observed := percentile(samples, objective.Percentile)
+		reports = append(reports, ObjectiveReport{
+			Operation: objective.Operation,
+			Objective: objective.String(),
+			Observed:  observed.Round(time.Millisecond).String(),
+			Requests:  len(samples),
+			Met:       observed <= objective.Target,
+		})
+	}
+	return reports
+}
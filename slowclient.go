@@ -0,0 +1,112 @@
+// Copyright 2023 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultClientTimeout is the default time a client has to send its
+	// request and receive the response.
+	DefaultClientTimeout = 30 * time.Second
+
+	// DefaultMinClientRate is the default minimum rate, in bytes per second,
+	// at which a client must accept the response.
+	DefaultMinClientRate = 512
+
+	// MinClientRateGrace is added to the deadline of every write, so small
+	// writes to a client on a slow link aren't cut off.
+	MinClientRateGrace = 2 * time.Second
+)
+
+// SlowClientGuard stops a hung or very slow client from holding on to a
+// request, and the reader service behind it, indefinitely.
+//
+// Each request must be read and answered within Timeout. On top of that,
+// each write to the client must finish within MinClientRateGrace plus the
+// time it would take at MinRate bytes per second. When a deadline passes,
+// the write fails and the connection is closed. Event streams and WebSocket
+// tunnels stay open as long as the page does, so they have no Timeout.
+// Operations given a longer upstream timeout than Timeout, with Timeouts,
+// get that instead, plus MinClientRateGrace to send the answer.
+type SlowClientGuard struct {
+	Timeout time.Duration
+	MinRate int64
+
+	// Timeouts are the upstream timeouts for particular operations,
+	// keyed by lower case operation name, from -operation-timeouts.
+	Timeouts map[string]time.Duration
+}
+
+// timeout returns the time a client has to send a request and receive the
+// response, extended for an operation which may wait longer on the reader service.
+func (g *SlowClientGuard) timeout(r *http.Request) time.Duration {
+	operation := strings.ToLower(operationName(r.Header.Get("SOAPAction"), r.URL.Path))
+	if upstream, ok := g.Timeouts[operation]; ok && upstream+MinClientRateGrace > g.Timeout {
+		return upstream + MinClientRateGrace
+	}
+	return g.Timeout
+}
+
+// Middleware wraps a handler with the slow client deadlines.
+func (g *SlowClientGuard) Middleware(next http.Handler) http.Handler {
+	if g.Timeout <= 0 && g.MinRate <= 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rc := http.NewResponseController(w)
+		var deadline time.Time
+		// Event streams stay open as long as the page is, so only the deadline for each write applies.
+		// WebSocket tunnels do too, and the deadlines would outlast the hijack, so none apply.
+		if g.Timeout > 0 && !isEventStream(r) && !isUpgrade(r) {
+			deadline = time.Now().Add(g.timeout(r))
+			// Errors mean the connection doesn't support deadlines,
+			// in which case there's nothing we can do.
+			rc.SetReadDeadline(deadline)
+			rc.SetWriteDeadline(deadline)
+		}
+		if g.MinRate > 0 {
+			w = &throughputWriter{
+				ResponseWriter: w,
+				rc:             rc,
+				minRate:        g.MinRate,
+				deadline:       deadline,
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// throughputWriter sets a write deadline for each write,
+// based on its size and the minimum transfer rate.
+type throughputWriter struct {
+	http.ResponseWriter
+	rc       *http.ResponseController
+	minRate  int64
+	deadline time.Time // The overall deadline for the request, if any.
+}
+
+// Write sets the deadline for this write, then writes.
+func (t *throughputWriter) Write(p []byte) (int, error) {
+	deadline := time.Now().Add(MinClientRateGrace + time.Duration(int64(len(p))*int64(time.Second)/t.minRate))
+	if !t.deadline.IsZero() && t.deadline.Before(deadline) {
+		deadline = t.deadline
+	}
+	t.rc.SetWriteDeadline(deadline)
+	return t.ResponseWriter.Write(p)
+}
+
+// Flush flushes the underlying writer, if it supports flushing.
+func (t *throughputWriter) Flush() {
+	t.rc.Flush()
+}
+
+// Unwrap returns the underlying writer, for http.ResponseController.
+func (t *throughputWriter) Unwrap() http.ResponseWriter {
+	return t.ResponseWriter
+}
@@ -0,0 +1,101 @@
+// Copyright 2023 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// echoTunnel hijacks the connection, and echoes each line, like a WebSocket
+// tunnel to the reader service.
+func echoTunnel(w http.ResponseWriter, _ *http.Request) {
+	conn, rw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	fmt.Fprint(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+	rw.Flush()
+	for {
+		line, err := rw.ReadString('\n')
+		if err != nil {
+			return
+		}
+		rw.WriteString(line)
+		if rw.Flush() != nil {
+			return
+		}
+	}
+}
+
+func TestSlowClientGuardTunnel(t *testing.T) {
+	const timeout = 200 * time.Millisecond
+	guard := &SlowClientGuard{Timeout: timeout, MinRate: DefaultMinClientRate}
+	server := httptest.NewServer(guard.Middleware(http.HandlerFunc(echoTunnel)))
+	defer server.Close()
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprint(conn, "GET /ws HTTP/1.1\r\nHost: localhost\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n")
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("got status %v, want 101", resp.StatusCode)
+	}
+	// Each message is sent after the client timeout has passed.
+	for _, message := range []string{"ping", "pong"} {
+		time.Sleep(2 * timeout)
+		conn.SetDeadline(time.Now().Add(time.Second))
+		fmt.Fprintln(conn, message)
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("tunnel closed after the client timeout: %v", err)
+		}
+		if got := strings.TrimSpace(line); got != message {
+			t.Errorf("got %q, want %q", got, message)
+		}
+	}
+}
+
+func TestSlowClientGuardTimeout(t *testing.T) {
+	guard := &SlowClientGuard{
+		Timeout:  30 * time.Second,
+		Timeouts: map[string]time.Duration{"writetags": 60 * time.Second, "setsecurity": 10 * time.Second},
+	}
+	tests := []struct {
+		name       string
+		soapAction string
+		path       string
+		want       time.Duration
+	}{
+		{"no operation timeout", "", "/getItems", 30 * time.Second},
+		{"longer operation timeout", `"urn:rfid#writeTags"`, "/", 60*time.Second + MinClientRateGrace},
+		{"longer operation timeout from the path", "", "/WriteTags", 60*time.Second + MinClientRateGrace},
+		{"shorter operation timeout", "urn:rfid#setSecurity", "/", 30 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, tt.path, nil)
+			if tt.soapAction != "" {
+				r.Header.Set("SOAPAction", tt.soapAction)
+			}
+			if got := guard.timeout(r); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,509 @@
+// Copyright 2023 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultSNMPCommunity is the community string the SNMP agent answers to by default.
+const DefaultSNMPCommunity = "public"
+
+// DefaultSNMPBaseOID is the OID our objects are published under by default, in
+// the experimental arc. Set -snmp-base-oid to place them under your own enterprise.
+const DefaultSNMPBaseOID = "1.3.6.1.3.53535"
+
+// SNMPMaxMessage is the largest SNMP message we read or write.
+const SNMPMaxMessage = 1472
+
+// The SNMP versions we answer.
+const (
+	snmpVersion1  = 0
+	snmpVersion2c = 1
+)
+
+// The BER and SNMP tags we read and write.
+const (
+	berInteger     = 0x02
+	berOctetString = 0x04
+	berNull        = 0x05
+	berOID         = 0x06
+	berSequence    = 0x30
+	snmpCounter32  = 0x41
+	snmpTimeTicks  = 0x43
+	snmpCounter64  = 0x46
+	snmpGet        = 0xa0
+	snmpGetNext    = 0xa1
+	snmpResponse   = 0xa2
+	snmpSet        = 0xa3
+	snmpGetBulk    = 0xa5
+	snmpNoSuchObj  = 0x80
+	snmpEndOfView  = 0x82
+)
+
+// The SNMP error statuses we send.
+const (
+	snmpNoSuchName = 2
+	snmpNoAccess   = 6
+)
+
+// The values of the upstream status object.
+const (
+	SNMPUpstreamOK    = 1
+	SNMPUpstreamAlert = 2
+)
+
+// ErrBadSNMPMessage is returned when an SNMP message can't be decoded.
+var ErrBadSNMPMessage = errors.New("bad SNMP message")
+
+// ErrBadOID is returned when an OID can't be parsed.
+var ErrBadOID = errors.New("bad OID")
+
+// SNMPAgent is a minimal, read only SNMP v1 and v2c agent, for network monitoring
+// which only speaks SNMP. It answers for sysDescr and sysUpTime, and for these
+// objects under the base OID:
+//
+//	.1.0 requests served, Counter64
+//	.2.0 requests answered with a 5xx status, Counter64
+//	.3.0 upstream requests, Counter64
+//	.4.0 failed upstream requests, Counter64
+//	.5.0 upstream status, 1 for ok or 2 while an alert is raised
+//	.6.0 version, as a string
+//
+// Counter64 isn't part of SNMP v1, so v1 requests see the counters as Counter32s.
+type SNMPAgent struct {
+	Community string
+	Metrics   *Metrics
+	Alarm     *UpstreamAlarm
+
+	conn    net.PacketConn
+	base    oid
+	start   time.Time
+	objects []snmpObject
+}
+
+// oid is an object identifier, like 1.3.6.1.2.1.1.3.0.
+type oid []uint32
+
+// snmpObject is one object the agent answers for.
+type snmpObject struct {
+	oid   oid
+	value func(version int) []byte // The value, BER encoded.
+}
+
+// NewSNMPAgent listens for SNMP requests on address.
+func NewSNMPAgent(address, community, baseOID string, metrics *Metrics, alarm *UpstreamAlarm) (*SNMPAgent, error) {
+	base, err := parseOID(baseOID)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenPacket("udp", address)
+	if err != nil {
+		return nil, fmt.Errorf("unable to listen for SNMP requests: %w", err)
+	}
+	a := &SNMPAgent{
+		Community: community,
+		Metrics:   metrics,
+		Alarm:     alarm,
+		conn:      conn,
+		base:      base,
+		start:     time.Now(),
+	}
+	a.objects = a.mib()
+	return a, nil
+}
+
+// Addr returns the address the agent listens on.
+func (a *SNMPAgent) Addr() net.Addr {
+	return a.conn.LocalAddr()
+}
+
+// Run answers requests until ctx is cancelled.
+func (a *SNMPAgent) Run(ctx context.Context) {
+	go func() {
+		<-ctx.Done()
+		a.conn.Close()
+	}()
+	buf := make([]byte, SNMPMaxMessage)
+	for {
+		n, addr, err := a.conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() == nil {
+				slog.Error("Unable to read SNMP request.", "error", err)
+			}
+			return
+		}
+		response, err := a.handle(buf[:n])
+		if err != nil {
+			slog.Debug("Ignoring SNMP request.", "client", addr, "error", err)
+			continue
+		}
+		if response == nil {
+			continue
+		}
+		_, err = a.conn.WriteTo(response, addr)
+		if err != nil {
+			slog.Warn("Unable to send SNMP response.", "client", addr, "error", err)
+		}
+	}
+}
+
+// mib returns the objects the agent answers for, sorted by OID.
+func (a *SNMPAgent) mib() []snmpObject {
+	counter := func(get func(MetricsSnapshot) int64) func(int) []byte {
+		return func(version int) []byte {
+			value := get(a.Metrics.Snapshot())
+			if version == snmpVersion1 {
+				return berUnsigned(snmpCounter32, uint64(uint32(value)))
+			}
+			return berUnsigned(snmpCounter64, uint64(value))
+		}
+	}
+	upstream := func(s MetricsSnapshot) (requests, failures int64) {
+		for _, stats := range s.Operations {
+			requests += stats.Requests
+			failures += stats.Failures
+		}
+		return requests, failures
+	}
+	under := func(arc uint32) oid {
+		return append(append(oid{}, a.base...), arc, 0)
+	}
+	objects := []snmpObject{
+		{oid{1, 3, 6, 1, 2, 1, 1, 1, 0}, func(int) []byte {
+			return berTLV(berOctetString, []byte("almarfidintercept "+version))
+		}},
+		{oid{1, 3, 6, 1, 2, 1, 1, 3, 0}, func(int) []byte {
+			return berUnsigned(snmpTimeTicks, uint64(uint32(time.Since(a.start)/(10*time.Millisecond))))
+		}},
+		{under(1), counter(func(s MetricsSnapshot) int64 { return s.Requests })},
+		{under(2), counter(func(s MetricsSnapshot) int64 { return s.Responses["5xx"] })},
+		{under(3), counter(func(s MetricsSnapshot) int64 { requests, _ := upstream(s); return requests })},
+		{under(4), counter(func(s MetricsSnapshot) int64 { _, failures := upstream(s); return failures })},
+		{under(5), func(int) []byte {
+			status := SNMPUpstreamOK
+			if reason, _ := a.Alarm.Alert(); reason != "" {
+				status = SNMPUpstreamAlert
+			}
+			return berInt(berInteger, int64(status))
+		}},
+		{under(6), func(int) []byte {
+			return berTLV(berOctetString, []byte(GetBuildInfo().Version))
+		}},
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].oid.less(objects[j].oid) })
+	return objects
+}
+
+// handle answers one request. It returns a nil response for requests
+// which shouldn't be answered, like those with the wrong community.
+func (a *SNMPAgent) handle(request []byte) ([]byte, error) {
+	tag, message, _, err := berRead(request)
+	if err != nil || tag != berSequence {
+		return nil, ErrBadSNMPMessage
+	}
+	tag, versionBytes, rest, err := berRead(message)
+	if err != nil || tag != berInteger {
+		return nil, ErrBadSNMPMessage
+	}
+	version := int(berParseInt(versionBytes))
+	if version != snmpVersion1 && version != snmpVersion2c {
+		return nil, fmt.Errorf("%w, unsupported version %v", ErrBadSNMPMessage, version)
+	}
+	tag, community, rest, err := berRead(rest)
+	if err != nil || tag != berOctetString {
+		return nil, ErrBadSNMPMessage
+	}
+	if string(community) != a.Community {
+		return nil, fmt.Errorf("%w, wrong community", ErrBadSNMPMessage)
+	}
+	pduType, pdu, _, err := berRead(rest)
+	if err != nil {
+		return nil, ErrBadSNMPMessage
+	}
+	var fields [3]int64 // Request ID, error status, and error index, or GetBulk's repeat counts.
+	for i := range fields {
+		var value []byte
+		tag, value, pdu, err = berRead(pdu)
+		if err != nil || tag != berInteger {
+			return nil, ErrBadSNMPMessage
+		}
+		fields[i] = berParseInt(value)
+	}
+	tag, bindings, _, err := berRead(pdu)
+	if err != nil || tag != berSequence {
+		return nil, ErrBadSNMPMessage
+	}
+	var oids []oid
+	for len(bindings) > 0 {
+		var binding, name []byte
+		tag, binding, bindings, err = berRead(bindings)
+		if err != nil || tag != berSequence {
+			return nil, ErrBadSNMPMessage
+		}
+		tag, name, _, err = berRead(binding)
+		if err != nil || tag != berOID {
+			return nil, ErrBadSNMPMessage
+		}
+		oids = append(oids, berParseOID(name))
+	}
+
+	var errorStatus, errorIndex int64
+	var results []byte
+	switch {
+	case pduType == snmpGet || pduType == snmpGetNext || (pduType == snmpGetBulk && version == snmpVersion2c):
+		if pduType == snmpGetBulk {
+			oids = a.bulk(oids, fields[1], fields[2])
+			pduType = snmpGetNext
+		}
+		for i, name := range oids {
+			object, found := a.find(name, pduType == snmpGetNext)
+			switch {
+			case found:
+				results = append(results, berTLV(berSequence, append(berEncodeOID(object.oid), object.value(version)...))...)
+			case version == snmpVersion1:
+				errorStatus, errorIndex = snmpNoSuchName, int64(i+1)
+			case pduType == snmpGetNext:
+				results = append(results, berTLV(berSequence, append(berEncodeOID(name), snmpEndOfView, 0))...)
+			default:
+				results = append(results, berTLV(berSequence, append(berEncodeOID(name), snmpNoSuchObj, 0))...)
+			}
+			if errorStatus != 0 {
+				break
+			}
+		}
+	case pduType == snmpSet:
+		errorStatus, errorIndex = snmpNoAccess, 1
+		if version == snmpVersion1 {
+			errorStatus = snmpNoSuchName
+		}
+	default:
+		return nil, fmt.Errorf("%w, unsupported PDU type %#x", ErrBadSNMPMessage, pduType)
+	}
+	if errorStatus != 0 {
+		// On error, the request's bindings are sent back unchanged.
+		results = nil
+		for _, name := range oids {
+			results = append(results, berTLV(berSequence, append(berEncodeOID(name), berNull, 0))...)
+		}
+	}
+
+	var response []byte
+	response = append(response, berInt(berInteger, fields[0])...)
+	response = append(response, berInt(berInteger, errorStatus)...)
+	response = append(response, berInt(berInteger, errorIndex)...)
+	response = append(response, berTLV(berSequence, results)...)
+	response = berTLV(snmpResponse, response)
+	response = append(berTLV(berOctetString, community), response...)
+	response = append(berInt(berInteger, int64(version)), response...)
+	response = berTLV(berSequence, response)
+	if len(response) > SNMPMaxMessage {
+		return nil, fmt.Errorf("%w, response too big", ErrBadSNMPMessage)
+	}
+	return response, nil
+}
+
+// bulk expands a GetBulk request into the OIDs to walk with GetNext. The first
+// nonRepeaters OIDs are walked once, the rest up to maxRepetitions times.
+func (a *SNMPAgent) bulk(oids []oid, nonRepeaters, maxRepetitions int64) []oid {
+	if nonRepeaters < 0 {
+		nonRepeaters = 0
+	}
+	if nonRepeaters > int64(len(oids)) {
+		nonRepeaters = int64(len(oids))
+	}
+	// There are only a few objects, so there's no point repeating more often than that.
+	if maxRepetitions > int64(len(a.objects)) {
+		maxRepetitions = int64(len(a.objects))
+	}
+	expanded := append([]oid{}, oids[:nonRepeaters]...)
+	for _, name := range oids[nonRepeaters:] {
+		for i := int64(0); i < maxRepetitions; i++ {
+			expanded = append(expanded, name)
+			object, found := a.find(name, true)
+			if !found {
+				break
+			}
+			name = object.oid
+		}
+	}
+	return expanded
+}
+
+// find returns the object with an OID, or with next, the first object after it.
+func (a *SNMPAgent) find(name oid, next bool) (snmpObject, bool) {
+	for _, object := range a.objects {
+		if next && name.less(object.oid) {
+			return object, true
+		}
+		if !next && name.equal(object.oid) {
+			return object, true
+		}
+	}
+	return snmpObject{}, false
+}
+
+// parseOID parses a dotted OID, like 1.3.6.1.3.53535.
+func parseOID(s string) (oid, error) {
+	var o oid
+	for _, arc := range strings.Split(strings.TrimPrefix(s, "."), ".") {
+		n, err := strconv.ParseUint(arc, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("%w %q", ErrBadOID, s)
+		}
+		o = append(o, uint32(n))
+	}
+	if len(o) < 2 || o[0] > 2 {
+		return nil, fmt.Errorf("%w %q", ErrBadOID, s)
+	}
+	return o, nil
+}
+
+// less reports whether o sorts before other.
+func (o oid) less(other oid) bool {
+	for i := 0; i < len(o) && i < len(other); i++ {
+		if o[i] != other[i] {
+			return o[i] < other[i]
+		}
+	}
+	return len(o) < len(other)
+}
+
+// equal reports whether o and other are the same OID.
+func (o oid) equal(other oid) bool {
+	return len(o) == len(other) && !o.less(other) && !other.less(o)
+}
+
+// berRead reads one TLV, returning its tag, its contents, and what follows it.
+func berRead(b []byte) (byte, []byte, []byte, error) {
+	if len(b) < 2 {
+		return 0, nil, nil, ErrBadSNMPMessage
+	}
+	tag, length, b := b[0], int(b[1]), b[2:]
+	if length&0x80 != 0 {
+		n := length & 0x7f
+		if n == 0 || n > 2 || len(b) < n {
+			return 0, nil, nil, ErrBadSNMPMessage
+		}
+		length = 0
+		for _, c := range b[:n] {
+			length = length<<8 | int(c)
+		}
+		b = b[n:]
+	}
+	if len(b) < length {
+		return 0, nil, nil, ErrBadSNMPMessage
+	}
+	return tag, b[:length], b[length:], nil
+}
+
+// berParseInt parses the contents of a signed integer.
+func berParseInt(b []byte) int64 {
+	var n int64
+	for i, c := range b {
+		if i == 0 && c&0x80 != 0 {
+			n = -1
+		}
+		n = n<<8 | int64(c)
+	}
+	return n
+}
+
+// berParseOID parses the contents of an OID.
+func berParseOID(b []byte) oid {
+	if len(b) == 0 {
+		return nil
+	}
+	var o oid
+	var arc uint32
+	for _, c := range b {
+		arc = arc<<7 | uint32(c&0x7f)
+		if c&0x80 != 0 {
+			continue
+		}
+		// The first subidentifier holds the first two arcs. The first arc
+		// is at most 2, so the second can be more than 39 under 2.
+		switch {
+		case len(o) > 0:
+			o = append(o, arc)
+		case arc < 80:
+			o = oid{arc / 40, arc % 40}
+		default:
+			o = oid{2, arc - 80}
+		}
+		arc = 0
+	}
+	return o
+}
+
+// berTLV encodes a TLV.
+func berTLV(tag byte, contents []byte) []byte {
+	b := []byte{tag}
+	switch n := len(contents); {
+	case n < 0x80:
+		b = append(b, byte(n))
+	case n < 0x100:
+		b = append(b, 0x81, byte(n))
+	default:
+		b = append(b, 0x82, byte(n>>8), byte(n))
+	}
+	return append(b, contents...)
+}
+
+// berInt encodes a signed integer, in as few bytes as possible.
+func berInt(tag byte, n int64) []byte {
+	var b []byte
+	for {
+		b = append([]byte{byte(n)}, b...)
+		if (n >= -0x80 && n < 0x80) || len(b) == 8 {
+			break
+		}
+		n >>= 8
+	}
+	return berTLV(tag, b)
+}
+
+// berUnsigned encodes an unsigned integer, like a counter or time ticks.
+func berUnsigned(tag byte, n uint64) []byte {
+	var b []byte
+	for {
+		b = append([]byte{byte(n)}, b...)
+		n >>= 8
+		if n == 0 {
+			break
+		}
+	}
+	// Keep the value positive.
+	if b[0]&0x80 != 0 {
+		b = append([]byte{0}, b...)
+	}
+	return berTLV(tag, b)
+}
+
+// berEncodeOID encodes an OID.
+func berEncodeOID(o oid) []byte {
+	if len(o) < 2 {
+		return berTLV(berOID, nil)
+	}
+	// The first two arcs are encoded together, as one subidentifier.
+	var b []byte
+	for _, arc := range append(oid{o[0]*40 + o[1]}, o[2:]...) {
+		var encoded []byte
+		encoded = append(encoded, byte(arc&0x7f))
+		for arc >>= 7; arc > 0; arc >>= 7 {
+			encoded = append([]byte{byte(arc&0x7f | 0x80)}, encoded...)
+		}
+		b = append(b, encoded...)
+	}
+	return berTLV(berOID, b)
+}
@@ -0,0 +1,305 @@
+// Copyright 2023 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"math"
+	"testing"
+)
+
+func TestBERTLV(t *testing.T) {
+	tests := []struct {
+		name   string
+		length int
+		header []byte
+	}{
+		{"empty", 0, []byte{0x04, 0x00}},
+		{"short form", 0x7f, []byte{0x04, 0x7f}},
+		{"one length byte", 0x80, []byte{0x04, 0x81, 0x80}},
+		{"largest one length byte", 0xff, []byte{0x04, 0x81, 0xff}},
+		{"two length bytes", 0x100, []byte{0x04, 0x82, 0x01, 0x00}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			contents := bytes.Repeat([]byte{0xaa}, tt.length)
+			got := berTLV(berOctetString, contents)
+			if want := append(append([]byte{}, tt.header...), contents...); !bytes.Equal(got, want) {
+				t.Fatalf("got header % x, want % x", got[:min(len(got), len(tt.header))], tt.header)
+			}
+			tag, read, rest, err := berRead(got)
+			if err != nil || tag != berOctetString || !bytes.Equal(read, contents) || len(rest) != 0 {
+				t.Errorf("berRead got tag %#x, %v bytes, %v left, error %v", tag, len(read), len(rest), err)
+			}
+		})
+	}
+}
+
+func TestBERRead(t *testing.T) {
+	tests := []struct {
+		name    string
+		b       []byte
+		wantErr bool
+	}{
+		{"too short", []byte{0x02}, true},
+		{"contents cut off", []byte{0x02, 0x02, 0x01}, true},
+		{"indefinite length", []byte{0x30, 0x80, 0x00, 0x00}, true},
+		{"three length bytes", []byte{0x04, 0x83, 0x00, 0x00, 0x01, 0xaa}, true},
+		{"length bytes cut off", []byte{0x04, 0x82, 0x01}, true},
+		{"integer", []byte{0x02, 0x01, 0x05}, false},
+		{"long form", []byte{0x04, 0x81, 0x01, 0xaa}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, _, err := berRead(tt.b)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("got error %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestBERInt(t *testing.T) {
+	tests := []struct {
+		n    int64
+		want []byte
+	}{
+		{0, []byte{0x02, 0x01, 0x00}},
+		{127, []byte{0x02, 0x01, 0x7f}},
+		{128, []byte{0x02, 0x02, 0x00, 0x80}},
+		{256, []byte{0x02, 0x02, 0x01, 0x00}},
+		{0x1234, []byte{0x02, 0x02, 0x12, 0x34}},
+		{-1, []byte{0x02, 0x01, 0xff}},
+		{-128, []byte{0x02, 0x01, 0x80}},
+		{-129, []byte{0x02, 0x02, 0xff, 0x7f}},
+		{math.MaxInt64, []byte{0x02, 0x08, 0x7f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+	}
+	for _, tt := range tests {
+		got := berInt(berInteger, tt.n)
+		if !bytes.Equal(got, tt.want) {
+			t.Errorf("berInt(%v) = % x, want % x", tt.n, got, tt.want)
+			continue
+		}
+		if parsed := berParseInt(got[2:]); parsed != tt.n {
+			t.Errorf("berParseInt(% x) = %v, want %v", got[2:], parsed, tt.n)
+		}
+	}
+}
+
+func TestBERUnsigned(t *testing.T) {
+	tests := []struct {
+		tag  byte
+		n    uint64
+		want []byte
+	}{
+		{snmpCounter32, 0, []byte{0x41, 0x01, 0x00}},
+		{snmpCounter32, 127, []byte{0x41, 0x01, 0x7f}},
+		{snmpCounter32, 255, []byte{0x41, 0x02, 0x00, 0xff}},
+		{snmpCounter32, math.MaxUint32, []byte{0x41, 0x05, 0x00, 0xff, 0xff, 0xff, 0xff}},
+		{snmpTimeTicks, 0x010000, []byte{0x43, 0x03, 0x01, 0x00, 0x00}},
+		{snmpCounter64, math.MaxUint64, []byte{0x46, 0x09, 0x00, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+	}
+	for _, tt := range tests {
+		if got := berUnsigned(tt.tag, tt.n); !bytes.Equal(got, tt.want) {
+			t.Errorf("berUnsigned(%#x, %v) = % x, want % x", tt.tag, tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestBEREncodeOID(t *testing.T) {
+	tests := []struct {
+		oid  string
+		want []byte
+	}{
+		// sysDescr.
+		{"1.3.6.1.2.1.1.1.0", []byte{0x06, 0x08, 0x2b, 0x06, 0x01, 0x02, 0x01, 0x01, 0x01, 0x00}},
+		// Arcs of 128 and more take several bytes, with the high bit set on all but the last.
+		{"1.3.6.1.3.53535.5.0", []byte{0x06, 0x09, 0x2b, 0x06, 0x01, 0x03, 0x83, 0xa2, 0x1f, 0x05, 0x00}},
+		{"1.3.6.1.4.1.128", []byte{0x06, 0x07, 0x2b, 0x06, 0x01, 0x04, 0x01, 0x81, 0x00}},
+		{"2.999.4294967295", []byte{0x06, 0x07, 0x88, 0x37, 0x8f, 0xff, 0xff, 0xff, 0x7f}},
+	}
+	for _, tt := range tests {
+		o, err := parseOID(tt.oid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := berEncodeOID(o)
+		if !bytes.Equal(got, tt.want) {
+			t.Errorf("berEncodeOID(%v) = % x, want % x", tt.oid, got, tt.want)
+			continue
+		}
+		if parsed := berParseOID(got[2:]); !parsed.equal(o) {
+			t.Errorf("berParseOID(% x) = %v, want %v", got[2:], parsed, o)
+		}
+	}
+}
+
+// newTestSNMPAgent returns an agent, which isn't listening, for the default base OID.
+func newTestSNMPAgent(t *testing.T) *SNMPAgent {
+	t.Helper()
+	base, err := parseOID(DefaultSNMPBaseOID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &SNMPAgent{Community: DefaultSNMPCommunity, Metrics: NewMetrics(), base: base}
+	a.objects = a.mib()
+	return a
+}
+
+func TestSNMPAgentHandle(t *testing.T) {
+	a := newTestSNMPAgent(t)
+	upstreamStatus := []byte{0x06, 0x09, 0x2b, 0x06, 0x01, 0x03, 0x83, 0xa2, 0x1f, 0x05, 0x00} // 1.3.6.1.3.53535.5.0
+	tests := []struct {
+		name    string
+		request []byte
+		want    []byte
+		wantErr bool
+	}{
+		{
+			name: "v2c get",
+			request: concat(
+				[]byte{0x30, 0x28},
+				[]byte{0x02, 0x01, 0x01},                         // Version 2c.
+				[]byte{0x04, 0x06, 'p', 'u', 'b', 'l', 'i', 'c'}, // Community.
+				[]byte{0xa0, 0x1b},                               // GetRequest.
+				[]byte{0x02, 0x02, 0x12, 0x34},                   // Request ID.
+				[]byte{0x02, 0x01, 0x00, 0x02, 0x01, 0x00},       // Error status and index.
+				[]byte{0x30, 0x0f, 0x30, 0x0d}, upstreamStatus, []byte{0x05, 0x00},
+			),
+			want: concat(
+				[]byte{0x30, 0x29},
+				[]byte{0x02, 0x01, 0x01},
+				[]byte{0x04, 0x06, 'p', 'u', 'b', 'l', 'i', 'c'},
+				[]byte{0xa2, 0x1c}, // GetResponse.
+				[]byte{0x02, 0x02, 0x12, 0x34},
+				[]byte{0x02, 0x01, 0x00, 0x02, 0x01, 0x00},
+				[]byte{0x30, 0x10, 0x30, 0x0e}, upstreamStatus, []byte{0x02, 0x01, 0x01}, // Upstream ok.
+			),
+		},
+		{
+			name: "v2c get of an unknown object",
+			request: concat(
+				[]byte{0x30, 0x21},
+				[]byte{0x02, 0x01, 0x01},
+				[]byte{0x04, 0x06, 'p', 'u', 'b', 'l', 'i', 'c'},
+				[]byte{0xa0, 0x14},
+				[]byte{0x02, 0x01, 0x07},
+				[]byte{0x02, 0x01, 0x00, 0x02, 0x01, 0x00},
+				[]byte{0x30, 0x09, 0x30, 0x07, 0x06, 0x03, 0x2b, 0x06, 0x02, 0x05, 0x00}, // 1.3.6.2.
+			),
+			want: concat(
+				[]byte{0x30, 0x21},
+				[]byte{0x02, 0x01, 0x01},
+				[]byte{0x04, 0x06, 'p', 'u', 'b', 'l', 'i', 'c'},
+				[]byte{0xa2, 0x14},
+				[]byte{0x02, 0x01, 0x07},
+				[]byte{0x02, 0x01, 0x00, 0x02, 0x01, 0x00},
+				[]byte{0x30, 0x09, 0x30, 0x07, 0x06, 0x03, 0x2b, 0x06, 0x02, 0x80, 0x00}, // noSuchObject.
+			),
+		},
+		{
+			name: "v1 get of an unknown object",
+			request: concat(
+				[]byte{0x30, 0x21},
+				[]byte{0x02, 0x01, 0x00}, // Version 1.
+				[]byte{0x04, 0x06, 'p', 'u', 'b', 'l', 'i', 'c'},
+				[]byte{0xa0, 0x14},
+				[]byte{0x02, 0x01, 0x07},
+				[]byte{0x02, 0x01, 0x00, 0x02, 0x01, 0x00},
+				[]byte{0x30, 0x09, 0x30, 0x07, 0x06, 0x03, 0x2b, 0x06, 0x02, 0x05, 0x00},
+			),
+			want: concat(
+				[]byte{0x30, 0x21},
+				[]byte{0x02, 0x01, 0x00},
+				[]byte{0x04, 0x06, 'p', 'u', 'b', 'l', 'i', 'c'},
+				[]byte{0xa2, 0x14},
+				[]byte{0x02, 0x01, 0x07},
+				[]byte{0x02, 0x01, 0x02, 0x02, 0x01, 0x01}, // noSuchName, for the first binding.
+				[]byte{0x30, 0x09, 0x30, 0x07, 0x06, 0x03, 0x2b, 0x06, 0x02, 0x05, 0x00},
+			),
+		},
+		{
+			name: "v2c getnext past the last object",
+			request: concat(
+				[]byte{0x30, 0x21},
+				[]byte{0x02, 0x01, 0x01},
+				[]byte{0x04, 0x06, 'p', 'u', 'b', 'l', 'i', 'c'},
+				[]byte{0xa1, 0x14}, // GetNextRequest.
+				[]byte{0x02, 0x01, 0x07},
+				[]byte{0x02, 0x01, 0x00, 0x02, 0x01, 0x00},
+				[]byte{0x30, 0x09, 0x30, 0x07, 0x06, 0x03, 0x2b, 0x07, 0x00, 0x05, 0x00}, // 1.3.7.0.
+			),
+			want: concat(
+				[]byte{0x30, 0x21},
+				[]byte{0x02, 0x01, 0x01},
+				[]byte{0x04, 0x06, 'p', 'u', 'b', 'l', 'i', 'c'},
+				[]byte{0xa2, 0x14},
+				[]byte{0x02, 0x01, 0x07},
+				[]byte{0x02, 0x01, 0x00, 0x02, 0x01, 0x00},
+				[]byte{0x30, 0x09, 0x30, 0x07, 0x06, 0x03, 0x2b, 0x07, 0x00, 0x82, 0x00}, // endOfMibView.
+			),
+		},
+		{
+			name: "v2c set",
+			request: concat(
+				[]byte{0x30, 0x28},
+				[]byte{0x02, 0x01, 0x01},
+				[]byte{0x04, 0x06, 'p', 'u', 'b', 'l', 'i', 'c'},
+				[]byte{0xa3, 0x1b}, // SetRequest.
+				[]byte{0x02, 0x02, 0x12, 0x34},
+				[]byte{0x02, 0x01, 0x00, 0x02, 0x01, 0x00},
+				[]byte{0x30, 0x0f, 0x30, 0x0d}, upstreamStatus, []byte{0x05, 0x00},
+			),
+			want: concat(
+				[]byte{0x30, 0x28},
+				[]byte{0x02, 0x01, 0x01},
+				[]byte{0x04, 0x06, 'p', 'u', 'b', 'l', 'i', 'c'},
+				[]byte{0xa2, 0x1b},
+				[]byte{0x02, 0x02, 0x12, 0x34},
+				[]byte{0x02, 0x01, 0x06, 0x02, 0x01, 0x01}, // noAccess, for the first binding.
+				[]byte{0x30, 0x0f, 0x30, 0x0d}, upstreamStatus, []byte{0x05, 0x00},
+			),
+		},
+		{
+			name: "wrong community",
+			request: concat(
+				[]byte{0x30, 0x29},
+				[]byte{0x02, 0x01, 0x01},
+				[]byte{0x04, 0x07, 'p', 'r', 'i', 'v', 'a', 't', 'e'},
+				[]byte{0xa0, 0x1b},
+				[]byte{0x02, 0x02, 0x12, 0x34},
+				[]byte{0x02, 0x01, 0x00, 0x02, 0x01, 0x00},
+				[]byte{0x30, 0x0f, 0x30, 0x0d}, upstreamStatus, []byte{0x05, 0x00},
+			),
+			wantErr: true,
+		},
+		{
+			name:    "v3",
+			request: []byte{0x30, 0x03, 0x02, 0x01, 0x03},
+			wantErr: true,
+		},
+		{
+			name:    "truncated",
+			request: []byte{0x30, 0x28, 0x02, 0x01, 0x01},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := a.handle(tt.request)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("got response\n% x\nwant\n% x", got, tt.want)
+			}
+		})
+	}
+}
+
+// concat joins byte slices.
+func concat(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
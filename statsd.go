@@ -0,0 +1,179 @@
+// Copyright 2023 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// StatsDPacketSize is the largest UDP datagram payload we send, small enough
+	// to avoid fragmentation on an ordinary Ethernet network.
+	StatsDPacketSize = 1432
+
+	// StatsDFlushInterval is how often metrics are sent to StatsD.
+	StatsDFlushInterval = time.Second
+
+	// StatsDQueueSize is how many metrics wait to be sent before new ones are dropped.
+	StatsDQueueSize = 4096
+
+	// DefaultStatsDPrefix starts the name of every metric sent to StatsD.
+	DefaultStatsDPrefix = "almarfidintercept"
+)
+
+// StatsD sends the request, latency, and error metrics to a StatsD server over
+// UDP, for sites which don't run Prometheus. Each request and upstream call is
+// sent as it happens, batched into packets, with the requests in flight sent
+// as a gauge each interval. With DogStatsD, the status and operation are sent
+// as tags, and otherwise they are part of the metric name.
+type StatsD struct {
+	Address   string
+	Prefix    string
+	DogStatsD bool
+	Metrics   *Metrics // For the requests in flight.
+
+	conn    net.Conn
+	queue   chan string
+	dropped atomic.Int64
+}
+
+// NewStatsD returns a StatsD sending to address, like localhost:8125.
+func NewStatsD(address, prefix string, dogStatsD bool) (*StatsD, error) {
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return nil, fmt.Errorf("unable to use StatsD address %v: %w", address, err)
+	}
+	return &StatsD{
+		Address:   address,
+		Prefix:    strings.TrimSuffix(prefix, "."),
+		DogStatsD: dogStatsD,
+		conn:      conn,
+		queue:     make(chan string, StatsDQueueSize),
+	}, nil
+}
+
+// Request sends a count of one request served, with its status.
+func (s *StatsD) Request(status int) {
+	if s == nil {
+		return
+	}
+	class := fmt.Sprintf("%dxx", status/100)
+	if s.DogStatsD {
+		s.send(fmt.Sprintf("requests:1|c|#status:%d,status_class:%v", status, class))
+		return
+	}
+	s.send("requests." + class + ":1|c")
+}
+
+// Upstream sends a count of one upstream call for an operation, and how long it took.
+func (s *StatsD) Upstream(operation string, latency time.Duration, failed bool) {
+	if s == nil {
+		return
+	}
+	ms := formatFloat(float64(latency.Microseconds()) / 1000)
+	if s.DogStatsD {
+		tags := "|#operation:" + statsDName(operation)
+		s.send("upstream.requests:1|c" + tags)
+		s.send("upstream.latency:" + ms + "|ms" + tags)
+		if failed {
+			s.send("upstream.errors:1|c" + tags)
+		}
+		return
+	}
+	operation = statsDName(operation)
+	s.send("upstream.requests." + operation + ":1|c")
+	s.send("upstream.latency." + operation + ":" + ms + "|ms")
+	if failed {
+		s.send("upstream.errors." + operation + ":1|c")
+	}
+}
+
+// send queues a metric line, without the prefix. If too many are waiting, it is dropped.
+func (s *StatsD) send(line string) {
+	if s.Prefix != "" {
+		line = s.Prefix + "." + line
+	}
+	select {
+	case s.queue <- line:
+	default:
+		s.dropped.Add(1)
+	}
+}
+
+// Run sends the queued metrics in packets each interval, until the context is cancelled.
+func (s *StatsD) Run(ctx context.Context) {
+	defer s.conn.Close()
+	ticker := time.NewTicker(StatsDFlushInterval)
+	defer ticker.Stop()
+	failing := false
+	for {
+		select {
+		case <-ctx.Done():
+			s.flush()
+			return
+		case <-ticker.C:
+			if s.Metrics != nil {
+				s.send(fmt.Sprintf("requests.in_flight:%d|g", s.Metrics.inFlight.Load()))
+			}
+			if dropped := s.dropped.Swap(0); dropped > 0 {
+				slog.Warn("Dropped StatsD metrics, too many were waiting to be sent.", "metrics", dropped)
+			}
+			err := s.flush()
+			switch {
+			case err != nil && !failing:
+				slog.Warn("Unable to send metrics to StatsD.", "address", s.Address, "error", err)
+			case err == nil && failing:
+				slog.Info("Sending metrics to StatsD again.", "address", s.Address)
+			}
+			failing = err != nil
+		}
+	}
+}
+
+// flush sends the queued metrics, as many to a packet as fit.
+func (s *StatsD) flush() error {
+	var packet strings.Builder
+	var err error
+	write := func() {
+		if packet.Len() == 0 {
+			return
+		}
+		if _, writeErr := s.conn.Write([]byte(packet.String())); writeErr != nil {
+			err = writeErr
+		}
+		packet.Reset()
+	}
+	for {
+		select {
+		case line := <-s.queue:
+			if packet.Len() > 0 && packet.Len()+1+len(line) > StatsDPacketSize {
+				write()
+			}
+			if packet.Len() > 0 {
+				packet.WriteByte('\n')
+			}
+			packet.WriteString(line)
+		default:
+			write()
+			return err
+		}
+	}
+}
+
+// statsDName replaces the characters which aren't safe in a metric name or tag.
+func statsDName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == '-' {
+			return r
+		}
+		return '_'
+	}, name)
+}
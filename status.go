@@ -0,0 +1,102 @@
+// Copyright 2023 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"html/template"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// statusPage shows staff how the proxy is doing, with a banner when an alert
+// is raised, and another when requests are proxied to a sandbox.
+const statusPage = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="30">
+<title>RFID intercept status</title>
+<style>
+body { font-family: sans-serif; max-width: 40em; margin: 2em auto; padding: 0 1em; }
+.alert { border: 2px solid #c00; border-radius: 6px; padding: 0.5em 1.5em; color: #c00; }
+.ok { border: 2px solid #080; border-radius: 6px; padding: 0.5em 1.5em; color: #080; }
+.sandbox { border: 2px solid #b05c00; border-radius: 6px; padding: 0.5em 1.5em; background: #fff3e0; color: #b05c00; }
+table { border-collapse: collapse; }
+th, td { text-align: left; padding: 0.2em 1em 0.2em 0; }
+.details { color: #555; font-size: 0.9em; }
+</style>
+</head>
+<body>
+<h1>RFID intercept status</h1>
+{{if eq .Environment "sandbox"}}<div class="sandbox"><p><strong>Sandbox:</strong> requests are proxied to a sandbox reader service, not the one used for real circulation.</p></div>
+{{else}}{{with .SandboxOrigins}}<div class="sandbox"><p><strong>Sandbox:</strong> requests from {{range $i, $origin := .}}{{if $i}}, {{end}}{{$origin}}{{end}} are proxied to a sandbox reader service.</p></div>
+{{end}}{{end}}{{if .Alert}}<div class="alert"><p><strong>Alert:</strong> {{.Alert}}</p>
+<p>Since {{.AlertSince.Format "2006-01-02 15:04:05"}}.</p></div>
+{{else}}<div class="ok"><p>No alerts.</p></div>
+{{end}}
+<h2>Requests</h2>
+<table>
+<tr><th>Uptime</th><td>{{.Metrics.Uptime}}</td></tr>
+<tr><th>Requests</th><td>{{.Metrics.Requests}}</td></tr>
+{{range $class, $count := .Metrics.Responses}}<tr><th>{{$class}} responses</th><td>{{$count}}</td></tr>
+{{end}}<tr><th>Preflights</th><td>{{.Metrics.Preflights}}</td></tr>
+</table>
+{{with .Metrics.Objectives}}<h2>Latency objectives</h2>
+<table>
+<tr><th>Operation</th><th>Objective</th><th>Observed</th><th>Requests</th><th></th></tr>
+{{range .}}<tr><td>{{.Operation}}</td><td>{{.Objective}}</td><td>{{.Observed}}</td><td>{{.Requests}}</td>
+<td>{{if .Met}}<span style="color: #080">Met</span>{{else}}<strong style="color: #c00">Missed</strong>{{end}}</td></tr>
+{{end}}</table>
+{{end}}<p class="details">Computer: {{.Station}}<br>
+Version: {{.Version}}<br>
+Time: {{.Time.Format "2006-01-02 15:04:05"}}</p>
+</body>
+</html>
+`
+
+// StatusPage serves a page summarizing the proxy's metrics and alerts.
+type StatusPage struct {
+	Metrics *Metrics
+	Alarm   *UpstreamAlarm
+	Station string
+
+	// Environments says whether requests are proxied to a sandbox. It may
+	// be nil, for production.
+	Environments Environments
+
+	page *template.Template
+}
+
+// NewStatusPage returns a StatusPage for the given metrics and alarm.
+func NewStatusPage(metrics *Metrics, alarm *UpstreamAlarm, station string) *StatusPage {
+	return &StatusPage{
+		Metrics: metrics,
+		Alarm:   alarm,
+		Station: station,
+		page:    template.Must(template.New("status").Parse(statusPage)),
+	}
+}
+
+// ServeHTTP renders the status page.
+func (s *StatusPage) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	alert, since := s.Alarm.Alert()
+	environment, sandboxOrigins := environmentsOf(s.Environments)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	err := s.page.Execute(w, map[string]any{
+		"Alert":          alert,
+		"AlertSince":     since,
+		"Environment":    environment,
+		"SandboxOrigins": sandboxOrigins,
+		"Metrics":        s.Metrics.Snapshot(),
+		"Station":        s.Station,
+		"Version":        version,
+		"Time":           time.Now(),
+	})
+	if err != nil {
+		slog.Error("Unable to render status page.", "error", err)
+	}
+}
@@ -0,0 +1,205 @@
+// Copyright 2023 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// DefaultReaderRestartDelay is how long the supervisor waits before
+	// restarting the RFID software after it exits.
+	DefaultReaderRestartDelay = 5 * time.Second
+
+	// readerMaxRestartDelay is the longest the supervisor waits before
+	// restarting the RFID software, when it keeps exiting.
+	readerMaxRestartDelay = 5 * time.Minute
+
+	// readerStableAfter is how long the RFID software must run before the
+	// restart delay goes back to the shortest.
+	readerStableAfter = time.Minute
+
+	// readerStopTimeout is how long the RFID software has to exit when the
+	// proxy stops, before it is killed.
+	readerStopTimeout = 10 * time.Second
+)
+
+var (
+	// ErrNoCommand is returned when a command is empty.
+	ErrNoCommand = errors.New("the command is empty")
+
+	// ErrUnclosedQuote is returned when a command has an unclosed quote.
+	ErrUnclosedQuote = errors.New("the command has an unclosed quote")
+)
+
+// Supervisor runs the vendor's RFID software as a child process, and
+// restarts it if it exits, so one service keeps the workstation's whole
+// RFID stack running. When it keeps exiting, the wait before restarting it
+// doubles, up to five minutes. Its output is logged. It is stopped when the
+// proxy stops.
+type Supervisor struct {
+	Command []string
+	Delay   time.Duration
+
+	mu      sync.Mutex
+	process *os.Process // The running RFID software, or nil.
+}
+
+// NewSupervisor returns a Supervisor running command, a program and its
+// arguments, which are quoted with double quotes if they have spaces.
+func NewSupervisor(command string, delay time.Duration) (*Supervisor, error) {
+	args, err := SplitCommand(command)
+	if err != nil {
+		return nil, err
+	}
+	return &Supervisor{Command: args, Delay: delay}, nil
+}
+
+// Run starts the RFID software, and restarts it whenever it exits, until ctx
+// is cancelled.
+func (s *Supervisor) Run(ctx context.Context) {
+	delay := s.Delay
+	for {
+		started := time.Now()
+		err := s.run(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if time.Since(started) > readerStableAfter {
+			delay = s.Delay
+		}
+		slog.Warn("The RFID software exited, restarting it.", "command", s.Command[0], "error", err, "delay", delay)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		delay = min(2*delay, readerMaxRestartDelay)
+	}
+}
+
+// Restart kills the RFID software, which Run then starts again.
+func (s *Supervisor) Restart() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.process != nil {
+		slog.Warn("Restarting the RFID software.", "command", s.Command[0])
+		s.process.Kill()
+	}
+}
+
+// run runs the RFID software until it exits, or ctx is cancelled.
+func (s *Supervisor) run(ctx context.Context) error {
+	cmd := exec.Command(s.Command[0], s.Command[1:]...)
+	// Programs the RFID software starts may keep its output open after
+	// it exits, so only wait a little for them.
+	output, writer := io.Pipe()
+	defer writer.Close()
+	cmd.Stdout = writer
+	cmd.Stderr = writer
+	cmd.WaitDelay = time.Second
+	go logOutput(output)
+	err := cmd.Start()
+	if err != nil {
+		return fmt.Errorf("unable to start the RFID software: %w", err)
+	}
+	slog.Info("Started the RFID software.", "command", s.Command[0], "pid", cmd.Process.Pid)
+	s.mu.Lock()
+	s.process = cmd.Process
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.process = nil
+		s.mu.Unlock()
+	}()
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	select {
+	case err := <-exited:
+		return err
+	case <-ctx.Done():
+	}
+	// Ask the RFID software to exit, and kill it if it doesn't. Windows
+	// has no signal to ask with.
+	if runtime.GOOS == "windows" {
+		cmd.Process.Kill()
+	} else {
+		cmd.Process.Signal(syscall.SIGTERM)
+	}
+	select {
+	case <-exited:
+	case <-time.After(readerStopTimeout):
+		cmd.Process.Kill()
+		<-exited
+	}
+	slog.Info("Stopped the RFID software.", "command", s.Command[0])
+	return nil
+}
+
+// logOutput logs each line of the RFID software's output.
+func logOutput(output io.Reader) {
+	scanner := bufio.NewScanner(output)
+	for scanner.Scan() {
+		slog.Info("RFID software output.", "line", scanner.Text())
+	}
+}
+
+// SplitCommand splits a command into the program and its arguments, at
+// spaces outside double quotes. Backslashes aren't special, so Windows
+// paths can be written as they are, like
+// "C:\Program Files\Vendor\service.exe" -port 21645.
+func SplitCommand(command string) ([]string, error) {
+	var args []string
+	var arg strings.Builder
+	inArg, quoted := false, false
+	for _, r := range command {
+		switch {
+		case r == '"':
+			quoted = !quoted
+			inArg = true
+		case !quoted && (r == ' ' || r == '\t'):
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		default:
+			arg.WriteRune(r)
+			inArg = true
+		}
+	}
+	if quoted {
+		return nil, ErrUnclosedQuote
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
+	if len(args) == 0 {
+		return nil, ErrNoCommand
+	}
+	return args, nil
+}
+
+// checkCommand checks the program in a command can be found.
+func checkCommand(command string) error {
+	args, err := SplitCommand(command)
+	if err != nil {
+		return err
+	}
+	_, err = exec.LookPath(args[0])
+	return err
+}
@@ -0,0 +1,136 @@
+// Copyright 2023 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultSyslogFacility is the facility logs are sent to syslog with.
+const DefaultSyslogFacility = "daemon"
+
+// syslogTime is the RFC 5424 timestamp layout, with microseconds.
+const syslogTime = "2006-01-02T15:04:05.000000Z07:00"
+
+// ErrBadSyslogAddress is returned when a syslog address isn't udp://, tcp://, or tls:// with a host and port.
+var ErrBadSyslogAddress = errors.New("syslog address must look like udp://host:514, tcp://host:514, or tls://host:6514")
+
+// ErrBadSyslogFacility is returned when a syslog facility isn't one of the standard names.
+var ErrBadSyslogFacility = errors.New("syslog facility must be kern, user, mail, daemon, auth, syslog, lpr, news, uucp, cron, authpriv, ftp, or local0 to local7")
+
+// SyslogHandler is a slog.Handler which sends records to a syslog collector,
+// like rsyslog, as RFC 5424 messages over UDP, TCP, or TCP with TLS. Over TCP,
+// messages are framed with their length, as in RFC 6587. The message is the
+// same as in the plain log format, without the timestamp, since syslog has its
+// own. Like the GELFHandler, messages are sent in the background, and fatal
+// messages are sent before returning.
+type SyslogHandler struct {
+	text     *LogHandler
+	sender   *logSender
+	facility int
+	host     string
+	pid      string
+}
+
+// NewSyslogHandler returns a SyslogHandler sending to an address like
+// udp://rsyslog:514 with facility, like daemon or local0. If caFile is set,
+// the certificates in it are trusted for tls:// addresses instead of the
+// system's. With fips, TLS is restricted to FIPS 140 approved algorithms.
+func NewSyslogHandler(address, facility, caFile string, fips bool, level slog.Leveler) (*SyslogHandler, error) {
+	code, err := syslogFacility(facility)
+	if err != nil {
+		return nil, err
+	}
+	u, err := url.Parse(address)
+	if err != nil || u.Host == "" || u.Port() == "" || (u.Scheme != "udp" && u.Scheme != "tcp" && u.Scheme != "tls") {
+		return nil, fmt.Errorf("%w, not %q", ErrBadSyslogAddress, address)
+	}
+	sender, err := newLogSender("syslog", u, caFile, fips)
+	if err != nil {
+		return nil, err
+	}
+	sender.frame = func(message []byte) []byte {
+		return append(strconv.AppendInt(nil, int64(len(message)), 10), append([]byte{' '}, message...)...)
+	}
+	go sender.run()
+	return &SyslogHandler{
+		text:     NewLogHandler(nil, LogOptions{Level: level, Format: LogFormatPlain}),
+		sender:   sender,
+		facility: code,
+		host:     hostname(),
+		pid:      strconv.Itoa(os.Getpid()),
+	}, nil
+}
+
+// Enabled reports whether messages at level are sent.
+func (h *SyslogHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.text.Enabled(ctx, level)
+}
+
+// Handle queues a record to be sent.
+func (h *SyslogHandler) Handle(_ context.Context, r slog.Record) error {
+	timestamp := "-"
+	if !r.Time.IsZero() {
+		timestamp = r.Time.Format(syslogTime)
+	}
+	priority := h.facility*8 + gelfLevel(r.Level)
+	r.Time = time.Time{}
+	text := strings.TrimSuffix(string(h.text.format(r)), "\n")
+	message := []byte(fmt.Sprintf("<%d>1 %v %v almarfidintercept %v - - %v", priority, timestamp, h.host, h.pid, text))
+	if r.Level >= LevelFatal {
+		return h.sender.send(message)
+	}
+	h.sender.enqueue(message)
+	return nil
+}
+
+// WithAttrs returns a handler which adds attrs to every message.
+func (h *SyslogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	h2 := *h
+	h2.text = h.text.WithAttrs(attrs).(*LogHandler)
+	return &h2
+}
+
+// WithGroup returns a handler which prefixes attribute keys with the group name.
+func (h *SyslogHandler) WithGroup(name string) slog.Handler {
+	h2 := *h
+	h2.text = h.text.WithGroup(name).(*LogHandler)
+	return &h2
+}
+
+// Close sends the queued messages, waiting up to LogSendTimeout, then closes the connection.
+func (h *SyslogHandler) Close() {
+	if h == nil {
+		return
+	}
+	h.sender.close()
+}
+
+// syslogFacility returns the code of a syslog facility.
+func syslogFacility(name string) (int, error) {
+	facilities := []string{
+		"kern", "user", "mail", "daemon", "auth", "syslog", "lpr", "news",
+		"uucp", "cron", "authpriv", "ftp",
+	}
+	for code, facility := range facilities {
+		if name == facility {
+			return code, nil
+		}
+	}
+	if local, ok := strings.CutPrefix(name, "local"); ok {
+		if n, err := strconv.Atoi(local); err == nil && n >= 0 && n <= 7 && len(local) == 1 {
+			return 16 + n, nil
+		}
+	}
+	return 0, fmt.Errorf("%w, not %q", ErrBadSyslogFacility, name)
+}
@@ -0,0 +1,133 @@
+// Copyright 2023 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSyslogFacility(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    int
+		wantErr bool
+	}{
+		{"kern", 0, false},
+		{"user", 1, false},
+		{"daemon", 3, false},
+		{"authpriv", 10, false},
+		{"ftp", 11, false},
+		{"local0", 16, false},
+		{"local7", 23, false},
+		{"local8", 0, true},
+		{"local07", 0, true},
+		{"local", 0, true},
+		{"Daemon", 0, true},
+		{"", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := syslogFacility(tt.name)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("syslogFacility(%q) = %v, %v, want %v, error %v", tt.name, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestSyslogHandler(t *testing.T) {
+	when := time.Date(2023, 9, 1, 12, 30, 0, 500_000_000, time.UTC)
+	tests := []struct {
+		name     string
+		network  string
+		facility string
+		level    slog.Level
+		time     time.Time
+		// The parts of the message before the host, and the text after the structured data.
+		priority  string
+		timestamp string
+		text      string
+	}{
+		{"tcp", "tcp", "daemon", slog.LevelWarn, when, "<28>1", "2023-09-01T12:30:00.500000Z", "WARNING: Reader service slow. operation=getItems"},
+		{"udp", "udp", "daemon", slog.LevelInfo, when, "<30>1", "2023-09-01T12:30:00.500000Z", "Reader service slow. operation=getItems"},
+		{"local facility", "udp", "local0", slog.LevelError, when, "<131>1", "2023-09-01T12:30:00.500000Z", "ERROR: Reader service slow. operation=getItems"},
+		{"no time", "udp", "daemon", slog.LevelDebug, time.Time{}, "<31>1", "-", "DEBUG: Reader service slow. operation=getItems"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var address string
+			var read func() string
+			if tt.network == "udp" {
+				conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer conn.Close()
+				address = conn.LocalAddr().String()
+				read = func() string {
+					conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+					buf := make([]byte, 2048)
+					n, _, err := conn.ReadFrom(buf)
+					if err != nil {
+						t.Fatal(err)
+					}
+					return string(buf[:n])
+				}
+			} else {
+				listener, err := net.Listen("tcp", "127.0.0.1:0")
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer listener.Close()
+				address = listener.Addr().String()
+				read = func() string {
+					conn, err := listener.Accept()
+					if err != nil {
+						t.Fatal(err)
+					}
+					defer conn.Close()
+					conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+					// Over TCP, each message is framed with its length and a space.
+					reader := bufio.NewReader(conn)
+					length, err := reader.ReadString(' ')
+					if err != nil {
+						t.Fatal(err)
+					}
+					n, err := strconv.Atoi(length[:len(length)-1])
+					if err != nil {
+						t.Fatalf("bad frame length %q", length)
+					}
+					message := make([]byte, n)
+					_, err = io.ReadFull(reader, message)
+					if err != nil {
+						t.Fatal(err)
+					}
+					return string(message)
+				}
+			}
+			h, err := NewSyslogHandler(tt.network+"://"+address, tt.facility, "", false, slog.LevelDebug)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer h.Close()
+			r := slog.NewRecord(tt.time, tt.level, "Reader service slow.", 0)
+			r.AddAttrs(slog.String("operation", "getItems"))
+			err = h.Handle(context.Background(), r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := fmt.Sprintf("%v %v %v almarfidintercept %v - - %v", tt.priority, tt.timestamp, h.host, h.pid, tt.text)
+			if got := read(); got != want {
+				t.Errorf("got  %q\nwant %q", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,167 @@
+// Copyright 2023 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+)
+
+// CertReloadInterval is how often the certificate and key files are checked for changes.
+const CertReloadInterval = time.Minute
+
+// ErrNoClientCAs is returned when the client CA file has no certificates in it.
+var ErrNoClientCAs = errors.New("no CA certificates found")
+
+// ErrCertExpired is returned when the TLS certificate being served has expired.
+var ErrCertExpired = errors.New("the TLS certificate has expired")
+
+// ErrIncompleteTLS is returned when only one of the certificate and key files is set.
+var ErrIncompleteTLS = errors.New("both a TLS certificate and key are needed to serve HTTPS")
+
+// NewServerTLSConfig returns the TLS configuration for serving HTTPS with the
+// certificate kept by the reloader.
+// With fips, TLS is restricted to FIPS 140 approved algorithms.
+func NewServerTLSConfig(reloader *CertReloader, fips bool) *tls.Config {
+	config := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.GetCertificate,
+		NextProtos:     []string{"h2", "http/1.1"},
+	}
+	if fips {
+		config = FIPSTLSConfig(config)
+	}
+	return config
+}
+
+// CertReloader keeps a certificate loaded from PEM files. The files are checked
+// for changes every CertReloadInterval, so a renewed certificate is used without
+// a restart, and Reload switches to other files when the configuration is reloaded.
+type CertReloader struct {
+	mu       sync.Mutex
+	certFile string
+	keyFile  string
+	cert     *tls.Certificate
+	modTime  time.Time
+	checked  time.Time
+}
+
+// NewCertReloader returns a CertReloader with the certificate and key loaded.
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	c := &CertReloader{}
+	err := c.Reload(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Reload loads the certificate and key from the files. If they can't be
+// loaded, the certificate already loaded is kept.
+func (c *CertReloader) Reload(certFile, keyFile string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	modTime, err := latestModTime(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return fmt.Errorf("unable to load TLS certificate: %w", err)
+	}
+	c.certFile = certFile
+	c.keyFile = keyFile
+	c.cert = &cert
+	c.modTime = modTime
+	c.checked = time.Now()
+	return nil
+}
+
+// Check returns an error if the certificate has expired, since browsers won't connect.
+func (c *CertReloader) Check() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	leaf, err := x509.ParseCertificate(c.cert.Certificate[0])
+	if err != nil {
+		return fmt.Errorf("unable to parse TLS certificate: %w", err)
+	}
+	if time.Now().After(leaf.NotAfter) {
+		return fmt.Errorf("%w, on %v", ErrCertExpired, leaf.NotAfter.Format(time.DateOnly))
+	}
+	return nil
+}
+
+// GetCertificate returns the certificate, first reloading it if the files changed.
+// If reloading fails, the certificate already loaded is used.
+func (c *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if time.Since(c.checked) >= CertReloadInterval {
+		c.checked = time.Now()
+		if modTime, err := latestModTime(c.certFile, c.keyFile); err == nil && !modTime.Equal(c.modTime) {
+			cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+			if err != nil {
+				slog.Error("Unable to reload TLS certificate, still using the old one.", "cert", c.certFile, "error", err)
+			} else {
+				c.cert = &cert
+				c.modTime = modTime
+				slog.Info("Reloaded TLS certificate.", "cert", c.certFile)
+			}
+		}
+	}
+	return c.cert, nil
+}
+
+// latestModTime returns the later of the certificate and key files' modification times.
+func latestModTime(certFile, keyFile string) (time.Time, error) {
+	var latest time.Time
+	for _, name := range []string{certFile, keyFile} {
+		info, err := os.Stat(name)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("unable to read TLS certificate: %w", err)
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// RequireClientCerts changes a server TLS configuration so callers must present
+// a certificate signed by one of the CAs in the PEM file, or the handshake fails
+// and nothing is proxied. ACME TLS-ALPN challenges are still answered, since the
+// certificate authority has no client certificate.
+func RequireClientCerts(config *tls.Config, caFile string) error {
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return fmt.Errorf("unable to read client CA file: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return fmt.Errorf("%w in %v", ErrNoClientCAs, caFile)
+	}
+	config.ClientCAs = pool
+	config.ClientAuth = tls.RequireAndVerifyClientCert
+	challenge := config.Clone()
+	challenge.ClientAuth = tls.NoClientCert
+	challenge.ClientCAs = nil
+	config.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		for _, proto := range hello.SupportedProtos {
+			if proto == acme.ALPNProto {
+				return challenge, nil
+			}
+		}
+		return nil, nil
+	}
+	return nil
+}
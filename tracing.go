@@ -0,0 +1,345 @@
+// Copyright 2023 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// TraceparentHeader carries the trace context between services, as in W3C Trace Context.
+	TraceparentHeader = "Traceparent"
+
+	// TraceExportInterval is how often finished spans are sent to the collector.
+	TraceExportInterval = 5 * time.Second
+
+	// TraceBatchSize is the most spans sent to the collector at once.
+	TraceBatchSize = 512
+
+	// TraceQueueSize is the most finished spans waiting to be sent. More are dropped.
+	TraceQueueSize = 2048
+
+	// TraceExportTimeout is how long the collector has to accept a batch of spans.
+	TraceExportTimeout = 10 * time.Second
+)
+
+// The kinds of span, as numbered by OTLP.
+const (
+	SpanKindServer = 2
+	SpanKindClient = 3
+)
+
+// The span status codes, as numbered by OTLP.
+const (
+	SpanStatusUnset = 0
+	SpanStatusError = 2
+)
+
+// Tracer records a span for each proxied request, and a child span for each
+// call to the reader service, and sends them to an OpenTelemetry collector with
+// OTLP over HTTP, encoded as JSON. The trace context in an incoming traceparent
+// header is continued, and passed on to the reader service, so slow operations
+// in Alma can be matched with the reader service's latency.
+type Tracer struct {
+	Endpoint    *url.URL // Like http://collector:4318/v1/traces.
+	ServiceName string
+	Station     string
+
+	client  *http.Client
+	queue   chan *Span
+	dropped atomic.Int64
+}
+
+// Span is one timed operation in a trace.
+type Span struct {
+	TraceID    [16]byte
+	SpanID     [8]byte
+	ParentID   [8]byte // Zero for the first span in a trace.
+	Sampled    bool
+	Name       string
+	Kind       int
+	Start      time.Time
+	End        time.Time
+	Attributes map[string]any
+	Status     int
+	Message    string
+}
+
+// spanKey is the context key of the current span.
+type spanKey struct{}
+
+// NewTracer returns a Tracer which sends spans to the OTLP HTTP endpoint. If
+// the endpoint has no path, the standard /v1/traces is used.
+func NewTracer(endpoint, serviceName, station string) (*Tracer, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse OTLP endpoint: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("OTLP endpoint %v: %w", endpoint, ErrNotHTTP)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/v1/traces"
+	}
+	return &Tracer{
+		Endpoint:    u,
+		ServiceName: serviceName,
+		Station:     station,
+		client:      &http.Client{Timeout: TraceExportTimeout},
+		queue:       make(chan *Span, TraceQueueSize),
+	}, nil
+}
+
+// Middleware wraps a handler, recording a server span for each request.
+func (t *Tracer) Middleware(next http.Handler) http.Handler {
+	if t == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		operation := operationName(r.Header.Get("SOAPAction"), r.URL.Path)
+		span := newSpan(parseTraceparent(r.Header.Get(TraceparentHeader)), r.Method+" "+operation, SpanKindServer)
+		span.Attributes["http.request.method"] = r.Method
+		span.Attributes["url.path"] = r.URL.Path
+		span.Attributes["client.address"] = r.RemoteAddr
+		span.Attributes["rfid.operation"] = operation
+		if origin := r.Header.Get("Origin"); origin != "" {
+			span.Attributes["http.request.header.origin"] = origin
+		}
+		recorder := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r.WithContext(context.WithValue(r.Context(), spanKey{}, span)))
+		span.Attributes["http.response.status_code"] = recorder.status
+		if recorder.status >= 500 {
+			span.Status = SpanStatusError
+		}
+		t.finish(span)
+	})
+}
+
+// Transport wraps a transport, recording a client span for each request made
+// while serving a traced request, and passing the trace context on with a
+// traceparent header. Other requests, like heartbeats, aren't traced.
+func (t *Tracer) Transport(next http.RoundTripper) http.RoundTripper {
+	if t == nil {
+		return next
+	}
+	return &tracingTransport{tracer: t, next: next}
+}
+
+// tracingTransport records a client span for each request.
+type tracingTransport struct {
+	tracer *Tracer
+	next   http.RoundTripper
+}
+
+// RoundTrip sends a request in a child span of the request being served.
+func (t *tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	next := t.next
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	parent, ok := req.Context().Value(spanKey{}).(*Span)
+	if !ok {
+		return next.RoundTrip(req)
+	}
+	operation := operationName(req.Header.Get("SOAPAction"), req.URL.Path)
+	span := newSpan(parent, "upstream "+operation, SpanKindClient)
+	span.Attributes["http.request.method"] = req.Method
+	span.Attributes["server.address"] = req.URL.Host
+	span.Attributes["url.full"] = req.URL.Redacted()
+	span.Attributes["rfid.operation"] = operation
+	req = req.Clone(req.Context())
+	req.Header.Set(TraceparentHeader, span.traceparent())
+	resp, err := next.RoundTrip(req)
+	if err != nil {
+		span.Status = SpanStatusError
+		span.Message = err.Error()
+	} else {
+		span.Attributes["http.response.status_code"] = resp.StatusCode
+		if resp.StatusCode >= 500 {
+			span.Status = SpanStatusError
+		}
+	}
+	t.tracer.finish(span)
+	return resp, err
+}
+
+// newSpan starts a span. It is a child of parent, if there is one, and the
+// first span of a new trace otherwise.
+func newSpan(parent *Span, name string, kind int) *Span {
+	span := &Span{
+		Sampled:    true,
+		Name:       name,
+		Kind:       kind,
+		Start:      time.Now(),
+		Attributes: map[string]any{},
+	}
+	if parent != nil {
+		span.TraceID = parent.TraceID
+		span.ParentID = parent.SpanID
+		span.Sampled = parent.Sampled
+	} else {
+		rand.Read(span.TraceID[:])
+	}
+	rand.Read(span.SpanID[:])
+	return span
+}
+
+// parseTraceparent returns the remote parent span in a traceparent header, or
+// nil if the header is missing or malformed.
+func parseTraceparent(header string) *Span {
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return nil
+	}
+	span := &Span{}
+	_, errTrace := hex.Decode(span.TraceID[:], []byte(parts[1]))
+	_, errSpan := hex.Decode(span.SpanID[:], []byte(parts[2]))
+	flags, errFlags := strconv.ParseUint(parts[3], 16, 8)
+	if errTrace != nil || errSpan != nil || errFlags != nil || span.TraceID == [16]byte{} || span.SpanID == [8]byte{} {
+		return nil
+	}
+	span.Sampled = flags&1 == 1
+	return span
+}
+
+// traceparent returns the traceparent header naming this span as the parent.
+func (s *Span) traceparent() string {
+	flags := "00"
+	if s.Sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%x-%x-%v", s.TraceID, s.SpanID, flags)
+}
+
+// finish ends a span, queueing it to be sent if it is sampled.
+// If the queue is full, the span is dropped.
+func (t *Tracer) finish(span *Span) {
+	span.End = time.Now()
+	if !span.Sampled {
+		return
+	}
+	select {
+	case t.queue <- span:
+	default:
+		t.dropped.Add(1)
+	}
+}
+
+// Run sends the finished spans to the collector in batches, until the context
+// is cancelled. Then the spans still waiting are sent.
+func (t *Tracer) Run(ctx context.Context) {
+	ticker := time.NewTicker(TraceExportInterval)
+	defer ticker.Stop()
+	var batch []*Span
+	failing := false
+	export := func() {
+		if dropped := t.dropped.Swap(0); dropped > 0 {
+			slog.Warn("Dropped spans, too many were waiting to be sent.", "spans", dropped)
+		}
+		if len(batch) == 0 {
+			return
+		}
+		err := t.export(batch)
+		switch {
+		case err != nil && !failing:
+			slog.Warn("Unable to send traces to the collector, dropping them.", "endpoint", t.Endpoint.Host, "spans", len(batch), "error", err)
+		case err == nil && failing:
+			slog.Info("Sending traces to the collector again.", "endpoint", t.Endpoint.Host)
+		}
+		failing = err != nil
+		batch = nil
+	}
+	for {
+		select {
+		case span := <-t.queue:
+			batch = append(batch, span)
+			if len(batch) >= TraceBatchSize {
+				export()
+			}
+		case <-ticker.C:
+			export()
+		case <-ctx.Done():
+			for {
+				select {
+				case span := <-t.queue:
+					batch = append(batch, span)
+				default:
+					export()
+					return
+				}
+			}
+		}
+	}
+}
+
+// export sends a batch of spans to the collector.
+func (t *Tracer) export(batch []*Span) error {
+	spans := make([]map[string]any, 0, len(batch))
+	for _, span := range batch {
+		spans = append(spans, span.otlp())
+	}
+	request := map[string]any{
+		"resourceSpans": []map[string]any{{
+			"resource": map[string]any{
+				"attributes": otlpAttributes(map[string]any{
+					"service.name":    t.ServiceName,
+					"service.version": version,
+					"host.name":       t.Station,
+				}),
+			},
+			"scopeSpans": []map[string]any{{
+				"scope": map[string]any{"name": "almarfidintercept", "version": version},
+				"spans": spans,
+			}},
+		}},
+	}
+	return postJSON(t.client, t.Endpoint.String(), "", request)
+}
+
+// otlp returns the span in the OTLP JSON encoding.
+func (s *Span) otlp() map[string]any {
+	span := map[string]any{
+		"traceId":           hex.EncodeToString(s.TraceID[:]),
+		"spanId":            hex.EncodeToString(s.SpanID[:]),
+		"name":              s.Name,
+		"kind":              s.Kind,
+		"startTimeUnixNano": strconv.FormatInt(s.Start.UnixNano(), 10),
+		"endTimeUnixNano":   strconv.FormatInt(s.End.UnixNano(), 10),
+		"attributes":        otlpAttributes(s.Attributes),
+		"status":            map[string]any{"code": s.Status, "message": s.Message},
+	}
+	if s.ParentID != [8]byte{} {
+		span["parentSpanId"] = hex.EncodeToString(s.ParentID[:])
+	}
+	return span
+}
+
+// otlpAttributes returns attributes in the OTLP JSON encoding.
+func otlpAttributes(attributes map[string]any) []map[string]any {
+	encoded := make([]map[string]any, 0, len(attributes))
+	for key, value := range attributes {
+		var v map[string]any
+		switch value := value.(type) {
+		case int:
+			v = map[string]any{"intValue": strconv.Itoa(value)}
+		case bool:
+			v = map[string]any{"boolValue": value}
+		default:
+			v = map[string]any{"stringValue": fmt.Sprint(value)}
+		}
+		encoded = append(encoded, map[string]any{"key": key, "value": v})
+	}
+	return encoded
+}
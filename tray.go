@@ -0,0 +1,234 @@
+// Copyright 2023 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"net/http"
+	"os/exec"
+	"runtime"
+	"sync"
+	"time"
+)
+
+const (
+	// TrayInterval is how often the tray icon checks the proxy.
+	TrayInterval = 5 * time.Second
+
+	// TraySlowLatency is how long the reader service can take to answer a
+	// health check before the tray icon turns yellow.
+	TraySlowLatency = time.Second
+
+	// trayIconSize is the width and height of the tray icon, in pixels.
+	trayIconSize = 32
+
+	// traySandboxRing is the width of the ring around the tray icon when
+	// requests are proxied to a sandbox, in pixels.
+	traySandboxRing = 6
+)
+
+// The colors of the tray icon.
+const (
+	TrayGreen  = "green"
+	TrayYellow = "yellow"
+	TrayRed    = "red"
+)
+
+// ErrTrayUnsupported is returned when the tray icon isn't supported on this platform.
+var ErrTrayUnsupported = errors.New("the tray icon is only supported on Windows")
+
+// TrayStatus is what the tray icon shows.
+type TrayStatus struct {
+	// Color is green when RFID works, yellow when it works but the reader
+	// service is slow, and red when it doesn't work.
+	Color   string
+	Summary string
+
+	// Sandbox is whether the proxy sends requests to a sandbox reader
+	// service, which isn't used for real circulation. The icon has a ring
+	// around it, and the summary says so.
+	Sandbox bool
+
+	// LastError is the last problem found, which is kept after it clears,
+	// so staff can tell IT what happened. It is empty if there hasn't been
+	// one.
+	LastError string
+}
+
+// TrayMonitor checks the proxy's /healthz for the tray icon.
+type TrayMonitor struct {
+	// URL is the proxy's address, like http://localhost:53535.
+	URL string
+
+	client *http.Client
+
+	mu        sync.Mutex
+	lastError string
+}
+
+// NewTrayMonitor returns a TrayMonitor checking the proxy at url.
+func NewTrayMonitor(url string) *TrayMonitor {
+	return &TrayMonitor{URL: url, client: &http.Client{Timeout: 2 * HealthCheckTimeout}}
+}
+
+// Check asks the proxy how it and the reader service are.
+func (m *TrayMonitor) Check(ctx context.Context) TrayStatus {
+	status := m.check(ctx)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if status.LastError != "" {
+		m.lastError = time.Now().Format("15:04") + " " + status.LastError
+	}
+	status.LastError = m.lastError
+	return status
+}
+
+// Record keeps a problem found outside the checks, like failing to restart
+// the proxy, as the last error.
+func (m *TrayMonitor) Record(problem string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.lastError = time.Now().Format("15:04") + " " + problem
+}
+
+// check asks the proxy how it and the reader service are, with only the
+// current problem in LastError.
+func (m *TrayMonitor) check(ctx context.Context) TrayStatus {
+	down := TrayStatus{Color: TrayRed, Summary: "RFID isn't working, the proxy isn't running."}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, m.URL+"/healthz", nil)
+	if err != nil {
+		down.LastError = err.Error()
+		return down
+	}
+	resp, err := m.client.Do(req)
+	if err != nil {
+		down.LastError = err.Error()
+		return down
+	}
+	defer resp.Body.Close()
+	var report HealthReport
+	err = json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&report)
+	if err != nil {
+		down.LastError = fmt.Sprintf("unable to read the proxy's health check: %v", err)
+		return down
+	}
+	status := upstreamStatus(report)
+	if report.Proxy.Environment == EnvironmentSandbox {
+		status.Sandbox = true
+		status.Summary = "Sandbox: " + status.Summary
+	}
+	return status
+}
+
+// upstreamStatus returns what the tray icon shows for the reader service in
+// a health check.
+func upstreamStatus(report HealthReport) TrayStatus {
+	latency := time.Duration(report.Upstream.LatencyMS) * time.Millisecond
+	switch {
+	case report.Upstream.Status != HealthOK:
+		return TrayStatus{
+			Color:     TrayRed,
+			Summary:   "RFID isn't working, the RFID software isn't answering.",
+			LastError: "the RFID software isn't answering: " + report.Upstream.Error,
+		}
+	case latency > TraySlowLatency:
+		return TrayStatus{
+			Color:     TrayYellow,
+			Summary:   "RFID is slow, the RFID software is slow to answer.",
+			LastError: fmt.Sprintf("the RFID software took %v to answer", latency),
+		}
+	}
+	return TrayStatus{Color: TrayGreen, Summary: "RFID is working."}
+}
+
+// TrayIcon returns a filled circle of a tray color, as an ICO on Windows,
+// and a PNG elsewhere. For a sandbox, the circle has a purple ring around it.
+func TrayIcon(shade string, sandbox bool) []byte {
+	fill := map[string]color.RGBA{
+		TrayGreen:  {0x1e, 0x9e, 0x3a, 0xff},
+		TrayYellow: {0xe8, 0xb0, 0x0c, 0xff},
+		TrayRed:    {0xd0, 0x1c, 0x1c, 0xff},
+	}[shade]
+	ring := color.RGBA{0x6a, 0x1b, 0x9a, 0xff}
+	img := image.NewRGBA(image.Rect(0, 0, trayIconSize, trayIconSize))
+	center := float64(trayIconSize-1) / 2
+	inner := center - traySandboxRing
+	for y := 0; y < trayIconSize; y++ {
+		for x := 0; x < trayIconSize; x++ {
+			dx, dy := float64(x)-center, float64(y)-center
+			switch distance := dx*dx + dy*dy; {
+			case distance > center*center:
+			case sandbox && distance > inner*inner:
+				img.SetRGBA(x, y, ring)
+			default:
+				img.SetRGBA(x, y, fill)
+			}
+		}
+	}
+	var icon bytes.Buffer
+	if runtime.GOOS == "windows" {
+		// An ICO file with one PNG image.
+		header := struct {
+			Reserved, Type, Count uint16
+			Width, Height, Colors uint8
+			Reserved2             uint8
+			Planes, BitsPerPixel  uint16
+			Size, Offset          uint32
+		}{Type: 1, Count: 1, Width: trayIconSize, Height: trayIconSize, Planes: 1, BitsPerPixel: 32, Offset: 22}
+		var encoded bytes.Buffer
+		_ = png.Encode(&encoded, img)
+		header.Size = uint32(encoded.Len())
+		_ = binary.Write(&icon, binary.LittleEndian, header)
+		icon.Write(encoded.Bytes())
+		return icon.Bytes()
+	}
+	_ = png.Encode(&icon, img)
+	return icon.Bytes()
+}
+
+// openBrowser opens an address in the default browser.
+func openBrowser(address string) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "windows":
+		cmd = exec.Command("rundll32", "url.dll,FileProtocolHandler", address)
+	case "darwin":
+		cmd = exec.Command("open", address)
+	default:
+		cmd = exec.Command("xdg-open", address)
+	}
+	err := cmd.Start()
+	if err != nil {
+		return fmt.Errorf("unable to open %v: %w", address, err)
+	}
+	go cmd.Wait()
+	return nil
+}
+
+// runTrayCommand shows an icon in the system tray, for circulation staff to
+// see at a glance whether RFID works, with the same configuration as the
+// proxy. The icon is green when it works, yellow when the RFID software is
+// slow, and red when the proxy or the RFID software isn't running, with a
+// purple ring when the proxy sends requests to a sandbox. Its menu shows the last problem, opens the self test page,
+// and restarts the proxy's service, which staff need to be allowed to do.
+// The proxy runs as a service, which can't show icons, so the tray icon is a
+// separate program, started when staff log in.
+func runTrayCommand(args []string, _ io.Writer) error {
+	config, err := ParseConfig("tray", args)
+	if err != nil {
+		return err
+	}
+	d := &doctor{get: func(name string) string { return config.fs.Lookup(name).Value.String() }}
+	return runTray(NewTrayMonitor(d.localURL()), DefaultServiceName)
+}
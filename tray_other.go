@@ -0,0 +1,13 @@
+// Copyright 2023 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+//go:build !windows
+
+package main
+
+// runTray isn't supported outside Windows. On macOS, systray needs cgo, and
+// releases are built without it.
+func runTray(_ *TrayMonitor, _ string) error {
+	return ErrTrayUnsupported
+}
@@ -0,0 +1,88 @@
+// Copyright 2023 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+//go:build windows
+
+package main
+
+import (
+	"context"
+	"time"
+
+	"fyne.io/systray"
+)
+
+// runTray shows the tray icon until staff choose Quit, checking the proxy
+// every TrayInterval. It must run on the main goroutine.
+func runTray(monitor *TrayMonitor, serviceName string) error {
+	systray.Run(func() { trayReady(monitor, serviceName) }, func() {})
+	return nil
+}
+
+// trayReady builds the tray menu, and keeps the icon up to date.
+func trayReady(monitor *TrayMonitor, serviceName string) {
+	systray.SetTitle("RFID")
+	summary := systray.AddMenuItem("Checking RFID...", "")
+	summary.Disable()
+	lastError := systray.AddMenuItem("", "")
+	lastError.Disable()
+	lastError.Hide()
+	systray.AddSeparator()
+	selfTest := systray.AddMenuItem("Open the self test", "Check RFID works in this browser.")
+	restart := systray.AddMenuItem("Restart the proxy", "Restart the "+serviceName+" service.")
+	systray.AddSeparator()
+	quit := systray.AddMenuItem("Quit", "Remove this icon. RFID keeps working.")
+
+	// Restarts report back here, so their errors are shown with the others.
+	restarted := make(chan error, 1)
+	update := func(status TrayStatus) {
+		systray.SetIcon(TrayIcon(status.Color, status.Sandbox))
+		if status.Sandbox {
+			systray.SetTitle("RFID sandbox")
+		} else {
+			systray.SetTitle("RFID")
+		}
+		systray.SetTooltip(status.Summary)
+		summary.SetTitle(status.Summary)
+		if status.LastError != "" {
+			lastError.SetTitle("Last problem: " + status.LastError)
+			lastError.Show()
+		}
+	}
+	check := func() {
+		ctx, cancel := context.WithTimeout(context.Background(), TrayInterval)
+		defer cancel()
+		update(monitor.Check(ctx))
+	}
+	check()
+	go func() {
+		ticker := time.NewTicker(TrayInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				check()
+			case <-selfTest.ClickedCh:
+				err := openBrowser(monitor.URL + SelfTestPrefix)
+				if err != nil {
+					monitor.Record(err.Error())
+					check()
+				}
+			case <-restart.ClickedCh:
+				restart.Disable()
+				summary.SetTitle("Restarting the proxy...")
+				go func() { restarted <- restartService(serviceName) }()
+			case err := <-restarted:
+				restart.Enable()
+				if err != nil {
+					monitor.Record("unable to restart the proxy, staff may need to be allowed to restart the " + serviceName + " service: " + err.Error())
+				}
+				check()
+			case <-quit.ClickedCh:
+				systray.Quit()
+				return
+			}
+		}
+	}()
+}
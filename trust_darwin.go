@@ -0,0 +1,30 @@
+// Copyright 2023 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+//go:build darwin
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// installTrustedCert adds a certificate to the login keychain, trusted as a
+// root, with the security tool. macOS asks the user for their password.
+func installTrustedCert(certFile string) error {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return fmt.Errorf("unable to find the login keychain: %w", err)
+	}
+	keychain := filepath.Join(home, "Library", "Keychains", "login.keychain-db")
+	output, err := exec.Command("security", "add-trusted-cert", "-r", "trustRoot", "-k", keychain, certFile).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("security add-trusted-cert failed, %w: %v", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
@@ -0,0 +1,12 @@
+// Copyright 2023 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+//go:build !windows && !darwin
+
+package main
+
+// installTrustedCert isn't supported outside Windows and macOS.
+func installTrustedCert(_ string) error {
+	return ErrTrustStoreUnsupported
+}
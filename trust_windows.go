@@ -0,0 +1,23 @@
+// Copyright 2023 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+//go:build windows
+
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// installTrustedCert adds a certificate to the current user's trusted root
+// certificates with certutil. Windows asks the user to confirm.
+func installTrustedCert(certFile string) error {
+	output, err := exec.Command("certutil", "-user", "-addstore", "Root", certFile).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("certutil failed, %w: %v", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
@@ -0,0 +1,214 @@
+// Copyright 2023 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultUpdateURL is the Gitea API address of the latest release, where
+	// goreleaser publishes them.
+	DefaultUpdateURL = "https://gitea.library.carleton.ca/api/v1/repos/cu-library/almarfidintercept/releases/latest"
+
+	// UpdateCheckTimeout is how long a check for updates may take.
+	UpdateCheckTimeout = 30 * time.Second
+
+	// maxReleaseBytes is the most of a release description read.
+	maxReleaseBytes = 1 << 20
+)
+
+// ErrUpdateCheck is returned when the release address answers with an error.
+var ErrUpdateCheck = errors.New("unable to check for updates")
+
+// UpdateChecker checks for a newer release every Interval, so months-old
+// deployments are noticed. It asks URL for the latest release, in the form of
+// the Gitea or GitHub releases API, with the version in tag_name and the release page
+// in html_url. When a newer version is found, it is logged once, and shown on
+// the admin dashboard and the diagnostics page.
+type UpdateChecker struct {
+	URL      *url.URL
+	Interval time.Duration
+
+	client *http.Client
+
+	mu      sync.Mutex
+	status  UpdateStatus
+	notice  string // The latest version a newer version message was logged for.
+	current string
+}
+
+// UpdateStatus is the result of the last check for updates.
+type UpdateStatus struct {
+	Current    string    `json:"current"`
+	Latest     string    `json:"latest,omitempty"`
+	ReleaseURL string    `json:"release_url,omitempty"`
+	Available  bool      `json:"available"`
+	Checked    time.Time `json:"checked,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// release is the part of a Gitea or GitHub release the checker reads.
+type release struct {
+	TagName string         `json:"tag_name"`
+	HTMLURL string         `json:"html_url"`
+	Assets  []releaseAsset `json:"assets"`
+}
+
+// releaseAsset is a file attached to a release.
+type releaseAsset struct {
+	Name string `json:"name"`
+	URL  string `json:"browser_download_url"`
+}
+
+// NewUpdateChecker returns an UpdateChecker asking address for the latest release.
+func NewUpdateChecker(address string, interval time.Duration) (*UpdateChecker, error) {
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse update address: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("update address %v: %w", address, ErrNotHTTP)
+	}
+	current := GetBuildInfo().Version
+	return &UpdateChecker{
+		URL:      u,
+		Interval: interval,
+		client:   &http.Client{Timeout: UpdateCheckTimeout},
+		status:   UpdateStatus{Current: current},
+		current:  current,
+	}, nil
+}
+
+// Run checks for updates now, then every Interval, until ctx is cancelled.
+func (u *UpdateChecker) Run(ctx context.Context) {
+	ticker := time.NewTicker(u.Interval)
+	defer ticker.Stop()
+	for {
+		u.Check(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Check asks for the latest release, and records whether it is newer.
+func (u *UpdateChecker) Check(ctx context.Context) UpdateStatus {
+	latest, err := u.latest(ctx)
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.status.Checked = time.Now()
+	if err != nil {
+		if ctx.Err() == nil {
+			slog.Debug("Unable to check for updates.", "url", u.URL.Redacted(), "error", err)
+		}
+		u.status.Error = err.Error()
+		return u.status
+	}
+	version := strings.TrimPrefix(latest.TagName, "v")
+	u.status.Error = ""
+	u.status.Latest = version
+	u.status.ReleaseURL = latest.HTMLURL
+	u.status.Available = newerVersion(version, u.current)
+	if u.status.Available && u.notice != version {
+		slog.Warn("A newer version is available.", "current", u.current, "latest", version, "release", latest.HTMLURL)
+		u.notice = version
+	}
+	return u.status
+}
+
+// Status returns the result of the last check. It is safe to call on a nil
+// UpdateChecker, which never checks.
+func (u *UpdateChecker) Status() UpdateStatus {
+	if u == nil {
+		return UpdateStatus{Current: GetBuildInfo().Version}
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.status
+}
+
+// latest asks for the latest release.
+func (u *UpdateChecker) latest(ctx context.Context) (release, error) {
+	var latest release
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.URL.String(), nil)
+	if err != nil {
+		return latest, err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("User-Agent", "almarfidintercept/"+u.current)
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return latest, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return latest, fmt.Errorf("%w, %v answered %v", ErrUpdateCheck, u.URL.Redacted(), resp.Status)
+	}
+	err = json.NewDecoder(io.LimitReader(resp.Body, maxReleaseBytes)).Decode(&latest)
+	if err != nil {
+		return latest, fmt.Errorf("unable to read the latest release: %w", err)
+	}
+	if latest.TagName == "" {
+		return latest, fmt.Errorf("%w, the latest release has no tag_name", ErrUpdateCheck)
+	}
+	return latest, nil
+}
+
+// newerVersion reports whether version latest is newer than current. Versions
+// are compared by their dot separated numbers, and a pre-release, like
+// 1.2.0-rc1, is older than the release. A development build, which isn't a
+// version number, is never out of date.
+func newerVersion(latest, current string) bool {
+	latestParts, latestPre, ok := parseVersion(latest)
+	if !ok {
+		return false
+	}
+	currentParts, currentPre, ok := parseVersion(current)
+	if !ok {
+		return false
+	}
+	for i := 0; i < max(len(latestParts), len(currentParts)); i++ {
+		var l, c int
+		if i < len(latestParts) {
+			l = latestParts[i]
+		}
+		if i < len(currentParts) {
+			c = currentParts[i]
+		}
+		if l != c {
+			return l > c
+		}
+	}
+	return currentPre != "" && (latestPre == "" || latestPre > currentPre)
+}
+
+// parseVersion splits a version like 1.2.3-rc1 into its numbers and its pre-release.
+func parseVersion(version string) ([]int, string, bool) {
+	version, pre, _ := strings.Cut(strings.TrimPrefix(version, "v"), "-")
+	version, _, _ = strings.Cut(version, "+")
+	var parts []int
+	for _, part := range strings.Split(version, ".") {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return nil, "", false
+		}
+		parts = append(parts, n)
+	}
+	return parts, pre, true
+}
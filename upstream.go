@@ -0,0 +1,334 @@
+// Copyright 2023 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultUpstreamTimeout is the default time the reader service has to respond.
+	DefaultUpstreamTimeout = 5 * time.Second
+
+	// UpstreamDialTimeout is the time allowed to connect to the reader service.
+	UpstreamDialTimeout = 5 * time.Second
+
+	// DefaultUpstreamIdleTimeout is how long an idle connection to the reader service is kept open by default.
+	DefaultUpstreamIdleTimeout = 90 * time.Second
+
+	// DefaultUpstreamIdleConns is how many idle connections to each reader service are kept open by default.
+	DefaultUpstreamIdleConns = 4
+
+	// UpstreamTLSHandshakeTimeout is the time allowed for the TLS handshake with an https reader service.
+	UpstreamTLSHandshakeTimeout = 5 * time.Second
+
+	// DefaultResolveTimeout is the default time allowed to look up the reader service's address.
+	DefaultResolveTimeout = 2 * time.Second
+
+	// DefaultWarmUpInterval is the default time between requests which keep
+	// a connection to the reader service open. It is less than DefaultUpstreamIdleTimeout.
+	DefaultWarmUpInterval = 30 * time.Second
+)
+
+var (
+	// ErrBadOperationTimeout is returned when an operation timeout isn't like writeTags=60s.
+	ErrBadOperationTimeout = errors.New("operation timeouts must look like writeTags=60s")
+
+	// ErrBadUpstream is returned when a reader service address isn't an http or https URL.
+	ErrBadUpstream = errors.New("the reader service's address must be an http:// or https:// URL")
+)
+
+// UpstreamOptions configure how the proxy connects to the reader service.
+type UpstreamOptions struct {
+	// Resolver is the address of the DNS server used to look up reader
+	// service host names. The system's resolver is used if it is empty.
+	Resolver string
+
+	// ResolveTimeout is the time allowed to look up a host name.
+	ResolveTimeout time.Duration
+
+	// LocalAddress is the local IP address, or the name of the network
+	// interface, connections to the reader service are made from. If it is
+	// empty, the operating system picks, based on the routing table.
+	LocalAddress string
+
+	// FIPS restricts TLS to FIPS 140 approved algorithms.
+	FIPS bool
+
+	// Timeout is the time the reader service has to respond,
+	// DefaultUpstreamTimeout if zero.
+	Timeout time.Duration
+
+	// IdleConns is how many idle connections to each reader service are
+	// kept open for reuse, DefaultUpstreamIdleConns if zero.
+	IdleConns int
+
+	// IdleTimeout is how long an idle connection is kept open,
+	// DefaultUpstreamIdleTimeout if zero.
+	IdleTimeout time.Duration
+}
+
+// NewUpstreamClient returns the client used for every request to the reader
+// service. It is made once, at startup, and its connections are kept open and
+// reused between requests, so a busy circulation desk doesn't open a new
+// connection for every poll.
+func NewUpstreamClient(opts UpstreamOptions) *http.Client {
+	idleConns := opts.IdleConns
+	if idleConns <= 0 {
+		idleConns = DefaultUpstreamIdleConns
+	}
+	idleTimeout := opts.IdleTimeout
+	if idleTimeout <= 0 {
+		idleTimeout = DefaultUpstreamIdleTimeout
+	}
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           upstreamDialer(opts),
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          4 * idleConns,
+		MaxIdleConnsPerHost:   idleConns,
+		IdleConnTimeout:       idleTimeout,
+		TLSHandshakeTimeout:   UpstreamTLSHandshakeTimeout,
+		ExpectContinueTimeout: time.Second,
+	}
+	if opts.FIPS {
+		transport.TLSClientConfig = FIPSTLSConfig(nil)
+	}
+	timeout := opts.Timeout
+	if timeout <= 0 {
+		timeout = DefaultUpstreamTimeout
+	}
+	return &http.Client{Transport: transport, Timeout: timeout}
+}
+
+// ParseOperationTimeouts parses a comma separated list of upstream timeouts for
+// particular operations, like writeTags=60s,setSecurity=20s. The operation names
+// are lower cased, since they're matched without regard to case.
+func ParseOperationTimeouts(list string) (map[string]time.Duration, error) {
+	timeouts := make(map[string]time.Duration)
+	for _, spec := range splitList(list) {
+		operation, timeout, found := strings.Cut(spec, "=")
+		operation = strings.ToLower(strings.TrimSpace(operation))
+		if !found || operation == "" {
+			return nil, fmt.Errorf("%w, not %q", ErrBadOperationTimeout, spec)
+		}
+		d, err := time.ParseDuration(strings.TrimSpace(timeout))
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("%w, bad duration in %q", ErrBadOperationTimeout, spec)
+		}
+		timeouts[operation] = d
+	}
+	return timeouts, nil
+}
+
+// parseUpstream parses the address of a reader service.
+func parseUpstream(address string) (*url.URL, error) {
+	target, err := url.Parse(address)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse the reader service's address: %w", err)
+	}
+	if (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		return nil, fmt.Errorf("%w, not %q", ErrBadUpstream, address)
+	}
+	return target, nil
+}
+
+// upstreamDialer returns a dial function which looks up host names with the
+// configured resolver and timeout, so broken DNS fails quickly and clearly.
+func upstreamDialer(opts UpstreamOptions) func(ctx context.Context, network, address string) (net.Conn, error) {
+	dialer := &localDialer{
+		Dialer: net.Dialer{
+			Timeout:   UpstreamDialTimeout,
+			KeepAlive: 30 * time.Second,
+		},
+		local: opts.LocalAddress,
+	}
+	resolver := net.DefaultResolver
+	if opts.Resolver != "" {
+		resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				return dialer.DialContext(ctx, network, opts.Resolver)
+			},
+		}
+	}
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(address)
+		if err != nil || net.ParseIP(host) != nil {
+			return dialer.DialContext(ctx, network, address)
+		}
+		// Never ask a DNS server about localhost. Try the IPv4 loopback
+		// address first, then IPv6, in case one of the IP stacks is disabled.
+		if host == "localhost" {
+			conn, err := dialer.DialContext(ctx, network, net.JoinHostPort("127.0.0.1", port))
+			if err == nil {
+				return conn, nil
+			}
+			conn, err6 := dialer.DialContext(ctx, network, net.JoinHostPort("::1", port))
+			if err6 == nil {
+				return conn, nil
+			}
+			return nil, err
+		}
+		lookupCtx := ctx
+		if opts.ResolveTimeout > 0 {
+			var cancel context.CancelFunc
+			lookupCtx, cancel = context.WithTimeout(ctx, opts.ResolveTimeout)
+			defer cancel()
+		}
+		addrs, err := resolver.LookupIPAddr(lookupCtx, host)
+		if err != nil {
+			return nil, fmt.Errorf("unable to look up the address of %v: %w", host, err)
+		}
+		var firstErr error
+		for _, addr := range addrs {
+			conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(addr.IP.String(), port))
+			if err == nil {
+				return conn, nil
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+		return nil, firstErr
+	}
+}
+
+// ErrNoLocalAddress is returned when the local address for upstream connections
+// isn't an IP address or the name of a network interface with an address.
+var ErrNoLocalAddress = errors.New("no such local address or interface")
+
+// localDialer is a net.Dialer which makes connections from a configured local
+// IP address or network interface. For an interface, the address used is its
+// first one of the same IP version as the remote address, looked up on each
+// dial, since an interface on a VLAN may get its address after we start.
+type localDialer struct {
+	net.Dialer
+	local string
+}
+
+// DialContext connects to an address from the local address.
+func (d *localDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if d.local == "" {
+		return d.Dialer.DialContext(ctx, network, address)
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	ip, err := LocalIP(d.local, net.ParseIP(host).To4() == nil)
+	if err != nil {
+		return nil, err
+	}
+	dialer := d.Dialer
+	if strings.HasPrefix(network, "udp") {
+		dialer.LocalAddr = &net.UDPAddr{IP: ip}
+	} else {
+		dialer.LocalAddr = &net.TCPAddr{IP: ip}
+	}
+	return dialer.DialContext(ctx, network, address)
+}
+
+// LocalIP returns the IP address to make connections from, given an IP address or
+// the name of a network interface. For an interface, it returns the interface's
+// first IPv6 address if ipv6 is set, its first IPv4 address otherwise.
+func LocalIP(local string, ipv6 bool) (net.IP, error) {
+	if ip := net.ParseIP(local); ip != nil {
+		return ip, nil
+	}
+	iface, err := net.InterfaceByName(local)
+	if err != nil {
+		return nil, fmt.Errorf("%w %q", ErrNoLocalAddress, local)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("unable to list the addresses of %v: %w", local, err)
+	}
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok || ipnet.IP.IsLinkLocalUnicast() || (ipnet.IP.To4() == nil) != ipv6 {
+			continue
+		}
+		return ipnet.IP, nil
+	}
+	version := "IPv4"
+	if ipv6 {
+		version = "IPv6"
+	}
+	return nil, fmt.Errorf("%w, %v has no %v address", ErrNoLocalAddress, local, version)
+}
+
+// ResolverAddress adds the default DNS port to a resolver address if it doesn't have one.
+func ResolverAddress(resolver string) string {
+	if resolver == "" {
+		return ""
+	}
+	if _, _, err := net.SplitHostPort(resolver); err != nil {
+		return net.JoinHostPort(resolver, "53")
+	}
+	return resolver
+}
+
+// Warmer opens a connection to each reader service as soon as the proxy is
+// listening, then keeps it open, so the first request of the day doesn't
+// wait for a connection to be made, or find out the reader service is down.
+type Warmer struct {
+	Client    *http.Client
+	Upstreams func() []string
+	Interval  time.Duration
+}
+
+// Run warms up the connections every Interval until the context is cancelled.
+func (w *Warmer) Run(ctx context.Context) {
+	ticker := time.NewTicker(w.Interval)
+	defer ticker.Stop()
+	warm := make(map[string]bool)
+	for {
+		for _, upstream := range w.Upstreams() {
+			err := w.touch(ctx, upstream)
+			if ctx.Err() != nil {
+				return
+			}
+			wasWarm, tried := warm[upstream]
+			switch {
+			case err != nil && (wasWarm || !tried):
+				slog.Warn("Unable to warm up connection to the reader service.", "upstream", upstream, "error", err)
+			case err == nil && !wasWarm:
+				slog.Info("Connection to the reader service is warmed up.", "upstream", upstream)
+			}
+			warm[upstream] = err == nil
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// touch sends a request to the reader service, leaving the connection open for reuse.
+func (w *Warmer) touch(ctx context.Context, upstream string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, upstream, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := w.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	// The body must be read to the end for the connection to be reused.
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return nil
+}
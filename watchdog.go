@@ -0,0 +1,144 @@
+// Copyright 2023 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultWatchdogCooldown is how long the watchdog waits after recovering
+	// the reader service before it will try again.
+	DefaultWatchdogCooldown = 5 * time.Minute
+
+	// WatchdogCommandTimeout is how long the recovery command may run.
+	WatchdogCommandTimeout = 2 * time.Minute
+)
+
+// WatchdogUpstreamEnv is the environment variable which tells the watchdog's
+// recovery command which reader service is wedged.
+const WatchdogUpstreamEnv = "ALMA_RFID_INTERCEPT_WEDGED_UPSTREAM"
+
+// Watchdog notices when a reader service is wedged, answering nothing
+// until its requests time out, and tries to recover it, instead of letting
+// desks get errors all morning. After Timeouts requests in a row to a reader
+// service time out, it raises an alert, which is logged and published on the
+// event bus, and runs Command, like a script restarting the vendor's service
+// or resetting its USB device, with the reader service's address in
+// WatchdogUpstreamEnv. Without a Command, it restarts the RFID software run
+// by -reader-command, if there is one and it is the wedged reader service.
+// It won't act again for that reader service for Cooldown. Each reader
+// service, like those of the institutions sharing a consortial server, is
+// watched separately, so one wedging doesn't count against the others.
+type Watchdog struct {
+	// Timeouts is how many upstream requests in a row must time out
+	// before the watchdog acts. Zero disables the watchdog.
+	Timeouts int
+
+	// Command recovers the reader service. It may be empty.
+	Command []string
+
+	// Supervisor runs the RFID software. It may be nil.
+	Supervisor *Supervisor
+
+	// Supervised returns the reader service the Supervisor runs, the
+	// default one. It may be nil if there's no Supervisor.
+	Supervised func() string
+
+	// Cooldown is how long to wait after acting before acting again.
+	Cooldown time.Duration
+
+	// Bus is where alert events are published.
+	Bus *EventBus
+
+	mu      sync.Mutex
+	watches map[string]*watch // Keyed by reader service address.
+}
+
+// watch is the state of the watchdog for one reader service.
+type watch struct {
+	timeouts  int       // Requests in a row which have timed out.
+	lastActed time.Time // When the watchdog last acted.
+}
+
+// Enabled reports whether the watchdog is on.
+func (w *Watchdog) Enabled() bool {
+	return w != nil && w.Timeouts > 0
+}
+
+// watch returns the state of the watchdog for a reader service. w.mu must be held.
+func (w *Watchdog) watch(upstream string) *watch {
+	if w.watches == nil {
+		w.watches = map[string]*watch{}
+	}
+	state, ok := w.watches[upstream]
+	if !ok {
+		state = &watch{}
+		w.watches[upstream] = state
+	}
+	return state
+}
+
+// Observe records how a request to a reader service went, with the error it
+// failed with, or nil, and acts if too many in a row have timed out. It does
+// nothing if the watchdog is off.
+func (w *Watchdog) Observe(upstream string, err error) {
+	if !w.Enabled() {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	state := w.watch(upstream)
+	if !isTimeout(err) {
+		state.timeouts = 0
+		return
+	}
+	state.timeouts++
+	if state.timeouts < w.Timeouts || time.Since(state.lastActed) < w.Cooldown {
+		return
+	}
+	state.timeouts = 0
+	state.lastActed = time.Now()
+	reason := fmt.Sprintf("%d requests in a row to the reader service timed out", w.Timeouts)
+	slog.Error("The reader service is wedged, recovering it.", "upstream", upstream, "reason", reason)
+	w.Bus.Publish(Event{Type: EventUpstreamWedged, Detail: reason, Time: state.lastActed, Upstream: upstream})
+	go w.recover(upstream)
+}
+
+// recover runs the recovery command, or restarts the RFID software if it is
+// the wedged reader service.
+func (w *Watchdog) recover(upstream string) {
+	if len(w.Command) == 0 {
+		if w.Supervisor != nil && w.Supervised != nil && w.Supervised() == upstream {
+			w.Supervisor.Restart()
+		}
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), WatchdogCommandTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, w.Command[0], w.Command[1:]...)
+	cmd.Env = append(os.Environ(), WatchdogUpstreamEnv+"="+upstream)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		slog.Error("The watchdog's recovery command failed.", "command", w.Command[0], "upstream", upstream, "error", err, "output", strings.TrimSpace(string(output)))
+		return
+	}
+	slog.Info("Ran the watchdog's recovery command.", "command", w.Command[0], "upstream", upstream, "output", strings.TrimSpace(string(output)))
+}
+
+// isTimeout reports whether an upstream request failed by timing out.
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout())
+}
@@ -0,0 +1,48 @@
+// Copyright 2023 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestWatchdogPerUpstream(t *testing.T) {
+	bus := NewEventBus()
+	events := bus.Subscribe()
+	w := &Watchdog{Timeouts: 2, Cooldown: time.Minute, Bus: bus}
+	tests := []struct {
+		upstream string
+		err      error
+		wedged   bool
+	}{
+		{"http://a", context.DeadlineExceeded, false},
+		{"http://b", context.DeadlineExceeded, false},
+		{"http://b", nil, false},
+		{"http://a", context.DeadlineExceeded, true},
+		{"http://b", context.DeadlineExceeded, false},
+		{"http://b", errors.New("connection refused"), false},
+		{"http://b", context.DeadlineExceeded, false},
+		{"http://b", context.DeadlineExceeded, true},
+		// Each reader service has its own cooldown.
+		{"http://a", context.DeadlineExceeded, false},
+		{"http://a", context.DeadlineExceeded, false},
+	}
+	for i, tt := range tests {
+		w.Observe(tt.upstream, tt.err)
+		select {
+		case e := <-events:
+			if !tt.wedged || e.Type != EventUpstreamWedged || e.Upstream != tt.upstream {
+				t.Errorf("%d: got event %v for %v, want none", i, e.Type, e.Upstream)
+			}
+		default:
+			if tt.wedged {
+				t.Errorf("%d: %v wasn't found wedged", i, tt.upstream)
+			}
+		}
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright 2023 Carleton University Library All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// WebhookTimeout is how long we wait for a webhook receiver to respond.
+	WebhookTimeout = 5 * time.Second
+
+	// DefaultWebhookEvents is the default list of event types sent to webhooks.
+	DefaultWebhookEvents = "tag.appear,security.failure"
+)
+
+// ErrNotHTTP is returned when an address which should be an HTTP URL isn't.
+var ErrNotHTTP = errors.New("scheme must be http or https")
+
+// ErrUnexpectedStatus is returned when a remote service responds with a non-2xx status.
+var ErrUnexpectedStatus = errors.New("unexpected response status")
+
+// Webhook posts events as JSON to a URL.
+type Webhook struct {
+	URL    *url.URL
+	Events map[EventType]bool
+
+	client *http.Client
+}
+
+// NewWebhook parses the receiver URL and returns a Webhook
+// which posts the given types of events to it.
+func NewWebhook(receiver string, events []EventType) (*Webhook, error) {
+	receiverURL, err := url.Parse(receiver)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse webhook address: %w", err)
+	}
+	if receiverURL.Scheme != "http" && receiverURL.Scheme != "https" {
+		return nil, fmt.Errorf("webhook address %v: %w", receiver, ErrNotHTTP)
+	}
+	wanted := make(map[EventType]bool, len(events))
+	for _, e := range events {
+		wanted[e] = true
+	}
+	return &Webhook{
+		URL:    receiverURL,
+		Events: wanted,
+		client: &http.Client{Timeout: WebhookTimeout},
+	}, nil
+}
+
+// Run posts events until the channel is closed.
+// Failed deliveries are logged and not retried.
+func (h *Webhook) Run(events <-chan Event) {
+	for e := range events {
+		if !h.Events[e.Type] {
+			continue
+		}
+		err := h.post(e)
+		if err != nil {
+			slog.Error("Unable to deliver event to webhook.", "type", e.Type, "webhook", h.URL.Host, "error", err)
+		}
+	}
+}
+
+// post sends one event to the receiver.
+func (h *Webhook) post(e Event) error {
+	return postJSON(h.client, h.URL.String(), "", e)
+}
+
+// postJSON encodes v as JSON and posts it to target. If token isn't empty,
+// it is sent as a bearer token in the Authorization header.
+func postJSON(client *http.Client, target, token string, v any) error {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("unable to encode payload: %w", err)
+	}
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, target, bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("unable to build request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "almarfidintercept/"+version)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("unable to send request: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("%w, %v", ErrUnexpectedStatus, resp.Status)
+	}
+	return nil
+}
+
+// splitList splits a comma separated list, dropping empty elements.
+func splitList(list string) []string {
+	var elements []string
+	for _, element := range strings.Split(list, ",") {
+		element = strings.TrimSpace(element)
+		if element != "" {
+			elements = append(elements, element)
+		}
+	}
+	return elements
+}